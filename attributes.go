@@ -1,5 +1,15 @@
 package saml
 
+import "strings"
+
+// Attribute name formats, telling how the Name of an attribute is to be
+// interpreted.
+const (
+	AttributeNameFormatUnspecified = "urn:oasis:names:tc:SAML:2.0:attrname-format:unspecified"
+	AttributeNameFormatURI         = "urn:oasis:names:tc:SAML:2.0:attrname-format:uri"
+	AttributeNameFormatBasic       = "urn:oasis:names:tc:SAML:2.0:attrname-format:basic"
+)
+
 // AttributesMap is a type that provides methods for working with SAML
 // attributes.
 type AttributesMap map[string][]string
@@ -33,6 +43,139 @@ func NewAttributesMap(assertion *Assertion) *AttributesMap {
 	return &props
 }
 
+// AttributeTransform rewrites the attributes released in an assertion, such as
+// to scope, map or filter their values. It may modify the given slice and its
+// elements in place.
+type AttributeTransform func([]Attribute) []Attribute
+
+// ScopeAttributes returns an AttributeTransform that appends "@" and scope to
+// the values of the attributes with the given names or friendly names, e.g.
+// eduPersonPrincipalName. Values that are already scoped are left alone.
+func ScopeAttributes(scope string, names ...string) AttributeTransform {
+	return func(attributes []Attribute) []Attribute {
+		for i := range attributes {
+			if !attributes[i].hasName(names) {
+				continue
+			}
+			for j, value := range attributes[i].Values {
+				if value.Value != "" && !strings.Contains(value.Value, "@") {
+					attributes[i].Values[j].Value = value.Value + "@" + scope
+				}
+			}
+		}
+		return attributes
+	}
+}
+
+// MapAttributeValues returns an AttributeTransform that replaces the values
+// of the attribute with the given name or friendly name through mapping.
+// Values that are not in mapping are kept.
+func MapAttributeValues(name string, mapping map[string]string) AttributeTransform {
+	return func(attributes []Attribute) []Attribute {
+		for i := range attributes {
+			if !attributes[i].hasName([]string{name}) {
+				continue
+			}
+			for j, value := range attributes[i].Values {
+				if mapped, ok := mapping[value.Value]; ok {
+					attributes[i].Values[j].Value = mapped
+				}
+			}
+		}
+		return attributes
+	}
+}
+
+// DropEmptyAttributes is an AttributeTransform that removes empty values, then
+// the attributes left without values.
+func DropEmptyAttributes(attributes []Attribute) []Attribute {
+	out := attributes[:0]
+	for _, attr := range attributes {
+		values := attr.Values[:0]
+		for _, value := range attr.Values {
+			if !value.isEmpty() {
+				values = append(values, value)
+			}
+		}
+		if len(values) > 0 {
+			attr.Values = values
+			out = append(out, attr)
+		}
+	}
+	return out
+}
+
+// isEmpty reports whether the value is empty or only whitespace.
+func (v *AttributeValue) isEmpty() bool {
+	return v.NameID == nil && strings.TrimSpace(v.Value) == ""
+}
+
+// EmptyAttributeValuePolicy tells how MakeAssertion sends empty attribute
+// values, which SPs disagree on.
+type EmptyAttributeValuePolicy int
+
+// Empty attribute value policies.
+const (
+	// EmptyAttributeValuesOmit drops empty values, and the attributes that
+	// only had empty values.
+	EmptyAttributeValuesOmit EmptyAttributeValuePolicy = iota
+	// EmptyAttributeValuesEmptyElement sends empty values as
+	// <AttributeValue/>.
+	EmptyAttributeValuesEmptyElement
+	// EmptyAttributeValuesXSINil sends empty values as
+	// <AttributeValue xsi:nil="true"/>.
+	EmptyAttributeValuesXSINil
+)
+
+// apply returns the attributes with their empty values handled according to
+// the policy. Values that are only whitespace are empty too.
+func (p EmptyAttributeValuePolicy) apply(attributes []Attribute) []Attribute {
+	switch p {
+	case EmptyAttributeValuesEmptyElement, EmptyAttributeValuesXSINil:
+		for i := range attributes {
+			for j := range attributes[i].Values {
+				value := &attributes[i].Values[j]
+				if value.isEmpty() {
+					*value = AttributeValue{Type: value.Type, Nil: p == EmptyAttributeValuesXSINil}
+				}
+			}
+		}
+		return attributes
+	default:
+		return DropEmptyAttributes(attributes)
+	}
+}
+
+func (a *Attribute) hasName(names []string) bool {
+	for _, name := range names {
+		if a.Name == name || a.FriendlyName == name {
+			return true
+		}
+	}
+	return false
+}
+
+// AttributeGroup is a named set of attributes sent in an AttributeStatement of
+// its own, for SPs that tell attributes apart by statement, e.g. identity and
+// authorization. The name is not sent.
+type AttributeGroup struct {
+	Name       string
+	Attributes []Attribute
+}
+
+// AddAttributeGroup adds attributes to the group with the given name, which
+// is created after the existing groups if there is none yet. It must be
+// called before MakeAssertion.
+func (req *IdpAuthnRequest) AddAttributeGroup(name string, attributes ...Attribute) {
+	for i := range req.AttributeGroups {
+		if req.AttributeGroups[i].Name == name {
+			req.AttributeGroups[i].Attributes = append(req.AttributeGroups[i].Attributes, attributes...)
+			return
+		}
+	}
+	req.AttributeGroups = append(req.AttributeGroups, AttributeGroup{Name: name, Attributes: attributes})
+}
+
 // Get returns the first value of the given attribute, if any.
 func (a *AttributesMap) Get(name string) string {
 	if v, ok := (map[string][]string)(*a)[name]; ok {
@@ -0,0 +1,76 @@
+package saml
+
+// AuthnContextPasswordProtectedTransport is the authentication context class
+// of a password sent over TLS, the default of Session.AuthnContextClassRef.
+const AuthnContextPasswordProtectedTransport = "urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport"
+
+// Comparison methods of a RequestedAuthnContext.
+const (
+	AuthnContextComparisonExact   = "exact"
+	AuthnContextComparisonMinimum = "minimum"
+	AuthnContextComparisonMaximum = "maximum"
+	AuthnContextComparisonBetter  = "better"
+)
+
+// Satisfies reports whether a user authenticated with the given context
+// class and declaration, either of which may be empty, meets the requested
+// context. A nil RequestedAuthnContext is met by anything.
+//
+// How contexts compare is up to the IdP, so only the listed ones are known
+// to meet exact, minimum and maximum comparisons. A better comparison, which
+// wants a context stronger than all of those listed, is never met.
+func (c *RequestedAuthnContext) Satisfies(classRef, declRef string) bool {
+	if c == nil {
+		return true
+	}
+	if c.Comparison == AuthnContextComparisonBetter {
+		return false
+	}
+	return c.matchesClass(classRef) || c.matchesDecl(declRef)
+}
+
+func (c *RequestedAuthnContext) matchesClass(classRef string) bool {
+	return classRef != "" && containsRef(c.AuthnContextClassRef, classRef)
+}
+
+func (c *RequestedAuthnContext) matchesDecl(declRef string) bool {
+	return declRef != "" && containsRef(c.AuthnContextDeclRef, declRef)
+}
+
+func containsRef(refs []string, ref string) bool {
+	for _, r := range refs {
+		if r == ref {
+			return true
+		}
+	}
+	return false
+}
+
+// authnContext returns the AuthnContext of the session's AuthnStatement. The
+// declaration alone is given when that is what matched the request, else the
+// class, along with the declaration if any.
+func (req *IdpAuthnRequest) authnContext(session *Session) AuthnContext {
+	classRef := session.AuthnContextClassRef
+	if classRef == "" {
+		classRef = AuthnContextPasswordProtectedTransport
+	}
+	declRef := session.AuthnContextDeclRef
+
+	requested := req.Request.RequestedAuthnContext
+	if !requested.Satisfies(classRef, declRef) {
+		Logf("Warning: session does not satisfy the authentication context requested by SP %q", req.Request.Issuer.Value)
+	}
+
+	if requested != nil && requested.matchesDecl(declRef) && !requested.matchesClass(classRef) {
+		return AuthnContext{
+			AuthnContextDeclRef: &AuthnContextDeclRef{Value: declRef},
+		}
+	}
+	authnContext := AuthnContext{
+		AuthnContextClassRef: &AuthnContextClassRef{Value: classRef},
+	}
+	if declRef != "" {
+		authnContext.AuthnContextDeclRef = &AuthnContextDeclRef{Value: declRef}
+	}
+	return authnContext
+}
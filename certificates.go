@@ -0,0 +1,56 @@
+package saml
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const xmldsigNamespace = "http://www.w3.org/2000/09/xmldsig#"
+
+// ExtractCertificates returns the certificates found in the
+// ds:KeyInfo/ds:X509Data/ds:X509Certificate elements of a signed XML
+// document, in document order. The certificates are parsed but not verified,
+// check them against a trust store before relying on them.
+func ExtractCertificates(xmlBytes []byte) ([]*x509.Certificate, error) {
+	certs := []*x509.Certificate{}
+
+	decoder := newXMLDecoder(bytes.NewReader(xmlBytes))
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return certs, nil
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "malformed XML document")
+		}
+
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Space != xmldsigNamespace || start.Name.Local != "X509Certificate" {
+			continue
+		}
+
+		var data string
+		if err := decoder.DecodeElement(&data, &start); err != nil {
+			return nil, err
+		}
+
+		// Certificates are often wrapped over many lines.
+		data = strings.Join(strings.Fields(data), "")
+
+		der, err := base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to decode X509Certificate")
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to parse X509Certificate")
+		}
+		certs = append(certs, cert)
+	}
+}
@@ -0,0 +1,126 @@
+package saml
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// HolderOfKeySSOBinding is the ProtocolBinding of AuthnRequests sent under
+// the Holder-of-Key Web Browser SSO profile, in which the user agent presents
+// the same TLS client certificate to the IdP and to the SP, and the assertion
+// is bound to it.
+//
+// See http://docs.oasis-open.org/security/saml/Post2.0/sstc-saml-holder-of-key-browser-sso.pdf
+const HolderOfKeySSOBinding = "urn:oasis:names:tc:SAML:2.0:profiles:holder-of-key:SSO:browser"
+
+// holderOfKeyNamespace is the namespace of the hoksso:ProtocolBinding
+// attribute, which gives the binding holder-of-key responses are sent with.
+const holderOfKeyNamespace = HolderOfKeySSOBinding
+
+// holderOfKeyAttrs returns the hoksso:ProtocolBinding attribute for the given
+// binding, with its namespace declaration, or nothing when binding is empty.
+func holderOfKeyAttrs(binding string) []xml.Attr {
+	if binding == "" {
+		return nil
+	}
+	return []xml.Attr{
+		{Name: xml.Name{Local: "xmlns:hoksso"}, Value: holderOfKeyNamespace},
+		{Name: xml.Name{Local: "hoksso:ProtocolBinding"}, Value: binding},
+	}
+}
+
+// takeHolderOfKeyBinding removes the hoksso:ProtocolBinding attribute from
+// start and returns its value. Left in place, it would also be decoded as the
+// ProtocolBinding attribute of an AuthnRequest, which has the same local name.
+func takeHolderOfKeyBinding(start *xml.StartElement) string {
+	var binding string
+	attrs := start.Attr[:0:0]
+	for _, attr := range start.Attr {
+		if attr.Name.Space == holderOfKeyNamespace && attr.Name.Local == "ProtocolBinding" {
+			binding = attr.Value
+			continue
+		}
+		attrs = append(attrs, attr)
+	}
+	start.Attr = attrs
+	return binding
+}
+
+// ErrNoClientCertificate is returned for holder-of-key requests made without
+// a TLS client certificate, so there is no key to bind the assertion to.
+var ErrNoClientCertificate = errors.New(StatusRequestDenied + ": holder-of-key request without a TLS client certificate")
+
+// ClientCertificateFunc returns the TLS client certificate of the user agent
+// that sent r, or nil when it presented none.
+//
+// The certificate only reaches the application when TLS is terminated by the
+// Go server, whose tls.Config must then ask for it with a ClientAuth of
+// tls.RequestClientCert or stricter: holder-of-key certificates are often
+// self-signed, the profile only cares about the key. Behind a proxy that
+// terminates TLS, the proxy must forward the certificate, e.g. in a header,
+// and remove that header from the requests it receives, and the
+// ClientCertificateFunc must read it from there.
+type ClientCertificateFunc func(r *http.Request) (*x509.Certificate, error)
+
+// TLSClientCertificate is the default ClientCertificateFunc, returning the
+// first certificate the client presented on the TLS connection of r.
+func TLSClientCertificate(r *http.Request) (*x509.Certificate, error) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil, nil
+	}
+	return r.TLS.PeerCertificates[0], nil
+}
+
+// clientCertificate returns the client certificate of r using fn, or
+// TLSClientCertificate when fn is nil.
+func clientCertificate(fn ClientCertificateFunc, r *http.Request) (*x509.Certificate, error) {
+	if fn == nil {
+		fn = TLSClientCertificate
+	}
+	cert, err := fn(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get the TLS client certificate")
+	}
+	return cert, nil
+}
+
+// HolderOfKeyConfirmation returns the first holder-of-key SubjectConfirmation
+// bound to the given certificate, or nil if there is none.
+func (s *Subject) HolderOfKeyConfirmation(cert *x509.Certificate) *SubjectConfirmation {
+	for i := range s.SubjectConfirmations {
+		confirmation := &s.SubjectConfirmations[i]
+		if confirmation.Method != SubjectConfirmationMethodHolderOfKey || confirmation.SubjectConfirmationData.KeyInfo == nil {
+			continue
+		}
+		der, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(confirmation.SubjectConfirmationData.KeyInfo.Certificate), ""))
+		if err == nil && bytes.Equal(der, cert.Raw) {
+			return confirmation
+		}
+	}
+	return nil
+}
+
+// holderOfKeyCertificate returns the client certificate the assertion is to
+// be bound to: always for requests sent under the holder-of-key profile, and
+// when one was presented for SPs with the HolderOfKey option. It is nil when
+// no holder-of-key confirmation is to be made.
+func (req *IdpAuthnRequest) holderOfKeyCertificate(spEntityID string) (*x509.Certificate, error) {
+	required := req.Request.ProtocolBinding == HolderOfKeySSOBinding
+	if !required && !req.IDP.spOptions(spEntityID).HolderOfKey {
+		return nil, nil
+	}
+	cert, err := clientCertificate(req.IDP.ClientCertificate, req.HTTPRequest)
+	if err != nil {
+		return nil, err
+	}
+	if cert == nil && required {
+		return nil, ErrNoClientCertificate
+	}
+	return cert, nil
+}
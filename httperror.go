@@ -0,0 +1,132 @@
+package saml
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Codes of the JSON error bodies sent by the IdP's handlers to clients that
+// accept application/json rather than HTML.
+const (
+	ErrorCodeInternal            = "internal_error"
+	ErrorCodeRequestDenied       = "request_denied"
+	ErrorCodeRequestNotSigned    = "request_not_signed"
+	ErrorCodeInvalidNameIDPolicy = "invalid_name_id_policy"
+	ErrorCodeRelayStateTooLong   = "relay_state_too_long"
+	ErrorCodeMessageTooLarge     = "message_too_large"
+	ErrorCodeInvalidXML          = "invalid_xml"
+	ErrorCodeUnknownMessageType  = "unknown_message_type"
+	ErrorCodeUnknownIdP          = "unknown_idp"
+	ErrorCodeUnknownSP           = "unknown_sp"
+	ErrorCodeRateLimited         = "rate_limited"
+	ErrorCodeMethodNotAllowed    = "method_not_allowed"
+	ErrorCodeTimeout             = "timeout"
+	ErrorCodeUnsupportedVersion  = "unsupported_version"
+)
+
+// jsonError is the body of an error sent as JSON.
+type jsonError struct {
+	Error string `json:"error"`
+	Code  string `json:"code"`
+}
+
+// errorCode returns the JSON error code of err, answered with the given HTTP
+// status.
+func errorCode(err error, status int) string {
+	switch errors.Cause(err) {
+	case ErrAuthnRequestNotSigned:
+		return ErrorCodeRequestNotSigned
+	case ErrNoPersistentID, ErrNoNameIDEncryptionKey:
+		return ErrorCodeInvalidNameIDPolicy
+	case ErrRelayStateTooLong:
+		return ErrorCodeRelayStateTooLong
+	case ErrMessageTooLarge, ErrMetadataTooLarge:
+		return ErrorCodeMessageTooLarge
+	case ErrXMLTooDeep, ErrDTDNotAllowed:
+		return ErrorCodeInvalidXML
+	case ErrUnknownMessageType:
+		return ErrorCodeUnknownMessageType
+	case ErrUnknownIdP:
+		return ErrorCodeUnknownIdP
+	case ErrUnknownIssuer:
+		return ErrorCodeUnknownSP
+	case ErrNoSigningKey:
+		return ErrorCodeRequestDenied
+	case ErrUnsupportedVersion:
+		return ErrorCodeUnsupportedVersion
+	}
+
+	msg := err.Error()
+	switch {
+	case strings.HasPrefix(msg, StatusRequestDenied):
+		return ErrorCodeRequestDenied
+	case strings.HasPrefix(msg, StatusInvalidNameIDPolicy):
+		return ErrorCodeInvalidNameIDPolicy
+	}
+
+	switch status {
+	case http.StatusForbidden:
+		return ErrorCodeRequestDenied
+	case http.StatusTooManyRequests:
+		return ErrorCodeRateLimited
+	case http.StatusMethodNotAllowed:
+		return ErrorCodeMethodNotAllowed
+	case http.StatusGatewayTimeout:
+		return ErrorCodeTimeout
+	}
+	return ErrorCodeInternal
+}
+
+// acceptsJSON reports whether the client prefers application/json, or
+// another JSON media type, over HTML.
+func acceptsJSON(r *http.Request) bool {
+	var jsonQ, htmlQ float64
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		switch {
+		case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+			jsonQ = maxQ(jsonQ, q)
+		case mediaType == "text/html" || mediaType == "application/xhtml+xml":
+			htmlQ = maxQ(htmlQ, q)
+		}
+	}
+	return jsonQ > 0 && jsonQ > htmlQ
+}
+
+func maxQ(a, b float64) float64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// writeError answers with the given status and err, as a JSON error for
+// clients that accept it and as text otherwise.
+func writeError(w http.ResponseWriter, r *http.Request, status int, err error) {
+	w.Header().Add("Vary", "Accept")
+	if acceptsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(jsonError{
+			Error: err.Error(),
+			Code:  errorCode(err, status),
+		})
+		return
+	}
+	w.WriteHeader(status)
+	w.Write([]byte(err.Error()))
+}
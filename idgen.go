@@ -0,0 +1,41 @@
+package saml
+
+import (
+	"context"
+	"strings"
+	"unicode"
+)
+
+// IDGenerator returns the ID of a response or assertion made by the IdP for
+// the HTTP request whose context is ctx, such as one derived from the trace
+// ID it carries to correlate a SAML flow across services. IDs must be unique:
+// add randomness, e.g. from NewID, to whatever is taken from ctx.
+type IDGenerator func(ctx context.Context) string
+
+// newID returns an ID made by the IdP's IDGenerator, or NewID, turned into a
+// valid NCName as XML IDs must be.
+func (req *IdpAuthnRequest) newID() string {
+	if req.IDP.IDGenerator == nil {
+		return NewID()
+	}
+	return ncName(req.IDP.IDGenerator(req.context()))
+}
+
+// ncName returns id with the characters an NCName cannot hold replaced by
+// underscores, and an underscore prepended when it does not start with a
+// letter or an underscore. NewID is used when id is empty.
+func ncName(id string) string {
+	if id == "" {
+		return NewID()
+	}
+	id = strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '-' || r == '.' {
+			return r
+		}
+		return '_'
+	}, id)
+	if first := []rune(id)[0]; !unicode.IsLetter(first) && first != '_' {
+		id = "_" + id
+	}
+	return id
+}
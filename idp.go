@@ -2,17 +2,23 @@ package saml
 
 import (
 	"bytes"
+	"context"
+	"crypto"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/pem"
 	"encoding/xml"
-	"errors"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
+	"strings"
 	"sync/atomic"
+	"text/template"
 	"time"
 
 	"github.com/goware/saml/xmlsec"
+	"github.com/pkg/errors"
 )
 
 // Session represents a user session. It is returned by the
@@ -33,6 +39,13 @@ type Session struct {
 	UserCommonName string
 	UserSurname    string
 	UserGivenName  string
+
+	// AuthnContextClassRef and AuthnContextDeclRef tell how the user was
+	// authenticated, by class or by declaration, and are checked against the
+	// request's RequestedAuthnContext. The class defaults to
+	// AuthnContextPasswordProtectedTransport.
+	AuthnContextClassRef string
+	AuthnContextDeclRef  string
 }
 
 // IdpAuthnRequest is used by IdentityProvider to handle a single authentication request.
@@ -44,9 +57,41 @@ type IdpAuthnRequest struct {
 	Request                 AuthnRequest
 	ServiceProviderMetadata *Metadata
 	ACSEndpoint             *IndexedEndpoint
-	Assertion               *Assertion
-	AssertionBuffer         []byte
-	Response                *Response
+
+	// OmitAuthnStatement makes MakeAssertion leave out the AuthnStatement,
+	// for attribute-only assertions that don't record an authentication,
+	// such as provisioning pushes.
+	OmitAuthnStatement bool
+
+	// AttributeGroups are added by MakeAssertion as AttributeStatements of
+	// their own, after the one holding the session attributes. See
+	// AddAttributeGroup.
+	AttributeGroups []AttributeGroup
+
+	// SignatureVerified is set by VerifySignature when the request carried
+	// a valid SP signature, as opposed to an unsigned request accepted
+	// because WantAuthnRequestsSigned is off.
+	SignatureVerified bool
+
+	// signatureInvalid is set by VerifySignature when the request carried a
+	// signature that did not verify, so its ID is never echoed.
+	signatureInvalid bool
+
+	// plaintextAssertion is set by MarshalAssertion when AssertionBuffer
+	// holds the signed assertion in the clear, for an SP without an
+	// encryption certificate.
+	plaintextAssertion bool
+
+	Assertion       *Assertion
+	AssertionBuffer []byte
+	Response        *Response
+
+	// responseBuffer is the Response as sent to the SP, see ResponseBytes.
+	responseBuffer []byte
+
+	Assertion11      *Assertion11
+	Response11       *Response11
+	Response11Buffer []byte
 }
 
 // IdentityProvider represents an identity provider.
@@ -57,19 +102,340 @@ type IdentityProvider struct {
 	PrivkeyPEM string
 	PubkeyPEM  string
 
+	// PrivkeyPassphrase decrypts the private key in KeyFile or PrivkeyPEM
+	// when it is an encrypted PEM block, either PKCS#8 or with the legacy
+	// OpenSSL Proc-Type headers. It is handed to xmlsec1, which decrypts the
+	// key in memory, so the key is never written out in the clear.
+	PrivkeyPassphrase string
+
+	// Signer, when set, signs assertions and responses instead of the private
+	// key in KeyFile or PrivkeyPEM, which lets the key live in an HSM or a
+	// cloud KMS. The certificate in CertFile or PubkeyPEM must match it.
+	Signer crypto.Signer
+
+	// SigningKey and SigningCert, when set, sign assertions and responses
+	// instead of Signer or the IdP's key, and SigningCert is embedded in
+	// their signatures. Metadata keeps advertising the certificate in CertFile
+	// or PubkeyPEM, so a new key can sign while SPs still trust the old one.
+	// Add SigningCert to MetadataCerts to advertise both during a rotation.
+	SigningKey  crypto.Signer
+	SigningCert *x509.Certificate
+
+	// MetadataCerts are advertised as signing certificates in the metadata,
+	// after the IdP's certificate.
+	MetadataCerts []*x509.Certificate
+
+	// EncryptionCert, when set, is advertised in the metadata as the IdP's
+	// encryption key instead of its certificate, for SPs that encrypt to the
+	// IdP with a key distinct from the signing one. The IdP itself decrypts
+	// nothing.
+	EncryptionCert *x509.Certificate
+
+	// SignatureTransforms are the algorithms of the Transforms of the
+	// signatures made by the IdP, in order. DefaultSignatureTransforms are
+	// used when empty.
+	SignatureTransforms []string
+
+	// SignatureMethod and DigestMethod are the algorithms of the signatures
+	// made by the IdP, such as xmlsec.RSASHA256 and xmlsec.DigestSHA256,
+	// the ones of xmlsec.DefaultSignature when empty. Metadata declares
+	// them, when set, with the SAML metadata algorithm support extensions.
+	// An SP whose metadata declares the algorithms it supports gets
+	// signatures made with the first of them the IdP can use instead, see
+	// signatureTemplate.
+	SignatureMethod string
+	DigestMethod    string
+
+	// InclusiveNamespaces is the PrefixList given to the exclusive
+	// canonicalization transforms of the IdP's signatures, for SPs that want
+	// some namespaces, such as xs, to be covered even where unused.
+	InclusiveNamespaces []string
+
+	// Organization and UIInfo, when set, describe the IdP in its metadata,
+	// with values in as many languages as needed.
+	Organization *Organization
+	UIInfo       *UIInfo
+
 	SSOURL      string
 	MetadataURL string
 
 	SPMetadataURL string
 	SPMetadata    *Metadata
 
+	// MetadataResolver, when set, looks up the metadata of the SP that sent
+	// each request by the request's Issuer, instead of using SPMetadata or
+	// SPMetadataURL. Requests from SPs it does not know are denied with
+	// ErrUnknownIssuer.
+	MetadataResolver SPMetadataResolver
+
+	// MetadataHTTPClient fetches SP metadata. http.DefaultClient is used when
+	// nil. See NewMetadataHTTPClient to trust a private CA.
+	MetadataHTTPClient *http.Client
+
 	SPAcsURL string
 
+	// EntityID is the IdP's entity ID, published in its metadata and used as
+	// the Issuer of its messages. MetadataURL is used when empty.
 	EntityID string
 
+	// EntityIDAliases are other entity IDs of the IdP, such as the one it had
+	// before a rebrand. SPs that still know the IdP under an alias are given
+	// it through the IssuerEntityID of their options. Only EntityID is
+	// published in the metadata.
+	EntityIDAliases []string
+
+	// AttributeNameFormat is the NameFormat given to attributes that have
+	// none, such as AttributeNameFormatBasic for SPs that look for plain
+	// names. AttributeNameFormatURI is used when empty.
+	AttributeNameFormat string
+
+	// AttributeValueType is the xsi:type given to attribute values, such as
+	// AttributeValueTypeString. Attribute values are untyped by default.
+	AttributeValueType string
+
+	// AttributeValueTypes overrides AttributeValueType for specific
+	// attributes, keyed by attribute name.
+	AttributeValueTypes map[string]string
+
+	// AttributeTransforms are applied in order by MakeAssertion to the
+	// attributes of the session, before those of the SP's options.
+	AttributeTransforms []AttributeTransform
+
+	// EmptyAttributeValues tells how MakeAssertion sends empty or whitespace
+	// attribute values. They are omitted by default.
+	EmptyAttributeValues EmptyAttributeValuePolicy
+
+	// PersistentIDStore provides NameIDs to SPs that request the persistent
+	// format. Transient NameIDs are used when nil.
+	PersistentIDStore PersistentIDStore
+
+	// TransientNameIDLength is the number of random bytes of transient
+	// NameIDs, DefaultTransientNameIDLength when zero. Transient NameIDs are
+	// a fresh random value for each assertion, which cannot be correlated
+	// across sessions, never the session's NameID.
+	TransientNameIDLength int
+
+	// DefaultNameIDFormat is the format of the NameIDs made for SPs whose
+	// NameIDPolicy and metadata do not ask for one the IdP can make, so
+	// that an Authenticator only has to fill in the session. With
+	// NameIDFormatEmailAddress the NameID is the session's UserEmail, or
+	// its NameID when that is an email address; with
+	// NameIDFormatUnspecified it is the session's NameID. Transient when
+	// empty, or when the session lacks what the format needs.
+	DefaultNameIDFormat string
+
+	// WantAuthnRequestsSigned makes ServeSSO deny authentication requests
+	// that are not signed by the SP. Signed requests are always verified.
+	WantAuthnRequestsSigned bool
+
+	// MaxRequestSkew makes ServeSSO deny authentication requests whose
+	// IssueInstant is further than this from the current time, in either
+	// direction. Zero disables the check. RequestSkewPolicy tells what is
+	// done with these requests instead, and SPOptions can override both
+	// for SPs with bad clocks.
+	MaxRequestSkew    time.Duration
+	RequestSkewPolicy RequestSkewPolicy
+
+	// HonorRequestedConditions makes MakeAssertion cap the NotOnOrAfter of
+	// the assertion's Conditions to the one of the Conditions in the
+	// request, when earlier. Requested conditions are ignored otherwise.
+	HonorRequestedConditions bool
+
+	// StrictIssuerFormat makes ServeSSO deny authentication requests whose
+	// Issuer has a Format other than NameIDFormatEntity. The Issuer of a
+	// protocol message must be an entity ID, the format is then omitted or
+	// entity. Other formats are accepted when false.
+	StrictIssuerFormat bool
+
+	// MetadataContentType is the Content-Type of the served metadata.
+	// DefaultMetadataContentType is used when empty.
+	MetadataContentType string
+
+	// IndentResponses pretty-prints the Responses sent to SPs, for debugging.
+	// Responses holding a signed element in the clear are always compact.
+	IndentResponses bool
+
+	// MetadataTemplate, when set, renders the IdP's metadata instead of the
+	// default XML marshalling, for SPs that are strict about its format. It is
+	// executed with the *Metadata returned by Metadata.
+	MetadataTemplate *template.Template
+
+	// SPCertExpiryPolicy is what happens when the certificate of the SP,
+	// taken from its metadata to encrypt assertions, is expired or not valid
+	// yet. It is ignored by default.
+	SPCertExpiryPolicy CertExpiryPolicy
+
+	// ValidateAssertionsAgainstSP makes WriteResponse check assertions with
+	// ValidateAgainstSP before sending them, failing with the SP's unmet
+	// requirements instead of letting the SP reject the response. Meant for
+	// tests and staging.
+	ValidateAssertionsAgainstSP bool
+
+	// SPOptions holds per-SP settings, keyed by the SP's entity ID.
+	SPOptions map[string]SPOptions
+
+	// ClientCertificate returns the TLS client certificate holder-of-key
+	// assertions are bound to. TLSClientCertificate is used when nil, see
+	// ClientCertificateFunc for what it takes to get the certificate behind
+	// a proxy.
+	ClientCertificate ClientCertificateFunc
+
+	// Observer receives metrics about SSO requests. Nothing is recorded when
+	// nil.
+	Observer Observer
+
+	// IDGenerator makes the IDs of the IdP's responses and assertions. NewID
+	// is used when nil.
+	IDGenerator IDGenerator
+
+	// RateLimiter, when set, is consulted by ServeSSO with the client's IP
+	// address before parsing the request, then with the SP's entity ID.
+	// Requests that are not allowed get a 429 response.
+	RateLimiter RateLimiter
+
+	// SSOTimeout bounds the time ServeSSO spends on a request, including
+	// metadata fetches, the Authenticator and xmlsec1, which get a request
+	// context with this deadline. Requests that exceed it are aborted with a
+	// 504. There is no timeout when zero.
+	SSOTimeout time.Duration
+
 	SecurityOpts
 
-	pemCert atomic.Value
+	pemCert         atomic.Value
+	metadataVersion atomic.Value
+	spMetadata      atomic.Value
+}
+
+// CertExpiryPolicy tells how peer certificates outside of their validity
+// period are dealt with.
+type CertExpiryPolicy int
+
+// Certificate expiry policies.
+const (
+	// CertExpiryIgnore uses the certificate anyway.
+	CertExpiryIgnore CertExpiryPolicy = iota
+	// CertExpiryWarn logs a warning and uses the certificate anyway.
+	CertExpiryWarn
+	// CertExpiryFail refuses to use the certificate.
+	CertExpiryFail
+)
+
+// RequestSkewPolicy tells how authentication requests whose IssueInstant is
+// outside of the allowed clock skew are dealt with.
+type RequestSkewPolicy int
+
+// Request skew policies.
+const (
+	// RequestSkewDefault uses the IdP's RequestSkewPolicy in SPOptions, and
+	// denies the request for the IdP.
+	RequestSkewDefault RequestSkewPolicy = iota
+	// RequestSkewDeny denies the request.
+	RequestSkewDeny
+	// RequestSkewWarn logs a warning and serves the request anyway.
+	RequestSkewWarn
+)
+
+// SPOptions represents settings that only apply to a given service provider.
+type SPOptions struct {
+	// SAML11 makes the IdP respond with SAML 1.1 messages, for legacy SPs that
+	// don't speak SAML 2.0.
+	SAML11 bool
+
+	// HolderOfKey adds a holder-of-key SubjectConfirmation, bound to the TLS
+	// client certificate of the user, after the bearer one. It is omitted
+	// when no client certificate was presented. Requests whose
+	// ProtocolBinding is HolderOfKeySSOBinding always get one, and are
+	// denied without a client certificate.
+	HolderOfKey bool
+
+	// AudienceOverride replaces the SP's entity ID as the Audience of its
+	// assertions. Some SPs, such as Okta, expect their ACS URL or a custom
+	// "Audience URI" there.
+	AudienceOverride string
+
+	// IssuerEntityID is the entity ID the IdP presents to the SP as the Issuer
+	// of its responses and assertions, and as the NameQualifier of its
+	// NameIDs. It must be the IdP's EntityID or one of its EntityIDAliases;
+	// EntityID is used when empty.
+	IssuerEntityID string
+
+	// AudienceInResponseExtensions repeats the Audience of the assertion in
+	// the Extensions of the Response, for legacy SPs that look for it there.
+	// The assertion always has its own AudienceRestriction.
+	AudienceInResponseExtensions bool
+
+	// SignaturePosition tells where the signature of the SP's assertions is
+	// placed, for SPs that look for it elsewhere than right after the Issuer,
+	// or that want the Response signed instead.
+	SignaturePosition SignaturePosition
+
+	// SignatureKeyInfo tells what the KeyInfo of the signatures of the SP's
+	// assertions carries: the signing certificate by default.
+	SignatureKeyInfo SignatureKeyInfo
+
+	// AttributeNameFormat overrides the IdP's AttributeNameFormat for the
+	// SP's attributes.
+	AttributeNameFormat string
+
+	// AttributeTransforms are applied to the attributes released to the SP,
+	// after the IdP's AttributeTransforms.
+	AttributeTransforms []AttributeTransform
+
+	// AllowUnencryptedAssertions sends the SP's assertions signed but in the
+	// clear when its metadata has no certificate to encrypt them with.
+	// MarshalAssertion fails with ErrNoEncryptionKey otherwise.
+	AllowUnencryptedAssertions bool
+
+	// SAMLEncoding, when set, is posted to the SP as the SAMLEncoding field
+	// of the response forms, next to SAMLResponse, for SPs that expect one.
+	// Responses are posted base64 encoded but not DEFLATEd, so give
+	// DeflateEncoding only to SPs that insist on it.
+	SAMLEncoding string
+
+	// MaxRequestSkew and RequestSkewPolicy override the IdP's for the
+	// SP's authentication requests when set. A negative MaxRequestSkew
+	// disables the check.
+	MaxRequestSkew    time.Duration
+	RequestSkewPolicy RequestSkewPolicy
+}
+
+// spOptions returns the settings for the SP with the given entity ID.
+func (idp *IdentityProvider) spOptions(entityID string) SPOptions {
+	return idp.SPOptions[entityID]
+}
+
+// entityID returns the IdP's primary entity ID.
+func (idp *IdentityProvider) entityID() string {
+	if idp.EntityID != "" {
+		return idp.EntityID
+	}
+	return idp.MetadataURL
+}
+
+// HasEntityID reports whether id is the IdP's entity ID or one of its
+// EntityIDAliases. Requests are honored whichever of them the SP knows the
+// IdP under.
+func (idp *IdentityProvider) HasEntityID(id string) bool {
+	if id == idp.entityID() {
+		return true
+	}
+	for _, alias := range idp.EntityIDAliases {
+		if id == alias {
+			return true
+		}
+	}
+	return false
+}
+
+// issuer returns the entity ID the IdP presents to the SP that sent the
+// request: the IssuerEntityID of its options, or the IdP's entity ID.
+func (req *IdpAuthnRequest) issuer() string {
+	if meta := req.ServiceProviderMetadata; meta != nil {
+		if id := req.IDP.spOptions(meta.EntityID).IssuerEntityID; id != "" {
+			return id
+		}
+	}
+	return req.IDP.entityID()
 }
 
 // PrivkeyFile returns a physical path where the IdP's key can be accessed.
@@ -83,6 +449,100 @@ func (idp *IdentityProvider) PrivkeyFile() (string, error) {
 	return "", errors.New("No private key given.")
 }
 
+// sign signs a XML document holding a Signature template, using SigningKey or
+// Signer when set and xmlsec1 with the IdP's private key otherwise. xmlsec1
+// is killed when ctx is done.
+func (idp *IdentityProvider) sign(ctx context.Context, buf []byte) ([]byte, error) {
+	if signer := idp.signer(); signer != nil {
+		out, err := xmlsec.SignWithSigner(buf, signer)
+		if err != nil {
+			return nil, err
+		}
+		logSignatureTrace("signed document", out)
+		return out, nil
+	}
+
+	keyFile, err := idp.PrivkeyFile()
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := xmlsec.SignWithContext(ctx, buf, keyFile, &xmlsec.ValidationOptions{
+		EnableIDAttrHack: true,
+		KeyPassword:      idp.PrivkeyPassphrase,
+	})
+	if err != nil && IsSecurityException(err, &idp.SecurityOpts) {
+		return nil, err
+	}
+	logSignatureTrace("signed document", out)
+	return out, nil
+}
+
+// signer returns the crypto.Signer that signs documents, or nil when xmlsec1
+// signs them with the IdP's private key.
+func (idp *IdentityProvider) signer() crypto.Signer {
+	if idp.SigningKey != nil {
+		return idp.SigningKey
+	}
+	return idp.Signer
+}
+
+// DefaultSignatureTransforms are the Transforms of the signatures made by an
+// IdP without SignatureTransforms: the enveloped signature transform, then
+// exclusive canonicalization.
+var DefaultSignatureTransforms = []string{xmlsec.EnvelopedSignatureTransform, xmlsec.ExcC14N10}
+
+// signatureTemplate returns the Signature template of the documents signed
+// by the IdP, embedding the given certificate. When the metadata of the peer,
+// if any, declares the algorithms it supports and not the IdP's, the first
+// it supports of signatureMethods and digestMethods are used instead.
+func (idp *IdentityProvider) signatureTemplate(cert *pem.Block, peer *Metadata) xmlsec.Signature {
+	transforms := idp.SignatureTransforms
+	if len(transforms) == 0 {
+		transforms = DefaultSignatureTransforms
+	}
+	signature := xmlsec.DefaultSignature(pem.EncodeToMemory(cert))
+	signature.Reference.Transforms = xmlsec.NewTransforms(transforms, idp.InclusiveNamespaces)
+	if idp.SignatureMethod != "" {
+		signature.SignatureMethod.Algorithm = idp.SignatureMethod
+	}
+	if idp.DigestMethod != "" {
+		signature.Reference.DigestMethod.Algorithm = idp.DigestMethod
+	}
+	if peer != nil {
+		if method := ChooseAlgorithm(signatureMethods(signature.SignatureMethod.Algorithm), peer.SigningMethods()); method != "" {
+			signature.SignatureMethod.Algorithm = method
+		}
+		if method := ChooseAlgorithm(digestMethods(signature.Reference.DigestMethod.Algorithm), peer.DigestMethods()); method != "" {
+			signature.Reference.DigestMethod.Algorithm = method
+		}
+	}
+	return signature
+}
+
+// signatureMethods returns the signature methods the IdP can use, preferred
+// first, then the others for the same type of key, strongest first.
+func signatureMethods(preferred string) []string {
+	if strings.HasPrefix(preferred, "http://www.w3.org/2001/04/xmldsig-more#ecdsa-") {
+		return []string{preferred, xmlsec.ECDSASHA256, xmlsec.ECDSASHA512, xmlsec.ECDSASHA1}
+	}
+	return []string{preferred, xmlsec.RSASHA256, xmlsec.RSASHA512, xmlsec.RSASHA1}
+}
+
+// digestMethods returns the digest methods the IdP can use, preferred first.
+func digestMethods(preferred string) []string {
+	return []string{preferred, xmlsec.DigestSHA256, xmlsec.DigestSHA512, xmlsec.DigestSHA1}
+}
+
+// signingCert returns the certificate embedded in signatures: SigningCert
+// when set, the IdP's certificate otherwise.
+func (idp *IdentityProvider) signingCert() (*pem.Block, error) {
+	if idp.SigningCert != nil {
+		return &pem.Block{Type: "CERTIFICATE", Bytes: idp.SigningCert.Raw}, nil
+	}
+	return idp.Cert()
+}
+
 // PubkeyFile returns a physical path where the IdP's public key can be
 // accessed.
 func (idp *IdentityProvider) PubkeyFile() (string, error) {
@@ -126,281 +586,993 @@ func (idp *IdentityProvider) Cert() (*pem.Block, error) {
 	return cert, nil
 }
 
+// Prepare checks the IdP's configuration once, at startup, so that mistakes
+// fail there rather than on the first SSO request: the private key must match
+// the certificate, the certificate must be currently valid and the metadata
+// must be buildable. With SigningKey, it is SigningKey that must match
+// SigningCert. The certificate is then cached for the requests to come.
+func (idp *IdentityProvider) Prepare() error {
+	_, err := idp.prepare()
+	return err
+}
+
+// prepare is Prepare, returning the file of the certificate that verifies the
+// IdP's signatures.
+func (idp *IdentityProvider) prepare() (string, error) {
+	for spEntityID, options := range idp.SPOptions {
+		if options.IssuerEntityID != "" && !idp.HasEntityID(options.IssuerEntityID) {
+			return "", errors.Errorf("IssuerEntityID %q of SP %q is not an entity ID of the IdP", options.IssuerEntityID, spEntityID)
+		}
+	}
+
+	if (idp.SigningKey == nil) != (idp.SigningCert == nil) {
+		return "", errors.New("SigningKey and SigningCert must be set together")
+	}
+
+	var pubKey crypto.PublicKey
+	switch {
+	case idp.SigningKey != nil:
+		pubKey = idp.SigningKey.Public()
+	case idp.Signer != nil:
+		pubKey = idp.Signer.Public()
+	case idp.PrivkeyPassphrase != "":
+		// Encrypted keys are only read by xmlsec1, which fails to sign with
+		// a wrong passphrase, so they cannot be matched here.
+		if _, err := idp.PrivkeyFile(); err != nil {
+			return "", err
+		}
+	default:
+		keyFile, err := idp.PrivkeyFile()
+		if err != nil {
+			return "", err
+		}
+
+		privKey, err := readPrivateKey(keyFile)
+		if err != nil {
+			return "", errors.Wrapf(err, "failed to read private key %v", keyFile)
+		}
+		pubKey = privKey
+	}
+
+	certFile, err := idp.PubkeyFile()
+	if err != nil {
+		return "", err
+	}
+
+	cert, err := retriveCertificate(certFile)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to read certificate %v", certFile)
+	}
+	if idp.SigningCert != nil {
+		cert = idp.SigningCert
+		if err := checkCertificateValidity(cert, time.Now()); err != nil {
+			return "", err
+		}
+	}
+
+	if pubKey != nil && !publicKeysMatch(pubKey, cert.PublicKey) {
+		return "", errors.New("private key does not match certificate")
+	}
+
+	if _, err := idp.Metadata(); err != nil {
+		return "", errors.Wrap(err, "failed to build metadata")
+	}
+
+	pemCert, err := idp.signingCert()
+	if err != nil {
+		return "", err
+	}
+	if idp.SigningCert != nil {
+		if certFile, err = writeFile(pem.EncodeToMemory(pemCert)); err != nil {
+			return "", err
+		}
+	}
+
+	return certFile, nil
+}
+
+// Validate does what Prepare does, and checks that the key is able to sign
+// and verify a test document.
+func (idp *IdentityProvider) Validate() error {
+	certFile, err := idp.prepare()
+	if err != nil {
+		return err
+	}
+	pemCert, err := idp.signingCert()
+	if err != nil {
+		return err
+	}
+
+	signatureTemplate := idp.signatureTemplate(pemCert, nil)
+	buf, err := xml.Marshal(&Assertion{
+		ID:           NewID(),
+		IssueInstant: Now(),
+		Version:      "2.0",
+		Signature:    &signatureTemplate,
+	})
+	if err != nil {
+		return err
+	}
+
+	buf, err = idp.sign(context.Background(), buf)
+	if err != nil {
+		return errors.Wrap(err, "failed to sign test assertion")
+	}
+
+	err = xmlsec.Verify(buf, certFile, &xmlsec.ValidationOptions{
+		EnableIDAttrHack: true,
+	})
+	if err != nil && IsSecurityException(err, &idp.SecurityOpts) {
+		return errors.Wrap(err, "failed to verify test assertion")
+	}
+
+	return nil
+}
+
 // Metadata returns a metadata value based on the IdP's data.
 func (idp *IdentityProvider) Metadata() (*Metadata, error) {
 	cert, err := idp.Cert()
 	if err != nil {
 		return nil, err
 	}
-	certStr := base64.StdEncoding.EncodeToString(cert.Bytes)
-
-	metadata := &Metadata{
-		EntityID:      idp.MetadataURL,
-		ValidUntil:    Now().Add(defaultValidDuration),
-		CacheDuration: defaultValidDuration,
-		IDPSSODescriptor: &IDPSSODescriptor{
-			ProtocolSupportEnumeration: "urn:oasis:names:tc:SAML:2.0:protocol",
-			KeyDescriptor: []KeyDescriptor{
-				KeyDescriptor{
-					Use: "signing",
-					KeyInfo: KeyInfo{
-						Certificate: certStr,
-					},
-				},
-				KeyDescriptor{
-					Use: "encryption",
-					KeyInfo: KeyInfo{
-						Certificate: certStr,
-					},
-					EncryptionMethods: []EncryptionMethod{
-						EncryptionMethod{Algorithm: "http://www.w3.org/2001/04/xmlenc#aes128-cbc"},
-						EncryptionMethod{Algorithm: "http://www.w3.org/2001/04/xmlenc#aes192-cbc"},
-						EncryptionMethod{Algorithm: "http://www.w3.org/2001/04/xmlenc#aes256-cbc"},
-						EncryptionMethod{Algorithm: "http://www.w3.org/2001/04/xmlenc#rsa-oaep-mgf1p"},
-					},
-				},
+	metadata := idpMetadata(idp.entityID(), idp.SSOURL, "", cert.Bytes, idp.nameIDFormats())
+	var signingMethods, digestMethods []string
+	if idp.SignatureMethod != "" {
+		signingMethods = []string{idp.SignatureMethod}
+	}
+	if idp.DigestMethod != "" {
+		digestMethods = []string{idp.DigestMethod}
+	}
+	WithAlgorithms(signingMethods, digestMethods)(metadata)
+	metadata.IDPSSODescriptor.WantAuthnRequestsSigned = idp.WantAuthnRequestsSigned
+	metadata.Organization = idp.Organization
+	if idp.UIInfo != nil {
+		metadata.IDPSSODescriptor.Extensions = &RoleExtensions{UIInfo: idp.UIInfo}
+	}
+	if idp.EncryptionCert != nil {
+		WithEncryptionCert(idp.EncryptionCert)(metadata)
+	}
+	for _, extra := range idp.MetadataCerts {
+		metadata.IDPSSODescriptor.KeyDescriptor = append(metadata.IDPSSODescriptor.KeyDescriptor, KeyDescriptor{
+			Use: "signing",
+			KeyInfo: KeyInfo{
+				Certificate: base64.StdEncoding.EncodeToString(extra.Raw),
 			},
-			NameIDFormat: []string{
-				"urn:oasis:names:tc:SAML:2.0:nameid-format:transient",
+		})
+	}
+	return metadata, nil
+}
+
+// nameIDFormats returns the NameID formats the IdP is able to produce.
+func (idp *IdentityProvider) nameIDFormats() []string {
+	formats := []string{NameIDFormatTransient}
+	if idp.PersistentIDStore != nil {
+		formats = append(formats, NameIDFormatPersistent)
+	}
+	switch idp.DefaultNameIDFormat {
+	case NameIDFormatEmailAddress, NameIDFormatUnspecified:
+		formats = append(formats, idp.DefaultNameIDFormat)
+	}
+	return formats
+}
+
+// spEntityID returns the entity ID of the SP's metadata, which must be set.
+func (req *IdpAuthnRequest) spEntityID() (string, error) {
+	metadata, err := req.spMetadata()
+	if err != nil {
+		return "", errors.Wrap(err, "cannot make an assertion without the SP's entity ID")
+	}
+	if metadata.EntityID == "" {
+		return "", errors.New("cannot make an assertion for an SP without an entity ID")
+	}
+	return metadata.EntityID, nil
+}
+
+// audience returns the Audience of the SP's assertions: its entity ID, or the
+// AudienceOverride of its options. An assertion without an audience would be
+// accepted by any SP, so an SP without an entity ID is an error.
+func (req *IdpAuthnRequest) audience() (string, error) {
+	entityID, err := req.spEntityID()
+	if err != nil {
+		return "", err
+	}
+	if override := req.IDP.spOptions(entityID).AudienceOverride; override != "" {
+		return override, nil
+	}
+	return entityID, nil
+}
+
+// MakeAssertion produces a SAML assertion for the given request and assigns it
+// to req.Assertion.
+func (req *IdpAuthnRequest) MakeAssertion(session *Session) error {
+	cert, err := req.IDP.signingCert()
+	if err != nil {
+		return err
+	}
+
+	signatureTemplate := req.IDP.signatureTemplate(cert, req.ServiceProviderMetadata)
+	if err := req.signatureKeyInfo().apply(&signatureTemplate, cert); err != nil {
+		return err
+	}
+	attributes := req.transformAttributes(sessionAttributes(session))
+	req.setAttributeNameFormats(attributes)
+	req.IDP.setAttributeValueTypes(attributes)
+	attributes = req.IDP.EmptyAttributeValues.apply(attributes)
+
+	if _, err := req.IDP.Metadata(); err != nil {
+		return err
+	}
+
+	spNameQualifier := func() string {
+		if meta := req.ServiceProviderMetadata; meta != nil {
+			return meta.EntityID
+		}
+		return ""
+	}
+
+	audience, err := req.audience()
+	if err != nil {
+		return err
+	}
+
+	nameID, err := req.makeNameID(session, req.issuer(), spNameQualifier())
+	if err != nil {
+		return err
+	}
+
+	confirmations, err := req.subjectConfirmations(spNameQualifier())
+	if err != nil {
+		return err
+	}
+
+	subject := &Subject{
+		NameID:               nameID,
+		SubjectConfirmations: confirmations,
+	}
+	if req.Request.NameIDPolicy.Format == NameIDFormatEncrypted {
+		if !req.spHasEncryptionKey() {
+			return ErrNoNameIDEncryptionKey
+		}
+		// The NameID is encrypted by MarshalAssertion.
+		subject.EncryptedID = &EncryptedID{NameID: nameID}
+		subject.NameID = nil
+	}
+
+	var authnStatement *AuthnStatement
+	if !req.OmitAuthnStatement {
+		authnStatement = &AuthnStatement{
+			AuthnInstant: session.CreateTime,
+			SessionIndex: session.Index,
+			SubjectLocality: SubjectLocality{
+				Address: req.HTTPRequest.RemoteAddr,
 			},
-			SingleSignOnService: []Endpoint{
-				{
-					Binding:  HTTPRedirectBinding,
-					Location: idp.SSOURL,
-				},
-				{
-					Binding:  HTTPPostBinding,
-					Location: idp.SSOURL,
-				},
+			AuthnContext: req.authnContext(session),
+		}
+	}
+
+	id := req.newID()
+	// See SignaturePosition for the Reference of the signature.
+	signature := &signatureTemplate
+	switch position := req.signaturePosition(); {
+	case position == SignatureInResponse:
+		signature = nil
+	case position != SignatureAfterIssuer:
+		signatureTemplate.Reference.URI = "#" + id
+	}
+
+	req.Assertion = &Assertion{
+		ID:           id,
+		IssueInstant: Now(),
+		Version:      "2.0",
+		Issuer: &Issuer{
+			Format: "urn:oasis:names:tc:SAML:2.0:nameid-format:entity",
+			Value:  req.issuer(),
+		},
+		Signature: signature,
+		Subject:   subject,
+		Conditions: &Conditions{
+			NotBefore:    Now(),
+			NotOnOrAfter: req.notOnOrAfter(),
+			AudienceRestriction: &AudienceRestriction{
+				Audience: &Audience{Value: audience},
 			},
 		},
+		AuthnStatement: authnStatement,
+		AttributeStatement: &AttributeStatement{
+			Attributes: attributes,
+		},
+	}
+
+	for _, group := range req.AttributeGroups {
+		req.setAttributeNameFormats(group.Attributes)
+		req.IDP.setAttributeValueTypes(group.Attributes)
+		req.Assertion.AttributeStatements = append(req.Assertion.AttributeStatements, AttributeStatement{
+			Attributes: req.IDP.EmptyAttributeValues.apply(group.Attributes),
+		})
+	}
+
+	return nil
+}
+
+// notOnOrAfter returns the end of the validity of the assertion, after
+// IssueLifetime or at the NotOnOrAfter requested by the SP, whichever comes
+// first, when the IdP honors requested conditions.
+func (req *IdpAuthnRequest) notOnOrAfter() time.Time {
+	notOnOrAfter := Now().Add(IssueLifetime)
+	if requested := req.Request.Conditions; req.IDP.HonorRequestedConditions && requested != nil {
+		if !requested.NotOnOrAfter.IsZero() && requested.NotOnOrAfter.Before(notOnOrAfter) {
+			notOnOrAfter = requested.NotOnOrAfter
+		}
+	}
+	return notOnOrAfter
+}
+
+// transformAttributes applies the IdP's and the SP's AttributeTransforms.
+func (req *IdpAuthnRequest) transformAttributes(attributes []Attribute) []Attribute {
+	transforms := req.IDP.AttributeTransforms
+	if meta := req.ServiceProviderMetadata; meta != nil {
+		transforms = append(transforms[:len(transforms):len(transforms)], req.IDP.spOptions(meta.EntityID).AttributeTransforms...)
+	}
+	for _, transform := range transforms {
+		attributes = transform(attributes)
+	}
+	return attributes
+}
+
+// sessionAttributes returns the list of attributes that describe the user of
+// the given session. They are always listed in the same order, so assertions
+// serialize identically for identical sessions.
+func sessionAttributes(session *Session) []Attribute {
+	attributes := []Attribute{}
+	if session.UserName != "" {
+		attributes = append(attributes, Attribute{
+			FriendlyName: "uid",
+			Name:         "urn:oid:0.9.2342.19200300.100.1.1",
+			NameFormat:   AttributeNameFormatURI,
+			Values: []AttributeValue{AttributeValue{
+				Value: session.UserName,
+			}},
+		})
+	}
+
+	if session.UserEmail != "" {
+		attributes = append(attributes, Attribute{
+			FriendlyName: "eduPersonPrincipalName",
+			Name:         "urn:oid:1.3.6.1.4.1.5923.1.1.1.6",
+			NameFormat:   AttributeNameFormatURI,
+			Values: []AttributeValue{AttributeValue{
+				Value: session.UserEmail,
+			}},
+		})
+	}
+	if session.UserSurname != "" {
+		attributes = append(attributes, Attribute{
+			FriendlyName: "sn",
+			Name:         "urn:oid:2.5.4.4",
+			NameFormat:   AttributeNameFormatURI,
+			Values: []AttributeValue{AttributeValue{
+				Value: session.UserSurname,
+			}},
+		})
+	}
+	if session.UserGivenName != "" {
+		attributes = append(attributes, Attribute{
+			FriendlyName: "givenName",
+			Name:         "urn:oid:2.5.4.42",
+			NameFormat:   AttributeNameFormatURI,
+			Values: []AttributeValue{AttributeValue{
+				Value: session.UserGivenName,
+			}},
+		})
+	}
+
+	if session.UserCommonName != "" {
+		attributes = append(attributes, Attribute{
+			FriendlyName: "cn",
+			Name:         "urn:oid:2.5.4.3",
+			NameFormat:   AttributeNameFormatURI,
+			Values: []AttributeValue{AttributeValue{
+				Value: session.UserCommonName,
+			}},
+		})
+	}
+
+	if session.UserID != "" {
+		attributes = append(attributes, Attribute{
+			FriendlyName: "MASTUsername",
+			Name:         "userid",
+			Values: []AttributeValue{AttributeValue{
+				Value: session.UserID,
+			}},
+		})
+	}
+
+	if session.UserEmail != "" {
+		attributes = append(attributes, Attribute{
+			FriendlyName: "MASTEmail",
+			Name:         "email",
+			Values: []AttributeValue{AttributeValue{
+				Value: session.UserEmail,
+			}},
+		})
+	}
+
+	if session.UserFullname != "" {
+		attributes = append(attributes, Attribute{
+			FriendlyName: "MASTName",
+			Name:         "fullname",
+			Values: []AttributeValue{AttributeValue{
+				Value: session.UserFullname,
+			}},
+		})
+	}
+
+	if len(session.Groups) != 0 {
+		groupMemberAttributeValues := []AttributeValue{}
+		for _, group := range session.Groups {
+			groupMemberAttributeValues = append(groupMemberAttributeValues, AttributeValue{
+				Value: group,
+			})
+		}
+		attributes = append(attributes, Attribute{
+			FriendlyName: "eduPersonAffiliation",
+			Name:         "urn:oid:1.3.6.1.4.1.5923.1.1.1.1",
+			NameFormat:   AttributeNameFormatURI,
+			Values:       groupMemberAttributeValues,
+		})
+	}
+
+	return attributes
+}
+
+// subjectConfirmations returns a bearer SubjectConfirmation, followed by a
+// holder-of-key one bound to the client's TLS certificate when the request
+// uses the holder-of-key profile, or when the SP asked for it in SPOptions and
+// the client presented a certificate.
+func (req *IdpAuthnRequest) subjectConfirmations(spEntityID string) ([]SubjectConfirmation, error) {
+	data := SubjectConfirmationData{
+		Address:      req.HTTPRequest.RemoteAddr,
+		InResponseTo: req.inResponseTo(),
+		NotOnOrAfter: Now().Add(IssueLifetime),
+		Recipient:    req.recipient(HTTPPostBinding),
+	}
+
+	confirmations := []SubjectConfirmation{{
+		Method:                  SubjectConfirmationMethodBearer,
+		SubjectConfirmationData: data,
+	}}
+
+	cert, err := req.holderOfKeyCertificate(spEntityID)
+	if err != nil {
+		return nil, err
+	}
+	if cert != nil {
+		data.KeyInfo = &KeyInfo{
+			Certificate: base64.StdEncoding.EncodeToString(cert.Raw),
+		}
+		confirmations = append(confirmations, SubjectConfirmation{
+			Method:                  SubjectConfirmationMethodHolderOfKey,
+			SubjectConfirmationData: data,
+		})
+	}
+	return confirmations, nil
+}
+
+// destination returns where the response is sent: the recipient of the bearer
+// subject confirmation, which callers of BuildAssertion may have changed.
+func (req *IdpAuthnRequest) destination() string {
+	if req.Assertion != nil && req.Assertion.Subject != nil {
+		if confirmation := req.Assertion.Subject.BearerConfirmation(); confirmation != nil {
+			return confirmation.SubjectConfirmationData.Recipient
+		}
+	}
+	return req.recipient(HTTPPostBinding)
+}
+
+// ErrStaleRequest is the cause of the errors returned by ValidateIssueInstant.
+var ErrStaleRequest = errors.New(StatusRequestDenied + ": request IssueInstant is outside of the allowed clock skew")
+
+// ValidateIssueInstant returns an error when the request's IssueInstant is
+// outside of the window allowed by the MaxRequestSkew of the SP's options, or
+// of the IdP. Requests from SPs whose RequestSkewPolicy is RequestSkewWarn
+// are only logged.
+func (req *IdpAuthnRequest) ValidateIssueInstant() error {
+	maxSkew, policy := req.requestSkew()
+	if maxSkew <= 0 {
+		return nil
+	}
+	now := Now()
+	issueInstant := req.Request.IssueInstant
+	if !issueInstant.Before(now.Add(-maxSkew)) && !issueInstant.After(now.Add(maxSkew)) {
+		return nil
+	}
+	err := errors.Wrapf(ErrStaleRequest, "IssueInstant %v of SP %q is more than %v away from current time %v", issueInstant, req.Request.Issuer.Value, maxSkew, now)
+	if policy == RequestSkewWarn {
+		Logf("Warning: %v", err)
+		return nil
+	}
+	return err
+}
+
+// requestSkew returns the clock skew allowed for the request and what to do
+// when it is exceeded, from the options of the SP that sent it or the IdP.
+func (req *IdpAuthnRequest) requestSkew() (time.Duration, RequestSkewPolicy) {
+	opts := req.IDP.spOptions(req.Request.Issuer.Value)
+	maxSkew, policy := req.IDP.MaxRequestSkew, req.IDP.RequestSkewPolicy
+	if opts.MaxRequestSkew != 0 {
+		maxSkew = opts.MaxRequestSkew
+	}
+	if opts.RequestSkewPolicy != RequestSkewDefault {
+		policy = opts.RequestSkewPolicy
+	}
+	return maxSkew, policy
+}
+
+// ValidateIssuerFormat returns an error when the IdP's StrictIssuerFormat is
+// set and the Format of the request's Issuer is neither omitted nor
+// NameIDFormatEntity.
+func (req *IdpAuthnRequest) ValidateIssuerFormat() error {
+	if !req.IDP.StrictIssuerFormat {
+		return nil
+	}
+	format := req.Request.Issuer.Format
+	if format != "" && format != NameIDFormatEntity {
+		return errors.Errorf("%s: request Issuer %q has Format %q, expecting %q or none", StatusRequestDenied, req.Request.Issuer.Value, format, NameIDFormatEntity)
+	}
+	return nil
+}
+
+// ErrAuthnRequestNotSigned is returned by VerifySignature for unsigned
+// requests when the IdP's WantAuthnRequestsSigned is set.
+var ErrAuthnRequestNotSigned = errors.New(StatusRequestDenied + ": request is not signed")
+
+// VerifySignature checks the SP's signature on the request, as sent through
+// the binding of HTTPRequest: the SigAlg and Signature query parameters of the
+// HTTP-Redirect binding for GET requests, or the enveloped Signature of the
+// HTTP-POST binding otherwise.
+//
+// A signature that is present is always checked, whether or not
+// WantAuthnRequestsSigned is set, and an invalid one is an error: its
+// request ID is then never echoed as InResponseTo, since anyone could have
+// made it up. Unsigned requests are accepted unless WantAuthnRequestsSigned
+// is set, in which case ErrAuthnRequestNotSigned is returned. Their ID is
+// still echoed, as the SP needs it to match the response with its request
+// and is the one checking it against the requests it actually sent.
+func (req *IdpAuthnRequest) VerifySignature() error {
+	req.SignatureVerified = false
+	req.signatureInvalid = false
+
+	var err error
+	if req.HTTPRequest != nil && req.HTTPRequest.Method != http.MethodPost {
+		query := rawQueryValues(req.HTTPRequest.URL.RawQuery)
+		if _, signed := query["Signature"]; !signed {
+			return req.verifyUnsigned()
+		}
+		err = req.verifyRedirectSignature(query)
+	} else if req.Request.Signature != nil {
+		err = req.verifyEnvelopedSignature()
+	} else {
+		return req.verifyUnsigned()
+	}
+
+	if err != nil {
+		req.signatureInvalid = true
+		return err
+	}
+	req.SignatureVerified = true
+	return nil
+}
+
+// verifyUnsigned accepts an unsigned request unless signatures are wanted.
+func (req *IdpAuthnRequest) verifyUnsigned() error {
+	if req.IDP.WantAuthnRequestsSigned {
+		return ErrAuthnRequestNotSigned
+	}
+	return nil
+}
+
+// verifyRedirectSignature checks a HTTP-Redirect binding signature, computed
+// over the SAMLRequest, RelayState and SigAlg parameters exactly as they were
+// URL-encoded by the SP.
+func (req *IdpAuthnRequest) verifyRedirectSignature(query map[string][]string) error {
+	// Repeated parameters would make the signed octets ambiguous.
+	for name, values := range query {
+		if len(values) > 1 {
+			return errors.Errorf("%s: repeated %q parameter", StatusRequestDenied, name)
+		}
+	}
+
+	request, ok := query["SAMLRequest"]
+	if !ok {
+		return errors.Errorf("%s: missing SAMLRequest", StatusRequestDenied)
+	}
+	rawSigAlg, ok := query["SigAlg"]
+	if !ok {
+		return errors.Errorf("%s: missing SigAlg", StatusRequestDenied)
+	}
+
+	signed := "SAMLRequest=" + request[0]
+	if relayState, ok := query["RelayState"]; ok {
+		signed += "&RelayState=" + relayState[0]
+	}
+	signed += "&SigAlg=" + rawSigAlg[0]
+
+	sigAlg, err := url.QueryUnescape(rawSigAlg[0])
+	if err != nil {
+		return errors.Wrapf(err, "%s: malformed SigAlg", StatusRequestDenied)
+	}
+	rawSignature, err := url.QueryUnescape(query["Signature"][0])
+	if err != nil {
+		return errors.Wrapf(err, "%s: malformed Signature", StatusRequestDenied)
+	}
+	signature, err := base64.StdEncoding.DecodeString(rawSignature)
+	if err != nil {
+		return errors.Wrapf(err, "%s: malformed Signature", StatusRequestDenied)
+	}
+
+	cert, err := req.spSigningCertificate()
+	if err != nil {
+		return err
+	}
+
+	err = xmlsec.VerifySignatureValue(sigAlg, cert.PublicKey, []byte(signed), signature)
+	if err != nil {
+		if DebugSignatures {
+			Logf("Signed octets of request failing verification, SigAlg %s: %s", sigAlg, signed)
+		}
+		logSignatureCertificate("request failing verification", cert)
+		return errors.Wrapf(err, "%s: invalid request signature", StatusRequestDenied)
+	}
+	return nil
+}
+
+// verifyEnvelopedSignature checks the Signature element of a request sent
+// through the HTTP-POST binding.
+func (req *IdpAuthnRequest) verifyEnvelopedSignature() error {
+	err := validateSignedNode(req.Request.Signature, req.Request.ID)
+	if err != nil {
+		return errors.Wrapf(err, "%s: invalid request signature", StatusRequestDenied)
+	}
+
+	cert, err := req.spSigningCertificate()
+	if err != nil {
+		return err
+	}
+	certFile, err := writeFile(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+	if err != nil {
+		return err
+	}
+
+	err = xmlsec.VerifyWithContext(req.context(), req.RequestBuffer, certFile, &xmlsec.ValidationOptions{
+		EnableIDAttrHack: true,
+	})
+	if err != nil && IsSecurityException(err, &req.IDP.SecurityOpts) {
+		logSignatureTrace("request failing verification", req.RequestBuffer)
+		logSignatureCertificate("request failing verification", cert)
+		return errors.Wrapf(err, "%s: invalid request signature", StatusRequestDenied)
+	}
+	return nil
+}
+
+// rawQueryValues splits a raw query string into its parameters, keeping their
+// values URL-encoded as they were sent, unlike url.ParseQuery. Names are
+// decoded, so that "SAML%52equest" is a repeated SAMLRequest rather than
+// another parameter. Names that cannot be decoded are kept as they are.
+func rawQueryValues(rawQuery string) map[string][]string {
+	query := map[string][]string{}
+	for _, param := range strings.Split(rawQuery, "&") {
+		if param == "" {
+			continue
+		}
+		name, value := param, ""
+		if i := strings.Index(param, "="); i >= 0 {
+			name, value = param[:i], param[i+1:]
+		}
+		if decoded, err := url.QueryUnescape(name); err == nil {
+			name = decoded
+		}
+		query[name] = append(query[name], value)
+	}
+	return query
+}
+
+// rawQueryValue returns the first value of the named parameter of a query
+// split by rawQueryValues, decoded, or "" when it is missing.
+func rawQueryValue(query map[string][]string, name string) (string, error) {
+	values := query[name]
+	if len(values) == 0 {
+		return "", nil
+	}
+	value, err := url.QueryUnescape(values[0])
+	if err != nil {
+		return "", errors.Wrapf(err, "malformed %s", name)
+	}
+	return value, nil
+}
+
+// spMetadata returns the metadata of the SP that sent the request.
+func (req *IdpAuthnRequest) spMetadata() (*Metadata, error) {
+	if req.ServiceProviderMetadata != nil {
+		return req.ServiceProviderMetadata, nil
+	}
+	return req.IDP.getSPMetadata(req.context())
+}
+
+// context returns the context of the HTTP request, which carries the
+// SSOTimeout deadline in ServeSSO.
+func (req *IdpAuthnRequest) context() context.Context {
+	if req.HTTPRequest != nil {
+		return req.HTTPRequest.Context()
+	}
+	return context.Background()
+}
+
+// ErrNoSigningKey is returned when a request is signed, or must be, but the
+// SP's metadata has no certificate to verify its signature with.
+var ErrNoSigningKey = errors.New(StatusRequestDenied + ": SP metadata has no signing certificate")
+
+// spSigningCertificate returns the certificate the SP signs requests with,
+// from a KeyDescriptor for signing or for no particular use.
+func (req *IdpAuthnRequest) spSigningCertificate() (*x509.Certificate, error) {
+	meta, err := req.spMetadata()
+	if err != nil {
+		return nil, err
+	}
+	if meta.SPSSODescriptor == nil {
+		return nil, errors.New("Missing SPSSODescriptor data")
+	}
+
+	for _, keyDescriptor := range meta.SPSSODescriptor.KeyDescriptor {
+		if keyDescriptor.Use != "signing" && keyDescriptor.Use != "" {
+			continue
+		}
+		if keyDescriptor.KeyInfo.Certificate == "" {
+			continue
+		}
+		der, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(keyDescriptor.KeyInfo.Certificate), ""))
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to decode SP signing certificate")
+		}
+		if err := req.IDP.checkSPCertificate(meta.EntityID, der); err != nil {
+			return nil, err
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to parse SP signing certificate")
+		}
+		return cert, nil
 	}
-
-	return metadata, nil
+	return nil, errors.Wrapf(ErrNoSigningKey, "SP %q", meta.EntityID)
 }
 
-// MakeAssertion produces a SAML assertion for the given request and assigns it
-// to req.Assertion.
-func (req *IdpAuthnRequest) MakeAssertion(session *Session) error {
-	cert, err := req.IDP.Cert()
-	if err != nil {
-		return err
+// inResponseTo returns the ID of the request being answered, which is empty
+// for unsolicited (IdP initiated) responses and for requests whose signature
+// failed to verify. The Response and its SubjectConfirmationData must both
+// use it, as SPs reject responses where only one of them is set.
+func (req *IdpAuthnRequest) inResponseTo() string {
+	if req.signatureInvalid {
+		return ""
 	}
+	return req.Request.ID
+}
 
-	signatureTemplate := xmlsec.DefaultSignature(pem.EncodeToMemory(cert))
-	attributes := []Attribute{}
-	if session.UserName != "" {
-		attributes = append(attributes, Attribute{
-			FriendlyName: "uid",
-			Name:         "urn:oid:0.9.2342.19200300.100.1.1",
-			NameFormat:   "urn:oasis:names:tc:SAML:2.0:attrname-format:uri",
-			Values: []AttributeValue{AttributeValue{
-				Type:  "xs:string",
-				Value: session.UserName,
-			}},
-		})
+// persistentID returns the user's persistent NameID for the SP, only looking
+// up existing ones when the request's NameIDPolicy does not allow creating
+// them. Requests without a NameIDPolicy allow it.
+func (req *IdpAuthnRequest) persistentID(userID string, spEntityID string) (string, error) {
+	store := req.IDP.PersistentIDStore
+	if req.Request.NameIDPolicy.allowsCreate() {
+		value, err := store.PersistentID(userID, spEntityID)
+		if err != nil {
+			return "", errors.Wrap(err, "failed to get persistent NameID")
+		}
+		return value, nil
 	}
 
-	if session.UserEmail != "" {
-		attributes = append(attributes, Attribute{
-			FriendlyName: "eduPersonPrincipalName",
-			Name:         "urn:oid:1.3.6.1.4.1.5923.1.1.1.6",
-			NameFormat:   "urn:oasis:names:tc:SAML:2.0:attrname-format:uri",
-			Values: []AttributeValue{AttributeValue{
-				Type:  "xs:string",
-				Value: session.UserEmail,
-			}},
-		})
+	lookup, ok := store.(PersistentIDLookup)
+	if !ok {
+		return "", ErrNoPersistentID
 	}
-	if session.UserSurname != "" {
-		attributes = append(attributes, Attribute{
-			FriendlyName: "sn",
-			Name:         "urn:oid:2.5.4.4",
-			NameFormat:   "urn:oasis:names:tc:SAML:2.0:attrname-format:uri",
-			Values: []AttributeValue{AttributeValue{
-				Type:  "xs:string",
-				Value: session.UserSurname,
-			}},
-		})
+	value, err := lookup.LookupPersistentID(userID, spEntityID)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to look up persistent NameID")
 	}
-	if session.UserGivenName != "" {
-		attributes = append(attributes, Attribute{
-			FriendlyName: "givenName",
-			Name:         "urn:oid:2.5.4.42",
-			NameFormat:   "urn:oasis:names:tc:SAML:2.0:attrname-format:uri",
-			Values: []AttributeValue{AttributeValue{
-				Type:  "xs:string",
-				Value: session.UserGivenName,
-			}},
-		})
+	if value == "" {
+		return "", ErrNoPersistentID
 	}
+	return value, nil
+}
 
-	if session.UserCommonName != "" {
-		attributes = append(attributes, Attribute{
-			FriendlyName: "cn",
-			Name:         "urn:oid:2.5.4.3",
-			NameFormat:   "urn:oasis:names:tc:SAML:2.0:attrname-format:uri",
-			Values: []AttributeValue{AttributeValue{
-				Type:  "xs:string",
-				Value: session.UserCommonName,
-			}},
-		})
+// spHasEncryptionKey reports whether the SP's metadata has a key usable for
+// encryption, that is a KeyDescriptor for encryption or for no particular use.
+func (req *IdpAuthnRequest) spHasEncryptionKey() bool {
+	meta, err := req.spMetadata()
+	if err != nil || meta.SPSSODescriptor == nil {
+		return false
 	}
-
-	if session.UserID != "" {
-		attributes = append(attributes, Attribute{
-			FriendlyName: "MASTUsername",
-			Name:         "userid",
-			Values: []AttributeValue{AttributeValue{
-				Type:  "xs:string",
-				Value: session.UserID,
-			}},
-		})
+	for _, keyDescriptor := range meta.SPSSODescriptor.KeyDescriptor {
+		if (keyDescriptor.Use == "encryption" || keyDescriptor.Use == "") && keyDescriptor.KeyInfo.Certificate != "" {
+			return true
+		}
 	}
+	return false
+}
 
-	if session.UserEmail != "" {
-		attributes = append(attributes, Attribute{
-			FriendlyName: "MASTEmail",
-			Name:         "email",
-			Values: []AttributeValue{AttributeValue{
-				Type:  "xs:string",
-				Value: session.UserEmail,
-			}},
-		})
+// makeNameID returns the NameID that identifies the session's user to the SP,
+// honoring the format requested by the SP's NameIDPolicy, or the formats of
+// its metadata when it requests none. See nameIDFormat.
+func (req *IdpAuthnRequest) makeNameID(session *Session, nameQualifier string, spEntityID string) (*NameID, error) {
+	nameID := &NameID{
+		Format:          NameIDFormatTransient,
+		NameQualifier:   nameQualifier,
+		SPNameQualifier: spEntityID,
+		Value:           session.NameID,
 	}
 
-	if session.UserFullname != "" {
-		attributes = append(attributes, Attribute{
-			FriendlyName: "MASTName",
-			Name:         "fullname",
-			Values: []AttributeValue{AttributeValue{
-				Type:  "xs:string",
-				Value: session.UserFullname,
-			}},
-		})
+	switch format := req.nameIDFormat(session); {
+	case format == NameIDFormatEmailAddress && sessionEmail(session) != "":
+		nameID.Format = NameIDFormatEmailAddress
+		nameID.Value = sessionEmail(session)
+	case format == NameIDFormatUnspecified:
+		nameID.Format = NameIDFormatUnspecified
+	case format == NameIDFormatPersistent && req.IDP.PersistentIDStore != nil:
+		userID := session.UserID
+		if userID == "" {
+			userID = session.NameID
+		}
+		value, err := req.persistentID(userID, spEntityID)
+		if err != nil {
+			return nil, err
+		}
+		nameID.Format = NameIDFormatPersistent
+		nameID.Value = value
 	}
 
-	if len(session.Groups) != 0 {
-		groupMemberAttributeValues := []AttributeValue{}
-		for _, group := range session.Groups {
-			groupMemberAttributeValues = append(groupMemberAttributeValues, AttributeValue{
-				Type:  "xs:string",
-				Value: group,
-			})
+	if nameID.Format == NameIDFormatTransient {
+		value, err := newTransientID(req.IDP.TransientNameIDLength)
+		if err != nil {
+			return nil, err
 		}
-		attributes = append(attributes, Attribute{
-			FriendlyName: "eduPersonAffiliation",
-			Name:         "urn:oid:1.3.6.1.4.1.5923.1.1.1.1",
-			NameFormat:   "urn:oasis:names:tc:SAML:2.0:attrname-format:uri",
-			Values:       groupMemberAttributeValues,
-		})
+		nameID.Value = value
 	}
 
-	idpMetadata, err := req.IDP.Metadata()
-	if err != nil {
-		return err
+	return nameID, nil
+}
+
+// nameIDFormat returns the NameID format requested by the SP's NameIDPolicy.
+// When the policy leaves it unspecified, it is the first of the formats listed
+// in the SP's metadata, in order of preference, that the IdP can make for the
+// session: transient, persistent with a PersistentIDStore, and emailAddress
+// when the session has an email address. The IdP's DefaultNameIDFormat is
+// used otherwise, or when the SP lists the unspecified format before any the
+// IdP can make.
+func (req *IdpAuthnRequest) nameIDFormat(session *Session) string {
+	switch requested := req.Request.NameIDPolicy.Format; requested {
+	case "", NameIDFormatUnspecified, NameIDFormatEncrypted:
+	default:
+		return requested
 	}
 
-	spNameQualifier := func() string {
-		if meta := req.ServiceProviderMetadata; meta != nil {
-			return meta.EntityID
+	meta, err := req.spMetadata()
+	if err != nil || meta.SPSSODescriptor == nil {
+		return req.IDP.defaultNameIDFormat()
+	}
+	for _, format := range meta.SPSSODescriptor.NameIDFormat {
+		switch strings.TrimSpace(format) {
+		case NameIDFormatTransient:
+			return NameIDFormatTransient
+		case NameIDFormatUnspecified:
+			return req.IDP.defaultNameIDFormat()
+		case NameIDFormatPersistent:
+			if req.IDP.PersistentIDStore != nil {
+				return NameIDFormatPersistent
+			}
+		case NameIDFormatEmailAddress:
+			if sessionEmail(session) != "" {
+				return NameIDFormatEmailAddress
+			}
 		}
-		return ""
 	}
+	return req.IDP.defaultNameIDFormat()
+}
 
-	req.Assertion = &Assertion{
-		ID:           NewID(),
-		IssueInstant: Now(),
-		Version:      "2.0",
-		Issuer: &Issuer{
-			Format: "XXX",
-			Value:  idpMetadata.EntityID,
-		},
-		Signature: &signatureTemplate,
-		Subject: &Subject{
-			NameID: &NameID{
-				Format:          "urn:oasis:names:tc:SAML:2.0:nameid-format:transient",
-				NameQualifier:   idpMetadata.EntityID,
-				SPNameQualifier: spNameQualifier(),
-				Value:           session.NameID,
-			},
-			SubjectConfirmation: &SubjectConfirmation{
-				Method: "urn:oasis:names:tc:SAML:2.0:cm:bearer",
-				SubjectConfirmationData: SubjectConfirmationData{
-					Address:      req.HTTPRequest.RemoteAddr,
-					InResponseTo: req.Request.ID,
-					NotOnOrAfter: Now().Add(IssueLifetime),
-					Recipient: func() string {
-						switch {
-						case req.ACSEndpoint != nil:
-							return req.ACSEndpoint.Location
-						case req.ServiceProviderMetadata != nil && req.ServiceProviderMetadata.SPSSODescriptor != nil:
-							for _, acs := range req.ServiceProviderMetadata.SPSSODescriptor.AssertionConsumerService {
-								if acs.Binding == "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST" {
-									return acs.Location
-								}
-							}
-						default:
-							return req.Request.AssertionConsumerServiceURL
-						}
-						return ""
-					}(),
-				},
-			},
-		},
-		Conditions: &Conditions{
-			NotBefore:    Now(),
-			NotOnOrAfter: Now().Add(IssueLifetime),
-			AudienceRestriction: func() *AudienceRestriction {
-				if req.ServiceProviderMetadata != nil {
-					return &AudienceRestriction{
-						Audience: &Audience{Value: req.ServiceProviderMetadata.EntityID},
-					}
-				}
-				return nil
-			}(),
-		},
-		AuthnStatement: &AuthnStatement{
-			AuthnInstant: session.CreateTime,
-			SessionIndex: session.Index,
-			SubjectLocality: SubjectLocality{
-				Address: req.HTTPRequest.RemoteAddr,
-			},
-			AuthnContext: AuthnContext{
-				AuthnContextClassRef: &AuthnContextClassRef{
-					Value: "urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport",
-				},
-			},
-		},
-		AttributeStatement: &AttributeStatement{
-			Attributes: attributes,
-		},
+// defaultNameIDFormat returns the DefaultNameIDFormat, or transient.
+func (idp *IdentityProvider) defaultNameIDFormat() string {
+	if idp.DefaultNameIDFormat == "" {
+		return NameIDFormatTransient
 	}
+	return idp.DefaultNameIDFormat
+}
 
-	return nil
+// setAttributeNameFormats gives the attributes without a NameFormat the
+// AttributeNameFormat of the SP's options, or the IdP's.
+func (req *IdpAuthnRequest) setAttributeNameFormats(attributes []Attribute) {
+	format := req.IDP.AttributeNameFormat
+	if meta := req.ServiceProviderMetadata; meta != nil {
+		if spFormat := req.IDP.spOptions(meta.EntityID).AttributeNameFormat; spFormat != "" {
+			format = spFormat
+		}
+	}
+	if format == "" {
+		format = AttributeNameFormatURI
+	}
+	for i := range attributes {
+		if attributes[i].NameFormat == "" {
+			attributes[i].NameFormat = format
+		}
+	}
 }
 
-// MarshalAssertion produces a valid and signed XML assertion.
-func (req *IdpAuthnRequest) MarshalAssertion() error {
-	buf, err := xml.Marshal(req.Assertion)
-	if err != nil {
-		return err
+// setAttributeValueTypes sets the configured xsi:type on every value of the
+// given attributes.
+func (idp *IdentityProvider) setAttributeValueTypes(attributes []Attribute) {
+	for i := range attributes {
+		valueType := idp.AttributeValueType
+		if t, ok := idp.AttributeValueTypes[attributes[i].Name]; ok {
+			valueType = t
+		}
+		for j := range attributes[i].Values {
+			attributes[i].Values[j].Type = valueType
+		}
 	}
+}
 
-	keyFile, err := req.IDP.PrivkeyFile()
-	if err != nil {
-		return err
+// recipient returns the location of the SP's assertion consumer service for
+// the given binding.
+func (req *IdpAuthnRequest) recipient(binding string) string {
+	switch {
+	case req.ACSEndpoint != nil:
+		return req.ACSEndpoint.Location
+	case req.ServiceProviderMetadata != nil && req.ServiceProviderMetadata.SPSSODescriptor != nil:
+		if acs := req.SelectACSEndpoint(binding); acs != nil {
+			return acs.Location
+		}
+	default:
+		return req.Request.AssertionConsumerServiceURL
 	}
+	return ""
+}
 
-	buf, err = xmlsec.Sign(buf, keyFile, &xmlsec.ValidationOptions{
-		EnableIDAttrHack: true,
-	})
-	if err != nil {
-		if IsSecurityException(err, &req.IDP.SecurityOpts) {
-			return err
+// SelectACSEndpoint returns ACSEndpoint when set, or the assertion consumer
+// service of the SP's metadata that responses with the given binding are sent
+// to: the one with isDefault="true", else the one with the lowest index, else
+// the first one declared. It returns nil when there is none, and can be used
+// to log the index of the selected endpoint.
+func (req *IdpAuthnRequest) SelectACSEndpoint(binding string) *IndexedEndpoint {
+	if req.ACSEndpoint != nil {
+		return req.ACSEndpoint
+	}
+	meta := req.ServiceProviderMetadata
+	if meta == nil || meta.SPSSODescriptor == nil {
+		return nil
+	}
+
+	var selected *IndexedEndpoint
+	for i := range meta.SPSSODescriptor.AssertionConsumerService {
+		acs := &meta.SPSSODescriptor.AssertionConsumerService[i]
+		if acs.Binding != binding {
+			continue
+		}
+		switch {
+		case selected == nil:
+			selected = acs
+		case acs.IsDefault != selected.IsDefault:
+			if acs.IsDefault {
+				selected = acs
+			}
+		case acs.Index < selected.Index:
+			selected = acs
 		}
 	}
+	if selected == nil {
+		return nil
+	}
+	endpoint := *selected
+	return &endpoint
+}
 
+// MarshalAssertion produces a valid and signed XML assertion.
+func (req *IdpAuthnRequest) MarshalAssertion() error {
 	req.IDP.SPMetadataURL = (func() string {
 		if req.Request.Issuer.Value != "" {
 			return req.Request.Issuer.Value
@@ -411,11 +1583,77 @@ func (req *IdpAuthnRequest) MarshalAssertion() error {
 		return ""
 	})()
 
-	spCertFile, err := req.IDP.GetSPCertFile()
+	req.plaintextAssertion = false
+	spCertFile, err := req.spCertFile()
+	if errors.Cause(err) == ErrNoEncryptionKey && req.allowUnencryptedAssertions() {
+		req.plaintextAssertion = true
+	} else if err != nil {
+		return err
+	}
+
+	if subject := req.Assertion.Subject; subject != nil && subject.EncryptedID != nil && subject.EncryptedID.NameID != nil {
+		nameID, err := xml.Marshal(subject.EncryptedID.NameID)
+		if err != nil {
+			return err
+		}
+		encrypted, err := encryptElement(req.context(), nameID, spCertFile, &req.IDP.SecurityOpts)
+		if err != nil {
+			return errors.Wrap(err, "failed to encrypt NameID")
+		}
+		subject.EncryptedID.EncryptedData = encrypted
+		subject.EncryptedID.NameID = nil
+	}
+
+	buf, err := xml.Marshal(req.Assertion)
 	if err != nil {
 		return err
 	}
 
+	if req.Assertion.Signature != nil {
+		if buf, err = req.signaturePosition().place(buf); err != nil {
+			return err
+		}
+
+		buf, err = req.IDP.sign(req.context(), buf)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The signed octets are encrypted, or sent in the clear, as they are and
+	// never serialized again, so what the SP gets is what was signed.
+	if req.plaintextAssertion {
+		req.AssertionBuffer = signedElement(buf)
+		return nil
+	}
+	req.AssertionBuffer, err = encryptElement(req.context(), signedElement(buf), spCertFile, &req.IDP.SecurityOpts)
+	return err
+}
+
+// allowUnencryptedAssertions reports whether the options of the SP, looked up
+// by the entity ID of its metadata, let it get assertions in the clear.
+func (req *IdpAuthnRequest) allowUnencryptedAssertions() bool {
+	meta, err := req.spMetadata()
+	return err == nil && req.IDP.spOptions(meta.EntityID).AllowUnencryptedAssertions
+}
+
+// signedElement returns the element of a document returned by sign, without
+// the XML declaration xmlsec1 adds and the whitespace around it. Neither is
+// covered by the signature, and a declaration has no place in the content of
+// an EncryptedData of type Element.
+func signedElement(buf []byte) []byte {
+	buf = bytes.TrimSpace(buf)
+	if bytes.HasPrefix(buf, []byte("<?xml")) {
+		if end := bytes.Index(buf, []byte("?>")); end >= 0 {
+			buf = bytes.TrimSpace(buf[end+len("?>"):])
+		}
+	}
+	return buf
+}
+
+// encryptElement encrypts an XML element for the SP, returning the resulting
+// EncryptedData element.
+func encryptElement(ctx context.Context, buf []byte, spCertFile string, opts *SecurityOpts) ([]byte, error) {
 	// EncryptedDataTemplate
 	tpl := xmlsec.NewEncryptedDataTemplate(
 		"http://www.w3.org/2001/04/xmlenc#aes128-cbc",
@@ -423,19 +1661,21 @@ func (req *IdpAuthnRequest) MarshalAssertion() error {
 	)
 
 	// TODO: pick an encryption algorithm from the actual metadata.
-	buf, err = xmlsec.Encrypt(tpl, buf, spCertFile, "aes-128-cbc")
+	buf, err := xmlsec.EncryptWithContext(ctx, tpl, buf, spCertFile, "aes-128-cbc")
 	if err != nil {
-		if IsSecurityException(err, &req.IDP.SecurityOpts) {
-			return err
+		if IsSecurityException(err, opts) {
+			return nil, err
 		}
 	}
 
-	req.AssertionBuffer = bytes.TrimSpace(bytes.TrimPrefix(buf, []byte(`<?xml version="1.0"?>`)))
-
-	return nil
+	return bytes.TrimSpace(bytes.TrimPrefix(buf, []byte(`<?xml version="1.0"?>`))), nil
 }
 
-// MakeResponse computes the Response field of the IdpAuthnRequest
+// MakeResponse computes the Response field of the IdpAuthnRequest, and the
+// bytes returned by ResponseBytes. Which element is signed depends on the
+// SP's SignaturePosition: for SignatureInResponse the Response is signed, by
+// signResponse, and the assertion it wraps is not. Otherwise the assertion is
+// signed, by MarshalAssertion, and the Response is not.
 func (req *IdpAuthnRequest) MakeResponse() error {
 	if req.AssertionBuffer == nil {
 		if err := req.MarshalAssertion(); err != nil {
@@ -444,30 +1684,130 @@ func (req *IdpAuthnRequest) MakeResponse() error {
 	}
 
 	req.Response = &Response{
-		Destination:  req.Assertion.Subject.SubjectConfirmation.SubjectConfirmationData.Recipient,
-		ID:           NewID(),
-		InResponseTo: req.Request.ID,
+		Destination:  req.destination(),
+		ID:           req.newID(),
+		InResponseTo: req.inResponseTo(),
 		IssueInstant: Now(),
 		Version:      "2.0",
 		Issuer: &Issuer{
 			Format: "urn:oasis:names:tc:SAML:2.0:nameid-format:entity",
-			Value:  req.IDP.MetadataURL,
+			Value:  req.issuer(),
 		},
 		Status: &Status{
 			StatusCode: StatusCode{
 				Value: StatusSuccess,
 			},
 		},
-		EncryptedAssertion: &EncryptedAssertion{
+	}
+	if req.plaintextAssertion {
+		req.Response.AssertionXML = req.AssertionBuffer
+	} else {
+		req.Response.EncryptedAssertion = &EncryptedAssertion{
 			EncryptedData: req.AssertionBuffer,
-		},
+		}
 	}
 	if req.Response.Destination == "" {
 		return errors.New(`Missing "Destination"`)
 	}
+	if err := req.addAudienceExtension(); err != nil {
+		return err
+	}
+	if req.signaturePosition() == SignatureInResponse {
+		return req.signResponse()
+	}
+	return req.bufferResponse()
+}
+
+// bufferResponse sets responseBuffer from Response.
+func (req *IdpAuthnRequest) bufferResponse() error {
+	buf, err := req.marshalResponse()
+	if err != nil {
+		return errors.Wrap(err, "failed to format response")
+	}
+	req.responseBuffer = buf
 	return nil
 }
 
+// ResponseBytes returns the Response as sent to the SP, set by MakeResponse
+// and MakeErrorResponse, or nil before either runs. It can be handed to other
+// consumers than the browser, such as a token service implementing the SAML
+// bearer grant of RFC 7522. Changes made to Response afterwards are not
+// reflected. The bytes are shared with the request and must not be modified.
+func (req *IdpAuthnRequest) ResponseBytes() []byte {
+	return req.responseBuffer
+}
+
+// addAudienceExtension repeats the assertion's Audience in the Extensions of
+// the Response for SPs whose options ask for it. The SP is known from
+// ServiceProviderMetadata or, failing that, the Issuer of the request, so no
+// metadata is fetched for the SPs that do not.
+func (req *IdpAuthnRequest) addAudienceExtension() error {
+	entityID := req.Request.Issuer.Value
+	if req.ServiceProviderMetadata != nil {
+		entityID = req.ServiceProviderMetadata.EntityID
+	}
+	if entityID == "" {
+		return nil
+	}
+	options := req.IDP.spOptions(entityID)
+	if !options.AudienceInResponseExtensions {
+		return nil
+	}
+	audience := entityID
+	if options.AudienceOverride != "" {
+		audience = options.AudienceOverride
+	}
+	var buf bytes.Buffer
+	buf.WriteString(`<saml:Audience xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion">`)
+	xml.EscapeText(&buf, []byte(audience))
+	buf.WriteString(`</saml:Audience>`)
+	return req.Response.AddExtensions(buf.Bytes())
+}
+
+// MakeErrorResponse creates a Response without an assertion that tells the SP
+// why the request failed. The top-level code is one of StatusRequester,
+// StatusResponder or StatusVersionMismatch; subCode, such as
+// StatusRequestDenied, and message may be empty.
+func (req *IdpAuthnRequest) MakeErrorResponse(code string, subCode string, message string) error {
+	status := &Status{
+		StatusCode: StatusCode{
+			Value: code,
+		},
+		StatusMessage: message,
+	}
+	if subCode != "" {
+		status.StatusCode.StatusCode = &StatusCode{Value: subCode}
+	}
+
+	req.Response = &Response{
+		Destination:  req.destination(),
+		ID:           req.newID(),
+		InResponseTo: req.inResponseTo(),
+		IssueInstant: Now(),
+		Version:      "2.0",
+		Issuer: &Issuer{
+			Format: "urn:oasis:names:tc:SAML:2.0:nameid-format:entity",
+			Value:  req.issuer(),
+		},
+		Status: status,
+	}
+	if req.Response.Destination == "" {
+		return errors.New(`Missing "Destination"`)
+	}
+	return req.bufferResponse()
+}
+
+// spCertFile returns a physical path where the certificate of the SP that
+// sent the request can be accessed, taken from ServiceProviderMetadata when
+// set so that no metadata is fetched.
+func (req *IdpAuthnRequest) spCertFile() (string, error) {
+	meta, err := req.spMetadata()
+	if err != nil {
+		return "", err
+	}
+	return req.IDP.writeSPCertFile(meta)
+}
+
 // GetSPCertFile returns a physical path where the SP's certificate can be
 // accessed.
 func (idp *IdentityProvider) GetSPCertFile() (string, error) {
@@ -475,7 +1815,16 @@ func (idp *IdentityProvider) GetSPCertFile() (string, error) {
 	if err != nil {
 		return "", err
 	}
+	return idp.writeSPCertFile(meta)
+}
+
+// ErrNoEncryptionKey is returned when assertions are to be encrypted for an SP
+// whose metadata has no certificate. See SPOptions.AllowUnencryptedAssertions.
+var ErrNoEncryptionKey = errors.New("SP metadata has no encryption certificate")
 
+// writeSPCertFile writes the encryption certificate of the SP of the given
+// metadata to a file and returns its path.
+func (idp *IdentityProvider) writeSPCertFile(meta *Metadata) (string, error) {
 	if meta.SPSSODescriptor == nil {
 		return "", errors.New("Missing SPSSODescriptor data")
 	}
@@ -498,11 +1847,15 @@ func (idp *IdentityProvider) GetSPCertFile() (string, error) {
 	}
 
 	if cert == "" {
-		return "", errors.New("Missing certificate data.")
+		return "", errors.Wrapf(ErrNoEncryptionKey, "SP %q", meta.EntityID)
 	}
 
 	certBytes, _ := base64.StdEncoding.DecodeString(cert)
 
+	if err := idp.checkSPCertificate(meta.EntityID, certBytes); err != nil {
+		return "", err
+	}
+
 	certBytes = pem.EncodeToMemory(&pem.Block{
 		Type:  "CERTIFICATE",
 		Bytes: certBytes,
@@ -511,8 +1864,37 @@ func (idp *IdentityProvider) GetSPCertFile() (string, error) {
 	return writeFile(certBytes)
 }
 
-// GetSPMetadata returns a the SP's metadata value
+// checkSPCertificate applies SPCertExpiryPolicy to the SP's certificate.
+func (idp *IdentityProvider) checkSPCertificate(entityID string, certDER []byte) error {
+	if idp.SPCertExpiryPolicy == CertExpiryIgnore {
+		return nil
+	}
+
+	cert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		return errors.Wrapf(err, "failed to parse certificate of SP %q", entityID)
+	}
+
+	err = checkCertificateValidity(cert, Now())
+	if err == nil {
+		return nil
+	}
+	err = errors.Wrapf(err, "certificate of SP %q", entityID)
+	if idp.SPCertExpiryPolicy == CertExpiryWarn {
+		Logf("Warning: %v", err)
+		return nil
+	}
+	return err
+}
+
+// GetSPMetadata returns a the SP's metadata value, which is SPMetadata or the
+// metadata at SPMetadataURL, fetched on first use.
 func (idp *IdentityProvider) GetSPMetadata() (*Metadata, error) {
+	return idp.getSPMetadata(context.Background())
+}
+
+// getSPMetadata is GetSPMetadata, fetching the metadata within ctx.
+func (idp *IdentityProvider) getSPMetadata(ctx context.Context) (*Metadata, error) {
 	if idp.SPMetadata != nil {
 		m := *(idp.SPMetadata)
 		return &m, nil
@@ -522,23 +1904,24 @@ func (idp *IdentityProvider) GetSPMetadata() (*Metadata, error) {
 		return nil, errors.New("Missing metadata URL.")
 	}
 
-	res, err := http.Get(idp.SPMetadataURL)
-	if err != nil {
-		return nil, err
+	if cached, ok := idp.spMetadata.Load().(*fetchedMetadata); ok {
+		m := *cached.metadata
+		return &m, nil
 	}
-	defer res.Body.Close()
 
-	buf, err := ioutil.ReadAll(res.Body)
+	metadata, err := GetMetadataWithContext(ctx, idp.MetadataHTTPClient, idp.SPMetadataURL)
 	if err != nil {
 		return nil, err
 	}
 
-	var metadata Metadata
-	err = xml.Unmarshal(buf, &metadata)
-	if err != nil {
-		return nil, err
-	}
+	m := *metadata
+	idp.spMetadata.Store(&fetchedMetadata{metadata: &m, fetched: Now()})
+	return metadata, nil
+}
 
-	idp.SPMetadata = &metadata
-	return &metadata, nil
+// fetchedMetadata is metadata fetched from a URL, with the time it was
+// fetched.
+type fetchedMetadata struct {
+	metadata *Metadata
+	fetched  time.Time
 }
@@ -3,143 +3,498 @@ package saml
 import (
 	"bytes"
 	"compress/flate"
+	"context"
 	"encoding/base64"
 	"encoding/xml"
 	"io/ioutil"
 	"net/http"
-	"text/template"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Paths served by the handler returned by IdentityProvider.Handler, relative
+// to its prefix.
+const (
+	MetadataPath = "/metadata"
+	SSOPath      = "/sso"
+	HealthzPath  = "/healthz"
 )
 
+// Handler returns an http.Handler that serves the IdP's metadata, SSO and
+// health check endpoints under the given path prefix (e.g. "/saml"). Make sure
+// MetadataURL and SSOURL point to the resulting locations.
+func (idp *IdentityProvider) Handler(prefix string, authFn Authenticator) http.Handler {
+	prefix = strings.TrimSuffix(prefix, "/")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(prefix+MetadataPath, idp.MetadataHandler)
+	mux.HandleFunc(prefix+SSOPath, idp.ServeSSO(authFn))
+	mux.HandleFunc(prefix+HealthzPath, idp.HealthzHandler)
+	return mux
+}
+
 // MetadataHandler generates and serves the IdP's metadata.xml file.
 func (idp *IdentityProvider) MetadataHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodHead) {
+		return
+	}
 	metadata, err := idp.Metadata()
 	if err != nil {
 		Logf("Failed to generate metadata: %v", err)
-		writeErr(w, err)
+		writeErr(w, r, err)
 		return
 	}
-	out, err := xml.MarshalIndent(metadata, "", "\t")
+	roundValidUntil(metadata)
+	out, err := idp.marshalMetadata(metadata)
 	if err != nil {
 		Logf("Failed to build metadata: %v", err)
-		writeErr(w, err)
+		writeErr(w, r, err)
 		return
 	}
-	w.Header().Set("Content-Type", "application/xml; charset=utf8")
-	w.Write([]byte("<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n"))
-	w.Write(out)
+	serveMetadata(w, r, &idp.metadataVersion, out, metadataContentType(idp.MetadataContentType))
+}
+
+// MarshalMetadata returns the IdP's metadata document, rendered through
+// MetadataTemplate when it is set.
+func (idp *IdentityProvider) MarshalMetadata() ([]byte, error) {
+	metadata, err := idp.Metadata()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to generate metadata")
+	}
+	return idp.marshalMetadata(metadata)
+}
+
+func (idp *IdentityProvider) marshalMetadata(metadata *Metadata) ([]byte, error) {
+	if idp.MetadataTemplate != nil {
+		buf := bytes.NewBuffer(nil)
+		if err := idp.MetadataTemplate.Execute(buf, metadata); err != nil {
+			return nil, errors.Wrap(err, "failed to render metadata template")
+		}
+		return buf.Bytes(), nil
+	}
+
+	out, err := xml.MarshalIndent(metadata, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte("<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n"), out...), nil
+}
+
+// HealthzHandler reports whether the IdP's crypto configuration is usable,
+// responding 200 when it is and 500 otherwise. See Validate.
+func (idp *IdentityProvider) HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	if err := idp.Validate(); err != nil {
+		Logf("IdP health check failed: %v", err)
+		writeErr(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("OK"))
 }
 
 // NewLoginRequest creates a login request against an SP.
 func (idp *IdentityProvider) NewLoginRequest(spMetadataURL string, authFn Authenticator) (*LoginRequest, error) {
-	metadata, err := GetMetadata(spMetadataURL)
+	metadata, err := GetMetadataWithClient(idp.MetadataHTTPClient, spMetadataURL)
 	if err != nil {
 		Logf("Failed to get metadata: %v", err)
 		return nil, err
 	}
+	lr, err := idp.NewLoginRequestFromMetadata(metadata, authFn)
+	if err != nil {
+		return nil, err
+	}
+	lr.spMetadataURL = spMetadataURL
+	return lr, nil
+}
+
+// NewLoginRequestFromMetadata creates a login request against the SP of the
+// given metadata, which is used as is: nothing is fetched, neither to build
+// the request nor to encrypt the assertion for the SP.
+func (idp *IdentityProvider) NewLoginRequestFromMetadata(metadata *Metadata, authFn Authenticator) (*LoginRequest, error) {
+	if metadata == nil || metadata.SPSSODescriptor == nil {
+		return nil, errors.New("SP metadata has no SPSSODescriptor")
+	}
 	lr := &LoginRequest{
-		spMetadataURL: spMetadataURL,
-		idp:           idp,
-		authFn:        authFn,
-		metadata:      metadata,
+		idp:      idp,
+		authFn:   authFn,
+		metadata: metadata,
 	}
 	return lr, nil
 }
 
-// ServeSSO creates and serves a SSO assertion based on a request.
+// ServeSSO creates and serves a SSO assertion based on a request sent through
+// either the HTTP-Redirect (GET) or the HTTP-POST binding. Users are
+// authenticated with the Authenticator stored in the request context by
+// WithAuthenticator, or authFn when there is none. The Authenticator can get
+// the SP's request with GetAuthnRequestFromCtx.
+//
+// Requests with a signature that does not verify, and unsigned ones when
+// WantAuthnRequestsSigned is set, are denied before the user is
+// authenticated, so no response is ever made for them. Unsigned requests are
+// otherwise answered like signed ones, InResponseTo included. Requests under
+// the holder-of-key profile are denied when the client presented no TLS
+// certificate, see ClientCertificateFunc. With a MetadataResolver, requests
+// from SPs it does not know are denied too. Requests taking longer than
+// SSOTimeout are aborted with a 504.
+//
+// Errors are sent as text, or as a JSON object with "error" and "code"
+// members, one of the ErrorCode constants, to clients that prefer
+// application/json over HTML.
 func (idp *IdentityProvider) ServeSSO(authFn Authenticator) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		sess, err := authFn(w, r)
-		if err != nil {
-			Logf("authFn: %v", err)
+		start := time.Now()
+		outcome := SSOOutcomeError
+		defer func() {
+			idp.observer().ObserveSSO(outcome, time.Since(start))
+		}()
+
+		if !allowMethods(w, r, http.MethodGet, http.MethodPost) {
+			outcome = SSOOutcomeInvalidRequest
 			return
 		}
 
-		values := r.URL.Query()
-
-		relayState := values.Get("RelayState")
-		samlRequest := values.Get("SAMLRequest")
+		if idp.SSOTimeout > 0 {
+			ctx, cancel := context.WithTimeout(r.Context(), idp.SSOTimeout)
+			defer cancel()
+			r = r.WithContext(ctx)
+		}
+		// timedOut answers with a 504 once the request's deadline is
+		// exceeded, whatever the step that was slow.
+		timedOut := func() bool {
+			if r.Context().Err() != context.DeadlineExceeded {
+				return false
+			}
+			Logf("SSO request timed out after %v", time.Since(start))
+			outcome = SSOOutcomeTimeout
+			timeoutErr(w, r)
+			return true
+		}
 
-		data, err := base64.StdEncoding.DecodeString(samlRequest)
-		if err != nil {
-			Logf("Failed to decode SAMLRequest: %v", err)
-			writeErr(w, err)
+		if !idp.allowRequest("ip:" + clientIP(r)) {
+			Logf("Rate limited SSO request from %v", clientIP(r))
+			outcome = SSOOutcomeRateLimited
+			rateLimitedErr(w, r)
 			return
 		}
-		buf, err := ioutil.ReadAll(flate.NewReader(bytes.NewBuffer(data)))
+
+		buf, relayState, err := readSSORequest(r)
 		if err != nil {
 			Logf("Failed to read SAMLRequest: %v", err)
-			writeErr(w, err)
+			outcome = SSOOutcomeInvalidRequest
+			writeErr(w, r, err)
 			return
 		}
+		if len(relayState) > MaxRelayStateLength {
+			Logf("Warning: RelayState is longer than %d bytes, some SPs may reject it", MaxRelayStateLength)
+		}
 
 		var authnRequest AuthnRequest
-		err = xml.Unmarshal(buf, &authnRequest)
+		err = unmarshalMessage(buf, &authnRequest)
 		if err != nil {
 			Logf("Failed to unmarshal SAMLRequest: %v", err)
-			writeErr(w, err)
+			outcome = SSOOutcomeInvalidRequest
+			writeErr(w, r, err)
+			return
+		}
+
+		err = checkVersion("AuthnRequest", authnRequest.Version)
+		if err != nil {
+			Logf("Denied SAMLRequest: %v", err)
+			outcome = SSOOutcomeInvalidRequest
+			deniedErr(w, r, err)
+			return
+		}
+
+		if !idp.allowRequest("sp:" + authnRequest.Issuer.Value) {
+			Logf("Rate limited SSO request from SP %q", authnRequest.Issuer.Value)
+			outcome = SSOOutcomeRateLimited
+			rateLimitedErr(w, r)
 			return
 		}
 
 		idpAuthnRequest := &IdpAuthnRequest{
-			IDP:         idp,
-			HTTPRequest: r,
-			Request:     authnRequest,
+			IDP:           idp,
+			HTTPRequest:   r,
+			RequestBuffer: buf,
+			Request:       authnRequest,
 		}
 
-		err = idpAuthnRequest.MakeAssertion(sess)
+		err = idpAuthnRequest.resolveSPMetadata()
+		if err != nil && timedOut() {
+			return
+		}
+		if errors.Cause(err) == ErrUnknownIssuer {
+			Logf("Denied SAMLRequest: %v", err)
+			outcome = SSOOutcomeDenied
+			deniedErr(w, r, err)
+			return
+		}
 		if err != nil {
-			Logf("Failed to make assertion: %v", err)
-			writeErr(w, err)
+			Logf("Failed to resolve SP metadata: %v", err)
+			writeErr(w, r, err)
 			return
 		}
 
-		err = idpAuthnRequest.MarshalAssertion()
+		err = idpAuthnRequest.ValidateIssueInstant()
 		if err != nil {
-			Logf("Failed to marshal assertion: %v", err)
-			writeErr(w, err)
+			Logf("Denied SAMLRequest: %v", err)
+			outcome = SSOOutcomeStaleRequest
+			deniedErr(w, r, err)
 			return
 		}
 
-		err = idpAuthnRequest.MakeResponse()
+		err = idpAuthnRequest.ValidateIssuerFormat()
 		if err != nil {
-			Logf("Failed to build response: %v", err)
-			writeErr(w, err)
+			Logf("Denied SAMLRequest: %v", err)
+			outcome = SSOOutcomeDenied
+			deniedErr(w, r, err)
 			return
 		}
 
-		buf, err = xml.MarshalIndent(idpAuthnRequest.Response, "", "\t")
+		// No response is minted for a request whose signature is required
+		// or present but does not verify. See VerifySignature.
+		err = idpAuthnRequest.VerifySignature()
+		if err != nil && timedOut() {
+			return
+		}
+		if err == ErrAuthnRequestNotSigned {
+			Logf("Denied unsigned SAMLRequest from SP %q", idpAuthnRequest.Request.Issuer.Value)
+			outcome = SSOOutcomeDenied
+			deniedErr(w, r, err)
+			return
+		}
 		if err != nil {
-			Logf("Failed to format response: %v", err)
-			writeErr(w, err)
+			Logf("Denied SAMLRequest with an invalid signature: %v", err)
+			outcome = SSOOutcomeDenied
+			deniedErr(w, r, err)
 			return
 		}
 
-		form := redirectForm{
-			FormAction:   idpAuthnRequest.Assertion.Subject.SubjectConfirmation.SubjectConfirmationData.Recipient,
-			RelayState:   relayState, // RelayState is passed as is.
-			SAMLResponse: base64.StdEncoding.EncodeToString(buf),
+		// Holder-of-key requests without a client certificate are denied
+		// before the user logs in for nothing.
+		if _, err := idpAuthnRequest.holderOfKeyCertificate(idpAuthnRequest.Request.Issuer.Value); err != nil {
+			if timedOut() {
+				return
+			}
+			Logf("Denied SAMLRequest: %v", err)
+			outcome = SSOOutcomeDenied
+			deniedErr(w, r, err)
+			return
+		}
+
+		// The request is parsed before authenticating the user, so the
+		// Authenticator can use it, e.g. to display the ProviderName.
+		r = r.WithContext(context.WithValue(r.Context(), "saml.AuthnRequest", &idpAuthnRequest.Request))
+		idpAuthnRequest.HTTPRequest = r
+
+		sess, err := requestAuthenticator(r, authFn)(w, r)
+		if err != nil {
+			Logf("authFn: %v", err)
+			outcome = SSOOutcomeUnauthenticated
+			return
+		}
+		if timedOut() {
+			return
 		}
 
-		formTpl, err := template.New("").Parse(redirectFormTemplate)
+		assertionStart := time.Now()
+		err = idpAuthnRequest.MakeAssertion(sess)
+		if err != nil && timedOut() {
+			return
+		}
+		if err == ErrNoPersistentID || err == ErrNoNameIDEncryptionKey {
+			// The SP is told with a status response at its ACS, as the
+			// SAML profile asks, rather than the user with an error page.
+			Logf("Denied SAMLRequest: %v", err)
+			outcome = SSOOutcomeDenied
+			if err := writeStatusResponse(w, idpAuthnRequest, relayState, StatusInvalidNameIDPolicy, err); err != nil {
+				Logf("Failed to write response: %v", err)
+				writeErr(w, r, err)
+			}
+			return
+		}
+		if err == ErrNoClientCertificate {
+			Logf("Denied SAMLRequest: %v", err)
+			outcome = SSOOutcomeDenied
+			deniedErr(w, r, err)
+			return
+		}
 		if err != nil {
-			Logf("Failed to create form: %v", err)
-			writeErr(w, err)
+			Logf("Failed to make assertion: %v", err)
+			writeErr(w, r, err)
 			return
 		}
 
-		formBuf := bytes.NewBuffer(nil)
-		if err := formTpl.Execute(formBuf, form); err != nil {
-			Logf("Failed to build form: %v", err)
-			writeErr(w, err)
+		if timedOut() {
+			return
+		}
+		err = WriteResponse(w, idpAuthnRequest, relayState)
+		if err != nil && timedOut() {
 			return
 		}
+		if err != nil {
+			Logf("Failed to write response: %v", err)
+			writeErr(w, r, err)
+			return
+		}
+		idp.observer().ObserveAssertion(time.Since(assertionStart))
+		outcome = SSOOutcomeSuccess
+	}
+}
 
-		w.Header().Set("Content-Type", "text/html")
-		w.Write(formBuf.Bytes())
+// BuildAssertion creates the unsigned assertion answering authnRequest for the
+// given session, which is what ServeSSO does once the user is authenticated.
+// The HTTP request r is the one that carried authnRequest. The assertion can
+// be inspected or changed before WriteResponse signs it and sends it to the
+// SP.
+func (idp *IdentityProvider) BuildAssertion(r *http.Request, sess *Session, authnRequest *AuthnRequest) (*IdpAuthnRequest, error) {
+	idpAuthnRequest := &IdpAuthnRequest{
+		IDP:         idp,
+		HTTPRequest: r,
+		Request:     *authnRequest,
+	}
+	if err := idpAuthnRequest.resolveSPMetadata(); err != nil {
+		return nil, err
 	}
+
+	err := idpAuthnRequest.MakeAssertion(sess)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to make assertion")
+	}
+	return idpAuthnRequest, nil
+}
+
+// WriteResponse signs and encrypts the assertion of req, as made by
+// BuildAssertion, wraps it in a Response and writes the HTML form that POSTs
+// it to the SP. The relayState is passed as is. With
+// ValidateAssertionsAgainstSP, the assertion is first checked with
+// ValidateAgainstSP. A Response req already has, such as one made by
+// MakeErrorResponse, is sent as is.
+func WriteResponse(w http.ResponseWriter, req *IdpAuthnRequest, relayState string) error {
+	if req.Response == nil {
+		if req.IDP.ValidateAssertionsAgainstSP {
+			if err := req.ValidateAgainstSP(nil); err != nil {
+				return err
+			}
+		}
+
+		err := req.MarshalAssertion()
+		if err != nil {
+			return errors.Wrap(err, "failed to marshal assertion")
+		}
+
+		err = req.MakeResponse()
+		if err != nil {
+			return errors.Wrap(err, "failed to build response")
+		}
+	}
+
+	form := req.responseForm(relayState, req.ResponseBytes())
+
+	formBuf := bytes.NewBuffer(nil)
+	if err := redirectFormTpl.Execute(formBuf, form); err != nil {
+		return errors.Wrap(err, "failed to build form")
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	w.Write(formBuf.Bytes())
+	return nil
+}
+
+// writeStatusResponse sends the SP a Response without an assertion, with the
+// Requester status and subCode, and the message of err as its StatusMessage.
+func writeStatusResponse(w http.ResponseWriter, req *IdpAuthnRequest, relayState string, subCode string, err error) error {
+	message := strings.TrimPrefix(err.Error(), subCode+": ")
+	if err := req.MakeErrorResponse(StatusRequester, subCode, message); err != nil {
+		return errors.Wrap(err, "failed to build response")
+	}
+	return WriteResponse(w, req, relayState)
+}
+
+// readSSORequest returns the SAMLRequest and RelayState of a request sent
+// through the HTTP-POST binding when r is a POST, or through the HTTP-Redirect
+// binding otherwise.
+func readSSORequest(r *http.Request) ([]byte, string, error) {
+	if r.Method == http.MethodPost {
+		if err := r.ParseForm(); err != nil {
+			return nil, "", errors.Wrap(err, "failed to parse form")
+		}
+		buf, err := base64.StdEncoding.DecodeString(r.PostForm.Get("SAMLRequest"))
+		if err != nil {
+			return nil, "", errors.Wrap(err, "failed to decode message")
+		}
+		return buf, r.PostForm.Get("RelayState"), nil
+	}
+
+	// The parameters are read as VerifySignature reads them, so the request
+	// parsed is the one whose signature is checked.
+	query := rawQueryValues(r.URL.RawQuery)
+	message, err := rawQueryValue(query, "SAMLRequest")
+	if err != nil {
+		return nil, "", err
+	}
+	relayState, err := rawQueryValue(query, "RelayState")
+	if err != nil {
+		return nil, "", err
+	}
+	buf, err := inflateMessage(message)
+	if err != nil {
+		return nil, "", err
+	}
+	return buf, relayState, nil
+}
+
+// marshalResponse serializes the Response for the SP. It is compact unless
+// IndentResponses is set and nothing in it is signed in the clear, since
+// added whitespace would change the signed octets.
+func (req *IdpAuthnRequest) marshalResponse() ([]byte, error) {
+	if req.IDP.IndentResponses && req.Response.Signature == nil && req.Response.Assertion == nil {
+		return xml.MarshalIndent(req.Response, "", "\t")
+	}
+	return xml.Marshal(req.Response)
+}
+
+// inflateMessage decodes and decompresses a message received through the
+// HTTP-Redirect binding.
+func inflateMessage(message string) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(message)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode message")
+	}
+	buf, err := ioutil.ReadAll(limitMessageReader(flate.NewReader(bytes.NewReader(data))))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to inflate message")
+	}
+	return buf, nil
+}
+
+// allowMethods reports whether r uses one of the given methods, answering 405
+// Method Not Allowed with an Allow header listing them when it does not.
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if r.Method == method {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, r, http.StatusMethodNotAllowed, errors.New(http.StatusText(http.StatusMethodNotAllowed)))
+	return false
+}
+
+func writeErr(w http.ResponseWriter, r *http.Request, err error) {
+	writeError(w, r, http.StatusInternalServerError, err)
+}
+
+func deniedErr(w http.ResponseWriter, r *http.Request, err error) {
+	writeError(w, r, http.StatusForbidden, err)
+}
+
+func rateLimitedErr(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusTooManyRequests, errors.New(http.StatusText(http.StatusTooManyRequests)))
 }
 
-func writeErr(w http.ResponseWriter, err error) {
-	w.WriteHeader(http.StatusInternalServerError)
-	w.Write([]byte(err.Error()))
+func timeoutErr(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusGatewayTimeout, errors.New(http.StatusText(http.StatusGatewayTimeout)))
 }
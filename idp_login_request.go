@@ -2,10 +2,10 @@ package saml
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
-	"encoding/xml"
+	"html/template"
 	"net/http"
-	"text/template"
 )
 
 var redirectFormTemplate = `<!DOCTYPE html>
@@ -15,6 +15,9 @@ var redirectFormTemplate = `<!DOCTYPE html>
 		<form id="redirect" method="POST" action="{{.FormAction}}">
 			<input type="hidden" name="RelayState" value="{{.RelayState}}" />
 			<input type="hidden" name="SAMLResponse" value="{{.SAMLResponse}}" />
+			{{- if .SAMLEncoding}}
+			<input type="hidden" name="SAMLEncoding" value="{{.SAMLEncoding}}" />
+			{{- end}}
 		</form>
 		<script type="text/javascript">
 			document.getElementById("redirect").submit();
@@ -22,14 +25,52 @@ var redirectFormTemplate = `<!DOCTYPE html>
 	</body>
 </html>`
 
+// redirectFormTpl is redirectFormTemplate, parsed once when the package is
+// loaded rather than on every request.
+var redirectFormTpl = template.Must(template.New("redirectForm").Parse(redirectFormTemplate))
+
 // Authenticator defines an authentication function that returns a
 // *saml.Session value.
 type Authenticator func(w http.ResponseWriter, r *http.Request) (*Session, error)
 
+// AuthenticatorContextKey is the request context key under which upstream
+// middleware can store an Authenticator. ServeSSO and LoginRequest prefer it
+// over the Authenticator they were created with.
+const AuthenticatorContextKey = "saml.Authenticator"
+
+// WithAuthenticator returns a copy of ctx holding the given Authenticator.
+func WithAuthenticator(ctx context.Context, authFn Authenticator) context.Context {
+	return context.WithValue(ctx, AuthenticatorContextKey, authFn)
+}
+
+// requestAuthenticator returns the Authenticator stored in the request's
+// context, or fallback when there is none.
+func requestAuthenticator(r *http.Request, fallback Authenticator) Authenticator {
+	if authFn, ok := r.Context().Value(AuthenticatorContextKey).(Authenticator); ok && authFn != nil {
+		return authFn
+	}
+	return fallback
+}
+
 type redirectForm struct {
 	FormAction   string
 	RelayState   string
 	SAMLResponse string
+	SAMLEncoding string
+}
+
+// responseForm returns the form posting the marshalled response buf to the
+// SP that sent the request.
+func (req *IdpAuthnRequest) responseForm(relayState string, buf []byte) redirectForm {
+	form := redirectForm{
+		FormAction:   req.destination(),
+		RelayState:   relayState,
+		SAMLResponse: base64.StdEncoding.EncodeToString(buf),
+	}
+	if meta := req.ServiceProviderMetadata; meta != nil {
+		form.SAMLEncoding = req.IDP.spOptions(meta.EntityID).SAMLEncoding
+	}
+	return form
 }
 
 // LoginRequest represents a login request that the IdP creates in order to try
@@ -42,10 +83,13 @@ type LoginRequest struct {
 }
 
 // PostForm creates and serves a form that is used to authenticate to the SP.
+// The response is always POSTed: the Web Browser SSO profile does not allow
+// sending it through the HTTP-Redirect binding. SPs redirect users to the IdP
+// with AuthnRequestHandler or RedirectAuthnRequest.
 func (lr *LoginRequest) PostForm(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
-	sess, err := lr.authFn(w, r)
+	sess, err := requestAuthenticator(r, lr.authFn)(w, r)
 	if err != nil {
 		Logf("authFn: %v", err)
 		return
@@ -60,30 +104,28 @@ func (lr *LoginRequest) PostForm(w http.ResponseWriter, r *http.Request) {
 		ServiceProviderMetadata: lr.metadata,
 	}
 
+	if lr.idp.spOptions(lr.metadata.EntityID).SAML11 {
+		lr.postForm11(w, r, idpAuthnRequest, sess)
+		return
+	}
+
 	if err = idpAuthnRequest.MakeAssertion(sess); err != nil {
 		Logf("Failed to build assertion %v", err)
-		writeErr(w, err)
+		writeErr(w, r, err)
 		return
 	}
 
 	err = idpAuthnRequest.MarshalAssertion()
 	if err != nil {
 		Logf("Failed to marshal assertion %v", err)
-		writeErr(w, err)
+		writeErr(w, r, err)
 		return
 	}
 
 	err = idpAuthnRequest.MakeResponse()
 	if err != nil {
 		Logf("Failed to build response %v", err)
-		writeErr(w, err)
-		return
-	}
-
-	buf, err := xml.MarshalIndent(idpAuthnRequest.Response, "", "\t")
-	if err != nil {
-		Logf("Failed to format response %v", err)
-		writeErr(w, err)
+		writeErr(w, r, err)
 		return
 	}
 
@@ -94,24 +136,55 @@ func (lr *LoginRequest) PostForm(w http.ResponseWriter, r *http.Request) {
 	if token != nil {
 		relayState, _ = token.(string)
 	}
+	if len(relayState) > MaxRelayStateLength {
+		Logf("Invalid RelayState: %v", ErrRelayStateTooLong)
+		writeErr(w, r, ErrRelayStateTooLong)
+		return
+	}
 
-	form := redirectForm{
-		FormAction:   lr.metadata.SPSSODescriptor.AssertionConsumerService[0].Location,
-		RelayState:   relayState,
-		SAMLResponse: base64.StdEncoding.EncodeToString(buf),
+	form := idpAuthnRequest.responseForm(relayState, idpAuthnRequest.ResponseBytes())
+
+	formBuf := bytes.NewBuffer(nil)
+	if err := redirectFormTpl.Execute(formBuf, form); err != nil {
+		Logf("Failed to build form %v", err)
+		writeErr(w, r, err)
+		return
 	}
 
-	formTpl, err := template.New("").Parse(redirectFormTemplate)
-	if err != nil {
-		Logf("Failed to create form %v", err)
-		writeErr(w, err)
+	w.Header().Set("Content-Type", "text/html")
+	w.Write(formBuf.Bytes())
+}
+
+// postForm11 serves the SAML 1.1 browser/POST profile equivalent of PostForm.
+func (lr *LoginRequest) postForm11(w http.ResponseWriter, r *http.Request, idpAuthnRequest *IdpAuthnRequest, sess *Session) {
+	if err := idpAuthnRequest.MakeAssertion11(sess); err != nil {
+		Logf("Failed to build assertion %v", err)
+		writeErr(w, r, err)
+		return
+	}
+
+	if err := idpAuthnRequest.MakeResponse11(); err != nil {
+		Logf("Failed to build response %v", err)
+		writeErr(w, r, err)
 		return
 	}
 
+	var target string
+	token := r.Context().Value("saml.RelayState")
+	if token != nil {
+		target, _ = token.(string)
+	}
+
+	form := redirectForm{
+		FormAction:   idpAuthnRequest.Response11.Recipient,
+		RelayState:   target,
+		SAMLResponse: base64.StdEncoding.EncodeToString(idpAuthnRequest.Response11Buffer),
+	}
+
 	formBuf := bytes.NewBuffer(nil)
-	if err := formTpl.Execute(formBuf, form); err != nil {
+	if err := redirectForm11Tpl.Execute(formBuf, form); err != nil {
 		Logf("Failed to build form %v", err)
-		writeErr(w, err)
+		writeErr(w, r, err)
 		return
 	}
 
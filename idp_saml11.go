@@ -0,0 +1,146 @@
+package saml
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"html/template"
+)
+
+var redirectForm11Template = `<!DOCTYPE html>
+<html>
+	<head></head>
+	<body>
+		<form id="redirect" method="POST" action="{{.FormAction}}">
+			<input type="hidden" name="TARGET" value="{{.RelayState}}" />
+			<input type="hidden" name="SAMLResponse" value="{{.SAMLResponse}}" />
+		</form>
+		<script type="text/javascript">
+			document.getElementById("redirect").submit();
+		</script>
+	</body>
+</html>`
+
+// redirectForm11Tpl is redirectForm11Template, parsed once like
+// redirectFormTpl.
+var redirectForm11Tpl = template.Must(template.New("redirectForm11").Parse(redirectForm11Template))
+
+// MakeAssertion11 produces a SAML 1.1 assertion for the given request and
+// assigns it to req.Assertion11. SAML 1.1 SPs don't send authentication
+// requests, so this is only meaningful for IdP initiated logins.
+func (req *IdpAuthnRequest) MakeAssertion11(session *Session) error {
+	if _, err := req.IDP.Metadata(); err != nil {
+		return err
+	}
+
+	attributes := []Attribute11{}
+	for _, attr := range sessionAttributes(session) {
+		values := []string{}
+		for _, value := range attr.Values {
+			values = append(values, value.Value)
+		}
+		attributes = append(attributes, Attribute11{
+			AttributeName:      attr.Name,
+			AttributeNamespace: SAML11AttributeNamespaceURI,
+			Values:             values,
+		})
+	}
+
+	subject := Subject11{
+		NameIdentifier: &NameIdentifier11{
+			NameQualifier: req.issuer(),
+			Value:         session.NameID,
+		},
+		SubjectConfirmation: &SubjectConfirmation11{
+			ConfirmationMethod: []string{SAML11BearerConfirmationMethod},
+		},
+	}
+
+	req.Assertion11 = &Assertion11{
+		AssertionID:  req.newID(),
+		Issuer:       req.issuer(),
+		IssueInstant: Now(),
+		MajorVersion: 1,
+		MinorVersion: 1,
+		Conditions: &Conditions11{
+			NotBefore:    Now(),
+			NotOnOrAfter: Now().Add(IssueLifetime),
+			AudienceRestrictionCondition: func() *AudienceRestrictionCondition11 {
+				if req.ServiceProviderMetadata != nil {
+					return &AudienceRestrictionCondition11{
+						Audience: []string{req.ServiceProviderMetadata.EntityID},
+					}
+				}
+				return nil
+			}(),
+		},
+		AuthenticationStatement: &AuthenticationStatement11{
+			AuthenticationMethod:  SAML11PasswordAuthenticationMethod,
+			AuthenticationInstant: session.CreateTime,
+			Subject:               subject,
+			SubjectLocality: &SubjectLocality11{
+				IPAddress: req.HTTPRequest.RemoteAddr,
+			},
+		},
+	}
+
+	if len(attributes) > 0 {
+		req.Assertion11.AttributeStatement = &AttributeStatement11{
+			Subject:    subject,
+			Attributes: attributes,
+		}
+	}
+
+	return nil
+}
+
+// MakeResponse11 wraps req.Assertion11 into a SAML 1.1 response, signs it and
+// assigns the resulting document to req.Response11Buffer. SAML 1.1 has no
+// support for encrypted assertions, so the whole response is signed instead.
+func (req *IdpAuthnRequest) MakeResponse11() error {
+	if req.Assertion11 == nil {
+		return errors.New("Missing SAML 1.1 assertion")
+	}
+
+	cert, err := req.IDP.signingCert()
+	if err != nil {
+		return err
+	}
+	signatureTemplate := req.IDP.signatureTemplate(cert, req.ServiceProviderMetadata)
+	if err := req.signatureKeyInfo().apply(&signatureTemplate, cert); err != nil {
+		return err
+	}
+
+	req.Response11 = &Response11{
+		SamlpNS:      SAML11ProtocolNamespace,
+		ResponseID:   req.newID(),
+		IssueInstant: Now(),
+		MajorVersion: 1,
+		MinorVersion: 1,
+		Recipient:    req.recipient(SAML11BrowserPostBinding),
+		Signature:    &signatureTemplate,
+		Status: &Status11{
+			StatusCode: StatusCode11{
+				Value: SAML11StatusSuccess,
+			},
+		},
+		Assertion: req.Assertion11,
+	}
+	if req.Response11.Recipient == "" {
+		return errors.New(`Missing "Recipient"`)
+	}
+
+	buf, err := xml.Marshal(req.Response11)
+	if err != nil {
+		return err
+	}
+
+	buf, err = req.IDP.sign(req.context(), buf)
+	if err != nil {
+		return err
+	}
+
+	req.Response11Buffer = bytes.TrimSpace(bytes.TrimPrefix(buf, []byte(`<?xml version="1.0"?>`)))
+
+	return nil
+}
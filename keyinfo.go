@@ -0,0 +1,59 @@
+package saml
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+
+	"github.com/goware/saml/xmlsec"
+	"github.com/pkg/errors"
+)
+
+// SignatureKeyInfo tells what the KeyInfo of the signatures of the
+// assertions made for an SP carries.
+type SignatureKeyInfo int
+
+// Signature KeyInfo contents.
+const (
+	// KeyInfoX509Data embeds the signing certificate in an X509Data.
+	KeyInfoX509Data SignatureKeyInfo = iota
+	// KeyInfoRSAKeyValue embeds the bare RSA public key of the signing
+	// certificate in a KeyValue, for legacy SPs that choke on X509Data.
+	KeyInfoRSAKeyValue
+	// KeyInfoX509DataAndRSAKeyValue embeds both.
+	KeyInfoX509DataAndRSAKeyValue
+)
+
+// apply sets the KeyInfo of a signature template embedding cert.
+func (k SignatureKeyInfo) apply(signature *xmlsec.Signature, cert *pem.Block) error {
+	switch k {
+	case KeyInfoX509Data:
+		return nil
+	case KeyInfoRSAKeyValue, KeyInfoX509DataAndRSAKeyValue:
+	default:
+		return errors.Errorf("unknown signature KeyInfo %d", k)
+	}
+
+	parsed, err := x509.ParseCertificate(cert.Bytes)
+	if err != nil {
+		return errors.Wrap(err, "failed to parse the signing certificate")
+	}
+	key, ok := parsed.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return errors.Errorf("cannot embed a %T signing key in an RSAKeyValue", parsed.PublicKey)
+	}
+	signature.KeyValue = xmlsec.NewRSAKeyValue(key)
+	if k == KeyInfoRSAKeyValue {
+		signature.X509Certificate = nil
+	}
+	return nil
+}
+
+// signatureKeyInfo returns the SignatureKeyInfo of the options of the SP
+// that sent the request.
+func (req *IdpAuthnRequest) signatureKeyInfo() SignatureKeyInfo {
+	if meta := req.ServiceProviderMetadata; meta != nil {
+		return req.IDP.spOptions(meta.EntityID).SignatureKeyInfo
+	}
+	return KeyInfoX509Data
+}
@@ -0,0 +1,88 @@
+package saml
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// readPrivateKey reads and parses the PEM encoded private key on the given
+// file.
+func readPrivateKey(file string) (crypto.PrivateKey, error) {
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return parsePrivateKey(buf)
+}
+
+// parsePrivateKey parses a PEM encoded private key: PKCS#1 RSA, SEC 1 EC or
+// PKCS#8 RSA or ECDSA keys. Encrypted keys are left to xmlsec1, see
+// IdentityProvider.PrivkeyPassphrase.
+func parsePrivateKey(buf []byte) (crypto.PrivateKey, error) {
+	block, _ := pem.Decode(buf)
+	if block == nil {
+		return nil, errors.New("failed to decode private key")
+	}
+	if isEncryptedPrivateKey(block) {
+		return nil, errors.Errorf("encrypted %q private key can only be read by xmlsec1", block.Type)
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to parse PKCS#1 private key")
+		}
+		return key, nil
+	case "EC PRIVATE KEY":
+		key, err := x509.ParseECPrivateKey(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to parse SEC 1 EC private key")
+		}
+		return key, nil
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			// Some tools label PKCS#1 keys as "PRIVATE KEY".
+			if rsaKey, rsaErr := x509.ParsePKCS1PrivateKey(block.Bytes); rsaErr == nil {
+				return rsaKey, nil
+			}
+			return nil, errors.Wrap(err, "failed to parse PKCS#8 private key")
+		}
+		return key, nil
+	}
+
+	return nil, errors.Errorf("unsupported private key type %q", block.Type)
+}
+
+// isEncryptedPrivateKey returns whether the given PEM block holds an
+// encrypted private key, either PKCS#8 or with the legacy OpenSSL Proc-Type
+// headers.
+func isEncryptedPrivateKey(block *pem.Block) bool {
+	return block.Type == "ENCRYPTED PRIVATE KEY" || strings.Contains(block.Headers["Proc-Type"], "ENCRYPTED")
+}
+
+// publicKeysMatch returns whether the given private key, or the public key of
+// a crypto.Signer, corresponds to the given public key.
+func publicKeysMatch(priv crypto.PrivateKey, pub crypto.PublicKey) bool {
+	switch k := priv.(type) {
+	case *rsa.PrivateKey:
+		return publicKeysMatch(&k.PublicKey, pub)
+	case *ecdsa.PrivateKey:
+		return publicKeysMatch(&k.PublicKey, pub)
+	case *rsa.PublicKey:
+		p, ok := pub.(*rsa.PublicKey)
+		return ok && k.N.Cmp(p.N) == 0 && k.E == p.E
+	case *ecdsa.PublicKey:
+		p, ok := pub.(*ecdsa.PublicKey)
+		return ok && k.Curve == p.Curve && k.X.Cmp(p.X) == 0 && k.Y.Cmp(p.Y) == 0
+	}
+	return false
+}
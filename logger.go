@@ -3,12 +3,18 @@ package saml
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"strings"
+
+	"github.com/goware/saml/xmlsec"
 )
 
 // UserRequest represents a request submitted from an user.
@@ -111,6 +117,56 @@ func InspectRequest(r *http.Request) *UserRequest {
 	}
 }
 
+// logSignatureTrace logs the signatures in buf when DebugSignatures is set.
+func logSignatureTrace(what string, buf []byte) {
+	if !DebugSignatures {
+		return
+	}
+	traces, err := xmlsec.TraceSignatures(buf)
+	if err != nil {
+		Logf("Failed to trace signatures of %s: %v", what, err)
+		return
+	}
+	for i := range traces {
+		Logf("Signature %d of %s:\n%v", i+1, what, &traces[i])
+	}
+}
+
+// logSignatureCertificate logs the subject and SHA-256 fingerprint of the
+// certificate a failing signature was checked against, when DebugSignatures
+// is set.
+func logSignatureCertificate(what string, cert *x509.Certificate) {
+	if !DebugSignatures || cert == nil {
+		return
+	}
+	sum := sha256.Sum256(cert.Raw)
+	Logf("Certificate used to verify %s: subject %q, SHA-256 fingerprint %s", what, cert.Subject.String(), hex.EncodeToString(sum[:]))
+}
+
+// logSignatureCertificateFile is logSignatureCertificate for the PEM encoded
+// certificate in the given file.
+func logSignatureCertificateFile(what string, path string) {
+	if !DebugSignatures {
+		return
+	}
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		Logf("Failed to read certificate used to verify %s: %v", what, err)
+		return
+	}
+	block, _ := pem.Decode(buf)
+	if block == nil {
+		Logf("Certificate used to verify %s is not PEM encoded", what)
+		return
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		Logf("Failed to parse certificate used to verify %s: %v", what, err)
+		return
+	}
+	logSignatureCertificate(what, cert)
+}
+
 // Log prints logging message, not necessarily an error.
 func Log(v ...interface{}) {
 	logger.Print(v...)
@@ -0,0 +1,138 @@
+package saml
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+const protocolNamespace = "urn:oasis:names:tc:SAML:2.0:protocol"
+
+// MessageType identifies the kind of a SAML protocol message by the local
+// name of its root element.
+type MessageType string
+
+// Message types recognized by DecodeMessage.
+const (
+	MessageTypeAuthnRequest    MessageType = "AuthnRequest"
+	MessageTypeLogoutRequest   MessageType = "LogoutRequest"
+	MessageTypeResponse        MessageType = "Response"
+	MessageTypeArtifactResolve MessageType = "ArtifactResolve"
+)
+
+// ErrUnknownMessageType is returned by DecodeMessage when the root element is
+// not one of the supported SAML protocol messages.
+var ErrUnknownMessageType = errors.New("unknown SAML message type")
+
+// DecodeMessage parses a SAML protocol message of unknown type, so a single
+// endpoint can dispatch AuthnRequests, LogoutRequests, Responses and
+// ArtifactResolves. The returned value is a *AuthnRequest, *LogoutRequest,
+// *Response or *ArtifactResolve matching the MessageType. The message is
+// parsed with the same limits as every other inbound message.
+func DecodeMessage(raw []byte) (interface{}, MessageType, error) {
+	if MaxMessageSize > 0 && int64(len(raw)) > MaxMessageSize {
+		return nil, "", ErrMessageTooLarge
+	}
+
+	name, err := rootElement(raw)
+	if err != nil {
+		return nil, "", err
+	}
+	if name.Space != protocolNamespace {
+		return nil, "", errors.Wrapf(ErrUnknownMessageType, "%s %s", name.Space, name.Local)
+	}
+
+	var message interface{}
+	switch MessageType(name.Local) {
+	case MessageTypeAuthnRequest:
+		message = &AuthnRequest{}
+	case MessageTypeLogoutRequest:
+		message = &LogoutRequest{}
+	case MessageTypeResponse:
+		message = &Response{}
+	case MessageTypeArtifactResolve:
+		message = &ArtifactResolve{}
+	default:
+		return nil, "", errors.Wrapf(ErrUnknownMessageType, "%s %s", name.Space, name.Local)
+	}
+
+	if err := unmarshalXML(raw, message); err != nil {
+		return nil, "", err
+	}
+	return message, MessageType(name.Local), nil
+}
+
+// DecodeRedirectMessage is DecodeMessage for a SAMLRequest or SAMLResponse
+// parameter received through the HTTP-Redirect binding, which is deflated and
+// base64 encoded.
+func DecodeRedirectMessage(message string) (interface{}, MessageType, error) {
+	buf, err := inflateMessage(message)
+	if err != nil {
+		return nil, "", err
+	}
+	return DecodeMessage(buf)
+}
+
+// DecodePostMessage is DecodeMessage for a SAMLRequest or SAMLResponse form
+// value received through the HTTP-POST binding, which is base64 encoded.
+func DecodePostMessage(message string) (interface{}, MessageType, error) {
+	buf, err := base64.StdEncoding.DecodeString(message)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "failed to decode message")
+	}
+	return DecodeMessage(buf)
+}
+
+// rootElement returns the namespaced name of the first element of a
+// document.
+func rootElement(buf []byte) (xml.Name, error) {
+	decoder := newXMLDecoder(bytes.NewReader(buf))
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return xml.Name{}, errors.New("missing root element")
+		}
+		if err != nil {
+			return xml.Name{}, err
+		}
+		if start, ok := token.(xml.StartElement); ok {
+			return start.Name, nil
+		}
+	}
+}
+
+// rawElement returns the bytes of the first element of a document with the
+// given name, as they appear in the document.
+func rawElement(buf []byte, name xml.Name) ([]byte, error) {
+	start, _, end, err := elementOffsets(buf, name)
+	if err != nil {
+		return nil, err
+	}
+	return buf[start:end], nil
+}
+
+// elementOffsets returns where the first element of a document with the
+// given name starts, where its start tag ends and where it ends.
+func elementOffsets(buf []byte, name xml.Name) (int, int, int, error) {
+	decoder := newXMLDecoder(bytes.NewReader(buf))
+	for {
+		offset := decoder.InputOffset()
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return 0, 0, 0, errors.Errorf("missing %s element", name.Local)
+		}
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		if start, ok := token.(xml.StartElement); ok && start.Name == name {
+			content := decoder.InputOffset()
+			if err := decoder.Skip(); err != nil {
+				return 0, 0, 0, err
+			}
+			return int(offset), int(content), int(decoder.InputOffset()), nil
+		}
+	}
+}
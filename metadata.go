@@ -25,7 +25,13 @@
 package saml
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/xml"
+	"net/http"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -35,12 +41,80 @@ const HTTPPostBinding = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
 // HTTPRedirectBinding is the official URN for the HTTP-Redirect binding (transport)
 const HTTPRedirectBinding = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect"
 
+// DeflateEncoding is the SAMLEncoding of messages sent through the
+// HTTP-Redirect binding, DEFLATE compressed.
+const DeflateEncoding = "urn:oasis:names:tc:SAML:bindings:URL-Encoding:DEFLATE"
+
+const metadataNamespace = "urn:oasis:names:tc:SAML:2.0:metadata"
+
+// DefaultMetadataContentType is the Content-Type of served metadata unless
+// MetadataContentType is set. Some validators require
+// "application/samlmetadata+xml" instead.
+const DefaultMetadataContentType = "application/xml; charset=utf-8"
+
+func metadataContentType(contentType string) string {
+	if contentType == "" {
+		return DefaultMetadataContentType
+	}
+	return contentType
+}
+
+// metadataVersion identifies the content of a metadata document and the time
+// it was first served.
+type metadataVersion struct {
+	etag    string
+	modTime time.Time
+}
+
+// metadataValidUntilPeriod is the granularity served validUntil values are
+// rounded up to.
+const metadataValidUntilPeriod = time.Hour
+
+// roundValidUntil rounds the metadata's validUntil up to the hour, so that the
+// document served, and its ETag, stays the same between requests instead of
+// moving forward on each of them.
+func roundValidUntil(metadata *Metadata) {
+	if metadata.ValidUntil.IsZero() {
+		return
+	}
+	validUntil := metadata.ValidUntil.Truncate(metadataValidUntilPeriod)
+	if validUntil.Before(metadata.ValidUntil) {
+		validUntil = validUntil.Add(metadataValidUntilPeriod)
+	}
+	metadata.ValidUntil = validUntil
+}
+
+// metadataETag returns an ETag for the metadata document out, as served.
+func metadataETag(out []byte) string {
+	sum := sha256.Sum256(out)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// serveMetadata writes a metadata document with ETag and Last-Modified
+// headers, answering conditional requests with 304 Not Modified. HEAD
+// requests get the same headers as GET requests, without the body.
+func serveMetadata(w http.ResponseWriter, r *http.Request, version *atomic.Value, out []byte, contentType string) {
+	w.Header().Set("Content-Type", contentType)
+
+	etag := metadataETag(out)
+	current, _ := version.Load().(*metadataVersion)
+	if current == nil || current.etag != etag {
+		current = &metadataVersion{etag: etag, modTime: Now()}
+		version.Store(current)
+	}
+
+	w.Header().Set("ETag", etag)
+	http.ServeContent(w, r, "", current.modTime, bytes.NewReader(out))
+}
+
 // EntitiesDescriptor represents the SAML object of the same name.
 //
 // See http://docs.oasis-open.org/security/saml/v2.0/saml-metadata-2.0-os.pdf section 2.3.1
 type EntitiesDescriptor struct {
-	XMLName          xml.Name    `xml:"urn:oasis:names:tc:SAML:2.0:metadata EntitiesDescriptor"`
-	EntityDescriptor []*Metadata `xml:"urn:oasis:names:tc:SAML:2.0:metadata EntityDescriptor"`
+	XMLName            xml.Name              `xml:"urn:oasis:names:tc:SAML:2.0:metadata EntitiesDescriptor"`
+	Name               string                `xml:",attr,omitempty"`
+	EntitiesDescriptor []*EntitiesDescriptor `xml:"urn:oasis:names:tc:SAML:2.0:metadata EntitiesDescriptor"`
+	EntityDescriptor   []*Metadata           `xml:"urn:oasis:names:tc:SAML:2.0:metadata EntityDescriptor"`
 }
 
 // Metadata represents the SAML EntityDescriptor object.
@@ -51,8 +125,233 @@ type Metadata struct {
 	ValidUntil       time.Time         `xml:"validUntil,attr"`
 	CacheDuration    time.Duration     `xml:"cacheDuration,attr,omitempty"`
 	EntityID         string            `xml:"entityID,attr"`
+	Extensions       *RoleExtensions   `xml:"urn:oasis:names:tc:SAML:2.0:metadata Extensions"`
 	SPSSODescriptor  *SPSSODescriptor  `xml:"SPSSODescriptor"`
 	IDPSSODescriptor *IDPSSODescriptor `xml:"IDPSSODescriptor"`
+	RoleDescriptors  []RoleDescriptor  `xml:"RoleDescriptor"`
+	Organization     *Organization     `xml:"urn:oasis:names:tc:SAML:2.0:metadata Organization"`
+}
+
+// UnmarshalXML implements xml.Unmarshaler. Entities described by a generic
+// RoleDescriptor supporting SAML 2.0 instead of an SPSSODescriptor get an
+// SPSSODescriptor made from it, so their endpoints and keys are found.
+func (m *Metadata) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	type metadata Metadata
+	var v metadata
+	if err := d.DecodeElement(&v, &start); err != nil {
+		return err
+	}
+	*m = Metadata(v)
+	if m.SPSSODescriptor == nil {
+		m.SPSSODescriptor = spDescriptorFromRoles(m.RoleDescriptors)
+	}
+	return nil
+}
+
+// RoleDescriptor represents a generic md:RoleDescriptor, whose content is
+// defined by its xsi:type, such as the fed:ApplicationServiceType of
+// WS-Federation metadata. Only the keys and the SAML endpoints it holds are
+// parsed.
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-metadata-2.0-os.pdf section 2.4.1
+type RoleDescriptor struct {
+	Type                       string            `xml:"http://www.w3.org/2001/XMLSchema-instance type,attr,omitempty"`
+	ProtocolSupportEnumeration string            `xml:"protocolSupportEnumeration,attr"`
+	KeyDescriptor              []KeyDescriptor   `xml:"KeyDescriptor"`
+	SingleLogoutService        []Endpoint        `xml:"SingleLogoutService"`
+	NameIDFormat               []string          `xml:"NameIDFormat"`
+	AssertionConsumerService   []IndexedEndpoint `xml:"AssertionConsumerService"`
+}
+
+// SupportsSAML2 reports whether the role declares SAML 2.0 protocol support.
+func (r *RoleDescriptor) SupportsSAML2() bool {
+	for _, protocol := range strings.Fields(r.ProtocolSupportEnumeration) {
+		if protocol == protocolNamespace {
+			return true
+		}
+	}
+	return false
+}
+
+// spDescriptorFromRoles returns an SPSSODescriptor made from the first role
+// supporting SAML 2.0 that has an assertion consumer service, or nil.
+func spDescriptorFromRoles(roles []RoleDescriptor) *SPSSODescriptor {
+	for _, role := range roles {
+		if !role.SupportsSAML2() || len(role.AssertionConsumerService) == 0 {
+			continue
+		}
+		return &SPSSODescriptor{
+			ProtocolSupportEnumeration: role.ProtocolSupportEnumeration,
+			KeyDescriptor:              role.KeyDescriptor,
+			SingleLogoutService:        role.SingleLogoutService,
+			NameIDFormat:               role.NameIDFormat,
+			AssertionConsumerService:   role.AssertionConsumerService,
+		}
+	}
+	return nil
+}
+
+// Organization represents the SAML object of the same name, the localized
+// names and URLs of the organization behind an entity.
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-metadata-2.0-os.pdf section 2.3.2.1
+type Organization struct {
+	OrganizationName        LocalizedValues `xml:"urn:oasis:names:tc:SAML:2.0:metadata OrganizationName"`
+	OrganizationDisplayName LocalizedValues `xml:"urn:oasis:names:tc:SAML:2.0:metadata OrganizationDisplayName"`
+	OrganizationURL         LocalizedValues `xml:"urn:oasis:names:tc:SAML:2.0:metadata OrganizationURL"`
+}
+
+// RoleExtensions represents the Extensions element of an entity or role
+// descriptor. Only the mdui:UIInfo extension and the alg:DigestMethod and
+// alg:SigningMethod extensions are understood, others are dropped on parsing.
+type RoleExtensions struct {
+	XMLName        xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:metadata Extensions"`
+	UIInfo         *UIInfo
+	DigestMethods  []DigestMethod  `xml:"urn:oasis:names:tc:SAML:metadata:algsupport DigestMethod"`
+	SigningMethods []SigningMethod `xml:"urn:oasis:names:tc:SAML:metadata:algsupport SigningMethod"`
+}
+
+// DigestMethod represents the alg:DigestMethod object, a digest algorithm
+// supported by an entity.
+//
+// See https://docs.oasis-open.org/security/saml/Post2.0/sstc-saml-metadata-algsupport-v1.0.html section 2.2
+type DigestMethod struct {
+	Algorithm string `xml:"Algorithm,attr"`
+}
+
+// SigningMethod represents the alg:SigningMethod object, a signature
+// algorithm supported by an entity, with the key sizes it supports it for.
+//
+// See https://docs.oasis-open.org/security/saml/Post2.0/sstc-saml-metadata-algsupport-v1.0.html section 2.3
+type SigningMethod struct {
+	Algorithm  string `xml:"Algorithm,attr"`
+	MinKeySize int    `xml:"MinKeySize,attr,omitempty"`
+	MaxKeySize int    `xml:"MaxKeySize,attr,omitempty"`
+}
+
+// SigningMethods returns the signature algorithms the entity declares in the
+// Extensions of its EntityDescriptor or of its SSO descriptors, in order of
+// appearance. It is empty when the entity declares none.
+func (m *Metadata) SigningMethods() []string {
+	var algorithms []string
+	for _, extensions := range m.extensions() {
+		for _, method := range extensions.SigningMethods {
+			algorithms = appendUnique(algorithms, method.Algorithm)
+		}
+	}
+	return algorithms
+}
+
+// DigestMethods returns the digest algorithms the entity declares, like
+// SigningMethods.
+func (m *Metadata) DigestMethods() []string {
+	var algorithms []string
+	for _, extensions := range m.extensions() {
+		for _, method := range extensions.DigestMethods {
+			algorithms = appendUnique(algorithms, method.Algorithm)
+		}
+	}
+	return algorithms
+}
+
+// extensions returns the Extensions of the EntityDescriptor and of its SSO
+// descriptors.
+func (m *Metadata) extensions() []*RoleExtensions {
+	var extensions []*RoleExtensions
+	if m.Extensions != nil {
+		extensions = append(extensions, m.Extensions)
+	}
+	if m.IDPSSODescriptor != nil && m.IDPSSODescriptor.Extensions != nil {
+		extensions = append(extensions, m.IDPSSODescriptor.Extensions)
+	}
+	if m.SPSSODescriptor != nil && m.SPSSODescriptor.Extensions != nil {
+		extensions = append(extensions, m.SPSSODescriptor.Extensions)
+	}
+	return extensions
+}
+
+// appendUnique appends value, trimmed, unless values already holds it.
+func appendUnique(values []string, value string) []string {
+	value = strings.TrimSpace(value)
+	for _, v := range values {
+		if v == value {
+			return values
+		}
+	}
+	return append(values, value)
+}
+
+// ChooseAlgorithm returns the first of our algorithms, in order of
+// preference, that the peer supports, as given by Metadata.SigningMethods or
+// Metadata.DigestMethods. Peers that declare no algorithms are assumed to
+// support ours, and the first one is returned. It is empty when there is no
+// algorithm in common.
+func ChooseAlgorithm(ours, peer []string) string {
+	if len(peer) == 0 {
+		if len(ours) == 0 {
+			return ""
+		}
+		return ours[0]
+	}
+	for _, algorithm := range ours {
+		for _, supported := range peer {
+			if algorithm == supported {
+				return algorithm
+			}
+		}
+	}
+	return ""
+}
+
+// UIInfo represents the mdui:UIInfo object, how an entity is presented to
+// users, in several languages.
+//
+// See https://docs.oasis-open.org/security/saml/Post2.0/sstc-saml-metadata-ui/v1.0/os/sstc-saml-metadata-ui-v1.0-os.html section 2.1.1
+type UIInfo struct {
+	XMLName             xml.Name        `xml:"urn:oasis:names:tc:SAML:metadata:ui UIInfo"`
+	DisplayName         LocalizedValues `xml:"urn:oasis:names:tc:SAML:metadata:ui DisplayName"`
+	Description         LocalizedValues `xml:"urn:oasis:names:tc:SAML:metadata:ui Description"`
+	InformationURL      LocalizedValues `xml:"urn:oasis:names:tc:SAML:metadata:ui InformationURL"`
+	PrivacyStatementURL LocalizedValues `xml:"urn:oasis:names:tc:SAML:metadata:ui PrivacyStatementURL"`
+}
+
+// LocalizedValue is the text of a localized metadata element, in the language
+// given by its xml:lang attribute.
+type LocalizedValue struct {
+	Lang  string `xml:"http://www.w3.org/XML/1998/namespace lang,attr"`
+	Value string `xml:",chardata"`
+}
+
+// LocalizedValues are the translations of a localized metadata element, one
+// element per language.
+type LocalizedValues []LocalizedValue
+
+// Get returns the value in the first of the given languages that is
+// available, matching "fr" with "fr-CA" and the other way around, or else the
+// English value, or else the first one. It is empty when there are no values.
+func (values LocalizedValues) Get(langs ...string) string {
+	for _, lang := range append(langs[:len(langs):len(langs)], "en") {
+		for _, value := range values {
+			if strings.EqualFold(value.Lang, lang) {
+				return value.Value
+			}
+		}
+		for _, value := range values {
+			if strings.EqualFold(primaryLanguage(value.Lang), primaryLanguage(lang)) {
+				return value.Value
+			}
+		}
+	}
+	if len(values) > 0 {
+		return values[0].Value
+	}
+	return ""
+}
+
+// primaryLanguage returns the primary subtag of a language tag, e.g. "fr" for
+// "fr-CA".
+func primaryLanguage(lang string) string {
+	return strings.SplitN(lang, "-", 2)[0]
 }
 
 // KeyDescriptor represents the XMLSEC object of the same name
@@ -86,9 +385,37 @@ type Endpoint struct {
 //
 // See http://docs.oasis-open.org/security/saml/v2.0/saml-metadata-2.0-os.pdf section 2.2.3
 type IndexedEndpoint struct {
-	Binding  string `xml:"Binding,attr"`
-	Location string `xml:"Location,attr"`
-	Index    int    `xml:"index,attr"`
+	Binding   string `xml:"Binding,attr"`
+	Location  string `xml:"Location,attr"`
+	Index     int    `xml:"index,attr"`
+	IsDefault bool   `xml:"isDefault,attr,omitempty"`
+
+	// HolderOfKeyProtocolBinding is the hoksso:ProtocolBinding of assertion
+	// consumer services with the HolderOfKeySSOBinding: the binding they
+	// receive responses with.
+	HolderOfKeyProtocolBinding string `xml:"-"`
+}
+
+// MarshalXML satisfies xml.Marshaler, writing HolderOfKeyProtocolBinding as
+// the hoksso:ProtocolBinding attribute.
+func (e IndexedEndpoint) MarshalXML(enc *xml.Encoder, start xml.StartElement) error {
+	type indexedEndpoint IndexedEndpoint
+	start.Attr = append(start.Attr, holderOfKeyAttrs(e.HolderOfKeyProtocolBinding)...)
+	return enc.EncodeElement(indexedEndpoint(e), start)
+}
+
+// UnmarshalXML satisfies xml.Unmarshaler, reading the hoksso:ProtocolBinding
+// attribute into HolderOfKeyProtocolBinding.
+func (e *IndexedEndpoint) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	type indexedEndpoint IndexedEndpoint
+	var v indexedEndpoint
+	binding := takeHolderOfKeyBinding(&start)
+	if err := d.DecodeElement(&v, &start); err != nil {
+		return err
+	}
+	v.HolderOfKeyProtocolBinding = binding
+	*e = IndexedEndpoint(v)
+	return nil
 }
 
 // SPSSODescriptor represents the SAML SPSSODescriptorType object.
@@ -99,13 +426,36 @@ type SPSSODescriptor struct {
 	AuthnRequestsSigned        bool              `xml:",attr"`
 	WantAssertionsSigned       bool              `xml:",attr"`
 	ProtocolSupportEnumeration string            `xml:"protocolSupportEnumeration,attr"`
+	Extensions                 *RoleExtensions   `xml:"urn:oasis:names:tc:SAML:2.0:metadata Extensions"`
 	KeyDescriptor              []KeyDescriptor   `xml:"KeyDescriptor"`
 	ArtifactResolutionService  []IndexedEndpoint `xml:"ArtifactResolutionService"`
 	SingleLogoutService        []Endpoint        `xml:"SingleLogoutService"`
 	ManageNameIDService        []Endpoint
-	NameIDFormat               []string          `xml:"NameIDFormat"`
-	AssertionConsumerService   []IndexedEndpoint `xml:"AssertionConsumerService"`
-	AttributeConsumingService  []interface{}
+	NameIDFormat               []string                    `xml:"NameIDFormat"`
+	AssertionConsumerService   []IndexedEndpoint           `xml:"AssertionConsumerService"`
+	AttributeConsumingService  []AttributeConsumingService `xml:"AttributeConsumingService"`
+}
+
+// AttributeConsumingService represents the SAML object of the same name, the
+// attributes an SP requests from IdPs.
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-metadata-2.0-os.pdf section 2.4.4.1
+type AttributeConsumingService struct {
+	Index              int                  `xml:"index,attr"`
+	IsDefault          bool                 `xml:"isDefault,attr,omitempty"`
+	ServiceName        LocalizedValues      `xml:"urn:oasis:names:tc:SAML:2.0:metadata ServiceName"`
+	RequestedAttribute []RequestedAttribute `xml:"urn:oasis:names:tc:SAML:2.0:metadata RequestedAttribute"`
+}
+
+// RequestedAttribute represents the SAML object of the same name. Requested
+// values, if any, are dropped on parsing.
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-metadata-2.0-os.pdf section 2.4.4.2
+type RequestedAttribute struct {
+	FriendlyName string `xml:",attr,omitempty"`
+	Name         string `xml:",attr"`
+	NameFormat   string `xml:",attr,omitempty"`
+	IsRequired   bool   `xml:"isRequired,attr,omitempty"`
 }
 
 // IDPSSODescriptor represents the SAML IDPSSODescriptorType object.
@@ -113,8 +463,11 @@ type SPSSODescriptor struct {
 // See http://docs.oasis-open.org/security/saml/v2.0/saml-metadata-2.0-os.pdf section 2.4.3
 type IDPSSODescriptor struct {
 	XMLName                    xml.Name        `xml:"urn:oasis:names:tc:SAML:2.0:metadata IDPSSODescriptor"`
+	WantAuthnRequestsSigned    bool            `xml:",attr,omitempty"`
 	ProtocolSupportEnumeration string          `xml:"protocolSupportEnumeration,attr"`
+	Extensions                 *RoleExtensions `xml:"urn:oasis:names:tc:SAML:2.0:metadata Extensions"`
 	KeyDescriptor              []KeyDescriptor `xml:"KeyDescriptor"`
+	SingleLogoutService        []Endpoint      `xml:"SingleLogoutService"`
 	NameIDFormat               []string        `xml:"NameIDFormat"`
 	SingleSignOnService        []Endpoint      `xml:"SingleSignOnService"`
 }
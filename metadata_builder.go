@@ -0,0 +1,140 @@
+package saml
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"time"
+)
+
+// MetadataOption customizes the metadata built by BuildIdPMetadata.
+type MetadataOption func(*Metadata)
+
+// WithNameIDFormats replaces the NameID formats advertised by the IdP, which
+// default to NameIDFormatTransient.
+func WithNameIDFormats(formats ...string) MetadataOption {
+	return func(metadata *Metadata) {
+		metadata.IDPSSODescriptor.NameIDFormat = formats
+	}
+}
+
+// WithValidDuration sets how long the metadata is valid and may be cached for.
+func WithValidDuration(d time.Duration) MetadataOption {
+	return func(metadata *Metadata) {
+		metadata.ValidUntil = Now().Add(d)
+		metadata.CacheDuration = d
+	}
+}
+
+// WithEncryptionCert advertises cert as the IdP's encryption key, instead of
+// the certificate it signs with.
+func WithEncryptionCert(cert *x509.Certificate) MetadataOption {
+	return func(metadata *Metadata) {
+		keyDescriptors := metadata.IDPSSODescriptor.KeyDescriptor
+		for i := range keyDescriptors {
+			if keyDescriptors[i].Use == "encryption" {
+				keyDescriptors[i].KeyInfo.Certificate = base64.StdEncoding.EncodeToString(cert.Raw)
+			}
+		}
+	}
+}
+
+// WithAlgorithms declares the signing and digest methods the IdP supports, in
+// the SAML metadata algorithm support extensions of its EntityDescriptor. It
+// adds no Extensions when both are empty.
+func WithAlgorithms(signingMethods, digestMethods []string) MetadataOption {
+	return func(metadata *Metadata) {
+		if len(signingMethods) == 0 && len(digestMethods) == 0 {
+			return
+		}
+		if metadata.Extensions == nil {
+			metadata.Extensions = &RoleExtensions{}
+		}
+		for _, algorithm := range digestMethods {
+			metadata.Extensions.DigestMethods = append(metadata.Extensions.DigestMethods, DigestMethod{Algorithm: algorithm})
+		}
+		for _, algorithm := range signingMethods {
+			metadata.Extensions.SigningMethods = append(metadata.Extensions.SigningMethods, SigningMethod{Algorithm: algorithm})
+		}
+	}
+}
+
+// BuildIdPMetadata returns the metadata of an IdP with the given entity ID,
+// SSO and, unless empty, SLO URLs, signing and encrypting with cert unless
+// WithEncryptionCert is given. It needs
+// no running IdentityProvider, so it can produce registration metadata from a
+// script or a test.
+func BuildIdPMetadata(entityID string, ssoURL, sloURL string, cert *x509.Certificate, opts ...MetadataOption) (*Metadata, error) {
+	if entityID == "" {
+		return nil, errors.New("missing entity ID")
+	}
+	if cert == nil {
+		return nil, errors.New("missing certificate")
+	}
+
+	metadata := idpMetadata(entityID, ssoURL, sloURL, cert.Raw, []string{NameIDFormatTransient})
+	for _, opt := range opts {
+		opt(metadata)
+	}
+	return metadata, nil
+}
+
+// idpMetadata builds IdP metadata around a DER encoded certificate.
+func idpMetadata(entityID string, ssoURL, sloURL string, certDER []byte, nameIDFormats []string) *Metadata {
+	certStr := base64.StdEncoding.EncodeToString(certDER)
+
+	metadata := &Metadata{
+		EntityID:      entityID,
+		ValidUntil:    Now().Add(defaultValidDuration),
+		CacheDuration: defaultValidDuration,
+		IDPSSODescriptor: &IDPSSODescriptor{
+			ProtocolSupportEnumeration: "urn:oasis:names:tc:SAML:2.0:protocol",
+			KeyDescriptor: []KeyDescriptor{
+				KeyDescriptor{
+					Use: "signing",
+					KeyInfo: KeyInfo{
+						Certificate: certStr,
+					},
+				},
+				KeyDescriptor{
+					Use: "encryption",
+					KeyInfo: KeyInfo{
+						Certificate: certStr,
+					},
+					EncryptionMethods: []EncryptionMethod{
+						EncryptionMethod{Algorithm: "http://www.w3.org/2001/04/xmlenc#aes128-cbc"},
+						EncryptionMethod{Algorithm: "http://www.w3.org/2001/04/xmlenc#aes192-cbc"},
+						EncryptionMethod{Algorithm: "http://www.w3.org/2001/04/xmlenc#aes256-cbc"},
+						EncryptionMethod{Algorithm: "http://www.w3.org/2001/04/xmlenc#rsa-oaep-mgf1p"},
+					},
+				},
+			},
+			NameIDFormat: nameIDFormats,
+			SingleSignOnService: []Endpoint{
+				{
+					Binding:  HTTPRedirectBinding,
+					Location: ssoURL,
+				},
+				{
+					Binding:  HTTPPostBinding,
+					Location: ssoURL,
+				},
+			},
+		},
+	}
+
+	if sloURL != "" {
+		metadata.IDPSSODescriptor.SingleLogoutService = []Endpoint{
+			{
+				Binding:  HTTPRedirectBinding,
+				Location: sloURL,
+			},
+			{
+				Binding:  HTTPPostBinding,
+				Location: sloURL,
+			},
+		}
+	}
+
+	return metadata
+}
@@ -0,0 +1,112 @@
+package saml
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/mail"
+)
+
+// NameID formats.
+const (
+	NameIDFormatTransient    = "urn:oasis:names:tc:SAML:2.0:nameid-format:transient"
+	NameIDFormatPersistent   = "urn:oasis:names:tc:SAML:2.0:nameid-format:persistent"
+	NameIDFormatEmailAddress = "urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress"
+	NameIDFormatEntity       = "urn:oasis:names:tc:SAML:2.0:nameid-format:entity"
+	NameIDFormatUnspecified  = "urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified"
+
+	// NameIDFormatEncrypted is only used in NameIDPolicy, to ask for the
+	// NameID to be sent as an EncryptedID.
+	NameIDFormatEncrypted = "urn:oasis:names:tc:SAML:2.0:nameid-format:encrypted"
+)
+
+// DefaultTransientNameIDLength is the number of random bytes of transient
+// NameIDs when TransientNameIDLength is not set.
+const DefaultTransientNameIDLength = 20
+
+// newTransientID returns a random transient NameID of n bytes, or
+// DefaultTransientNameIDLength when n is not positive, URL-safe base64
+// encoded.
+func newTransientID(n int) (string, error) {
+	if n <= 0 {
+		n = DefaultTransientNameIDLength
+	}
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// sessionEmail returns the email address of the session: its UserEmail, or
+// its NameID when that is a bare email address.
+func sessionEmail(session *Session) string {
+	if session.UserEmail != "" {
+		return session.UserEmail
+	}
+	if addr, err := mail.ParseAddress(session.NameID); err == nil && addr.Address == session.NameID {
+		return session.NameID
+	}
+	return ""
+}
+
+// PersistentIDStore looks up or mints persistent NameIDs. A persistent NameID
+// must be opaque and stable for a given user and SP, and different for each
+// SP the user logs in to.
+type PersistentIDStore interface {
+	PersistentID(userID, spEntityID string) (string, error)
+}
+
+// PersistentIDLookup is implemented by PersistentIDStores that can tell
+// whether a persistent NameID already exists, which is needed to honor
+// AllowCreate="false" in the SP's NameIDPolicy. Requests that forbid creating
+// an identifier are denied when the store does not implement it.
+type PersistentIDLookup interface {
+	// LookupPersistentID returns the existing persistent NameID of the user
+	// for the SP, or an empty string when there is none. It must not create
+	// one.
+	LookupPersistentID(userID, spEntityID string) (string, error)
+}
+
+// ErrNoPersistentID is returned when the SP asks for a persistent NameID,
+// forbids creating one and the user has none for it yet.
+var ErrNoPersistentID = errors.New(StatusInvalidNameIDPolicy + ": no persistent NameID exists and the SP does not allow creating one")
+
+// ErrNoNameIDEncryptionKey is returned when the SP asks for an encrypted
+// NameID but its metadata has no encryption key.
+var ErrNoNameIDEncryptionKey = errors.New(StatusInvalidNameIDPolicy + ": the SP asks for an encrypted NameID but publishes no encryption key")
+
+// HMACPersistentIDStore is a PersistentIDStore that derives identifiers from
+// an HMAC of the user ID and the SP's entity ID, so no storage is required.
+// Changing the secret changes every identifier.
+type HMACPersistentIDStore struct {
+	Secret []byte
+}
+
+// PersistentID satisfies PersistentIDStore.
+func (s *HMACPersistentIDStore) PersistentID(userID, spEntityID string) (string, error) {
+	if len(s.Secret) == 0 {
+		return "", errors.New("missing HMAC secret")
+	}
+	if userID == "" {
+		return "", errors.New("missing user ID")
+	}
+	mac := hmac.New(sha256.New, s.Secret)
+	mac.Write([]byte(userID))
+	mac.Write([]byte{0})
+	mac.Write([]byte(spEntityID))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// LookupPersistentID satisfies PersistentIDLookup. Derived identifiers always
+// exist, so this is the same as PersistentID.
+func (s *HMACPersistentIDStore) LookupPersistentID(userID, spEntityID string) (string, error) {
+	return s.PersistentID(userID, spEntityID)
+}
+
+var (
+	_ PersistentIDStore  = (*HMACPersistentIDStore)(nil)
+	_ PersistentIDLookup = (*HMACPersistentIDStore)(nil)
+)
@@ -0,0 +1,46 @@
+package saml
+
+import (
+	"time"
+)
+
+// Outcomes reported to Observer.ObserveSSO.
+const (
+	SSOOutcomeSuccess         = "success"
+	SSOOutcomeInvalidRequest  = "invalid_request"
+	SSOOutcomeDenied          = "denied"
+	SSOOutcomeStaleRequest    = "stale_request"
+	SSOOutcomeRateLimited     = "rate_limited"
+	SSOOutcomeTimeout         = "timeout"
+	SSOOutcomeUnauthenticated = "unauthenticated"
+	SSOOutcomeError           = "error"
+)
+
+// Observer receives metrics about the SSO flows served by an IdP, so they can
+// be exported to Prometheus, OpenTelemetry or similar without this package
+// depending on them. Implementations must be safe for concurrent use.
+type Observer interface {
+	// ObserveSSO is called once at the end of every request handled by
+	// ServeSSO, with one of the SSOOutcome* values and the time it took.
+	ObserveSSO(outcome string, d time.Duration)
+
+	// ObserveAssertion is called with the time it took to build, sign and
+	// encrypt an assertion and to write the response holding it.
+	ObserveAssertion(d time.Duration)
+}
+
+// NopObserver is an Observer that discards everything.
+type NopObserver struct{}
+
+// ObserveSSO implements Observer.
+func (NopObserver) ObserveSSO(outcome string, d time.Duration) {}
+
+// ObserveAssertion implements Observer.
+func (NopObserver) ObserveAssertion(d time.Duration) {}
+
+func (idp *IdentityProvider) observer() Observer {
+	if idp.Observer != nil {
+		return idp.Observer
+	}
+	return NopObserver{}
+}
@@ -0,0 +1,110 @@
+package saml
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RateLimiter decides whether a request identified by key may proceed. Keys
+// are prefixed with their kind, such as "ip:" for client addresses and "sp:"
+// for SP entity IDs. Implementations must be safe for concurrent use.
+type RateLimiter interface {
+	Allow(key string) bool
+}
+
+// TokenBucketLimiter is a RateLimiter giving every key a bucket of Burst
+// tokens, refilled at Rate tokens per second. Each request takes a token and
+// is denied when the bucket is empty.
+type TokenBucketLimiter struct {
+	Rate  float64
+	Burst int
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	pruned  time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucketLimiter creates a TokenBucketLimiter that allows rate requests
+// per second per key, with bursts of up to burst requests.
+func NewTokenBucketLimiter(rate float64, burst int) *TokenBucketLimiter {
+	return &TokenBucketLimiter{
+		Rate:  rate,
+		Burst: burst,
+	}
+}
+
+// Allow implements RateLimiter.
+func (l *TokenBucketLimiter) Allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := Now()
+	if l.buckets == nil {
+		l.buckets = map[string]*tokenBucket{}
+	}
+	l.prune(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(l.Burst), last: now}
+		l.buckets[key] = b
+	}
+	l.refill(b, now)
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (l *TokenBucketLimiter) refill(b *tokenBucket, now time.Time) {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * l.Rate
+		if b.tokens > float64(l.Burst) {
+			b.tokens = float64(l.Burst)
+		}
+	}
+	b.last = now
+}
+
+// prune forgets buckets that are full again, as they are equivalent to new
+// ones, so the map does not grow with every client ever seen.
+func (l *TokenBucketLimiter) prune(now time.Time) {
+	if now.Sub(l.pruned) < time.Minute {
+		return
+	}
+	l.pruned = now
+	for key, b := range l.buckets {
+		l.refill(b, now)
+		if b.tokens >= float64(l.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// clientIP returns the IP address of the client that sent r. Forwarding
+// headers are not trusted, put a proxy aware middleware in front of the
+// handler to rewrite RemoteAddr if needed.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// allowRequest consults the IdP's RateLimiter, if any.
+func (idp *IdentityProvider) allowRequest(key string) bool {
+	if idp.RateLimiter == nil {
+		return true
+	}
+	return idp.RateLimiter.Allow(key)
+}
@@ -0,0 +1,121 @@
+package saml
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ErrUnknownIdP is returned by an IdPResolver when no IdP matches a request.
+var ErrUnknownIdP = errors.New("unknown identity provider")
+
+// IdPResolver returns the IdentityProvider that should handle a request.
+type IdPResolver func(r *http.Request) (*IdentityProvider, error)
+
+// Registry serves many logical IdPs, each with its own EntityID, keypair and
+// SPs, from a single HTTP server. Every request is dispatched to the IdP
+// returned by Resolve.
+type Registry struct {
+	Resolve IdPResolver
+	AuthFn  Authenticator
+}
+
+// NewRegistry creates a Registry that dispatches requests using the given
+// resolver and authenticates users with authFn.
+func NewRegistry(resolve IdPResolver, authFn Authenticator) *Registry {
+	return &Registry{
+		Resolve: resolve,
+		AuthFn:  authFn,
+	}
+}
+
+// HostResolver returns an IdPResolver that selects an IdP by the request's
+// host name, ignoring the port.
+func HostResolver(idps map[string]*IdentityProvider) IdPResolver {
+	return func(r *http.Request) (*IdentityProvider, error) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if idp, ok := idps[strings.ToLower(host)]; ok {
+			return idp, nil
+		}
+		return nil, errors.Wrapf(ErrUnknownIdP, "host %q", host)
+	}
+}
+
+// PathResolver returns an IdPResolver that selects an IdP by the first
+// segment of the request's path after prefix, e.g. "acme" in
+// "/saml/acme/sso" for a "/saml" prefix.
+func PathResolver(prefix string, idps map[string]*IdentityProvider) IdPResolver {
+	prefix = strings.TrimSuffix(prefix, "/") + "/"
+	return func(r *http.Request) (*IdentityProvider, error) {
+		if !strings.HasPrefix(r.URL.Path, prefix) {
+			return nil, errors.Wrapf(ErrUnknownIdP, "path %q", r.URL.Path)
+		}
+		tenant := strings.SplitN(strings.TrimPrefix(r.URL.Path, prefix), "/", 2)[0]
+		if idp, ok := idps[tenant]; ok {
+			return idp, nil
+		}
+		return nil, errors.Wrapf(ErrUnknownIdP, "tenant %q", tenant)
+	}
+}
+
+// resolve returns the IdP for the request, writing an error response when
+// there is none.
+func (reg *Registry) resolve(w http.ResponseWriter, r *http.Request) (*IdentityProvider, bool) {
+	idp, err := reg.Resolve(r)
+	if err != nil {
+		Logf("Failed to resolve IdP: %v", err)
+		if errors.Cause(err) == ErrUnknownIdP {
+			http.NotFound(w, r)
+		} else {
+			writeErr(w, r, err)
+		}
+		return nil, false
+	}
+	return idp, true
+}
+
+// MetadataHandler serves the metadata of the IdP that matches the request.
+func (reg *Registry) MetadataHandler(w http.ResponseWriter, r *http.Request) {
+	if idp, ok := reg.resolve(w, r); ok {
+		idp.MetadataHandler(w, r)
+	}
+}
+
+// ServeSSO handles an authentication request with the IdP that matches the
+// request.
+func (reg *Registry) ServeSSO(w http.ResponseWriter, r *http.Request) {
+	if idp, ok := reg.resolve(w, r); ok {
+		idp.ServeSSO(reg.AuthFn)(w, r)
+	}
+}
+
+// HealthzHandler reports the health of the IdP that matches the request.
+func (reg *Registry) HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	if idp, ok := reg.resolve(w, r); ok {
+		idp.HealthzHandler(w, r)
+	}
+}
+
+// Handler returns an http.Handler that serves the metadata, SSO and health
+// check endpoints for every IdP, dispatching each request through Resolve.
+// It matches any path ending with MetadataPath, SSOPath or HealthzPath, so it
+// works with both HostResolver and PathResolver.
+func (reg *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, MetadataPath):
+			reg.MetadataHandler(w, r)
+		case strings.HasSuffix(r.URL.Path, SSOPath):
+			reg.ServeSSO(w, r)
+		case strings.HasSuffix(r.URL.Path, HealthzPath):
+			reg.HealthzHandler(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
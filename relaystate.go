@@ -0,0 +1,163 @@
+package saml
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// MaxRelayStateLength is the largest RelayState, in bytes, allowed by the
+// SAML bindings specification. Some IdPs and SPs reject longer values.
+const MaxRelayStateLength = 80
+
+// ErrRelayStateTooLong is returned when a RelayState is longer than
+// MaxRelayStateLength and there is no RelayStateStore to keep it in.
+var ErrRelayStateTooLong = errors.Errorf("RelayState must not be longer than %d bytes", MaxRelayStateLength)
+
+// RelayStateStore keeps RelayState values too long to be sent as is, so a
+// short opaque token can be sent instead. Implementations must be safe for
+// concurrent use.
+type RelayStateStore interface {
+	// Put stores state and returns the token that identifies it.
+	Put(state string) (string, error)
+	// Take returns the state identified by token and forgets it. ok is false
+	// for unknown or expired tokens.
+	Take(token string) (state string, ok bool)
+}
+
+// MemoryRelayStateStore is a RelayStateStore that keeps states in memory for
+// TTL. It only works when every request of a login flow reaches the same
+// process.
+type MemoryRelayStateStore struct {
+	TTL time.Duration
+
+	mu     sync.Mutex
+	states map[string]storedRelayState
+}
+
+type storedRelayState struct {
+	state   string
+	expires time.Time
+}
+
+// NewMemoryRelayStateStore creates a MemoryRelayStateStore that keeps states
+// for ttl.
+func NewMemoryRelayStateStore(ttl time.Duration) *MemoryRelayStateStore {
+	return &MemoryRelayStateStore{
+		TTL: ttl,
+	}
+}
+
+// Put implements RelayStateStore.
+func (s *MemoryRelayStateStore) Put(state string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := Now()
+	if s.states == nil {
+		s.states = map[string]storedRelayState{}
+	}
+	for token, stored := range s.states {
+		if now.After(stored.expires) {
+			delete(s.states, token)
+		}
+	}
+
+	token := NewID()
+	s.states[token] = storedRelayState{state: state, expires: now.Add(s.TTL)}
+	return token, nil
+}
+
+// Take implements RelayStateStore.
+func (s *MemoryRelayStateStore) Take(token string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.states[token]
+	if !ok {
+		return "", false
+	}
+	delete(s.states, token)
+	if Now().After(stored.expires) {
+		return "", false
+	}
+	return stored.state, true
+}
+
+// outboundRelayState returns the RelayState to send for state: state itself
+// when it is short enough, or a token from store otherwise.
+func outboundRelayState(state string, store RelayStateStore) (string, error) {
+	if len(state) <= MaxRelayStateLength {
+		return state, nil
+	}
+	if store == nil {
+		return "", ErrRelayStateTooLong
+	}
+	token, err := store.Put(state)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to store RelayState")
+	}
+	if len(token) > MaxRelayStateLength {
+		return "", ErrRelayStateTooLong
+	}
+	return token, nil
+}
+
+// relayStateMACLength is the length, in bytes, of the truncated HMAC-SHA256
+// of the tokens made by EncodeRelayState.
+const relayStateMACLength = 16
+
+// MaxSignedRelayStateData is the largest data EncodeRelayState can turn into
+// a token that fits in MaxRelayStateLength.
+const MaxSignedRelayStateData = MaxRelayStateLength*3/4 - relayStateMACLength
+
+// ErrInvalidRelayState is returned by DecodeRelayState for tokens that were
+// not made by EncodeRelayState with the same key, or were altered since.
+var ErrInvalidRelayState = errors.New("invalid RelayState token")
+
+// EncodeRelayState returns a RelayState token carrying data, signed with key
+// so that DecodeRelayState detects any change made to it on the way through
+// the IdP and the browser. The key should be at least 32 random bytes and
+// kept secret by the application.
+//
+// The token is the URL-safe base64 encoding of data followed by a 128 bit
+// HMAC-SHA256 of it: data is readable by anyone, only its integrity is
+// protected, and the same data always gives the same token, which can be
+// replayed. The token fits in MaxRelayStateLength for up to
+// MaxSignedRelayStateData bytes of data, such as a short path to deep-link
+// to. Longer tokens are fine for IdPs that accept them, otherwise keep the
+// data in a RelayStateStore and sign nothing.
+func EncodeRelayState(data []byte, key []byte) string {
+	buf := make([]byte, 0, len(data)+relayStateMACLength)
+	buf = append(buf, data...)
+	buf = append(buf, relayStateMAC(data, key)...)
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// DecodeRelayState returns the data of a token made by EncodeRelayState with
+// key, or ErrInvalidRelayState when the token was altered.
+func DecodeRelayState(token string, key []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, errors.New("missing RelayState key")
+	}
+	buf, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(buf) < relayStateMACLength {
+		return nil, ErrInvalidRelayState
+	}
+	data, mac := buf[:len(buf)-relayStateMACLength], buf[len(buf)-relayStateMACLength:]
+	if !hmac.Equal(mac, relayStateMAC(data, key)) {
+		return nil, ErrInvalidRelayState
+	}
+	return data, nil
+}
+
+// relayStateMAC returns the truncated HMAC-SHA256 of data with key.
+func relayStateMAC(data []byte, key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)[:relayStateMACLength]
+}
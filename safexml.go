@@ -0,0 +1,132 @@
+package saml
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// MaxMessageSize is the largest inbound SAML message, in bytes, that will be
+// parsed, after decoding and inflating. Zero disables the limit.
+var MaxMessageSize int64 = 1 << 20
+
+// MaxXMLDepth is the deepest element nesting accepted in inbound XML. SAML
+// messages and metadata are far shallower, deeper documents are only useful
+// to exhaust the parser. Zero disables the limit.
+var MaxXMLDepth = 64
+
+// ErrMessageTooLarge is returned when an inbound message is larger than
+// MaxMessageSize.
+var ErrMessageTooLarge = errors.New("message is too large")
+
+// ErrXMLTooDeep is returned when an inbound document nests elements deeper
+// than MaxXMLDepth.
+var ErrXMLTooDeep = errors.New("XML document is nested too deeply")
+
+// ErrDTDNotAllowed is returned when an inbound document has a DOCTYPE or any
+// other directive. SAML forbids them, and they carry the entity definitions
+// used by XXE and entity expansion attacks.
+var ErrDTDNotAllowed = errors.New("XML document must not contain a DTD")
+
+// unmarshalMessage parses an inbound SAML message into v, like unmarshalXML,
+// after checking it is no larger than MaxMessageSize.
+func unmarshalMessage(buf []byte, v interface{}) error {
+	if MaxMessageSize > 0 && int64(len(buf)) > MaxMessageSize {
+		return ErrMessageTooLarge
+	}
+	return unmarshalXML(buf, v)
+}
+
+// unmarshalXML parses untrusted XML into v. Documents holding a DTD or nested
+// deeper than MaxXMLDepth are rejected before unmarshalling, and entities
+// other than the predefined ones are never expanded.
+func unmarshalXML(buf []byte, v interface{}) error {
+	buf = stripBOM(buf)
+	if err := checkXML(buf); err != nil {
+		return err
+	}
+	return newXMLDecoder(bytes.NewReader(buf)).Decode(v)
+}
+
+// checkXML walks the tokens of a document looking for directives and
+// excessive nesting.
+func checkXML(buf []byte) error {
+	decoder := newXMLDecoder(bytes.NewReader(buf))
+	depth := 0
+	for {
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch token.(type) {
+		case xml.Directive:
+			return ErrDTDNotAllowed
+		case xml.StartElement:
+			depth++
+			if MaxXMLDepth > 0 && depth > MaxXMLDepth {
+				return ErrXMLTooDeep
+			}
+		case xml.EndElement:
+			depth--
+		}
+	}
+}
+
+// utf8BOM is the byte order mark some servers, such as ADFS, put before
+// their UTF-8 documents.
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// stripBOM removes a leading UTF-8 byte order mark.
+func stripBOM(buf []byte) []byte {
+	return bytes.TrimPrefix(buf, utf8BOM)
+}
+
+// skipBOM is stripBOM for streams.
+func skipBOM(r io.Reader) io.Reader {
+	br := bufio.NewReader(r)
+	if prefix, err := br.Peek(len(utf8BOM)); err == nil && bytes.Equal(prefix, utf8BOM) {
+		br.Discard(len(utf8BOM))
+	}
+	return br
+}
+
+// newXMLDecoder returns a decoder for inbound XML, which understands the
+// encodings declared by the documents SAML partners actually send.
+func newXMLDecoder(r io.Reader) *xml.Decoder {
+	decoder := xml.NewDecoder(r)
+	decoder.CharsetReader = charsetReader
+	return decoder
+}
+
+// charsetReader is the CharsetReader of newXMLDecoder, called for documents
+// declaring an encoding other than UTF-8. Only encodings whose documents are
+// read as is are accepted, so that offsets in the decoded document are
+// offsets in the original bytes.
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	switch strings.ToLower(charset) {
+	case "utf-16", "utf-16le", "utf-16be", "ucs-2", "unicode":
+		// The declaration was read as ASCII, so the document is not UTF-16:
+		// some ADFS servers label their UTF-8 documents UTF-16.
+		return input, nil
+	case "us-ascii", "ascii":
+		return input, nil
+	}
+	return nil, errors.Errorf("unsupported XML encoding %q", charset)
+}
+
+// limitMessageReader wraps r so reads fail with ErrMessageTooLarge after
+// MaxMessageSize bytes.
+func limitMessageReader(r io.Reader) io.Reader {
+	if MaxMessageSize <= 0 {
+		return r
+	}
+	return &maxSizeReader{r: r, n: MaxMessageSize, err: ErrMessageTooLarge}
+}
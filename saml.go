@@ -2,13 +2,17 @@ package saml
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/xml"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"time"
 
 	"github.com/goware/saml/xmlsec"
+	"github.com/pkg/errors"
 	"github.com/satori/go.uuid"
 )
 
@@ -22,6 +26,14 @@ const IssueLifetime = time.Second * 90
 // tolerance to assertion's NotBefore and NotOnOrAfter
 var ClockDriftTolerance = time.Duration(0)
 
+// DebugSignatures logs, through Logf, the canonical octets and digests of
+// every signature the IdP makes and every signature that fails verification,
+// on requests as well as responses, with the subject and fingerprint of the
+// certificate it was checked against, to help diff them against xmlsec1 or
+// OpenSSL output. They may hold personal data, don't enable this in
+// production.
+var DebugSignatures = false
+
 // Now is a function that returns the current time. This vale can be
 // overwritten during tests.
 var Now = time.Now
@@ -32,22 +44,73 @@ var NewID = func() string {
 	return fmt.Sprintf("id-%x", uuid.NewV4())
 }
 
+// MaxMetadataSize is the largest metadata document, in bytes, that will be
+// read from a remote server. Zero disables the limit.
+var MaxMetadataSize int64 = 10 << 20
+
+// MaxAggregateSize is the largest metadata aggregate, in bytes, that
+// ExtractEntityDescriptor and GetEntityFromAggregate will read. Federation
+// aggregates are much larger than a single entity's metadata, but are
+// stream-parsed, so the limit only bounds how long they are read for. Zero
+// disables the limit.
+var MaxAggregateSize int64 = 1 << 30
+
+// ErrMetadataTooLarge is returned when a metadata document is larger than
+// MaxMetadataSize, or an aggregate larger than MaxAggregateSize.
+var ErrMetadataTooLarge = errors.New("metadata document is too large")
+
+// ErrUnsupportedVersion is the cause of the errors returned for inbound
+// requests, responses and assertions whose Version is not "2.0".
+var ErrUnsupportedVersion = errors.New(StatusVersionMismatch + ": unsupported SAML version")
+
+// checkVersion returns an error wrapping ErrUnsupportedVersion unless version,
+// the Version of the named message or assertion, is "2.0".
+func checkVersion(what, version string) error {
+	if version == "2.0" {
+		return nil
+	}
+	return errors.Wrapf(ErrUnsupportedVersion, "%s Version %q", what, version)
+}
+
 // GetMetadata takes the URL of a metadata.xml file, downloads and parses it.
 // Returns a *Metadata value.
 func GetMetadata(metadataURL string) (*Metadata, error) {
-	res, err := http.Get(metadataURL)
+	return GetMetadataWithClient(nil, metadataURL)
+}
+
+// GetMetadataWithClient is GetMetadata using the given client, or
+// http.DefaultClient when nil. See NewMetadataHTTPClient.
+func GetMetadataWithClient(client *http.Client, metadataURL string) (*Metadata, error) {
+	return GetMetadataWithContext(context.Background(), client, metadataURL)
+}
+
+// GetMetadataWithContext is GetMetadataWithClient, giving up when ctx is
+// done.
+func GetMetadataWithContext(ctx context.Context, client *http.Client, metadataURL string) (*Metadata, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequest("GET", metadataURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := client.Do(req.WithContext(ctx))
 	if err != nil {
 		return nil, err
 	}
 	defer res.Body.Close()
 
-	buf, err := ioutil.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("failed to fetch metadata from %v: %v", metadataURL, res.Status)
+	}
+
+	buf, err := ioutil.ReadAll(limitMetadataReader(res.Body, MaxMetadataSize))
 	if err != nil {
 		return nil, err
 	}
 
 	var metadata Metadata
-	err = xml.Unmarshal(buf, &metadata)
+	err = unmarshalXML(buf, &metadata)
 	if err != nil {
 		return nil, err
 	}
@@ -55,6 +118,155 @@ func GetMetadata(metadataURL string) (*Metadata, error) {
 	return &metadata, nil
 }
 
+// NewMetadataHTTPClient returns a client for fetching metadata from servers
+// whose TLS certificate is issued by a private CA, or is self-signed. Only
+// certificates chaining to roots are trusted, the system roots are not. A
+// self-signed certificate is pinned by adding it, as the only certificate, to
+// roots. Host names are still verified.
+//
+// Set it as the MetadataHTTPClient of an IdentityProvider or ServiceProvider,
+// or pass it to GetMetadataWithClient, rather than disabling verification or
+// changing http.DefaultClient, so no other request trusts these roots.
+func NewMetadataHTTPClient(roots *x509.CertPool) *http.Client {
+	return &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			TLSHandshakeTimeout: 10 * time.Second,
+			TLSClientConfig: &tls.Config{
+				RootCAs:    roots,
+				MinVersion: tls.VersionTLS12,
+			},
+		},
+	}
+}
+
+// GetEntityFromAggregate downloads a federation metadata aggregate, such as
+// the ones published by InCommon or eduGAIN, and returns the EntityDescriptor
+// with the given entity ID. An error is returned if there is no such entity.
+//
+// WARNING: the aggregate's signature is NOT verified. Federations sign their
+// aggregates because the certificates and endpoints in them are what SSO trust
+// is built on, and anyone able to tamper with the download, or to serve it,
+// can otherwise substitute their own keys. Unless the aggregate URL is itself
+// trusted, download the aggregate, verify its signature against the
+// federation's signing certificate, and pass the verified document to
+// ExtractEntityDescriptor instead.
+func GetEntityFromAggregate(aggregateURL string, entityID string) (*Metadata, error) {
+	return GetEntityFromAggregateWithClient(nil, aggregateURL, entityID)
+}
+
+// GetEntityFromAggregateWithClient is GetEntityFromAggregate using the given
+// client, or http.DefaultClient when nil. See NewMetadataHTTPClient. The
+// aggregate's signature is not verified either.
+func GetEntityFromAggregateWithClient(client *http.Client, aggregateURL string, entityID string) (*Metadata, error) {
+	return GetEntityFromAggregateWithContext(context.Background(), client, aggregateURL, entityID)
+}
+
+// GetEntityFromAggregateWithContext is GetEntityFromAggregateWithClient,
+// giving up when ctx is done.
+func GetEntityFromAggregateWithContext(ctx context.Context, client *http.Client, aggregateURL string, entityID string) (*Metadata, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequest("GET", aggregateURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("failed to get metadata aggregate: %s", res.Status)
+	}
+
+	return ExtractEntityDescriptor(res.Body, entityID)
+}
+
+// ExtractEntityDescriptor stream-parses a metadata document, which is usually
+// an EntitiesDescriptor aggregate, and returns the EntityDescriptor with the
+// given entity ID. Other entities are skipped without being unmarshalled, so
+// memory usage does not grow with the size of the aggregate. Reading fails with
+// ErrMetadataTooLarge after MaxAggregateSize bytes.
+func ExtractEntityDescriptor(r io.Reader, entityID string) (*Metadata, error) {
+	decoder := newXMLDecoder(skipBOM(limitMetadataReader(r, MaxAggregateSize)))
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return nil, errors.Errorf("entity %q not found in metadata", entityID)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if _, ok := token.(xml.Directive); ok {
+			return nil, ErrDTDNotAllowed
+		}
+
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Space != metadataNamespace || start.Name.Local != "EntityDescriptor" {
+			continue
+		}
+
+		if !hasAttr(start, "entityID", entityID) {
+			if err := decoder.Skip(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		var metadata Metadata
+		if err := decoder.DecodeElement(&metadata, &start); err != nil {
+			return nil, err
+		}
+		return &metadata, nil
+	}
+}
+
+func hasAttr(start xml.StartElement, name string, value string) bool {
+	for _, attr := range start.Attr {
+		if attr.Name.Local == name {
+			return attr.Value == value
+		}
+	}
+	return false
+}
+
+// limitMetadataReader wraps r so reads fail with ErrMetadataTooLarge after
+// limit bytes. A limit of zero or less disables it.
+func limitMetadataReader(r io.Reader, limit int64) io.Reader {
+	if limit <= 0 {
+		return r
+	}
+	return &maxSizeReader{r: r, n: limit, err: ErrMetadataTooLarge}
+}
+
+type maxSizeReader struct {
+	r   io.Reader
+	n   int64
+	err error
+}
+
+func (m *maxSizeReader) Read(p []byte) (int, error) {
+	if m.n < 0 {
+		return 0, m.err
+	}
+	// Allow reading one byte past the limit, so a document of exactly
+	// limit is accepted.
+	if int64(len(p)) > m.n+1 {
+		p = p[:m.n+1]
+	}
+	n, err := m.r.Read(p)
+	m.n -= int64(n)
+	if m.n < 0 {
+		return n, m.err
+	}
+	return n, err
+}
+
 // SecurityOpts allows to bypass some security checks.
 type SecurityOpts struct {
 	AllowSelfSignedCert   bool
@@ -80,3 +292,16 @@ func IsSecurityException(err error, opts *SecurityOpts) bool {
 func GetAssertionFromCtx(ctx context.Context) *Assertion {
 	return ctx.Value("saml.assertion").(*Assertion)
 }
+
+// GetAuthnRequestFromCtx returns the authentication request being served by
+// ServeSSO. It is available to the Authenticator.
+func GetAuthnRequestFromCtx(ctx context.Context) *AuthnRequest {
+	req, _ := ctx.Value("saml.AuthnRequest").(*AuthnRequest)
+	return req
+}
+
+// GetResponseFromCtx returns the Response validated by AssertionMiddleware,
+// which gives access to elements outside of the assertion, like Extensions.
+func GetResponseFromCtx(ctx context.Context) *Response {
+	return ctx.Value("saml.response").(*Response)
+}
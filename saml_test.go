@@ -1,7 +1,20 @@
 package saml
 
 import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
 	"time"
+
+	"github.com/goware/saml/xmlsec"
+	"github.com/stretchr/testify/assert"
 )
 
 func tearUp() {
@@ -15,3 +28,591 @@ func tearUp() {
 		return "id-MOCKID"
 	}
 }
+
+const testAggregateMetadata = `<?xml version="1.0" encoding="UTF-8"?>
+<EntitiesDescriptor xmlns="urn:oasis:names:tc:SAML:2.0:metadata" Name="urn:example:federation">
+	<EntityDescriptor entityID="https://sp-a.example.org/metadata">
+		<SPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol">
+			<AssertionConsumerService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST" Location="https://sp-a.example.org/acs" index="1"></AssertionConsumerService>
+		</SPSSODescriptor>
+	</EntityDescriptor>
+	<EntitiesDescriptor Name="urn:example:federation:nested">
+		<EntityDescriptor entityID="https://sp-b.example.org/metadata">
+			<SPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol">
+				<AssertionConsumerService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST" Location="https://sp-b.example.org/acs" index="1"></AssertionConsumerService>
+			</SPSSODescriptor>
+		</EntityDescriptor>
+	</EntitiesDescriptor>
+</EntitiesDescriptor>`
+
+func TestExtractEntityDescriptor(t *testing.T) {
+	metadata, err := ExtractEntityDescriptor(strings.NewReader(testAggregateMetadata), "https://sp-b.example.org/metadata")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://sp-b.example.org/metadata", metadata.EntityID)
+	assert.Equal(t, "https://sp-b.example.org/acs", metadata.SPSSODescriptor.AssertionConsumerService[0].Location)
+
+	_, err = ExtractEntityDescriptor(strings.NewReader(testAggregateMetadata), "https://sp-c.example.org/metadata")
+	assert.Error(t, err)
+}
+
+const testRoleDescriptorMetadata = `<?xml version="1.0" encoding="UTF-8"?>
+<EntityDescriptor xmlns="urn:oasis:names:tc:SAML:2.0:metadata" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" xmlns:fed="http://docs.oasis-open.org/wsfed/federation/200706" entityID="https://partner.example.com/sp">
+	<RoleDescriptor xsi:type="fed:ApplicationServiceType" protocolSupportEnumeration="http://docs.oasis-open.org/wsfed/federation/200706">
+		<fed:PassiveRequestorEndpoint>https://partner.example.com/wsfed</fed:PassiveRequestorEndpoint>
+	</RoleDescriptor>
+	<RoleDescriptor xsi:type="fed:ApplicationServiceType" protocolSupportEnumeration="urn:oasis:names:tc:SAML:1.1:protocol urn:oasis:names:tc:SAML:2.0:protocol">
+		<KeyDescriptor use="signing">
+			<KeyInfo xmlns="http://www.w3.org/2000/09/xmldsig#">
+				<X509Data><X509Certificate>MIIBxzCCATCgAwIBAgIJAJ</X509Certificate></X509Data>
+			</KeyInfo>
+		</KeyDescriptor>
+		<SingleLogoutService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect" Location="https://partner.example.com/saml/slo"></SingleLogoutService>
+		<NameIDFormat>urn:oasis:names:tc:SAML:2.0:nameid-format:persistent</NameIDFormat>
+		<AssertionConsumerService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST" Location="https://partner.example.com/saml/acs" index="0"></AssertionConsumerService>
+	</RoleDescriptor>
+</EntityDescriptor>`
+
+func TestRoleDescriptorMetadata(t *testing.T) {
+	var metadata Metadata
+	assert.NoError(t, unmarshalXML([]byte(testRoleDescriptorMetadata), &metadata))
+	if assert.Len(t, metadata.RoleDescriptors, 2) {
+		assert.Equal(t, "fed:ApplicationServiceType", metadata.RoleDescriptors[0].Type)
+		assert.False(t, metadata.RoleDescriptors[0].SupportsSAML2())
+		assert.True(t, metadata.RoleDescriptors[1].SupportsSAML2())
+	}
+
+	// The SAML 2.0 role stands in for the missing SPSSODescriptor.
+	descriptor := metadata.SPSSODescriptor
+	if assert.NotNil(t, descriptor) {
+		assert.Equal(t, "https://partner.example.com/saml/acs", descriptor.AssertionConsumerService[0].Location)
+		assert.Equal(t, "https://partner.example.com/saml/slo", descriptor.SingleLogoutService[0].Location)
+		assert.Equal(t, []string{NameIDFormatPersistent}, descriptor.NameIDFormat)
+		if assert.Len(t, descriptor.KeyDescriptor, 1) {
+			assert.Equal(t, "signing", descriptor.KeyDescriptor[0].Use)
+			assert.Equal(t, "MIIBxzCCATCgAwIBAgIJAJ", descriptor.KeyDescriptor[0].KeyInfo.Certificate)
+		}
+	}
+
+	extracted, err := ExtractEntityDescriptor(strings.NewReader(testRoleDescriptorMetadata), "https://partner.example.com/sp")
+	assert.NoError(t, err)
+	assert.Equal(t, descriptor, extracted.SPSSODescriptor)
+
+	// Roles without SAML 2.0 support are not used.
+	metadata = Metadata{}
+	assert.NoError(t, unmarshalXML([]byte(strings.Replace(testRoleDescriptorMetadata, " urn:oasis:names:tc:SAML:2.0:protocol", "", 1)), &metadata))
+	assert.Nil(t, metadata.SPSSODescriptor)
+
+	// A real SPSSODescriptor is preferred.
+	metadata = Metadata{}
+	withSPSSO := strings.Replace(testRoleDescriptorMetadata, "</EntityDescriptor>", `<SPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol">`+
+		`<AssertionConsumerService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST" Location="https://partner.example.com/acs" index="1"></AssertionConsumerService>`+
+		`</SPSSODescriptor></EntityDescriptor>`, 1)
+	assert.NoError(t, unmarshalXML([]byte(withSPSSO), &metadata))
+	assert.Equal(t, "https://partner.example.com/acs", metadata.SPSSODescriptor.AssertionConsumerService[0].Location)
+}
+
+func TestMaxMetadataSize(t *testing.T) {
+	defer func(size int64) { MaxMetadataSize = size }(MaxMetadataSize)
+	defer func(size int64) { MaxAggregateSize = size }(MaxAggregateSize)
+
+	MaxAggregateSize = int64(len(testAggregateMetadata))
+	_, err := ExtractEntityDescriptor(strings.NewReader(testAggregateMetadata), "https://sp-b.example.org/metadata")
+	assert.NoError(t, err)
+
+	MaxAggregateSize = 512
+	_, err = ExtractEntityDescriptor(strings.NewReader(testAggregateMetadata), "https://sp-b.example.org/metadata")
+	assert.Equal(t, ErrMetadataTooLarge, err)
+
+	MaxMetadataSize = 512
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testAggregateMetadata))
+	}))
+	defer server.Close()
+
+	_, err = GetMetadata(server.URL)
+	assert.Equal(t, ErrMetadataTooLarge, err)
+
+	sp := ServiceProvider{IdPMetadataURL: server.URL}
+	_, err = sp.GetIdPMetadata()
+	assert.Equal(t, ErrMetadataTooLarge, err)
+}
+
+func TestGetMetadataStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, testRoleDescriptorMetadata, http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	_, err := GetMetadata(server.URL)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "404 Not Found")
+	}
+
+	sp := ServiceProvider{IdPMetadataURL: server.URL}
+	_, err = sp.GetIdPMetadata()
+	assert.Error(t, err)
+	assert.Nil(t, sp.IdPMetadata)
+}
+
+func TestMetadataHTTPClient(t *testing.T) {
+	tearUp()
+
+	spMetadata, err := testSP.Metadata()
+	assert.NoError(t, err)
+	out, err := xml.Marshal(spMetadata)
+	assert.NoError(t, err)
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(out)
+	}))
+	defer server.Close()
+
+	// The server's certificate is not trusted by default.
+	_, err = GetMetadata(server.URL)
+	assert.Error(t, err)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+	client := NewMetadataHTTPClient(roots)
+
+	metadata, err := GetMetadataWithClient(client, server.URL)
+	if assert.NoError(t, err) {
+		assert.Equal(t, testSP.MetadataURL, metadata.EntityID)
+	}
+
+	idp := *testIdP
+	idp.SPMetadata = nil
+	idp.SPMetadataURL = server.URL
+	idp.MetadataHTTPClient = client
+	metadata, err = idp.GetSPMetadata()
+	if assert.NoError(t, err) {
+		assert.Equal(t, testSP.MetadataURL, metadata.EntityID)
+	}
+
+	sp := ServiceProvider{IdPMetadataURL: server.URL, MetadataHTTPClient: client}
+	metadata, err = sp.GetIdPMetadata()
+	if assert.NoError(t, err) {
+		assert.Equal(t, testSP.MetadataURL, metadata.EntityID)
+	}
+
+	// The client trusts nothing but the given roots.
+	_, err = GetMetadataWithClient(NewMetadataHTTPClient(x509.NewCertPool()), server.URL)
+	assert.Error(t, err)
+
+	// Other clients are unaffected.
+	_, err = GetMetadata(server.URL)
+	assert.Error(t, err)
+}
+
+func TestExtractEntityDescriptorLargeAggregate(t *testing.T) {
+	// Pad the aggregate with other entities until it is larger than
+	// MaxMetadataSize, which only applies to single metadata documents.
+	entity := `<EntityDescriptor entityID="https://sp-x.example.org/metadata"><SPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol"></SPSSODescriptor></EntityDescriptor>`
+	padding := strings.Repeat(entity, int(MaxMetadataSize)/len(entity)+1)
+	aggregate := strings.Replace(testAggregateMetadata, `Name="urn:example:federation">`, `Name="urn:example:federation">`+padding, 1)
+	assert.True(t, int64(len(aggregate)) > MaxMetadataSize)
+
+	metadata, err := ExtractEntityDescriptor(strings.NewReader(aggregate), "https://sp-b.example.org/metadata")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "https://sp-b.example.org/acs", metadata.SPSSODescriptor.AssertionConsumerService[0].Location)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(aggregate))
+	}))
+	defer server.Close()
+
+	metadata, err = GetEntityFromAggregate(server.URL, "https://sp-b.example.org/metadata")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "https://sp-b.example.org/metadata", metadata.EntityID)
+	}
+}
+
+func TestGetEntityFromAggregate(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testAggregateMetadata))
+	}))
+	defer server.Close()
+
+	metadata, err := GetEntityFromAggregate(server.URL, "https://sp-a.example.org/metadata")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://sp-a.example.org/metadata", metadata.EntityID)
+	assert.Equal(t, "https://sp-a.example.org/acs", metadata.SPSSODescriptor.AssertionConsumerService[0].Location)
+
+	metadata, err = GetEntityFromAggregate(server.URL, "https://sp-b.example.org/metadata")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://sp-b.example.org/metadata", metadata.EntityID)
+
+	_, err = GetEntityFromAggregate(server.URL, "https://sp-c.example.org/metadata")
+	assert.Error(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = GetEntityFromAggregateWithContext(ctx, nil, server.URL, "https://sp-a.example.org/metadata")
+	assert.Error(t, err)
+
+	tlsServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testAggregateMetadata))
+	}))
+	defer tlsServer.Close()
+
+	_, err = GetEntityFromAggregate(tlsServer.URL, "https://sp-a.example.org/metadata")
+	assert.Error(t, err)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(tlsServer.Certificate())
+	metadata, err = GetEntityFromAggregateWithClient(NewMetadataHTTPClient(roots), tlsServer.URL, "https://sp-a.example.org/metadata")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "https://sp-a.example.org/metadata", metadata.EntityID)
+	}
+}
+
+const (
+	testXXEMessage = `<?xml version="1.0"?>
+<!DOCTYPE AuthnRequest [<!ENTITY xxe SYSTEM "file:///etc/passwd">]>
+<AuthnRequest xmlns="urn:oasis:names:tc:SAML:2.0:protocol" ID="id-1" Version="2.0">
+	<Issuer xmlns="urn:oasis:names:tc:SAML:2.0:assertion">&xxe;</Issuer>
+</AuthnRequest>`
+
+	testBillionLaughsMessage = `<?xml version="1.0"?>
+<!DOCTYPE lolz [
+	<!ENTITY lol "lol">
+	<!ENTITY lol1 "&lol;&lol;&lol;&lol;&lol;&lol;&lol;&lol;&lol;&lol;">
+	<!ENTITY lol2 "&lol1;&lol1;&lol1;&lol1;&lol1;&lol1;&lol1;&lol1;&lol1;&lol1;">
+	<!ENTITY lol3 "&lol2;&lol2;&lol2;&lol2;&lol2;&lol2;&lol2;&lol2;&lol2;&lol2;">
+]>
+<Response xmlns="urn:oasis:names:tc:SAML:2.0:protocol" ID="id-1" Version="2.0">&lol3;</Response>`
+)
+
+func TestUnmarshalMessage(t *testing.T) {
+	var authnRequest AuthnRequest
+	assert.Equal(t, ErrDTDNotAllowed, unmarshalMessage([]byte(testXXEMessage), &authnRequest))
+	assert.Equal(t, "", authnRequest.Issuer.Value)
+
+	var res Response
+	assert.Equal(t, ErrDTDNotAllowed, unmarshalMessage([]byte(testBillionLaughsMessage), &res))
+
+	// Undeclared entities are not expanded either.
+	err := unmarshalMessage([]byte(`<Response xmlns="urn:oasis:names:tc:SAML:2.0:protocol">&lol;</Response>`), &res)
+	assert.Error(t, err)
+
+	deep := strings.Repeat("<a>", MaxXMLDepth+1) + strings.Repeat("</a>", MaxXMLDepth+1)
+	assert.Equal(t, ErrXMLTooDeep, unmarshalMessage([]byte(deep), &res))
+
+	defer func(size int64) { MaxMessageSize = size }(MaxMessageSize)
+	MaxMessageSize = 64
+	large := `<Response xmlns="urn:oasis:names:tc:SAML:2.0:protocol" ID="` + strings.Repeat("a", 64) + `"></Response>`
+	assert.Equal(t, ErrMessageTooLarge, unmarshalMessage([]byte(large), &res))
+
+	MaxMessageSize = 0
+	assert.NoError(t, unmarshalMessage([]byte(large), &res))
+	assert.Equal(t, strings.Repeat("a", 64), res.ID)
+}
+
+// adfsResponse generates a response in the shape of ADFS's, with its
+// Consent attribute and samlp prefix, preceded by a UTF-8 byte order mark
+// when bom is set and by an XML declaration claiming the given encoding when
+// it is not empty, as .NET writers produce when a UTF-8 stream is labelled
+// with the encoding of the string it came from. The body is always UTF-8.
+// It is built, not captured from an ADFS server.
+func adfsResponse(bom bool, encoding string) string {
+	var out string
+	if bom {
+		out += "\xef\xbb\xbf"
+	}
+	if encoding != "" {
+		out += `<?xml version="1.0" encoding="` + encoding + `"?>`
+	}
+	return out + `<samlp:Response ID="_5a1e2b3c-7d8e-4f90-a1b2-c3d4e5f60718" Version="2.0" IssueInstant="2017-09-01T12:00:00.000Z" ` +
+		`Destination="https://sp.example.com/saml/acs" Consent="urn:oasis:names:tc:SAML:2.0:consent:unspecified" ` +
+		`InResponseTo="id-MOCKID" xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol">` +
+		`<Issuer xmlns="urn:oasis:names:tc:SAML:2.0:assertion">http://adfs.example.com/adfs/services/trust</Issuer>` +
+		`<samlp:Status><samlp:StatusCode Value="urn:oasis:names:tc:SAML:2.0:status:Success" /></samlp:Status>` +
+		`</samlp:Response>`
+}
+
+func TestInboundEncodings(t *testing.T) {
+	for _, vector := range []string{
+		adfsResponse(true, "utf-16"),
+		adfsResponse(true, ""),
+		adfsResponse(false, "utf-16"),
+		adfsResponse(true, "UTF-16LE"),
+		adfsResponse(true, "us-ascii"),
+	} {
+		var res Response
+		if assert.NoError(t, unmarshalMessage([]byte(vector), &res)) {
+			assert.Equal(t, "_5a1e2b3c-7d8e-4f90-a1b2-c3d4e5f60718", res.ID)
+			assert.Equal(t, "http://adfs.example.com/adfs/services/trust", res.Issuer.Value)
+			assert.Equal(t, StatusSuccess, res.Status.StatusCode.Value)
+		}
+
+		message, messageType, err := DecodeMessage([]byte(vector))
+		assert.NoError(t, err)
+		assert.Equal(t, MessageTypeResponse, messageType)
+		_, ok := message.(*Response)
+		assert.True(t, ok)
+	}
+
+	// Encodings that would need transcoding are refused.
+	var res Response
+	err := unmarshalMessage([]byte(adfsResponse(true, "ISO-8859-1")), &res)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), `unsupported XML encoding "ISO-8859-1"`)
+	}
+
+	// Metadata is read the same way.
+	metadata, err := ExtractEntityDescriptor(strings.NewReader("\xef\xbb\xbf"+strings.Replace(testAggregateMetadata, "UTF-8", "utf-16", 1)), "https://sp-a.example.org/metadata")
+	assert.NoError(t, err)
+	assert.Equal(t, "https://sp-a.example.org/acs", metadata.SPSSODescriptor.AssertionConsumerService[0].Location)
+}
+
+func TestInflateMessageTooLarge(t *testing.T) {
+	defer func(size int64) { MaxMessageSize = size }(MaxMessageSize)
+	MaxMessageSize = 1 << 10
+
+	message, err := deflateMessage(make([]byte, 1<<10), flate.DefaultCompression)
+	assert.NoError(t, err)
+	_, err = inflateMessage(message)
+	assert.NoError(t, err)
+
+	message, err = deflateMessage(make([]byte, 1<<20), flate.DefaultCompression)
+	assert.NoError(t, err)
+	_, err = inflateMessage(message)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), ErrMessageTooLarge.Error())
+}
+
+func TestDecodeMessage(t *testing.T) {
+	tests := []struct {
+		in          string
+		messageType MessageType
+		id          func(interface{}) string
+	}{
+		{
+			`<AuthnRequest xmlns="urn:oasis:names:tc:SAML:2.0:protocol" ID="id-1" Version="2.0"><Issuer xmlns="urn:oasis:names:tc:SAML:2.0:assertion">http://localhost:1235/saml/service.xml</Issuer></AuthnRequest>`,
+			MessageTypeAuthnRequest,
+			func(v interface{}) string { return v.(*AuthnRequest).ID },
+		},
+		{
+			`<samlp:LogoutRequest xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" ID="id-1" Version="2.0"><saml:NameID>anakin</saml:NameID><samlp:SessionIndex>s-1</samlp:SessionIndex></samlp:LogoutRequest>`,
+			MessageTypeLogoutRequest,
+			func(v interface{}) string { return v.(*LogoutRequest).ID },
+		},
+		{
+			`<Response xmlns="urn:oasis:names:tc:SAML:2.0:protocol" ID="id-1" Version="2.0"><Status><StatusCode Value="urn:oasis:names:tc:SAML:2.0:status:Success"></StatusCode></Status></Response>`,
+			MessageTypeResponse,
+			func(v interface{}) string { return v.(*Response).ID },
+		},
+		{
+			`<ArtifactResolve xmlns="urn:oasis:names:tc:SAML:2.0:protocol" ID="id-1" Version="2.0"><Artifact>AAQAAA==</Artifact></ArtifactResolve>`,
+			MessageTypeArtifactResolve,
+			func(v interface{}) string { return v.(*ArtifactResolve).ID },
+		},
+	}
+	for _, test := range tests {
+		message, messageType, err := DecodeMessage([]byte(test.in))
+		if assert.NoError(t, err) {
+			assert.Equal(t, test.messageType, messageType)
+			assert.Equal(t, "id-1", test.id(message))
+		}
+
+		message, messageType, err = DecodePostMessage(base64.StdEncoding.EncodeToString([]byte(test.in)))
+		if assert.NoError(t, err) {
+			assert.Equal(t, test.messageType, messageType)
+			assert.Equal(t, "id-1", test.id(message))
+		}
+
+		deflated, err := deflateMessage([]byte(test.in), flate.DefaultCompression)
+		assert.NoError(t, err)
+		message, messageType, err = DecodeRedirectMessage(deflated)
+		if assert.NoError(t, err) {
+			assert.Equal(t, test.messageType, messageType)
+			assert.Equal(t, "id-1", test.id(message))
+		}
+	}
+
+	logoutRequest, _, err := DecodeMessage([]byte(tests[1].in))
+	assert.NoError(t, err)
+	assert.Equal(t, "anakin", logoutRequest.(*LogoutRequest).NameID.Value)
+	assert.Equal(t, []string{"s-1"}, logoutRequest.(*LogoutRequest).SessionIndex)
+
+	// The namespace must match too.
+	_, _, err = DecodeMessage([]byte(`<Response xmlns="urn:oasis:names:tc:SAML:1.0:protocol"></Response>`))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), ErrUnknownMessageType.Error())
+
+	_, _, err = DecodeMessage([]byte(`<ManageNameIDRequest xmlns="urn:oasis:names:tc:SAML:2.0:protocol"></ManageNameIDRequest>`))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), ErrUnknownMessageType.Error())
+
+	_, _, err = DecodeMessage([]byte(testXXEMessage))
+	assert.Equal(t, ErrDTDNotAllowed, err)
+
+	_, _, err = DecodeMessage(nil)
+	assert.Error(t, err)
+}
+
+func FuzzUnmarshalMessage(f *testing.F) {
+	f.Add([]byte(testXXEMessage))
+	f.Add([]byte(testBillionLaughsMessage))
+	f.Add([]byte(`<AuthnRequest xmlns="urn:oasis:names:tc:SAML:2.0:protocol" ID="id-1" Version="2.0"><Issuer xmlns="urn:oasis:names:tc:SAML:2.0:assertion">http://localhost:1235/saml/service.xml</Issuer></AuthnRequest>`))
+	f.Add([]byte(`<Response xmlns="urn:oasis:names:tc:SAML:2.0:protocol"><Status><StatusCode Value="urn:oasis:names:tc:SAML:2.0:status:Success"></StatusCode></Status></Response>`))
+
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		var authnRequest AuthnRequest
+		if err := unmarshalMessage(buf, &authnRequest); err == nil && bytes.Contains(buf, []byte("<!ENTITY")) && !bytes.Contains(buf, []byte("<!--")) && !bytes.Contains(buf, []byte("<![CDATA[")) {
+			t.Fatalf("accepted an entity declaration: %q", buf)
+		}
+
+		var res Response
+		unmarshalMessage(buf, &res)
+	})
+}
+
+func TestLocalizedMetadata(t *testing.T) {
+	tearUp()
+
+	var metadata Metadata
+	err := xml.Unmarshal([]byte(`<md:EntityDescriptor xmlns:md="urn:oasis:names:tc:SAML:2.0:metadata" xmlns:mdui="urn:oasis:names:tc:SAML:metadata:ui" entityID="https://sp.example.com">
+	<md:SPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol">
+		<md:Extensions>
+			<mdui:UIInfo>
+				<mdui:DisplayName xml:lang="en">Library</mdui:DisplayName>
+				<mdui:DisplayName xml:lang="fr">Bibliothèque</mdui:DisplayName>
+				<mdui:Description xml:lang="en">The university library</mdui:Description>
+			</mdui:UIInfo>
+		</md:Extensions>
+	</md:SPSSODescriptor>
+	<md:Organization>
+		<md:OrganizationName xml:lang="fr">Université</md:OrganizationName>
+		<md:OrganizationDisplayName xml:lang="fr">Université d'Exemple</md:OrganizationDisplayName>
+		<md:OrganizationURL xml:lang="fr">https://example.fr/</md:OrganizationURL>
+	</md:Organization>
+</md:EntityDescriptor>`), &metadata)
+	assert.NoError(t, err)
+
+	if assert.NotNil(t, metadata.SPSSODescriptor.Extensions) && assert.NotNil(t, metadata.SPSSODescriptor.Extensions.UIInfo) {
+		uiInfo := metadata.SPSSODescriptor.Extensions.UIInfo
+		assert.Equal(t, "Bibliothèque", uiInfo.DisplayName.Get("fr"))
+		assert.Equal(t, "Bibliothèque", uiInfo.DisplayName.Get("fr-CA", "en"))
+		assert.Equal(t, "Library", uiInfo.DisplayName.Get("de"))
+		assert.Equal(t, "The university library", uiInfo.Description.Get("fr"))
+	}
+	if assert.NotNil(t, metadata.Organization) {
+		assert.Equal(t, "Université d'Exemple", metadata.Organization.OrganizationDisplayName.Get("en"))
+		assert.Equal(t, "", LocalizedValues(nil).Get("en"))
+	}
+
+	idp := *testIdP
+	idp.UIInfo = &UIInfo{
+		DisplayName: LocalizedValues{{Lang: "en", Value: "Example Login"}, {Lang: "fr", Value: "Connexion Exemple"}},
+	}
+	idp.Organization = &Organization{
+		OrganizationName:        LocalizedValues{{Lang: "en", Value: "Example"}},
+		OrganizationDisplayName: LocalizedValues{{Lang: "en", Value: "Example Inc."}},
+		OrganizationURL:         LocalizedValues{{Lang: "en", Value: "https://example.com/"}},
+	}
+	out, err := idp.MarshalMetadata()
+	assert.NoError(t, err)
+	assert.Contains(t, string(out), `xml:lang="fr">Connexion Exemple</DisplayName>`)
+	assert.Contains(t, string(out), `xml:lang="en">Example Inc.</OrganizationDisplayName>`)
+
+	var parsed Metadata
+	assert.NoError(t, xml.Unmarshal(out, &parsed))
+	assert.Equal(t, "Connexion Exemple", parsed.IDPSSODescriptor.Extensions.UIInfo.DisplayName.Get("fr"))
+	assert.Equal(t, *idp.Organization, *parsed.Organization)
+}
+
+func TestMetadataAlgorithms(t *testing.T) {
+	tearUp()
+
+	// The IdP declares the algorithms it signs with.
+	idp := *testIdP
+	idp.SignatureMethod = xmlsec.RSASHA256
+	idp.DigestMethod = xmlsec.DigestSHA256
+	out, err := idp.MarshalMetadata()
+	assert.NoError(t, err)
+	assert.Contains(t, string(out), `<SigningMethod xmlns="urn:oasis:names:tc:SAML:metadata:algsupport" Algorithm="`+xmlsec.RSASHA256+`">`)
+
+	var parsed Metadata
+	assert.NoError(t, xml.Unmarshal(out, &parsed))
+	assert.Equal(t, []string{xmlsec.RSASHA256}, parsed.SigningMethods())
+	assert.Equal(t, []string{xmlsec.DigestSHA256}, parsed.DigestMethods())
+
+	cert, err := idp.Cert()
+	assert.NoError(t, err)
+	signature := idp.signatureTemplate(cert, nil)
+	assert.Equal(t, xmlsec.RSASHA256, signature.SignatureMethod.Algorithm)
+	assert.Equal(t, xmlsec.DigestSHA256, signature.Reference.DigestMethod.Algorithm)
+
+	// Nothing is declared by default.
+	out, err = testIdP.MarshalMetadata()
+	assert.NoError(t, err)
+	assert.NotContains(t, string(out), "Extensions")
+
+	// Peers may declare them for the entity or for its roles.
+	peer := `<md:EntityDescriptor xmlns:md="urn:oasis:names:tc:SAML:2.0:metadata" xmlns:alg="urn:oasis:names:tc:SAML:metadata:algsupport" entityID="https://idp.example.org">
+	<md:Extensions>
+		<alg:DigestMethod Algorithm="http://www.w3.org/2001/04/xmlenc#sha512"/>
+		<alg:SigningMethod Algorithm="http://www.w3.org/2001/04/xmldsig-more#rsa-sha512" MinKeySize="2048"/>
+	</md:Extensions>
+	<md:IDPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol">
+		<md:Extensions>
+			<alg:SigningMethod Algorithm="http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"/>
+			<alg:SigningMethod Algorithm="http://www.w3.org/2001/04/xmldsig-more#rsa-sha512"/>
+		</md:Extensions>
+	</md:IDPSSODescriptor>
+</md:EntityDescriptor>`
+	parsed = Metadata{}
+	assert.NoError(t, xml.Unmarshal([]byte(peer), &parsed))
+	assert.Equal(t, 2048, parsed.Extensions.SigningMethods[0].MinKeySize)
+	assert.Equal(t, []string{xmlsec.RSASHA512, xmlsec.RSASHA256}, parsed.SigningMethods())
+	assert.Equal(t, []string{xmlsec.DigestSHA512}, parsed.DigestMethods())
+
+	ours := []string{xmlsec.RSASHA256, xmlsec.RSASHA512}
+	assert.Equal(t, xmlsec.RSASHA256, ChooseAlgorithm(ours, parsed.SigningMethods()))
+	assert.Equal(t, xmlsec.RSASHA1, ChooseAlgorithm([]string{xmlsec.RSASHA1}, nil))
+	assert.Equal(t, "", ChooseAlgorithm([]string{xmlsec.RSASHA1}, parsed.SigningMethods()))
+
+	// The IdP signs with the algorithms the SP supports.
+	signature = idp.signatureTemplate(cert, &parsed)
+	assert.Equal(t, xmlsec.RSASHA256, signature.SignatureMethod.Algorithm)
+	assert.Equal(t, xmlsec.DigestSHA512, signature.Reference.DigestMethod.Algorithm)
+	signature = testIdP.signatureTemplate(cert, &parsed)
+	assert.Equal(t, xmlsec.RSASHA256, signature.SignatureMethod.Algorithm)
+	signature = testIdP.signatureTemplate(cert, &Metadata{})
+	assert.Equal(t, xmlsec.RSASHA1, signature.SignatureMethod.Algorithm)
+	assert.Equal(t, xmlsec.DigestSHA1, signature.Reference.DigestMethod.Algorithm)
+
+	idpAuthnRequest := &IdpAuthnRequest{
+		IDP:                     testIdP,
+		ServiceProviderMetadata: &parsed,
+		HTTPRequest:             &http.Request{RemoteAddr: "127.0.0.1"},
+		ACSEndpoint:             &IndexedEndpoint{Location: testSP.AcsURL},
+	}
+	assert.NoError(t, idpAuthnRequest.MakeAssertion(&Session{NameID: "anakin"}))
+	assert.Equal(t, xmlsec.RSASHA256, idpAuthnRequest.Assertion.Signature.SignatureMethod.Algorithm)
+	assert.Equal(t, xmlsec.DigestSHA512, idpAuthnRequest.Assertion.Signature.Reference.DigestMethod.Algorithm)
+}
+
+func TestRawElement(t *testing.T) {
+	assertion := `<saml:Assertion ID="id-2" Version="2.0"><saml:Issuer>https://idp.example.com</saml:Issuer>` +
+		`<ext:Unmodeled xmlns:ext="urn:example:ext" kept="yes">  spaces  </ext:Unmodeled></saml:Assertion>`
+	raw := []byte(`<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" ID="id-1">` +
+		`<saml:Issuer>https://idp.example.com</saml:Issuer>` + assertion + `</samlp:Response>`)
+
+	buf, err := rawElement(raw, xml.Name{Space: "urn:oasis:names:tc:SAML:2.0:assertion", Local: "Assertion"})
+	assert.NoError(t, err)
+	assert.Equal(t, assertion, string(buf))
+
+	// Parsing drops the unmodeled element, so only the raw bytes can be
+	// verified.
+	var res Response
+	assert.NoError(t, xml.Unmarshal(raw, &res))
+	remarshalled, err := xml.Marshal(res.Assertion)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(remarshalled), "Unmodeled")
+
+	_, err = rawElement(raw, xml.Name{Space: "urn:oasis:names:tc:SAML:2.0:assertion", Local: "EncryptedAssertion"})
+	assert.Error(t, err)
+}
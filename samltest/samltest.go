@@ -0,0 +1,328 @@
+// Package samltest provides an identity provider and a service provider that
+// trust each other, and helpers to drive an SSO round-trip between them in
+// memory, to test SAML integrations without a network. Their keys are
+// generated on creation. Signing, encryption and verification go through
+// xmlsec1, which must be installed, unless the IdP is made by
+// NewNativeFakeIdP.
+package samltest
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"encoding/xml"
+	"html"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/goware/saml"
+	"github.com/goware/saml/xmlsec"
+	"github.com/pkg/errors"
+)
+
+// URLs of the fake providers. Nothing listens on them, the round-trip
+// helpers call the providers' handlers directly.
+const (
+	IdPMetadataURL = "https://idp.example.com/saml/metadata"
+	IdPSSOURL      = "https://idp.example.com/saml/sso"
+	SPMetadataURL  = "https://sp.example.com/saml/metadata"
+	SPAcsURL       = "https://sp.example.com/saml/acs"
+)
+
+// FakeIdP is an IdentityProvider that authenticates every user as Session.
+type FakeIdP struct {
+	*saml.IdentityProvider
+
+	// Session is returned by the IdP's Authenticator. Authentication fails
+	// when it is nil.
+	Session *saml.Session
+
+	key    *rsa.PrivateKey
+	cert   *x509.Certificate
+	native bool
+}
+
+// NewFakeIdP creates an IdP with a new key and a self-signed certificate,
+// authenticating users as "alice". Use NewFakeSP to make an SP it trusts.
+func NewFakeIdP() (*FakeIdP, error) {
+	key, cert, err := newKeyPair("idp.example.com")
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, certPEM := encodeKeyPair(key, cert)
+	return &FakeIdP{
+		IdentityProvider: &saml.IdentityProvider{
+			PrivkeyPEM:   keyPEM,
+			PubkeyPEM:    certPEM,
+			SSOURL:       IdPSSOURL,
+			MetadataURL:  IdPMetadataURL,
+			SecurityOpts: saml.SecurityOpts{AllowSelfSignedCert: true},
+		},
+		Session: &saml.Session{
+			NameID:    "alice",
+			UserName:  "alice",
+			UserEmail: "alice@example.com",
+		},
+		key:  key,
+		cert: cert,
+	}, nil
+}
+
+// NewNativeFakeIdP is NewFakeIdP for tests that run without xmlsec1. The IdP
+// signs with its in-memory key as SigningKey, the SPs made by NewFakeSP get
+// unencrypted assertions, and Login checks the signatures natively instead
+// of running the SP's AssertionMiddleware.
+func NewNativeFakeIdP() (*FakeIdP, error) {
+	idp, err := NewFakeIdP()
+	if err != nil {
+		return nil, err
+	}
+	idp.SigningKey = idp.key
+	idp.SigningCert = idp.cert
+	idp.native = true
+	return idp, nil
+}
+
+// Authenticator returns the saml.Authenticator of the IdP, which returns
+// Session.
+func (idp *FakeIdP) Authenticator() saml.Authenticator {
+	return func(w http.ResponseWriter, r *http.Request) (*saml.Session, error) {
+		if idp.Session == nil {
+			http.Error(w, "not authenticated", http.StatusUnauthorized)
+			return nil, errors.New("samltest: no session")
+		}
+		return idp.Session, nil
+	}
+}
+
+// Respond serves the SSO request at redirectURL, as sent by the SP through
+// the HTTP-Redirect binding, and returns the form the IdP makes the browser
+// post to the SP.
+func (idp *FakeIdP) Respond(redirectURL string) (url.Values, error) {
+	w := httptest.NewRecorder()
+	idp.ServeSSO(idp.Authenticator())(w, httptest.NewRequest("GET", redirectURL, nil))
+	if w.Code != http.StatusOK {
+		return nil, errors.Errorf("samltest: IdP answered %d: %s", w.Code, strings.TrimSpace(w.Body.String()))
+	}
+
+	form := url.Values{}
+	for _, match := range formInput.FindAllStringSubmatch(w.Body.String(), -1) {
+		form.Set(match[1], html.UnescapeString(match[2]))
+	}
+	if form.Get("SAMLResponse") == "" {
+		return nil, errors.New("samltest: IdP answered without a SAMLResponse")
+	}
+	return form, nil
+}
+
+// formInput matches the hidden inputs of the form served by the IdP.
+var formInput = regexp.MustCompile(`name="(RelayState|SAMLResponse|SAMLEncoding)" value="([^"]*)"`)
+
+// FakeSP is a ServiceProvider trusting a FakeIdP.
+type FakeSP struct {
+	*saml.ServiceProvider
+}
+
+// NewFakeSP creates an SP with a new key and a self-signed certificate, and
+// wires the metadata of idp and of the SP into each other. For an IdP made by
+// NewNativeFakeIdP, the SP's metadata given to the IdP holds no certificate and the IdP
+// sends it unencrypted assertions.
+func NewFakeSP(idp *FakeIdP) (*FakeSP, error) {
+	key, cert, err := newKeyPair("sp.example.com")
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, certPEM := encodeKeyPair(key, cert)
+	sp := &FakeSP{
+		ServiceProvider: &saml.ServiceProvider{
+			PrivkeyPEM:   keyPEM,
+			PubkeyPEM:    certPEM,
+			MetadataURL:  SPMetadataURL,
+			AcsURL:       SPAcsURL,
+			SecurityOpts: saml.SecurityOpts{AllowSelfSignedCert: true},
+		},
+	}
+
+	if sp.IdPMetadata, err = idp.Metadata(); err != nil {
+		return nil, errors.Wrap(err, "samltest: failed to build IdP metadata")
+	}
+	if idp.SPMetadata, err = sp.Metadata(); err != nil {
+		return nil, errors.Wrap(err, "samltest: failed to build SP metadata")
+	}
+	if idp.native {
+		// The IdP encrypts for any certificate of the SP.
+		descriptor := *idp.SPMetadata.SPSSODescriptor
+		descriptor.KeyDescriptor = nil
+		idp.SPMetadata.SPSSODescriptor = &descriptor
+		if idp.SPOptions == nil {
+			idp.SPOptions = map[string]saml.SPOptions{}
+		}
+		options := idp.SPOptions[SPMetadataURL]
+		options.AllowUnencryptedAssertions = true
+		idp.SPOptions[SPMetadataURL] = options
+	}
+	return sp, nil
+}
+
+// AuthnRequestURL returns where the SP's AuthnRequestHandler redirects the
+// browser: the IdP's SSO URL, with the authentication request.
+func (sp *FakeSP) AuthnRequestURL() (string, error) {
+	w := httptest.NewRecorder()
+	sp.AuthnRequestHandler(w, httptest.NewRequest("GET", "/saml/login", nil))
+	if w.Code != http.StatusFound {
+		return "", errors.Errorf("samltest: SP answered %d: %s", w.Code, strings.TrimSpace(w.Body.String()))
+	}
+	return w.Header().Get("Location"), nil
+}
+
+// Consume posts the form made by the IdP to the SP's AssertionMiddleware and
+// returns the Response and the assertion it validated.
+func (sp *FakeSP) Consume(form url.Values) (*saml.Response, *saml.Assertion, error) {
+	var res *saml.Response
+	var assertion *saml.Assertion
+	handler := sp.AssertionMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		res = saml.GetResponseFromCtx(r.Context())
+		assertion = saml.GetAssertionFromCtx(r.Context())
+	}))
+
+	r := httptest.NewRequest("POST", SPAcsURL, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if assertion == nil {
+		return nil, nil, errors.Errorf("samltest: SP answered %d: %s", w.Code, strings.TrimSpace(w.Body.String()))
+	}
+	return res, assertion, nil
+}
+
+// Login drives an SP-initiated SSO round-trip in memory: the SP's
+// authentication request is sent to the IdP, which authenticates
+// idp.Session, and the IdP's response is validated by the SP, or by Verify
+// for an IdP made by NewNativeFakeIdP. It returns the validated Response and
+// assertion.
+func Login(idp *FakeIdP, sp *FakeSP) (*saml.Response, *saml.Assertion, error) {
+	redirectURL, err := sp.AuthnRequestURL()
+	if err != nil {
+		return nil, nil, err
+	}
+	form, err := idp.Respond(redirectURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	if idp.native {
+		return idp.Verify(form)
+	}
+	return sp.Consume(form)
+}
+
+// Verify checks natively, without xmlsec1, the signature of the unencrypted
+// assertion of a form made by the IdP, and returns the Response and the
+// assertion. Unlike Consume, it only checks the signature, not the
+// conditions of the assertion.
+func (idp *FakeIdP) Verify(form url.Values) (*saml.Response, *saml.Assertion, error) {
+	raw, err := DecodeResponse(form)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "samltest: failed to decode SAMLResponse")
+	}
+	var res saml.Response
+	if err := xml.Unmarshal(raw, &res); err != nil {
+		return nil, nil, errors.Wrap(err, "samltest: failed to parse SAMLResponse")
+	}
+	if res.Assertion == nil || res.Assertion.Signature == nil {
+		return nil, nil, errors.New("samltest: response without a signed, unencrypted assertion")
+	}
+
+	assertion, err := rawElement(raw, xml.Name{Space: assertionNamespace, Local: "Assertion"})
+	if err != nil {
+		return nil, nil, err
+	}
+	traces, err := xmlsec.TraceSignatures(assertion)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "samltest: failed to trace the assertion signature")
+	}
+	if len(traces) != 1 {
+		return nil, nil, errors.Errorf("samltest: assertion with %d signatures", len(traces))
+	}
+	for _, reference := range traces[0].References {
+		if !reference.Match() {
+			return nil, nil, errors.Errorf("samltest: digest mismatch for Reference %q", reference.URI)
+		}
+	}
+	signature, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(res.Assertion.Signature.SignatureValue), ""))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "samltest: malformed SignatureValue")
+	}
+	if err := xmlsec.VerifySignatureValue(traces[0].SignatureMethod, idp.cert.PublicKey, traces[0].SignedInfo, signature); err != nil {
+		return nil, nil, errors.Wrap(err, "samltest: invalid assertion signature")
+	}
+	return &res, res.Assertion, nil
+}
+
+const assertionNamespace = "urn:oasis:names:tc:SAML:2.0:assertion"
+
+// rawElement returns the first element of a document with the given name, as
+// it appears in the document.
+func rawElement(buf []byte, name xml.Name) ([]byte, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(buf))
+	for {
+		offset := decoder.InputOffset()
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, errors.Wrapf(err, "samltest: missing %s element", name.Local)
+		}
+		if start, ok := token.(xml.StartElement); ok && start.Name == name {
+			if err := decoder.Skip(); err != nil {
+				return nil, err
+			}
+			return buf[offset:decoder.InputOffset()], nil
+		}
+	}
+}
+
+// DecodeResponse returns the XML of the SAMLResponse of a form made by the
+// IdP.
+func DecodeResponse(form url.Values) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(form.Get("SAMLResponse"))
+}
+
+// newKeyPair generates an RSA key and a self-signed certificate for it, valid
+// for a year.
+func newKeyPair(commonName string) (*rsa.PrivateKey, *x509.Certificate, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "samltest: failed to generate key")
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(now.UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "samltest: failed to create certificate")
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "samltest: failed to parse certificate")
+	}
+	return key, cert, nil
+}
+
+// encodeKeyPair returns the key and the certificate PEM encoded.
+func encodeKeyPair(key *rsa.PrivateKey, cert *x509.Certificate) (string, string) {
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	return string(keyPEM), string(certPEM)
+}
@@ -0,0 +1,113 @@
+package samltest
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/url"
+	"os/exec"
+	"testing"
+
+	"github.com/goware/saml"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFakeProviders(t *testing.T) {
+	idp, err := NewFakeIdP()
+	assert.NoError(t, err)
+	sp, err := NewFakeSP(idp)
+	assert.NoError(t, err)
+
+	// The providers know each other.
+	assert.Equal(t, SPMetadataURL, idp.SPMetadata.EntityID)
+	assert.Equal(t, IdPMetadataURL, sp.IdPMetadata.EntityID)
+
+	redirectURL, err := sp.AuthnRequestURL()
+	assert.NoError(t, err)
+	u, err := url.Parse(redirectURL)
+	assert.NoError(t, err)
+	assert.Equal(t, IdPSSOURL, u.Scheme+"://"+u.Host+u.Path)
+	assert.NotEmpty(t, u.Query().Get("SAMLRequest"))
+
+	if _, err := exec.LookPath("xmlsec1"); err != nil {
+		t.Skip("xmlsec1 is not installed")
+	}
+	assert.NoError(t, idp.Validate())
+
+	_, assertion, err := Login(idp, sp)
+	assert.NoError(t, err)
+	if assert.NotNil(t, assertion) {
+		assert.Equal(t, saml.NameIDFormatTransient, assertion.Subject.NameID.Format)
+	}
+
+	// Failed authentications are errors.
+	idp.Session = nil
+	_, _, err = Login(idp, sp)
+	assert.Error(t, err)
+}
+
+func TestSignedResponseRoundTrip(t *testing.T) {
+	if _, err := exec.LookPath("xmlsec1"); err != nil {
+		t.Skip("xmlsec1 is not installed")
+	}
+	idp, err := NewFakeIdP()
+	assert.NoError(t, err)
+	sp, err := NewFakeSP(idp)
+	assert.NoError(t, err)
+
+	// The signed assertion reaches the SP as it was signed, even when the
+	// IdP is asked to indent its responses.
+	for _, indent := range []bool{false, true} {
+		idp.IndentResponses = indent
+
+		redirectURL, err := sp.AuthnRequestURL()
+		assert.NoError(t, err)
+		form, err := idp.Respond(redirectURL)
+		assert.NoError(t, err)
+		raw, err := DecodeResponse(form)
+		assert.NoError(t, err)
+		assert.Contains(t, string(raw), "EncryptedAssertion")
+
+		_, assertion, err := sp.Consume(form)
+		assert.NoError(t, err, "indent: %v", indent)
+		if assert.NotNil(t, assertion) {
+			assert.NotNil(t, assertion.Signature)
+		}
+	}
+}
+
+func TestNativeFakeProviders(t *testing.T) {
+	idp, err := NewNativeFakeIdP()
+	assert.NoError(t, err)
+	sp, err := NewFakeSP(idp)
+	assert.NoError(t, err)
+
+	res, assertion, err := Login(idp, sp)
+	assert.NoError(t, err)
+	if assert.NotNil(t, assertion) {
+		assert.Equal(t, saml.NameIDFormatTransient, assertion.Subject.NameID.Format)
+		assert.NotNil(t, assertion.Signature)
+	}
+	if assert.NotNil(t, res) {
+		assert.Equal(t, SPAcsURL, res.Destination)
+		assert.NotEmpty(t, res.InResponseTo)
+	}
+
+	// Tampered assertions are rejected.
+	redirectURL, err := sp.AuthnRequestURL()
+	assert.NoError(t, err)
+	form, err := idp.Respond(redirectURL)
+	assert.NoError(t, err)
+	raw, err := DecodeResponse(form)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(raw), "EncryptedAssertion")
+	form.Set("SAMLResponse", base64.StdEncoding.EncodeToString(bytes.Replace(raw, []byte(">alice<"), []byte(">mallory<"), 1)))
+	_, _, err = idp.Verify(form)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "digest mismatch")
+	}
+
+	// Failed authentications are errors.
+	idp.Session = nil
+	_, _, err = Login(idp, sp)
+	assert.Error(t, err)
+}
@@ -0,0 +1,43 @@
+package saml_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/goware/saml"
+	"github.com/goware/saml/samltest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedirectAuthnRequestRoundTrip(t *testing.T) {
+	idp, err := samltest.NewNativeFakeIdP()
+	assert.NoError(t, err)
+	sp, err := samltest.NewFakeSP(idp)
+	assert.NoError(t, err)
+
+	r := httptest.NewRequest("POST", "/saml/login", nil)
+	r = r.WithContext(context.WithValue(r.Context(), "saml.RelayState", "/dashboard"))
+	w := httptest.NewRecorder()
+	sp.RedirectAuthnRequest(w, r)
+	assert.Equal(t, http.StatusSeeOther, w.Code)
+
+	// The IdP answers the redirected request to the SP's ACS, keeping the
+	// RelayState.
+	form, err := idp.Respond(w.Header().Get("Location"))
+	assert.NoError(t, err)
+	assert.Equal(t, "/dashboard", form.Get("RelayState"))
+
+	res, assertion, err := idp.Verify(form)
+	assert.NoError(t, err)
+	if assert.NotNil(t, res) {
+		assert.Equal(t, samltest.SPAcsURL, res.Destination)
+		assert.Equal(t, samltest.IdPMetadataURL, res.Issuer.Value)
+	}
+	if assert.NotNil(t, assertion) {
+		assert.Equal(t, saml.NameIDFormatTransient, assertion.Subject.NameID.Format)
+		assert.Equal(t, samltest.SPMetadataURL, assertion.Conditions.AudienceRestriction.Audience.Value)
+		assert.Equal(t, res.InResponseTo, assertion.Subject.BearerConfirmation().SubjectConfirmationData.InResponseTo)
+	}
+}
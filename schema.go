@@ -25,10 +25,13 @@
 package saml
 
 import (
+	"bytes"
 	"encoding/xml"
+	"io"
 	"time"
 
 	"github.com/goware/saml/xmlsec"
+	"github.com/pkg/errors"
 )
 
 // AuthnRequest represents the SAML object of the same name, a request from a service provider
@@ -42,10 +45,90 @@ type AuthnRequest struct {
 	ID                          string            `xml:",attr"`
 	IssueInstant                time.Time         `xml:",attr"`
 	ProtocolBinding             string            `xml:",attr"`
+	ProviderName                string            `xml:",attr,omitempty"`
 	Version                     string            `xml:",attr"`
 	Issuer                      Issuer            `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
 	Signature                   *xmlsec.Signature `xml:"http://www.w3.org/2000/09/xmldsig# Signature"`
 	NameIDPolicy                NameIDPolicy      `xml:"urn:oasis:names:tc:SAML:2.0:protocol NameIDPolicy"`
+
+	// Conditions are the conditions the SP requests on the assertion, such
+	// as a NotOnOrAfter cap. See the IdP's HonorRequestedConditions.
+	Conditions            *Conditions `xml:"urn:oasis:names:tc:SAML:2.0:assertion Conditions"`
+	RequestedAuthnContext *RequestedAuthnContext
+
+	// HolderOfKeyProtocolBinding is the hoksso:ProtocolBinding of requests
+	// sent under the Holder-of-Key Web Browser SSO profile: the binding the
+	// response is to be sent with.
+	HolderOfKeyProtocolBinding string `xml:"-"`
+}
+
+// MarshalXML satisfies xml.Marshaler, writing HolderOfKeyProtocolBinding as
+// the hoksso:ProtocolBinding attribute. The encoder does not pass on the
+// namespace of XMLName to marshalers, so it is set here.
+func (r AuthnRequest) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	type authnRequest AuthnRequest
+	start.Name = xml.Name{Space: protocolNamespace, Local: "AuthnRequest"}
+	start.Attr = append(start.Attr, holderOfKeyAttrs(r.HolderOfKeyProtocolBinding)...)
+	return e.EncodeElement(authnRequest(r), start)
+}
+
+// UnmarshalXML satisfies xml.Unmarshaler, reading the hoksso:ProtocolBinding
+// attribute into HolderOfKeyProtocolBinding.
+func (r *AuthnRequest) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	type authnRequest AuthnRequest
+	var v authnRequest
+	binding := takeHolderOfKeyBinding(&start)
+	if err := d.DecodeElement(&v, &start); err != nil {
+		return err
+	}
+	v.HolderOfKeyProtocolBinding = binding
+	*r = AuthnRequest(v)
+	return nil
+}
+
+// RequestedAuthnContext represents the SAML object of the same name, the
+// authentication contexts an SP wants the user to be authenticated with,
+// given by class or by declaration.
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf
+type RequestedAuthnContext struct {
+	XMLName              xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol RequestedAuthnContext"`
+	Comparison           string   `xml:",attr,omitempty"`
+	AuthnContextClassRef []string `xml:"urn:oasis:names:tc:SAML:2.0:assertion AuthnContextClassRef"`
+	AuthnContextDeclRef  []string `xml:"urn:oasis:names:tc:SAML:2.0:assertion AuthnContextDeclRef"`
+}
+
+// LogoutRequest represents the SAML object of the same name, a request to end
+// the sessions of a principal.
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf
+type LogoutRequest struct {
+	XMLName      xml.Name          `xml:"urn:oasis:names:tc:SAML:2.0:protocol LogoutRequest"`
+	Destination  string            `xml:",attr,omitempty"`
+	ID           string            `xml:",attr"`
+	IssueInstant time.Time         `xml:",attr"`
+	NotOnOrAfter string            `xml:",attr,omitempty"`
+	Reason       string            `xml:",attr,omitempty"`
+	Version      string            `xml:",attr"`
+	Issuer       *Issuer           `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
+	Signature    *xmlsec.Signature `xml:"http://www.w3.org/2000/09/xmldsig# Signature"`
+	NameID       *NameID           `xml:"urn:oasis:names:tc:SAML:2.0:assertion NameID"`
+	SessionIndex []string          `xml:"urn:oasis:names:tc:SAML:2.0:protocol SessionIndex"`
+}
+
+// ArtifactResolve represents the SAML object of the same name, a request for
+// the message referenced by an artifact.
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf
+type ArtifactResolve struct {
+	XMLName      xml.Name          `xml:"urn:oasis:names:tc:SAML:2.0:protocol ArtifactResolve"`
+	Destination  string            `xml:",attr,omitempty"`
+	ID           string            `xml:",attr"`
+	IssueInstant time.Time         `xml:",attr"`
+	Version      string            `xml:",attr"`
+	Issuer       *Issuer           `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
+	Signature    *xmlsec.Signature `xml:"http://www.w3.org/2000/09/xmldsig# Signature"`
+	Artifact     string            `xml:"urn:oasis:names:tc:SAML:2.0:protocol Artifact"`
 }
 
 // Issuer represents the SAML object of the same name.
@@ -63,46 +146,176 @@ type Issuer struct {
 type NameIDPolicy struct {
 	XMLName     xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol NameIDPolicy"`
 	AllowCreate bool     `xml:",attr"`
-	Format      string   `xml:",chardata"`
+	Format      string   `xml:",attr,omitempty"`
+
+	// present is set when the policy was parsed from a request. AllowCreate
+	// is only honored then: a request without a NameIDPolicy, or an IdP
+	// initiated login, allows creating identifiers.
+	present bool
+}
+
+// UnmarshalXML satisfies xml.Unmarshaler. AllowCreate defaults to true when
+// the attribute is absent.
+func (p *NameIDPolicy) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	type nameIDPolicy NameIDPolicy
+	v := nameIDPolicy{AllowCreate: true}
+	if err := d.DecodeElement(&v, &start); err != nil {
+		return err
+	}
+	*p = NameIDPolicy(v)
+	p.present = true
+	return nil
 }
 
-// Response represents the SAML object of the same name.
+// allowsCreate reports whether the IdP may create a new identifier for the
+// user: AllowCreate, defaulting to true when the request has no NameIDPolicy.
+func (p *NameIDPolicy) allowsCreate() bool {
+	return !p.present || p.AllowCreate
+}
+
+// Response represents the SAML object of the same name. Fields are declared in
+// the order mandated by the schema, which strict parsers enforce.
 //
 // See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf
 type Response struct {
-	XMLName            xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol Response"`
-	Destination        string   `xml:",attr"`
-	Signature          *xmlsec.Signature
+	XMLName            xml.Name  `xml:"urn:oasis:names:tc:SAML:2.0:protocol Response"`
+	Destination        string    `xml:",attr"`
 	ID                 string    `xml:",attr"`
-	InResponseTo       string    `xml:",attr"`
+	InResponseTo       string    `xml:",attr,omitempty"`
 	IssueInstant       time.Time `xml:",attr"`
 	Version            string    `xml:",attr"`
 	Issuer             *Issuer   `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
-	Status             *Status   `xml:"urn:oasis:names:tc:SAML:2.0:protocol Status"`
+	Signature          *xmlsec.Signature
+	Extensions         *Extensions `xml:"urn:oasis:names:tc:SAML:2.0:protocol Extensions"`
+	Status             *Status     `xml:"urn:oasis:names:tc:SAML:2.0:protocol Status"`
 	EncryptedAssertion *EncryptedAssertion
 	Assertion          *Assertion `xml:"urn:oasis:names:tc:SAML:2.0:assertion Assertion"`
+
+	// AssertionXML, when set, is written as is after Assertion. It holds a
+	// signed assertion sent in the clear, which must not be marshalled
+	// again. It is never set on parsing, Assertion is.
+	AssertionXML []byte `xml:",innerxml"`
+
+	// Raw holds the response as received when it is validated by a
+	// ResponseValidator with PreserveRawXML. It keeps the elements this
+	// package does not model, which are dropped on parsing.
+	Raw []byte `xml:"-"`
+}
+
+// UnmarshalXML implements xml.Unmarshaler, leaving AssertionXML empty.
+func (r *Response) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	type response Response
+	var v response
+	if err := d.DecodeElement(&v, &start); err != nil {
+		return err
+	}
+	v.AssertionXML = nil
+	*r = Response(v)
+	return nil
+}
+
+// SetExtensions sets the content of the response's Extensions element. The
+// given XML is copied as is and must be well-formed. Extensions are children
+// of the Response, so they are covered by a signature over the response.
+func (r *Response) SetExtensions(innerXML []byte) error {
+	if err := checkExtensions(innerXML); err != nil {
+		return err
+	}
+	r.Extensions = &Extensions{InnerXML: innerXML}
+	return nil
+}
+
+// AddExtensions is SetExtensions, keeping the extensions the response already
+// has before the given ones.
+func (r *Response) AddExtensions(innerXML []byte) error {
+	if r.Extensions == nil {
+		return r.SetExtensions(innerXML)
+	}
+	if err := checkExtensions(innerXML); err != nil {
+		return err
+	}
+	buf := make([]byte, 0, len(r.Extensions.InnerXML)+len(innerXML))
+	buf = append(append(buf, r.Extensions.InnerXML...), innerXML...)
+	r.Extensions = &Extensions{InnerXML: buf}
+	return nil
+}
+
+// checkExtensions returns an error unless the given XML is well-formed.
+func checkExtensions(innerXML []byte) error {
+	decoder := xml.NewDecoder(bytes.NewReader(innerXML))
+	for {
+		_, err := decoder.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "malformed extensions")
+		}
+	}
+}
+
+// Extensions represents the SAML object of the same name. It holds arbitrary,
+// vendor specific, XML.
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf
+type Extensions struct {
+	XMLName  xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol Extensions"`
+	InnerXML []byte   `xml:",innerxml"`
 }
 
 // Status represents the SAML object of the same name.
 //
 // See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf
 type Status struct {
-	XMLName    xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol Status"`
-	StatusCode StatusCode
+	XMLName       xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol Status"`
+	StatusCode    StatusCode
+	StatusMessage string `xml:"urn:oasis:names:tc:SAML:2.0:protocol StatusMessage,omitempty"`
+}
+
+// String returns the status code, its second-level code and the status
+// message, if any, as in "Responder/RequestDenied: message".
+func (s *Status) String() string {
+	out := s.StatusCode.Value
+	if s.StatusCode.StatusCode != nil {
+		out += "/" + s.StatusCode.StatusCode.Value
+	}
+	if s.StatusMessage != "" {
+		out += ": " + s.StatusMessage
+	}
+	return out
 }
 
-// StatusCode represents the SAML object of the same name.
+// StatusCode represents the SAML object of the same name. The nested
+// StatusCode holds an optional second-level code.
 //
 // See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf
 type StatusCode struct {
-	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol StatusCode"`
-	Value   string   `xml:",attr"`
+	XMLName    xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol StatusCode"`
+	Value      string   `xml:",attr"`
+	StatusCode *StatusCode
 }
 
 // StatusSuccess is the value of a StatusCode element when the authentication succeeds.
 // (nominally a constant, except for testing)
 var StatusSuccess = "urn:oasis:names:tc:SAML:2.0:status:Success"
 
+// StatusRequester, StatusResponder and StatusVersionMismatch are the top-level
+// StatusCode values of a failed request, telling whether the requester or the
+// responder is at fault.
+var (
+	StatusRequester       = "urn:oasis:names:tc:SAML:2.0:status:Requester"
+	StatusResponder       = "urn:oasis:names:tc:SAML:2.0:status:Responder"
+	StatusVersionMismatch = "urn:oasis:names:tc:SAML:2.0:status:VersionMismatch"
+)
+
+// StatusRequestDenied is the value of a StatusCode element when the IdP
+// refuses to process a request.
+var StatusRequestDenied = "urn:oasis:names:tc:SAML:2.0:status:RequestDenied"
+
+// StatusInvalidNameIDPolicy is the value of a StatusCode element when the IdP
+// cannot honor the NameIDPolicy of a request.
+var StatusInvalidNameIDPolicy = "urn:oasis:names:tc:SAML:2.0:status:InvalidNameIDPolicy"
+
 // EncryptedAssertion represents the SAML object of the same name.
 //
 // See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf
@@ -111,7 +324,8 @@ type EncryptedAssertion struct {
 	EncryptedData []byte `xml:",innerxml"`
 }
 
-// Assertion represents the SAML object of the same name.
+// Assertion represents the SAML object of the same name. Fields are declared in
+// the order mandated by the schema, which strict parsers enforce.
 //
 // See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf
 type Assertion struct {
@@ -125,15 +339,48 @@ type Assertion struct {
 	Conditions         *Conditions
 	AuthnStatement     *AuthnStatement
 	AttributeStatement *AttributeStatement
+
+	// AttributeStatements are marshalled after AttributeStatement. When
+	// unmarshalling, the attributes of every AttributeStatement are merged
+	// into AttributeStatement instead.
+	AttributeStatements AttributeStatements `xml:",any"`
+
+	// Raw holds the Assertion element as received, or as decrypted, when it
+	// is validated by a ResponseValidator with PreserveRawXML. Namespaces
+	// declared on an enclosing Response are not repeated.
+	Raw []byte `xml:"-"`
 }
 
 // Subject represents the SAML object of the same name.
 //
 // See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf
 type Subject struct {
-	XMLName             xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:assertion Subject"`
-	NameID              *NameID
-	SubjectConfirmation *SubjectConfirmation
+	XMLName              xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:assertion Subject"`
+	NameID               *NameID
+	EncryptedID          *EncryptedID
+	SubjectConfirmations []SubjectConfirmation `xml:"SubjectConfirmation"`
+}
+
+// EncryptedID represents the SAML object of the same name. NameID holds the
+// identifier until it is encrypted into EncryptedData, or once it has been
+// decrypted; it is never serialized.
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf
+type EncryptedID struct {
+	XMLName       xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:assertion EncryptedID"`
+	NameID        *NameID  `xml:"-"`
+	EncryptedData []byte   `xml:",innerxml"`
+}
+
+// BearerConfirmation returns the first bearer SubjectConfirmation, or nil if
+// there is none.
+func (s *Subject) BearerConfirmation() *SubjectConfirmation {
+	for i := range s.SubjectConfirmations {
+		if s.SubjectConfirmations[i].Method == SubjectConfirmationMethodBearer {
+			return &s.SubjectConfirmations[i]
+		}
+	}
+	return nil
 }
 
 // NameID represents the SAML object of the same name.
@@ -154,14 +401,39 @@ type SubjectConfirmation struct {
 	SubjectConfirmationData SubjectConfirmationData
 }
 
-// SubjectConfirmationData represents the SAML object of the same name.
+// Subject confirmation methods.
+const (
+	SubjectConfirmationMethodBearer      = "urn:oasis:names:tc:SAML:2.0:cm:bearer"
+	SubjectConfirmationMethodHolderOfKey = "urn:oasis:names:tc:SAML:2.0:cm:holder-of-key"
+)
+
+// SubjectConfirmationData represents the SAML object of the same name. It has
+// no NotBefore: the bearer confirmations of the Web Browser SSO profile must
+// not carry one, the assertion's validity starts with its Conditions.
 //
 // See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf
 type SubjectConfirmationData struct {
 	Address      string    `xml:",attr"`
-	InResponseTo string    `xml:",attr"`
+	InResponseTo string    `xml:",attr,omitempty"`
 	NotOnOrAfter time.Time `xml:",attr"`
 	Recipient    string    `xml:",attr"`
+
+	// KeyInfo holds the key of the presenter in holder-of-key confirmations.
+	KeyInfo *KeyInfo
+}
+
+// MarshalXML satisfies xml.Marshaler. Data carrying a KeyInfo is given the
+// KeyInfoConfirmationDataType xsi:type required by the holder-of-key profile.
+func (d SubjectConfirmationData) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	type subjectConfirmationData SubjectConfirmationData
+	if d.KeyInfo != nil {
+		start.Attr = append(start.Attr,
+			xml.Attr{Name: xml.Name{Local: "xmlns:saml"}, Value: assertionNamespace},
+			xml.Attr{Name: xml.Name{Local: "xmlns:xsi"}, Value: xsiNamespace},
+			xml.Attr{Name: xml.Name{Local: "xsi:type"}, Value: "saml:KeyInfoConfirmationDataType"},
+		)
+	}
+	return e.EncodeElement(subjectConfirmationData(d), start)
 }
 
 // Conditions represents the SAML object of the same name.
@@ -173,11 +445,62 @@ type Conditions struct {
 	AudienceRestriction *AudienceRestriction
 }
 
+// MarshalXML satisfies xml.Marshaler, leaving out the times that are not set,
+// as in the Conditions of an AuthnRequest, which often only caps
+// NotOnOrAfter.
+func (c Conditions) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	for _, attr := range []struct {
+		name  string
+		value time.Time
+	}{
+		{"NotBefore", c.NotBefore},
+		{"NotOnOrAfter", c.NotOnOrAfter},
+	} {
+		if !attr.value.IsZero() {
+			start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: attr.name}, Value: attr.value.Format(time.RFC3339Nano)})
+		}
+	}
+	return e.EncodeElement(struct {
+		AudienceRestriction *AudienceRestriction
+	}{c.AudienceRestriction}, start)
+}
+
 // AudienceRestriction represents the SAML object of the same name.
 //
 // See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf
 type AudienceRestriction struct {
 	Audience *Audience
+
+	// Audiences holds every Audience of a parsed restriction, which may list
+	// several, Audience being the first one. Only Audience is marshalled.
+	Audiences []Audience `xml:"-"`
+}
+
+// UnmarshalXML satisfies xml.Unmarshaler, keeping every Audience.
+func (r *AudienceRestriction) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	var v struct {
+		Audiences []Audience `xml:"Audience"`
+	}
+	if err := d.DecodeElement(&v, &start); err != nil {
+		return err
+	}
+	*r = AudienceRestriction{Audiences: v.Audiences}
+	if len(v.Audiences) > 0 {
+		r.Audience = &v.Audiences[0]
+	}
+	return nil
+}
+
+// audiences returns the values of the restriction's audiences.
+func (r *AudienceRestriction) audiences() []string {
+	if len(r.Audiences) == 0 && r.Audience != nil {
+		return []string{r.Audience.Value}
+	}
+	var values []string
+	for _, audience := range r.Audiences {
+		values = append(values, audience.Value)
+	}
+	return values
 }
 
 // Audience represents the SAML object of the same name.
@@ -209,6 +532,7 @@ type SubjectLocality struct {
 // See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf
 type AuthnContext struct {
 	AuthnContextClassRef *AuthnContextClassRef
+	AuthnContextDeclRef  *AuthnContextDeclRef
 }
 
 // AuthnContextClassRef represents the SAML object of the same name.
@@ -218,6 +542,13 @@ type AuthnContextClassRef struct {
 	Value string `xml:",chardata"`
 }
 
+// AuthnContextDeclRef represents the SAML object of the same name.
+//
+// See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf
+type AuthnContextDeclRef struct {
+	Value string `xml:",chardata"`
+}
+
 // AttributeStatement represents the SAML object of the same name.
 //
 // See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf
@@ -225,6 +556,26 @@ type AttributeStatement struct {
 	Attributes []Attribute `xml:"Attribute"`
 }
 
+// AttributeStatements is a list of additional AttributeStatement elements.
+type AttributeStatements []AttributeStatement
+
+// MarshalXML implements xml.Marshaler, writing every statement as an
+// AttributeStatement element.
+func (s AttributeStatements) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	for _, statement := range s {
+		if err := e.EncodeElement(statement, xml.StartElement{Name: xml.Name{Local: "AttributeStatement"}}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UnmarshalXML implements xml.Unmarshaler. It only receives the assertion
+// elements that match no other field, which are skipped.
+func (s *AttributeStatements) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	return d.Skip()
+}
+
 // Attribute represents the SAML object of the same name.
 //
 // See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf
@@ -235,11 +586,52 @@ type Attribute struct {
 	Values       []AttributeValue `xml:"AttributeValue"`
 }
 
+// Attribute value types that can be used as the xsi:type of an
+// AttributeValue.
+const (
+	AttributeValueTypeString  = "xs:string"
+	AttributeValueTypeBoolean = "xs:boolean"
+	AttributeValueTypeInteger = "xs:integer"
+	AttributeValueTypeAnyURI  = "xs:anyURI"
+)
+
+const (
+	assertionNamespace = "urn:oasis:names:tc:SAML:2.0:assertion"
+	xsNamespace        = "http://www.w3.org/2001/XMLSchema"
+	xsiNamespace       = "http://www.w3.org/2001/XMLSchema-instance"
+)
+
 // AttributeValue represents the SAML object of the same name.
 //
 // See http://docs.oasis-open.org/security/saml/v2.0/saml-core-2.0-os.pdf
 type AttributeValue struct {
 	Type   string `xml:"http://www.w3.org/2001/XMLSchema-instance type,attr"`
+	Nil    bool   `xml:"http://www.w3.org/2001/XMLSchema-instance nil,attr"`
 	Value  string `xml:",chardata"`
 	NameID *NameID
 }
+
+// MarshalXML satisfies xml.Marshaler. Typed values are written with the
+// conventional xs and xsi prefixes, which are declared on the element itself
+// so the QName in xsi:type can be resolved. Nil values are written with
+// xsi:nil and no type.
+func (v AttributeValue) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	switch {
+	case v.Nil:
+		start.Attr = append(start.Attr,
+			xml.Attr{Name: xml.Name{Local: "xmlns:xsi"}, Value: xsiNamespace},
+			xml.Attr{Name: xml.Name{Local: "xsi:nil"}, Value: "true"},
+		)
+		return e.EncodeElement(struct{}{}, start)
+	case v.Type != "":
+		start.Attr = append(start.Attr,
+			xml.Attr{Name: xml.Name{Local: "xmlns:xs"}, Value: xsNamespace},
+			xml.Attr{Name: xml.Name{Local: "xmlns:xsi"}, Value: xsiNamespace},
+			xml.Attr{Name: xml.Name{Local: "xsi:type"}, Value: v.Type},
+		)
+	}
+	return e.EncodeElement(struct {
+		Value  string `xml:",chardata"`
+		NameID *NameID
+	}{v.Value, v.NameID}, start)
+}
@@ -0,0 +1,147 @@
+package saml
+
+import (
+	"encoding/xml"
+	"time"
+
+	"github.com/goware/saml/xmlsec"
+)
+
+// SAML 1.1 URNs used while building responses for legacy SPs.
+const (
+	SAML11ProtocolNamespace = "urn:oasis:names:tc:SAML:1.0:protocol"
+
+	SAML11BrowserPostBinding = "urn:oasis:names:tc:SAML:1.0:profiles:browser-post"
+
+	SAML11StatusSuccess = "samlp:Success"
+
+	SAML11PasswordAuthenticationMethod = "urn:oasis:names:tc:SAML:1.0:am:password"
+	SAML11BearerConfirmationMethod     = "urn:oasis:names:tc:SAML:1.0:cm:bearer"
+	SAML11AttributeNamespaceURI        = "urn:mace:shibboleth:1.0:attributeNamespace:uri"
+)
+
+// Response11 represents the SAML 1.1 Response object.
+//
+// See https://www.oasis-open.org/committees/download.php/3406/oasis-sstc-saml-core-1.1.pdf
+type Response11 struct {
+	XMLName      xml.Name  `xml:"urn:oasis:names:tc:SAML:1.0:protocol Response"`
+	SamlpNS      string    `xml:"xmlns:samlp,attr"`
+	ResponseID   string    `xml:",attr"`
+	InResponseTo string    `xml:",attr,omitempty"`
+	IssueInstant time.Time `xml:",attr"`
+	MajorVersion int       `xml:",attr"`
+	MinorVersion int       `xml:",attr"`
+	Recipient    string    `xml:",attr,omitempty"`
+	Signature    *xmlsec.Signature
+	Status       *Status11
+	Assertion    *Assertion11
+}
+
+// Status11 represents the SAML 1.1 Status object.
+//
+// See https://www.oasis-open.org/committees/download.php/3406/oasis-sstc-saml-core-1.1.pdf
+type Status11 struct {
+	XMLName    xml.Name `xml:"urn:oasis:names:tc:SAML:1.0:protocol Status"`
+	StatusCode StatusCode11
+}
+
+// StatusCode11 represents the SAML 1.1 StatusCode object. Its value is a
+// QName, such as "samlp:Success".
+//
+// See https://www.oasis-open.org/committees/download.php/3406/oasis-sstc-saml-core-1.1.pdf
+type StatusCode11 struct {
+	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:1.0:protocol StatusCode"`
+	Value   string   `xml:",attr"`
+}
+
+// Assertion11 represents the SAML 1.1 Assertion object.
+//
+// See https://www.oasis-open.org/committees/download.php/3406/oasis-sstc-saml-core-1.1.pdf
+type Assertion11 struct {
+	XMLName                 xml.Name  `xml:"urn:oasis:names:tc:SAML:1.0:assertion Assertion"`
+	AssertionID             string    `xml:",attr"`
+	Issuer                  string    `xml:",attr"`
+	IssueInstant            time.Time `xml:",attr"`
+	MajorVersion            int       `xml:",attr"`
+	MinorVersion            int       `xml:",attr"`
+	Conditions              *Conditions11
+	AuthenticationStatement *AuthenticationStatement11
+	AttributeStatement      *AttributeStatement11
+	Signature               *xmlsec.Signature
+}
+
+// Conditions11 represents the SAML 1.1 Conditions object.
+//
+// See https://www.oasis-open.org/committees/download.php/3406/oasis-sstc-saml-core-1.1.pdf
+type Conditions11 struct {
+	NotBefore                    time.Time `xml:",attr"`
+	NotOnOrAfter                 time.Time `xml:",attr"`
+	AudienceRestrictionCondition *AudienceRestrictionCondition11
+}
+
+// AudienceRestrictionCondition11 represents the SAML 1.1 object of the same
+// name.
+//
+// See https://www.oasis-open.org/committees/download.php/3406/oasis-sstc-saml-core-1.1.pdf
+type AudienceRestrictionCondition11 struct {
+	Audience []string `xml:"Audience"`
+}
+
+// AuthenticationStatement11 represents the SAML 1.1 object of the same name,
+// which takes the place of SAML 2.0's AuthnStatement.
+//
+// See https://www.oasis-open.org/committees/download.php/3406/oasis-sstc-saml-core-1.1.pdf
+type AuthenticationStatement11 struct {
+	AuthenticationMethod  string    `xml:",attr"`
+	AuthenticationInstant time.Time `xml:",attr"`
+	Subject               Subject11
+	SubjectLocality       *SubjectLocality11
+}
+
+// SubjectLocality11 represents the SAML 1.1 object of the same name.
+//
+// See https://www.oasis-open.org/committees/download.php/3406/oasis-sstc-saml-core-1.1.pdf
+type SubjectLocality11 struct {
+	IPAddress string `xml:",attr,omitempty"`
+}
+
+// Subject11 represents the SAML 1.1 Subject object.
+//
+// See https://www.oasis-open.org/committees/download.php/3406/oasis-sstc-saml-core-1.1.pdf
+type Subject11 struct {
+	NameIdentifier      *NameIdentifier11
+	SubjectConfirmation *SubjectConfirmation11
+}
+
+// NameIdentifier11 represents the SAML 1.1 object of the same name.
+//
+// See https://www.oasis-open.org/committees/download.php/3406/oasis-sstc-saml-core-1.1.pdf
+type NameIdentifier11 struct {
+	Format        string `xml:",attr,omitempty"`
+	NameQualifier string `xml:",attr,omitempty"`
+	Value         string `xml:",chardata"`
+}
+
+// SubjectConfirmation11 represents the SAML 1.1 object of the same name.
+//
+// See https://www.oasis-open.org/committees/download.php/3406/oasis-sstc-saml-core-1.1.pdf
+type SubjectConfirmation11 struct {
+	ConfirmationMethod []string `xml:"ConfirmationMethod"`
+}
+
+// AttributeStatement11 represents the SAML 1.1 object of the same name.
+//
+// See https://www.oasis-open.org/committees/download.php/3406/oasis-sstc-saml-core-1.1.pdf
+type AttributeStatement11 struct {
+	Subject    Subject11
+	Attributes []Attribute11 `xml:"Attribute"`
+}
+
+// Attribute11 represents the SAML 1.1 object of the same name.
+//
+// See https://www.oasis-open.org/committees/download.php/3406/oasis-sstc-saml-core-1.1.pdf
+type Attribute11 struct {
+	AttributeName      string   `xml:",attr"`
+	AttributeNamespace string   `xml:",attr"`
+	Values             []string `xml:"AttributeValue"`
+}
@@ -0,0 +1,106 @@
+package saml
+
+import (
+	"bytes"
+	"encoding/xml"
+
+	"github.com/pkg/errors"
+)
+
+// SignaturePosition tells where the enveloped signature of the assertions
+// made for an SP is placed. Wherever it is, the signature covers the whole
+// element that encloses it. Right after the Issuer of the Assertion, its
+// Reference has an empty URI, the Assertion being the whole document when it
+// is signed. Elsewhere, the Reference points to the ID of the enclosing
+// element.
+type SignaturePosition int
+
+// Signature positions.
+const (
+	// SignatureAfterIssuer places the signature right after the Issuer of
+	// the assertion, as the SAML schema wants.
+	SignatureAfterIssuer SignaturePosition = iota
+	// SignatureInSubject places the signature as the first child of the
+	// Subject, for SPs that look for it there.
+	SignatureInSubject
+	// SignatureLast places the signature as the last child of the
+	// Assertion.
+	SignatureLast
+	// SignatureInResponse places the signature in the Response, right after
+	// its Issuer, for SPs that want the Response signed. The assertion is
+	// not signed then, the signature of the Response covers it.
+	SignatureInResponse
+)
+
+// place moves the Signature template of a marshalled assertion to the
+// position. The template must be moved before signing, since the digest of
+// the assertion depends on where the signature is.
+func (p SignaturePosition) place(buf []byte) ([]byte, error) {
+	if p == SignatureAfterIssuer || p == SignatureInResponse {
+		return buf, nil
+	}
+
+	start, _, end, err := elementOffsets(buf, xml.Name{Space: xmldsigNamespace, Local: "Signature"})
+	if err != nil {
+		return nil, err
+	}
+	signature := buf[start:end]
+	rest := make([]byte, 0, len(buf)-len(signature))
+	rest = append(append(rest, buf[:start]...), buf[end:]...)
+
+	var at int
+	switch p {
+	case SignatureInSubject:
+		_, content, _, err := elementOffsets(rest, xml.Name{Space: assertionNamespace, Local: "Subject"})
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot place the signature in the Subject")
+		}
+		at = content
+	case SignatureLast:
+		// The end tag of the Assertion is the last one of the document.
+		at = bytes.LastIndex(rest, []byte("</"))
+	default:
+		return nil, errors.Errorf("unknown signature position %d", p)
+	}
+
+	out := make([]byte, 0, len(buf))
+	out = append(out, rest[:at]...)
+	out = append(out, signature...)
+	return append(out, rest[at:]...), nil
+}
+
+// signaturePosition returns the SignaturePosition of the options of the SP
+// that sent the request.
+func (req *IdpAuthnRequest) signaturePosition() SignaturePosition {
+	if meta := req.ServiceProviderMetadata; meta != nil {
+		return req.IDP.spOptions(meta.EntityID).SignaturePosition
+	}
+	return SignatureAfterIssuer
+}
+
+// signResponse signs the Response, for SPs with the SignatureInResponse
+// position, and sets responseBuffer to the signed octets, which are never
+// serialized again.
+func (req *IdpAuthnRequest) signResponse() error {
+	cert, err := req.IDP.signingCert()
+	if err != nil {
+		return err
+	}
+	signature := req.IDP.signatureTemplate(cert, req.ServiceProviderMetadata)
+	if err := req.signatureKeyInfo().apply(&signature, cert); err != nil {
+		return err
+	}
+	signature.Reference.URI = "#" + req.Response.ID
+	req.Response.Signature = &signature
+
+	buf, err := xml.Marshal(req.Response)
+	if err != nil {
+		return errors.Wrap(err, "failed to format response")
+	}
+	buf, err = req.IDP.sign(req.context(), buf)
+	if err != nil {
+		return errors.Wrap(err, "failed to sign response")
+	}
+	req.responseBuffer = signedElement(buf)
+	return nil
+}
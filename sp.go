@@ -3,12 +3,12 @@ package saml
 import (
 	"encoding/base64"
 	"encoding/pem"
-	"encoding/xml"
 	"errors"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"sync/atomic"
+	"time"
 )
 
 // ServiceProvider represents a service provider.
@@ -17,6 +17,10 @@ type ServiceProvider struct {
 	IdPMetadataXML []byte
 	IdPMetadata    *Metadata
 
+	// MetadataHTTPClient fetches IdP metadata. http.DefaultClient is used
+	// when nil. See NewMetadataHTTPClient to trust a private CA.
+	MetadataHTTPClient *http.Client
+
 	KeyFile  string
 	CertFile string
 
@@ -26,13 +30,77 @@ type ServiceProvider struct {
 	MetadataURL string
 	AcsURL      string
 
+	// ProviderName is a human readable name of the SP, sent in authentication
+	// requests. Some IdPs display it on their login screen.
+	ProviderName string
+
 	DTDFile string
 
+	// MetadataContentType is the Content-Type of the served metadata.
+	// DefaultMetadataContentType is used when empty.
+	MetadataContentType string
+
 	AllowIdpInitiated bool
 
+	// AllowResponseInQuery makes AssertionMiddleware accept the SAMLResponse
+	// and RelayState from the query string of GET requests, for IdPs that
+	// redirect to the ACS instead of posting the response. This is not part
+	// of any SAML binding and weakens the SP: URLs end up in browser history,
+	// in server and proxy logs and in the Referer header of the pages loaded
+	// next, so the response can leak and be replayed until it expires. A
+	// response in the URL fragment never reaches the server and cannot be
+	// accepted.
+	AllowResponseInQuery bool
+
+	// AllowMissingSubjectConfirmationExpiry accepts assertions whose
+	// SubjectConfirmationData has no NotOnOrAfter. This violates the Web
+	// Browser SSO profile and should only be enabled for broken IdPs.
+	AllowMissingSubjectConfirmationExpiry bool
+
+	// AcceptedNameIDFormats, when set, are the only NameID formats accepted
+	// in assertions, to catch IdPs that send the wrong one. They are
+	// advertised in the metadata and the first one is requested in
+	// authentication requests. Any format is accepted by default.
+	AcceptedNameIDFormats []string
+
+	// SkipAudienceCheck accepts assertions whatever their
+	// AudienceRestriction. By default the SP's entity ID, its MetadataURL,
+	// must be one of their audiences, so that an assertion issued for
+	// another SP cannot be replayed to this one.
+	SkipAudienceCheck bool
+
+	// MaxAssertionAge rejects assertions issued longer than this ago, even if
+	// their NotOnOrAfter has not passed yet, to shrink the replay window below
+	// what the IdP chose. Zero disables the check.
+	MaxAssertionAge time.Duration
+
+	// HolderOfKey makes the SP use the Holder-of-Key Web Browser SSO profile:
+	// authentication requests ask for it, and assertions are only accepted
+	// with a holder-of-key SubjectConfirmation bound to the TLS client
+	// certificate presented to the ACS, which is required.
+	HolderOfKey bool
+
+	// ClientCertificate returns the TLS client certificate presented to the
+	// ACS. TLSClientCertificate is used when nil, see ClientCertificateFunc
+	// for what it takes to get the certificate behind a proxy.
+	ClientCertificate ClientCertificateFunc
+
+	// CompressionLevel, when set, is the DEFLATE level used for
+	// HTTP-Redirect requests, from flate.NoCompression to
+	// flate.BestCompression, or flate.HuffmanOnly, which often gives the
+	// smallest output for short requests. flate.DefaultCompression is used
+	// when it is nil.
+	CompressionLevel *int
+
+	// RelayStateStore keeps RelayStates longer than MaxRelayStateLength,
+	// which are then sent to the IdP as a short token. Without it, such
+	// RelayStates are an error.
+	RelayStateStore RelayStateStore
+
 	SecurityOpts
 
-	pemCert atomic.Value
+	pemCert         atomic.Value
+	metadataVersion atomic.Value
 }
 
 // PrivkeyFile returns a physical path where the SP's key can be accessed.
@@ -132,22 +200,18 @@ func (sp *ServiceProvider) GetIdPMetadata() (*Metadata, error) {
 			return nil, errors.New("Missing metadata URL.")
 		}
 
-		res, err := http.Get(sp.IdPMetadataURL)
+		metadata, err := GetMetadataWithClient(sp.MetadataHTTPClient, sp.IdPMetadataURL)
 		if err != nil {
 			return nil, err
 		}
-		defer res.Body.Close()
 
-		buf, err := ioutil.ReadAll(res.Body)
-		if err != nil {
-			return nil, err
-		}
-
-		sp.IdPMetadataXML = buf
+		m := *metadata
+		sp.IdPMetadata = &m
+		return metadata, nil
 	}
 
 	var metadata Metadata
-	err := xml.Unmarshal(sp.IdPMetadataXML, &metadata)
+	err := unmarshalXML(sp.IdPMetadataXML, &metadata)
 	if err != nil {
 		return nil, err
 	}
@@ -223,6 +287,7 @@ func (sp *ServiceProvider) Metadata() (*Metadata, error) {
 					},
 				},
 			},
+			NameIDFormat: sp.AcceptedNameIDFormats,
 			AssertionConsumerService: []IndexedEndpoint{{
 				Binding:  HTTPPostBinding,
 				Location: sp.AcsURL,
@@ -230,6 +295,14 @@ func (sp *ServiceProvider) Metadata() (*Metadata, error) {
 			}},
 		},
 	}
+	if sp.HolderOfKey {
+		metadata.SPSSODescriptor.AssertionConsumerService = append(metadata.SPSSODescriptor.AssertionConsumerService, IndexedEndpoint{
+			Binding:                    HolderOfKeySSOBinding,
+			HolderOfKeyProtocolBinding: HTTPPostBinding,
+			Location:                   sp.AcsURL,
+			Index:                      2,
+		})
+	}
 
 	return metadata, nil
 }
@@ -237,11 +310,25 @@ func (sp *ServiceProvider) Metadata() (*Metadata, error) {
 // MakeAuthenticationRequest produces a new AuthnRequest object for the given
 // idpURL.
 func (sp *ServiceProvider) MakeAuthenticationRequest(idpURL string) (*AuthnRequest, error) {
+	nameIDFormat := NameIDFormatTransient
+	if len(sp.AcceptedNameIDFormats) > 0 {
+		nameIDFormat = sp.AcceptedNameIDFormats[0]
+	}
+
+	var protocolBinding, holderOfKeyProtocolBinding string
+	if sp.HolderOfKey {
+		protocolBinding = HolderOfKeySSOBinding
+		holderOfKeyProtocolBinding = HTTPPostBinding
+	}
+
 	req := AuthnRequest{
 		AssertionConsumerServiceURL: sp.AcsURL,
 		Destination:                 idpURL,
 		ID:                          NewID(),
 		IssueInstant:                Now(),
+		ProtocolBinding:             protocolBinding,
+		HolderOfKeyProtocolBinding:  holderOfKeyProtocolBinding,
+		ProviderName:                sp.ProviderName,
 		Version:                     "2.0",
 		Issuer: Issuer{
 			Format: "urn:oasis:names:tc:SAML:2.0:nameid-format:entity",
@@ -252,7 +339,7 @@ func (sp *ServiceProvider) MakeAuthenticationRequest(idpURL string) (*AuthnReque
 			// TODO(ross): figure out exactly policy we need
 			// urn:mace:shibboleth:1.0:nameIdentifier
 			// urn:oasis:names:tc:SAML:2.0:nameid-format:transient
-			Format: "urn:oasis:names:tc:SAML:2.0:nameid-format:transient",
+			Format: nameIDFormat,
 		},
 	}
 	return &req, nil
@@ -38,71 +38,120 @@ func parseFormAndKeepBody(r *http.Request) error {
 // AuthnRequestHandler creates an authentication assert and makes the user send it
 // to the IdP (via redirection).
 func (sp *ServiceProvider) AuthnRequestHandler(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
+	sp.redirectAuthnRequest(w, r, http.StatusFound)
+}
 
-	destination, err := sp.GetIdPAuthResource()
+// RedirectAuthnRequest is AuthnRequestHandler answering with a 303 See Other,
+// which makes the browser GET the IdP's SSO URL whatever the method of r, e.g.
+// when the login is started by POSTing a form.
+func (sp *ServiceProvider) RedirectAuthnRequest(w http.ResponseWriter, r *http.Request) {
+	sp.redirectAuthnRequest(w, r, http.StatusSeeOther)
+}
+
+// redirectAuthnRequest redirects the user to the IdP with a new
+// authentication request, answering with the given status. The RelayState is
+// taken from the request context.
+func (sp *ServiceProvider) redirectAuthnRequest(w http.ResponseWriter, r *http.Request, status int) {
+	// RelayState is an opaque string that can be used to keep track of this
+	// session on our side.
+	var relayState string
+	token := r.Context().Value("saml.RelayState")
+	if token != nil {
+		relayState, _ = token.(string)
+	}
+
+	redirectURL, err := sp.AuthnRequestRedirectURL(relayState)
 	if err != nil {
-		internalErr(w, errors.Errorf("GetIdPAuthResource: %v", err))
+		internalErr(w, err)
 		return
 	}
 
+	w.Header().Add("Location", redirectURL)
+	w.WriteHeader(status)
+}
+
+// AuthnRequestRedirectURL returns the IdP's SSO URL carrying a new
+// authentication request and the given RelayState, as the SAMLRequest and
+// RelayState query parameters of the HTTP-Redirect binding. It can be given
+// to http.Redirect. The RelayState goes through the RelayStateStore, if any.
+func (sp *ServiceProvider) AuthnRequestRedirectURL(relayState string) (string, error) {
+	destination, err := sp.GetIdPAuthResource()
+	if err != nil {
+		return "", errors.Errorf("GetIdPAuthResource: %v", err)
+	}
+
 	authnRequest, err := sp.MakeAuthenticationRequest(destination)
 	if err != nil {
-		internalErr(w, errors.Errorf("Failed to make auth request to %v: %v", destination, err))
-		return
+		return "", errors.Errorf("Failed to make auth request to %v: %v", destination, err)
 	}
 
 	buf, err := xml.MarshalIndent(authnRequest, "", "\t")
 	if err != nil {
-		internalErr(w, errors.Errorf("Failed to marshal auth request %v", err))
-		return
+		return "", errors.Errorf("Failed to marshal auth request %v", err)
 	}
 
-	// RelayState is an opaque string that can be used to keep track of this
-	// session on our side.
-	var relayState string
-	token := ctx.Value("saml.RelayState")
-	if token != nil {
-		relayState, _ = token.(string)
+	relayState, err = outboundRelayState(relayState, sp.RelayStateStore)
+	if err != nil {
+		return "", err
 	}
 
-	fbuf := bytes.NewBuffer(nil)
-	fwri, err := flate.NewWriter(fbuf, flate.DefaultCompression)
+	message, err := deflateMessage(buf, sp.compressionLevel())
 	if err != nil {
-		internalErr(w, errors.Errorf("Failed to build buffer %v", err))
-		return
+		return "", errors.Wrap(err, "Failed to compress auth request")
 	}
 
-	_, err = fwri.Write(buf)
-	if err != nil {
-		internalErr(w, errors.Errorf("Failed to write to buffer %v", err))
-		return
+	separator := "?"
+	if strings.Contains(destination, "?") {
+		separator = "&"
 	}
-	fwri.Close()
-	message := base64.StdEncoding.EncodeToString(fbuf.Bytes())
+	return destination + separator + fmt.Sprintf(`RelayState=%s&SAMLRequest=%s`, url.QueryEscape(relayState), url.QueryEscape(message)), nil
+}
 
-	redirectURL := destination + fmt.Sprintf(`?RelayState=%s&SAMLRequest=%s`, url.QueryEscape(relayState), url.QueryEscape(message))
+// compressionLevel returns the SP's CompressionLevel, or
+// flate.DefaultCompression when it is not set.
+func (sp *ServiceProvider) compressionLevel() int {
+	if sp.CompressionLevel == nil {
+		return flate.DefaultCompression
+	}
+	return *sp.CompressionLevel
+}
 
-	w.Header().Add("Location", redirectURL)
-	w.WriteHeader(http.StatusFound)
-	return
+// deflateMessage compresses and base64 encodes a message for the
+// HTTP-Redirect binding. A zero level means flate.DefaultCompression.
+func deflateMessage(buf []byte, level int) (string, error) {
+	fbuf := bytes.NewBuffer(nil)
+	fwri, err := flate.NewWriter(fbuf, level)
+	if err != nil {
+		return "", err
+	}
+	if _, err := fwri.Write(buf); err != nil {
+		return "", err
+	}
+	// Close flushes the last block, the message is truncated without it.
+	if err := fwri.Close(); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(fbuf.Bytes()), nil
 }
 
 // MetadataHandler creates and serves a metadata XML file.
 func (sp *ServiceProvider) MetadataHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodHead) {
+		return
+	}
 	metadata, err := sp.Metadata()
 	if err != nil {
 		internalErr(w, errors.Wrapf(err, "could not build nor serve metadata XML"))
 		return
 	}
+	roundValidUntil(metadata)
 	out, err := xml.MarshalIndent(metadata, "", "\t")
 	if err != nil {
 		internalErr(w, errors.Wrapf(err, "could not format metadata"))
 		return
 	}
-	w.Header().Set("Content-Type", "application/xml; charset=utf8")
-	w.Write([]byte("<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n"))
-	w.Write(out)
+	out = append([]byte("<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n"), out...)
+	serveMetadata(w, r, &sp.metadataVersion, out, metadataContentType(sp.MetadataContentType))
 }
 
 func (sp *ServiceProvider) possibleResponseIDs() []string {
@@ -113,51 +162,38 @@ func (sp *ServiceProvider) possibleResponseIDs() []string {
 	return responseIDs
 }
 
-func (sp *ServiceProvider) verifySignature(plaintextMessage []byte) error {
-	idpCertFile, err := sp.GetIdPCertFile()
-	if err != nil {
-		return err
-	}
-
-	err = xmlsec.Verify(plaintextMessage, idpCertFile, &xmlsec.ValidationOptions{
-		DTDFile: sp.DTDFile,
-	})
-	if err == nil {
-		// No error, this message is OK
-		return nil
-	}
-
-	// We got an error...
-	if !IsSecurityException(err, &sp.SecurityOpts) {
-		// ...but it was not a security exception, so we ignore it and accept
-		// the verification.
-		return nil
-	}
-
-	return err
-}
-
 // AssertionMiddleware creates an HTTP handler that can be used to authenticate
 // and validate an assertion. If the assertion is valid the flow it passed to
-// the given grantFn function.
+// the given grantFn function. The RelayState, looked up in RelayStateStore
+// when it is set, is stored in the context as "saml.RelayState". The response
+// must be posted, unless AllowResponseInQuery is set.
 func (sp *ServiceProvider) AssertionMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		now := Now()
-
 		if err := parseFormAndKeepBody(r); err != nil {
 			clientErr(w, r, errors.Wrap(err, "Unable to read POST data"))
+			return
 		}
 
-		samlResponse := r.Form.Get("SAMLResponse")
+		// The response is posted by the IdP, so it is only taken from the
+		// query string when AllowResponseInQuery is set.
+		form := r.PostForm
+		if sp.AllowResponseInQuery && r.Method == http.MethodGet {
+			form = r.URL.Query()
+		}
+		samlResponse := form.Get("SAMLResponse")
 
 		// This RelayState (if any) needs to be been validated by the invoker.
-		relayState := r.Form.Get("RelayState")
+		relayState := form.Get("RelayState")
 
 		// TODO: Remove this when we're stable enough.
 		Logf("SAMLResponse -> %v", samlResponse)
 		Logf("relayState -> %v", relayState)
 
-		_ = relayState // Don't know what to do with this yet.
+		if sp.RelayStateStore != nil {
+			if state, ok := sp.RelayStateStore.Take(relayState); ok {
+				relayState = state
+			}
+		}
 
 		samlResponseXML, err := base64.StdEncoding.DecodeString(samlResponse)
 		if err != nil {
@@ -168,260 +204,33 @@ func (sp *ServiceProvider) AssertionMiddleware(next http.Handler) http.Handler {
 
 		Logf("SAMLResponse (XML) -> %v", string(samlResponseXML))
 
-		var res Response
-		err = xml.Unmarshal(samlResponseXML, &res)
-		if err != nil {
-			err = errors.Wrapf(err, "could not unmarshal XML document: %s", string(samlResponseXML))
-			clientErr(w, r, errors.Wrap(err, "Malformed XML"))
-			return
-		}
-
-		_, err = sp.GetIdPMetadata()
-		if err != nil {
-			clientErr(w, r, errors.Wrap(err, "unable to retrieve IdP metadata"))
-			return
-		}
-
-		// Validate message.
-
-		if res.Destination != sp.AcsURL {
-			// Note: OneLogin triggers this error when the Recipient field
-			// is left blank (or when not set to the correct ACS endpoint)
-			// in the OneLogin SAML configuration page. OneLogin returns
-			// Destination="{recipient}" in the SAML reponse in this case.
-			err := errors.Errorf("Wrong ACS destination, expecting %q, got %q", sp.AcsURL, res.Destination)
-			clientErr(w, r, errors.Wrap(err, "Wrong ACS destination"))
-			return
-		}
-
-		if sp.IdPMetadata.EntityID != "" {
-			if res.Issuer == nil {
-				clientErr(w, r, errors.New(`Missing "Issuer" node`))
-				return
-			}
-			if res.Issuer.Value != sp.IdPMetadata.EntityID {
-				err := errors.Errorf("Issuer %q does not match expected entity ID %q", res.Issuer.Value, sp.IdPMetadata.EntityID)
-				clientErr(w, r, errors.Wrap(err, "Issuer does not match expected entity ID"))
-				return
-			}
-		}
-
-		if res.Status.StatusCode.Value != "urn:oasis:names:tc:SAML:2.0:status:Success" {
-			err := errors.Errorf("Unexpected status code: %v", res.Status.StatusCode.Value)
-			clientErr(w, r, errors.Wrap(err, "Unexpected status code"))
-			return
-		}
-
-		expectedResponse := false
-		responseIDs := sp.possibleResponseIDs()
-		for i := range responseIDs {
-			if responseIDs[i] == res.InResponseTo {
-				expectedResponse = true
-			}
-		}
-		if len(responseIDs) == 1 && responseIDs[0] == "" {
-			expectedResponse = true
-		}
-		if !expectedResponse && len(responseIDs) > 0 {
-			err := errors.Errorf("Expecting a proper InResponseTo value, got %#v", responseIDs)
-			clientErr(w, r, err)
-			return
-		}
-
-		// Try getting the IdP's cert file before using it.
-		_, err = sp.GetIdPCertFile()
+		validator, err := sp.ResponseValidator()
 		if err != nil {
-			internalErr(w, errors.Errorf("Failed to get private key: %v", err))
-			return
-		}
-
-		// Validate signatures
-
-		if res.Signature != nil {
-			err := validateSignedNode(res.Signature, res.ID)
-			if err != nil {
-				clientErr(w, r, errors.Wrap(err, "failed to validate Response + Signature"))
-				return
-			}
-		}
-
-		if res.Assertion != nil && res.Assertion.Signature != nil {
-			err := validateSignedNode(res.Assertion.Signature, res.Assertion.ID)
-			if err != nil {
-				clientErr(w, r, errors.Wrap(err, "failed to validate Assertion + Signature"))
-				return
-			}
-		}
-
-		// Validating message.
-		signatureOK := false
-
-		if res.Signature != nil || (res.Assertion != nil && res.Assertion.Signature != nil) {
-			err := sp.verifySignature(samlResponseXML)
-			if err != nil {
-				clientErr(w, r, errors.Wrapf(err, "Unable to verify message signature"))
-				return
-			} else {
-				signatureOK = true
-			}
-		}
-
-		// Retrieve assertion
-		var assertion *Assertion
-
-		if res.EncryptedAssertion != nil {
-			keyFile, err := sp.PrivkeyFile()
-			if err != nil {
-				internalErr(w, errors.Errorf("Failed to get private key: %v", err))
-				return
-			}
-
-			plainTextAssertion, err := xmlsec.Decrypt(res.EncryptedAssertion.EncryptedData, keyFile)
-			if err != nil {
-				if IsSecurityException(err, &sp.SecurityOpts) {
-					clientErr(w, r, errors.Wrap(err, "Unable to decrypt message"))
-					return
-				}
-			}
-
-			assertion = &Assertion{}
-			if err := xml.Unmarshal(plainTextAssertion, assertion); err != nil {
-				clientErr(w, r, errors.Wrap(err, "Unable to parse assertion"))
-				return
-			}
-
-			if assertion.Signature != nil {
-				err := validateSignedNode(assertion.Signature, assertion.ID)
-				if err != nil {
-					clientErr(w, r, errors.Wrap(err, "failed to validate Assertion + Signature"))
-					return
-				}
-
-				err = sp.verifySignature(plainTextAssertion)
-				if err != nil {
-					clientErr(w, r, errors.Wrapf(err, "Unable to verify assertion signature"))
-					return
-				} else {
-					signatureOK = true
-				}
-			}
-		} else {
-			assertion = res.Assertion
-		}
-		if assertion == nil {
-			clientErr(w, r, errors.New("Missing assertion"))
+			internalErr(w, err)
 			return
 		}
-
-		// Did we receive a signature?
-		if !signatureOK {
-			clientErr(w, r, errors.New("Unable to validate signature: node not found"))
-			return
-		}
-
-		// Validate assertion.
-		{
-			var err error
-			switch {
-			case sp.IdPMetadata.EntityID == "":
-				// Skip issuer validation
-			case res.Issuer == nil:
-				err = errors.New(`missing Assertion > Issuer`)
-			case assertion.Issuer.Value != sp.IdPMetadata.EntityID:
-				err = errors.Errorf("Assertion issuer %q does not match expected entity ID %q", assertion.Issuer.Value, sp.IdPMetadata.EntityID)
-			}
-			if err != nil {
-				clientErr(w, r, errors.Wrap(err, "Assertion issuer does not match expected entity ID"))
-			}
-		}
-
-		// Validate recipient
-		{
-			var err error
-			switch {
-			case assertion.Subject == nil:
-				err = errors.New(`missing Assertion > Subject`)
-			case assertion.Subject.SubjectConfirmation == nil:
-				err = errors.New(`missing Assertion > Subject > SubjectConfirmation`)
-			case assertion.Subject.SubjectConfirmation.SubjectConfirmationData.Recipient != sp.AcsURL:
-				err = errors.Errorf("unexpected assertion recipient, expecting %q, got %q", sp.AcsURL, assertion.Subject.SubjectConfirmation.SubjectConfirmationData.Recipient)
-			}
+		if sp.HolderOfKey {
+			cert, err := clientCertificate(sp.ClientCertificate, r)
 			if err != nil {
-				clientErr(w, r, errors.Wrapf(err, "invalid assertion recipient"))
+				internalErr(w, err)
 				return
 			}
-		}
-
-		// Make sure we have Conditions
-		if assertion.Conditions == nil {
-			clientErr(w, r, errors.New(`missing Assertion > Conditions`))
-			return
-		}
-
-		// The NotBefore and NotOnOrAfter attributes specify time limits on the
-		// validity of the assertion within the context of its profile(s) of use.
-		// They do not guarantee that the statements in the assertion will be
-		// correct or accurate throughout the validity period. The NotBefore
-		// attribute specifies the time instant at which the validity interval
-		// begins. The NotOnOrAfter attribute specifies the time instant at which
-		// the validity interval has ended. If the value for either NotBefore or
-		// NotOnOrAfter is omitted, then it is considered unspecified.
-		{
-			validFrom := assertion.Conditions.NotBefore
-			if !validFrom.IsZero() && validFrom.After(now.Add(ClockDriftTolerance)) {
-				err := errors.Errorf("Assertion conditions are not valid yet, got %v, current time is %v", validFrom, now)
-				clientErr(w, r, errors.Wrap(err, "Assertion conditions are not valid yet"))
-				return
-			}
-		}
-
-		{
-			validUntil := assertion.Conditions.NotOnOrAfter
-			if !validUntil.IsZero() && validUntil.Before(now.Add(-ClockDriftTolerance)) {
-				err := errors.Errorf("Assertion conditions already expired, got %v current time is %v, extra time is %v", validUntil, now, now.Add(-ClockDriftTolerance))
-				clientErr(w, r, errors.Wrap(err, "Assertion conditions already expired"))
+			if cert == nil {
+				clientErr(w, r, errors.New("Holder-of-key assertion without a TLS client certificate"))
 				return
 			}
+			validator.ClientCertificate = cert
 		}
 
-		// A time instant at which the subject can no longer be confirmed. The time
-		// value is encoded in UTC, as described in Section 1.3.3.
-		//
-		// Note that the time period specified by the optional NotBefore and
-		// NotOnOrAfter attributes, if present, SHOULD fall within the overall
-		// assertion validity period as specified by the element's NotBefore and
-		// NotOnOrAfter attributes. If both attributes are present, the value for
-		// NotBefore MUST be less than (earlier than) the value for NotOnOrAfter.
-
-		if validUntil := assertion.Subject.SubjectConfirmation.SubjectConfirmationData.NotOnOrAfter; validUntil.Before(now.Add(-ClockDriftTolerance)) {
-			err := errors.Errorf("Assertion conditions already expired, got %v current time is %v", validUntil, now)
-			clientErr(w, r, errors.Wrap(err, "Assertion conditions already expired"))
-			return
-		}
-
-		// if assertion.Conditions != nil && assertion.Conditions.AudienceRestriction != nil {
-		//   if assertion.Conditions.AudienceRestriction.Audience.Value != sp.MetadataURL {
-		//     clientErr(w, fmt.Errorf("Audience restriction mismatch, got %q, expecting %q", assertion.Conditions.AudienceRestriction.Audience.Value, sp.MetadataURL), errors.New("Audience restriction mismatch"))
-		//     return
-		//   }
-		// }
-
-		expectedResponse = false
-		for i := range responseIDs {
-			if responseIDs[i] == assertion.Subject.SubjectConfirmation.SubjectConfirmationData.InResponseTo {
-				expectedResponse = true
-			}
-		}
-		if len(responseIDs) == 1 && responseIDs[0] == "" {
-			expectedResponse = true
-		}
-
-		if !expectedResponse && len(responseIDs) > 0 {
-			clientErr(w, r, errors.New("Unexpected assertion InResponseTo value"))
+		res, assertion, err := validator.validate(samlResponseXML)
+		if err != nil {
+			clientErr(w, r, err)
 			return
 		}
 
 		ctx := context.WithValue(r.Context(), "saml.assertion", assertion)
+		ctx = context.WithValue(ctx, "saml.response", res)
+		ctx = context.WithValue(ctx, "saml.RelayState", relayState)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
@@ -449,7 +258,7 @@ func clientErr(w http.ResponseWriter, r *http.Request, err error) {
 
 	Fatal(fmt.Errorf("failed request: %v, details: %s", err, report.String()))
 
-	w.Header().Set("Content-Type", "text/plain; charset=utf8")
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	w.WriteHeader(http.StatusBadRequest)
 	w.Write([]byte(publicError))
 }
@@ -461,7 +270,7 @@ func internalErr(w http.ResponseWriter, err error) {
 func serverErr(w http.ResponseWriter, err error) {
 	Fatal(err)
 
-	w.Header().Set("Content-Type", "text/plain; charset=utf8")
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	w.WriteHeader(http.StatusInternalServerError)
 	w.Write([]byte(publicErrorMessage(err)))
 }
@@ -1,11 +1,29 @@
 package saml
 
 import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
 	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os/exec"
+	"strings"
 	"testing"
 	"time"
 	//"log"
 
+	"github.com/goware/saml/xmlsec"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -148,8 +166,687 @@ func TestMakeAuthenticationRequest(t *testing.T) {
 
 	expectedOutput := `<AuthnRequest xmlns="urn:oasis:names:tc:SAML:2.0:protocol" AssertionConsumerServiceURL="http://localhost:1235/saml/acs" Destination="http://localhost:1233/saml/sso" ID="id-MOCKID" IssueInstant="` + Now().Format(time.RFC3339Nano) + `" ProtocolBinding="" Version="2.0">
 	<Issuer xmlns="urn:oasis:names:tc:SAML:2.0:assertion" Format="urn:oasis:names:tc:SAML:2.0:nameid-format:entity">http://localhost:1235/saml/service.xml</Issuer>
-	<NameIDPolicy xmlns="urn:oasis:names:tc:SAML:2.0:protocol" AllowCreate="true">urn:oasis:names:tc:SAML:2.0:nameid-format:transient</NameIDPolicy>
+	<NameIDPolicy xmlns="urn:oasis:names:tc:SAML:2.0:protocol" AllowCreate="true" Format="urn:oasis:names:tc:SAML:2.0:nameid-format:transient"></NameIDPolicy>
 </AuthnRequest>`
 
 	assert.Equal(t, expectedOutput, string(out))
 }
+
+func TestContainsID(t *testing.T) {
+	assert.True(t, containsID([]string{"id-a", "id-b"}, "id-b"))
+	assert.False(t, containsID([]string{"id-a", "id-b"}, "id-c"))
+	assert.False(t, containsID([]string{"id-a"}, "id-"))
+	assert.False(t, containsID(nil, ""))
+	assert.True(t, containsID([]string{""}, ""))
+}
+
+func TestDeflateMessageRoundTrip(t *testing.T) {
+	tearUp()
+
+	authnRequest, err := testSP.MakeAuthenticationRequest("http://localhost:1233/saml/sso")
+	assert.NoError(t, err)
+
+	buf, err := xml.Marshal(authnRequest)
+	assert.NoError(t, err)
+
+	for _, level := range []int{flate.NoCompression, flate.DefaultCompression, flate.BestSpeed, flate.BestCompression, flate.HuffmanOnly} {
+		message, err := deflateMessage(buf, level)
+		assert.NoError(t, err)
+
+		out, err := inflateMessage(message)
+		assert.NoError(t, err)
+		assert.Equal(t, string(buf), string(out))
+	}
+
+	_, err = deflateMessage(buf, 42)
+	assert.Error(t, err)
+}
+
+func TestCompressionLevel(t *testing.T) {
+	tearUp()
+
+	messageSize := func(sp *ServiceProvider) int {
+		redirectURL, err := sp.AuthnRequestRedirectURL("relay")
+		assert.NoError(t, err)
+		u, err := url.Parse(redirectURL)
+		assert.NoError(t, err)
+		message, err := base64.StdEncoding.DecodeString(u.Query().Get("SAMLRequest"))
+		assert.NoError(t, err)
+		return len(message)
+	}
+
+	idpMetadata, err := testIdP.Metadata()
+	assert.NoError(t, err)
+	sp := *testSP
+	sp.IdPMetadata = idpMetadata
+	compressed := messageSize(&sp)
+
+	// NoCompression is honored, not mistaken for an unset level.
+	level := flate.NoCompression
+	sp.CompressionLevel = &level
+	assert.True(t, messageSize(&sp) > compressed)
+}
+
+func TestOutboundRelayState(t *testing.T) {
+	tearUp()
+
+	maxState := strings.Repeat("a", MaxRelayStateLength)
+	longState := maxState + "a"
+
+	state, err := outboundRelayState(maxState, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, maxState, state)
+
+	_, err = outboundRelayState(longState, nil)
+	assert.Equal(t, ErrRelayStateTooLong, err)
+
+	store := NewMemoryRelayStateStore(time.Minute)
+
+	// Short states are sent as is, even with a store.
+	state, err = outboundRelayState(maxState, store)
+	assert.NoError(t, err)
+	assert.Equal(t, maxState, state)
+
+	token, err := outboundRelayState(longState, store)
+	assert.NoError(t, err)
+	assert.Equal(t, "id-MOCKID", token)
+
+	state, ok := store.Take(token)
+	assert.True(t, ok)
+	assert.Equal(t, longState, state)
+
+	// Tokens can only be used once.
+	_, ok = store.Take(token)
+	assert.False(t, ok)
+
+	// Expired tokens are unknown.
+	token, err = store.Put(longState)
+	assert.NoError(t, err)
+	now := Now()
+	Now = func() time.Time {
+		return now.Add(2 * time.Minute)
+	}
+	_, ok = store.Take(token)
+	assert.False(t, ok)
+}
+
+func TestSignedRelayState(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+
+	token := EncodeRelayState([]byte("/reports/42?tab=summary"), key)
+	data, err := DecodeRelayState(token, key)
+	assert.NoError(t, err)
+	assert.Equal(t, "/reports/42?tab=summary", string(data))
+	assert.Equal(t, token, url.QueryEscape(token))
+
+	// Tokens fit in a RelayState up to MaxSignedRelayStateData bytes.
+	assert.Len(t, EncodeRelayState(make([]byte, MaxSignedRelayStateData), key), MaxRelayStateLength)
+	assert.True(t, len(EncodeRelayState(make([]byte, MaxSignedRelayStateData+1), key)) > MaxRelayStateLength)
+
+	// Altered tokens, and tokens signed with another key, are rejected.
+	tampered := EncodeRelayState([]byte("/reports/43?tab=summary"), key)
+	tampered = tampered[:len(tampered)-22] + token[len(token)-22:]
+	for _, token := range []string{tampered, EncodeRelayState(data, []byte("another key")), "", "!!", "c2hvcnQ"} {
+		_, err := DecodeRelayState(token, key)
+		assert.Equal(t, ErrInvalidRelayState, err, token)
+	}
+	_, err = DecodeRelayState(token, nil)
+	assert.Error(t, err)
+}
+
+func TestAuthnRequestHandlerRelayState(t *testing.T) {
+	tearUp()
+
+	idpMetadata, err := testIdP.Metadata()
+	assert.NoError(t, err)
+
+	sp := *testSP
+	sp.IdPMetadata = idpMetadata
+
+	authnRequest := func(relayState string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/saml/login", nil)
+		r = r.WithContext(context.WithValue(r.Context(), "saml.RelayState", relayState))
+		w := httptest.NewRecorder()
+		sp.AuthnRequestHandler(w, r)
+		return w
+	}
+	relayState := func(w *httptest.ResponseRecorder) string {
+		location, err := url.Parse(w.Header().Get("Location"))
+		assert.NoError(t, err)
+		return location.Query().Get("RelayState")
+	}
+
+	maxState := strings.Repeat("a", MaxRelayStateLength)
+	w := authnRequest(maxState)
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, maxState, relayState(w))
+
+	w = authnRequest(maxState + "a")
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+
+	sp.RelayStateStore = NewMemoryRelayStateStore(time.Minute)
+	w = authnRequest(maxState + "a")
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, "id-MOCKID", relayState(w))
+}
+
+func TestRedirectAuthnRequest(t *testing.T) {
+	tearUp()
+
+	idpMetadata, err := testIdP.Metadata()
+	assert.NoError(t, err)
+
+	sp := *testSP
+	sp.IdPMetadata = idpMetadata
+
+	r := httptest.NewRequest("POST", "/saml/login", nil)
+	r = r.WithContext(context.WithValue(r.Context(), "saml.RelayState", "/dashboard"))
+	w := httptest.NewRecorder()
+	sp.RedirectAuthnRequest(w, r)
+	assert.Equal(t, http.StatusSeeOther, w.Code)
+
+	location, err := url.Parse(w.Header().Get("Location"))
+	assert.NoError(t, err)
+	assert.Equal(t, testIdP.SSOURL, location.Scheme+"://"+location.Host+location.Path)
+	assert.Equal(t, "/dashboard", location.Query().Get("RelayState"))
+
+	buf, err := inflateMessage(location.Query().Get("SAMLRequest"))
+	assert.NoError(t, err)
+	var authnRequest AuthnRequest
+	assert.NoError(t, xml.Unmarshal(buf, &authnRequest))
+	assert.Equal(t, testSP.MetadataURL, authnRequest.Issuer.Value)
+	assert.Equal(t, testIdP.SSOURL, authnRequest.Destination)
+
+	// Query parameters of the SSO URL are kept.
+	sp.IdPMetadata.IDPSSODescriptor.SingleSignOnService[0].Location = testIdP.SSOURL + "?tenant=acme"
+	redirectURL, err := sp.AuthnRequestRedirectURL("")
+	assert.NoError(t, err)
+	location, err = url.Parse(redirectURL)
+	assert.NoError(t, err)
+	assert.Equal(t, "acme", location.Query().Get("tenant"))
+	assert.NotEmpty(t, location.Query().Get("SAMLRequest"))
+}
+
+func TestValidateAudience(t *testing.T) {
+	tearUp()
+
+	var conditions Conditions
+	err := xml.Unmarshal([]byte(`<Conditions xmlns="urn:oasis:names:tc:SAML:2.0:assertion">
+		<AudienceRestriction>
+			<Audience>https://sp-a.example.com/saml/metadata</Audience>
+			<Audience>https://sp-b.example.com/saml/metadata</Audience>
+		</AudienceRestriction>
+	</Conditions>`), &conditions)
+	assert.NoError(t, err)
+	assertion := &Assertion{Conditions: &conditions}
+
+	// Any of the audiences will do.
+	assert.NoError(t, validateAudience(assertion, "https://sp-a.example.com/saml/metadata"))
+	assert.NoError(t, validateAudience(assertion, "https://sp-b.example.com/saml/metadata"))
+	err = validateAudience(assertion, "https://sp-c.example.com/saml/metadata")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), `got "https://sp-a.example.com/saml/metadata", "https://sp-b.example.com/saml/metadata", expecting "https://sp-c.example.com/saml/metadata"`)
+	}
+
+	assertion.Conditions = &Conditions{AudienceRestriction: &AudienceRestriction{Audience: &Audience{Value: testSP.MetadataURL}}}
+	assert.NoError(t, validateAudience(assertion, testSP.MetadataURL))
+	assertion.Conditions = &Conditions{}
+	assert.Error(t, validateAudience(assertion, testSP.MetadataURL))
+
+	// The SP checks its own entity ID unless told not to.
+	idpMetadata, err := testIdP.Metadata()
+	assert.NoError(t, err)
+	sp := *testSP
+	sp.IdPMetadata = idpMetadata
+	v, err := sp.ResponseValidator()
+	assert.NoError(t, err)
+	assert.Equal(t, testSP.MetadataURL, v.Audience)
+
+	sp.SkipAudienceCheck = true
+	v, err = sp.ResponseValidator()
+	assert.NoError(t, err)
+	assert.Empty(t, v.Audience)
+}
+
+func TestValidateSubjectConfirmation(t *testing.T) {
+	tearUp()
+
+	v := &ResponseValidator{AcsURL: testSP.AcsURL}
+	now := Now()
+
+	makeAssertion := func(recipient string, notOnOrAfter time.Time) *Assertion {
+		return &Assertion{
+			Subject: &Subject{
+				SubjectConfirmations: []SubjectConfirmation{{
+					Method: SubjectConfirmationMethodBearer,
+					SubjectConfirmationData: SubjectConfirmationData{
+						Recipient:    recipient,
+						NotOnOrAfter: notOnOrAfter,
+					},
+				}},
+			},
+		}
+	}
+
+	assert.NoError(t, v.validateSubjectConfirmation(makeAssertion(v.AcsURL, now.Add(time.Minute)), now))
+	assert.Error(t, v.validateSubjectConfirmation(makeAssertion(v.AcsURL, now.Add(-time.Minute)), now))
+	assert.Error(t, v.validateSubjectConfirmation(makeAssertion("", now.Add(time.Minute)), now))
+	assert.Error(t, v.validateSubjectConfirmation(makeAssertion("http://evil.example.com/acs", now.Add(time.Minute)), now))
+
+	// Some spellings of the ACS URL are the same endpoint, the others are
+	// rejected with both URLs in the error.
+	v.AcsURL = "https://sp.example.com/saml/acs"
+	assert.NoError(t, v.validateSubjectConfirmation(makeAssertion("HTTPS://SP.example.com:443/saml/acs", now.Add(time.Minute)), now))
+	for _, recipient := range []string{"http://sp.example.com/saml/acs", "https://sp.example.com:8443/saml/acs", "https://sp.example.com/SAML/acs", "https://sp.example.com/saml/acs/"} {
+		err := v.validateSubjectConfirmation(makeAssertion(recipient, now.Add(time.Minute)), now)
+		if assert.Error(t, err, recipient) {
+			assert.Contains(t, err.Error(), `expecting "https://sp.example.com/saml/acs", got "`+recipient+`"`)
+		}
+	}
+	assert.True(t, sameURL("http://sp.example.com", "http://sp.example.com:80/"))
+	assert.False(t, sameURL("http://sp.example.com/acs?a=1", "http://sp.example.com/acs"))
+
+	err := v.validateSubjectConfirmation(makeAssertion(v.AcsURL, time.Time{}), now)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "NotOnOrAfter")
+
+	v.AllowMissingSubjectConfirmationExpiry = true
+	assert.NoError(t, v.validateSubjectConfirmation(makeAssertion(v.AcsURL, time.Time{}), now))
+	assert.Error(t, v.validateSubjectConfirmation(makeAssertion("", time.Time{}), now))
+}
+
+func TestNameIDFormats(t *testing.T) {
+	tearUp()
+
+	v := &ResponseValidator{}
+	assertion := &Assertion{Subject: &Subject{NameID: &NameID{Format: NameIDFormatTransient, Value: "id-1"}}}
+
+	// Lenient by default.
+	assert.NoError(t, v.validateNameIDFormat(assertion))
+	assert.NoError(t, v.validateNameIDFormat(&Assertion{}))
+
+	v.NameIDFormats = []string{NameIDFormatPersistent}
+	err := v.validateNameIDFormat(assertion)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), NameIDFormatTransient)
+	assert.Error(t, v.validateNameIDFormat(&Assertion{}))
+
+	assertion.Subject.NameID.Format = NameIDFormatPersistent
+	assert.NoError(t, v.validateNameIDFormat(assertion))
+
+	assertion.Subject.NameID.Format = ""
+	assert.Error(t, v.validateNameIDFormat(assertion))
+	v.NameIDFormats = append(v.NameIDFormats, NameIDFormatUnspecified)
+	assert.NoError(t, v.validateNameIDFormat(assertion))
+
+	// The SP requests and advertises its first format.
+	sp := *testSP
+	sp.AcceptedNameIDFormats = []string{NameIDFormatPersistent, NameIDFormatEmailAddress}
+	req, err := sp.MakeAuthenticationRequest(testIdP.SSOURL)
+	assert.NoError(t, err)
+	assert.Equal(t, NameIDFormatPersistent, req.NameIDPolicy.Format)
+	metadata, err := sp.Metadata()
+	assert.NoError(t, err)
+	assert.Equal(t, sp.AcceptedNameIDFormats, metadata.SPSSODescriptor.NameIDFormat)
+}
+
+func TestHolderOfKeyValidation(t *testing.T) {
+	tearUp()
+
+	block, _ := pem.Decode([]byte(testSP.PubkeyPEM))
+	clientCert, err := x509.ParseCertificate(block.Bytes)
+	assert.NoError(t, err)
+	otherCert := &x509.Certificate{Raw: []byte("other")}
+
+	data := SubjectConfirmationData{Recipient: testSP.AcsURL, NotOnOrAfter: Now().Add(time.Minute)}
+	bearer := SubjectConfirmation{Method: SubjectConfirmationMethodBearer, SubjectConfirmationData: data}
+	data.KeyInfo = &KeyInfo{Certificate: base64.StdEncoding.EncodeToString(clientCert.Raw)}
+	holderOfKey := SubjectConfirmation{Method: SubjectConfirmationMethodHolderOfKey, SubjectConfirmationData: data}
+
+	v := &ResponseValidator{AcsURL: testSP.AcsURL, ClientCertificate: clientCert}
+	assertion := &Assertion{Subject: &Subject{SubjectConfirmations: []SubjectConfirmation{bearer, holderOfKey}}}
+	assert.NoError(t, v.validateSubjectConfirmation(assertion, Now()))
+
+	// A bearer confirmation is not enough, nor is one bound to another key.
+	assertion.Subject.SubjectConfirmations = []SubjectConfirmation{bearer}
+	assert.Error(t, v.validateSubjectConfirmation(assertion, Now()))
+	v.ClientCertificate = otherCert
+	assertion.Subject.SubjectConfirmations = []SubjectConfirmation{bearer, holderOfKey}
+	err = v.validateSubjectConfirmation(assertion, Now())
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "bound to the TLS client certificate")
+	}
+
+	// The holder-of-key confirmation is checked like a bearer one.
+	v.ClientCertificate = clientCert
+	assertion.Subject.SubjectConfirmations[1].SubjectConfirmationData.Recipient = "https://evil.example.com/acs"
+	assert.Error(t, v.validateSubjectConfirmation(assertion, Now()))
+
+	// The ACS requires a client certificate.
+	sp := *testSP
+	sp.HolderOfKey = true
+	idpMetadata, err := testIdP.Metadata()
+	assert.NoError(t, err)
+	sp.IdPMetadata = idpMetadata
+	called := false
+	handler := sp.AssertionMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	form := url.Values{"SAMLResponse": {base64.StdEncoding.EncodeToString([]byte("<Response/>"))}}
+	r := httptest.NewRequest("POST", testSP.AcsURL, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.False(t, called)
+	assert.Contains(t, w.Body.String(), "Holder-of-key")
+
+	r = httptest.NewRequest("POST", testSP.AcsURL, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{clientCert}}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.False(t, called)
+	assert.NotContains(t, w.Body.String(), "Holder-of-key")
+}
+
+func TestResponseInQuery(t *testing.T) {
+	tearUp()
+
+	sp := *testSP
+	idpMetadata, err := testIdP.Metadata()
+	assert.NoError(t, err)
+	sp.IdPMetadata = idpMetadata
+
+	handler := sp.AssertionMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	serve := func() string {
+		response := `<Response xmlns="urn:oasis:names:tc:SAML:2.0:protocol" Version="2.0"></Response>`
+		query := url.Values{"SAMLResponse": {base64.StdEncoding.EncodeToString([]byte(response))}}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", testSP.AcsURL+"?"+query.Encode(), nil))
+		return w.Body.String()
+	}
+
+	// The query string is ignored by default.
+	assert.Contains(t, serve(), "Malformed XML")
+
+	sp.AllowResponseInQuery = true
+	assert.Contains(t, serve(), "Wrong ACS destination")
+}
+
+func TestMaxAssertionAge(t *testing.T) {
+	tearUp()
+
+	v := &ResponseValidator{}
+	now := Now()
+	assertion := &Assertion{IssueInstant: now.Add(-5 * time.Minute)}
+
+	assert.NoError(t, v.validateAssertionAge(assertion, now))
+
+	v.MaxAssertionAge = 2 * time.Minute
+	err := v.validateAssertionAge(assertion, now)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "too old")
+
+	assert.NoError(t, v.validateAssertionAge(&Assertion{IssueInstant: now.Add(-time.Minute)}, now))
+	assert.Error(t, v.validateAssertionAge(&Assertion{}, now))
+
+	v.ClockSkew = 5 * time.Minute
+	assert.NoError(t, v.validateAssertionAge(assertion, now))
+}
+
+func TestMetadataContentType(t *testing.T) {
+	tearUp()
+
+	sp := *testSP
+
+	w := httptest.NewRecorder()
+	sp.MetadataHandler(w, httptest.NewRequest("GET", "/saml/metadata", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/xml; charset=utf-8", w.Header().Get("Content-Type"))
+
+	sp.MetadataContentType = "application/samlmetadata+xml"
+
+	w = httptest.NewRecorder()
+	sp.MetadataHandler(w, httptest.NewRequest("GET", "/saml/metadata", nil))
+	assert.Equal(t, "application/samlmetadata+xml", w.Header().Get("Content-Type"))
+}
+
+func TestResponseValidator(t *testing.T) {
+	tearUp()
+
+	v := &ResponseValidator{
+		IdPEntityID: "http://localhost:1233/saml/service.xml",
+		AcsURL:      testSP.AcsURL,
+	}
+
+	makeResponse := func(destination, issuer, status string) []byte {
+		buf, err := xml.Marshal(&Response{
+			Destination:  destination,
+			ID:           "id-1",
+			IssueInstant: Now(),
+			Version:      "2.0",
+			Issuer:       &Issuer{Value: issuer},
+			Status:       &Status{StatusCode: StatusCode{Value: status}},
+			Assertion:    &Assertion{ID: "id-2"},
+		})
+		assert.NoError(t, err)
+		return buf
+	}
+
+	_, err := v.Validate([]byte("<Response"))
+	assert.Error(t, err)
+
+	_, err = v.Validate(makeResponse("http://evil.example.com/acs", v.IdPEntityID, StatusSuccess))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "Wrong ACS destination")
+
+	_, err = v.Validate(makeResponse(v.AcsURL, "http://evil.example.com", StatusSuccess))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "Issuer does not match")
+
+	_, err = v.Validate(makeResponse(v.AcsURL, v.IdPEntityID, StatusRequestDenied))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "Unexpected status code")
+
+	_, err = v.Validate(makeResponse(v.AcsURL, v.IdPEntityID, StatusSuccess))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "node not found")
+
+	// A signed plaintext assertion must not vouch for an encrypted one.
+	buf, err := xml.Marshal(&Response{
+		Destination:        v.AcsURL,
+		ID:                 "id-1",
+		IssueInstant:       Now(),
+		Version:            "2.0",
+		Issuer:             &Issuer{Value: v.IdPEntityID},
+		Status:             &Status{StatusCode: StatusCode{Value: StatusSuccess}},
+		EncryptedAssertion: &EncryptedAssertion{EncryptedData: []byte("<EncryptedData/>")},
+		Assertion:          &Assertion{ID: "id-2"},
+	})
+	assert.NoError(t, err)
+	_, err = v.Validate(buf)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "both an Assertion and an EncryptedAssertion")
+}
+
+func TestValidateDetailed(t *testing.T) {
+	tearUp()
+
+	v := &ResponseValidator{
+		IdPEntityID: "http://localhost:1233/saml/service.xml",
+		AcsURL:      testSP.AcsURL,
+		ResponseIDs: []string{"id-request"},
+	}
+
+	result := v.ValidateDetailed([]byte("<Response"))
+	assert.Nil(t, result.Response)
+	if assert.Len(t, result.Failed(), 1) {
+		assert.Equal(t, CheckMessage, result.Failed()[0].Name)
+	}
+
+	// Every independent check runs, and the result collapses to the error
+	// Validate returns.
+	buf, err := xml.Marshal(&Response{
+		Destination:  "http://evil.example.com/acs",
+		ID:           "id-1",
+		InResponseTo: "id-request",
+		IssueInstant: Now(),
+		Version:      "2.0",
+		Issuer:       &Issuer{Value: "http://evil.example.com"},
+		Status:       &Status{StatusCode: StatusCode{Value: StatusRequestDenied}},
+		Assertion:    &Assertion{ID: "id-2"},
+	})
+	assert.NoError(t, err)
+	result = v.ValidateDetailed(buf)
+	assert.NotNil(t, result.Response)
+	assert.Nil(t, result.Assertion)
+
+	var names []string
+	for _, check := range result.Checks {
+		names = append(names, check.Name)
+	}
+	assert.Equal(t, []string{CheckVersion, CheckDestination, CheckIssuer, CheckStatus, CheckInResponseTo, CheckSignature}, names)
+
+	var failed []string
+	for _, check := range result.Failed() {
+		failed = append(failed, check.Name)
+	}
+	assert.Equal(t, []string{CheckDestination, CheckIssuer, CheckStatus, CheckSignature}, failed)
+	assert.True(t, result.Check(CheckInResponseTo).Passed())
+	assert.Contains(t, result.Check(CheckStatus).Err.Error(), "Unexpected status code")
+	assert.Nil(t, result.Check(CheckAudience))
+
+	_, err = v.Validate(buf)
+	assert.Equal(t, result.Err().Error(), err.Error())
+	assert.Contains(t, err.Error(), "Wrong ACS destination")
+
+	// Validate does not verify the signature of a rejected response.
+	assert.Nil(t, v.runChecks(buf, false).Check(CheckSignature))
+}
+
+func TestResponseVersion(t *testing.T) {
+	tearUp()
+
+	v := &ResponseValidator{AcsURL: testSP.AcsURL}
+	for _, version := range []string{"", "1.1", "2.1"} {
+		buf, err := xml.Marshal(&Response{
+			Destination: v.AcsURL,
+			ID:          "id-1",
+			Version:     version,
+			Status:      &Status{StatusCode: StatusCode{Value: StatusSuccess}},
+		})
+		assert.NoError(t, err)
+		_, err = v.Validate(buf)
+		assert.Equal(t, CheckVersion, v.ValidateDetailed(buf).Failed()[0].Name, "version: %q", version)
+		assert.Contains(t, err.Error(), ErrUnsupportedVersion.Error())
+	}
+}
+
+// azureADResponse generates a response shaped like Azure AD's: a signed
+// samlp:Response holding an unsigned assertion encrypted to testSP with
+// aes256-cbc and rsa-oaep-mgf1p, signed by testIdP with rsa-sha256 under an
+// Azure AD issuer. It is built rather than captured from a tenant, with a
+// fresh content key on every run.
+func azureADResponse(t *testing.T) []byte {
+	assertion := `<Assertion xmlns="urn:oasis:names:tc:SAML:2.0:assertion" ID="_3f6c1d0a-8e2b-4b7f-9a41-5d0e7c2b9f18" IssueInstant="2026-10-14T09:30:00.000Z" Version="2.0">` +
+		`<Issuer>https://sts.windows.net/72f988bf-86f1-41af-91ab-2d7cd011db47/</Issuer>` +
+		`<Subject><NameID Format="urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress">adele.vance@contoso.com</NameID>` +
+		`<SubjectConfirmation Method="urn:oasis:names:tc:SAML:2.0:cm:bearer"><SubjectConfirmationData InResponseTo="id-MOCKID" NotOnOrAfter="2026-10-14T09:35:00.000Z" Recipient="` + testSP.AcsURL + `"/></SubjectConfirmation></Subject>` +
+		`<Conditions NotBefore="2026-10-14T09:25:00.000Z" NotOnOrAfter="2026-10-14T10:30:00.000Z"><AudienceRestriction><Audience>` + testSP.MetadataURL + `</Audience></AudienceRestriction></Conditions>` +
+		`<AuthnStatement AuthnInstant="2026-10-14T09:29:58.000Z" SessionIndex="_3f6c1d0a-8e2b-4b7f-9a41-5d0e7c2b9f18"><AuthnContext><AuthnContextClassRef>urn:oasis:names:tc:SAML:2.0:ac:classes:Password</AuthnContextClassRef></AuthnContext></AuthnStatement>` +
+		`</Assertion>`
+
+	// XML Encryption: the assertion is padded to the AES block size, the
+	// last octet giving the padding length, and follows the IV.
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	assert.NoError(t, err)
+	block, err := aes.NewCipher(key)
+	assert.NoError(t, err)
+	padding := aes.BlockSize - len(assertion)%aes.BlockSize
+	plaintext := append([]byte(assertion), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	ciphertext := make([]byte, aes.BlockSize+len(plaintext))
+	_, err = rand.Read(ciphertext[:aes.BlockSize])
+	assert.NoError(t, err)
+	cipher.NewCBCEncrypter(block, ciphertext[:aes.BlockSize]).CryptBlocks(ciphertext[aes.BlockSize:], plaintext)
+
+	spBlock, _ := pem.Decode([]byte(testSP.PubkeyPEM))
+	spCert, err := x509.ParseCertificate(spBlock.Bytes)
+	assert.NoError(t, err)
+	encryptedKey, err := rsa.EncryptOAEP(sha1.New(), rand.Reader, spCert.PublicKey.(*rsa.PublicKey), key, nil)
+	assert.NoError(t, err)
+
+	signature := xmlsec.DefaultSignature([]byte(testIdP.PubkeyPEM))
+	signature.CanonicalizationMethod.Algorithm = xmlsec.ExcC14N10
+	signature.SignatureMethod.Algorithm = xmlsec.RSASHA256
+	signature.Reference.URI = "#_9b4d2e61-0a7c-4f3e-8d15-6c2a9e7f1b3d"
+	signature.Reference.Transforms = append(signature.Reference.Transforms, xmlsec.Method{Algorithm: xmlsec.ExcC14N10})
+	signature.Reference.DigestMethod.Algorithm = xmlsec.DigestSHA256
+	signatureXML, err := xml.Marshal(signature)
+	assert.NoError(t, err)
+
+	response := `<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" Destination="` + testSP.AcsURL + `" ID="_9b4d2e61-0a7c-4f3e-8d15-6c2a9e7f1b3d" InResponseTo="id-MOCKID" IssueInstant="2026-10-14T09:30:00.000Z" Version="2.0">` +
+		`<Issuer xmlns="urn:oasis:names:tc:SAML:2.0:assertion">https://sts.windows.net/72f988bf-86f1-41af-91ab-2d7cd011db47/</Issuer>` +
+		string(signatureXML) +
+		`<samlp:Status><samlp:StatusCode Value="urn:oasis:names:tc:SAML:2.0:status:Success"/></samlp:Status>` +
+		`<EncryptedAssertion xmlns="urn:oasis:names:tc:SAML:2.0:assertion"><xenc:EncryptedData xmlns:xenc="http://www.w3.org/2001/04/xmlenc#" Type="http://www.w3.org/2001/04/xmlenc#Element">` +
+		`<xenc:EncryptionMethod Algorithm="http://www.w3.org/2001/04/xmlenc#aes256-cbc"/>` +
+		`<dsig:KeyInfo xmlns:dsig="http://www.w3.org/2000/09/xmldsig#"><xenc:EncryptedKey><xenc:EncryptionMethod Algorithm="http://www.w3.org/2001/04/xmlenc#rsa-oaep-mgf1p"/>` +
+		`<xenc:CipherData><xenc:CipherValue>` + base64.StdEncoding.EncodeToString(encryptedKey) + `</xenc:CipherValue></xenc:CipherData></xenc:EncryptedKey></dsig:KeyInfo>` +
+		`<xenc:CipherData><xenc:CipherValue>` + base64.StdEncoding.EncodeToString(ciphertext) + `</xenc:CipherValue></xenc:CipherData></xenc:EncryptedData></EncryptedAssertion>` +
+		`</samlp:Response>`
+
+	idpBlock, _ := pem.Decode([]byte(testIdP.PrivkeyPEM))
+	idpKey, err := x509.ParsePKCS1PrivateKey(idpBlock.Bytes)
+	assert.NoError(t, err)
+	signed, err := xmlsec.SignWithSigner([]byte(response), idpKey)
+	assert.NoError(t, err)
+	return signed
+}
+
+// TestResponseValidatorEncryptedAssertion validates a response shaped like
+// Azure AD's, made by azureADResponse: the Response is signed and holds an
+// unsigned, encrypted assertion.
+func TestResponseValidatorEncryptedAssertion(t *testing.T) {
+	tearUp()
+
+	raw := azureADResponse(t)
+	traces, err := xmlsec.TraceSignatures(raw)
+	assert.NoError(t, err)
+	if assert.Len(t, traces, 1) && assert.Len(t, traces[0].References, 1) {
+		assert.True(t, traces[0].References[0].Match())
+	}
+
+	if _, err := exec.LookPath("xmlsec1"); err != nil {
+		t.Skip("xmlsec1 is not installed")
+	}
+
+	certFile, err := testIdP.PubkeyFile()
+	assert.NoError(t, err)
+	keyFile, err := testSP.PrivkeyFile()
+	assert.NoError(t, err)
+
+	v := &ResponseValidator{
+		IdPCertFile:  certFile,
+		IdPEntityID:  "https://sts.windows.net/72f988bf-86f1-41af-91ab-2d7cd011db47/",
+		AcsURL:       testSP.AcsURL,
+		Audience:     testSP.MetadataURL,
+		PrivkeyFile:  keyFile,
+		ResponseIDs:  []string{"id-MOCKID"},
+		Now:          time.Date(2026, 10, 14, 9, 31, 0, 0, time.UTC),
+		SecurityOpts: SecurityOpts{AllowSelfSignedCert: true},
+	}
+
+	assertion, err := v.Validate(raw)
+	assert.NoError(t, err)
+	if assert.NotNil(t, assertion) {
+		assert.Equal(t, "adele.vance@contoso.com", assertion.Subject.NameID.Value)
+	}
+
+	// The response signature covers the encrypted assertion and is checked
+	// before decrypting it.
+	tampered := bytes.Replace(raw, []byte("<xenc:CipherValue>"), []byte("<xenc:CipherValue>AAAA"), 1)
+	_, err = v.Validate(tampered)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "Unable to verify message signature")
+}
@@ -0,0 +1,640 @@
+package saml
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/goware/saml/xmlsec"
+	"github.com/pkg/errors"
+)
+
+// ResponseValidator performs the SP side validation of a SAML response,
+// without any HTTP involvement. It can be used to build audit tools or test
+// harnesses around the same checks AssertionMiddleware does.
+type ResponseValidator struct {
+	// IdPCertFile is the path of the IdP's PEM encoded certificate, used to
+	// verify signatures.
+	IdPCertFile string
+
+	// IdPEntityID is the expected issuer of the response and its assertion.
+	// The issuer is not validated when empty.
+	IdPEntityID string
+
+	// AcsURL is the expected Destination of the response and Recipient of the
+	// assertion.
+	AcsURL string
+
+	// Audience is the SP's entity ID, which must be one of the assertion's
+	// audiences. The audience is not validated when empty.
+	Audience string
+
+	// PrivkeyFile is the path of the SP's private key, used to decrypt
+	// encrypted assertions.
+	PrivkeyFile string
+
+	// ResponseIDs are the accepted InResponseTo values. InResponseTo is not
+	// validated when it is empty or only holds the empty string, which is
+	// what AllowIdpInitiated gives.
+	ResponseIDs []string
+
+	// ClockSkew is added or substracted to the current time when checking
+	// NotBefore and NotOnOrAfter.
+	ClockSkew time.Duration
+
+	// Now is the time the response is validated against. The current time is
+	// used when zero. Set it to check archived responses.
+	Now time.Time
+
+	// AllowMissingSubjectConfirmationExpiry accepts assertions whose
+	// SubjectConfirmationData has no NotOnOrAfter.
+	AllowMissingSubjectConfirmationExpiry bool
+
+	// NameIDFormats are the accepted formats of the assertion's NameID. Any
+	// format is accepted when empty.
+	NameIDFormats []string
+
+	// MaxAssertionAge is the maximum time elapsed since the assertion's
+	// IssueInstant, regardless of its NotOnOrAfter. Zero disables the check.
+	MaxAssertionAge time.Duration
+
+	// ClientCertificate, when set, is the TLS client certificate of the user
+	// agent that presented the response. The assertion must then have a
+	// holder-of-key SubjectConfirmation bound to it, which is validated
+	// instead of the bearer one.
+	ClientCertificate *x509.Certificate
+
+	// PreserveRawXML sets the Raw field of the validated Response and
+	// Assertion to the bytes they were parsed from. Signatures are always
+	// verified against those bytes, never against a re-marshalled struct.
+	PreserveRawXML bool
+
+	DTDFile string
+
+	SecurityOpts
+}
+
+// ResponseValidator returns a ResponseValidator configured with the SP's
+// settings, as used by AssertionMiddleware.
+func (sp *ServiceProvider) ResponseValidator() (*ResponseValidator, error) {
+	meta, err := sp.GetIdPMetadata()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to retrieve IdP metadata")
+	}
+
+	idpCertFile, err := sp.GetIdPCertFile()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to get IdP certificate")
+	}
+
+	// The SP can work without a private key as long as assertions are not
+	// encrypted.
+	keyFile, _ := sp.PrivkeyFile()
+
+	return &ResponseValidator{
+		IdPCertFile:                           idpCertFile,
+		IdPEntityID:                           meta.EntityID,
+		AcsURL:                                sp.AcsURL,
+		Audience:                              sp.audience(),
+		PrivkeyFile:                           keyFile,
+		ResponseIDs:                           sp.possibleResponseIDs(),
+		ClockSkew:                             ClockDriftTolerance,
+		AllowMissingSubjectConfirmationExpiry: sp.AllowMissingSubjectConfirmationExpiry,
+		MaxAssertionAge:                       sp.MaxAssertionAge,
+		NameIDFormats:                         sp.AcceptedNameIDFormats,
+		DTDFile:                               sp.DTDFile,
+		SecurityOpts:                          sp.SecurityOpts,
+	}, nil
+}
+
+// audience returns the audience assertions must be restricted to: the SP's
+// entity ID, unless SkipAudienceCheck is set.
+func (sp *ServiceProvider) audience() string {
+	if sp.SkipAudienceCheck {
+		return ""
+	}
+	return sp.MetadataURL
+}
+
+// Validate validates the given Response XML document, decoded from the
+// SAMLResponse form field, and returns its assertion.
+func (v *ResponseValidator) Validate(raw []byte) (*Assertion, error) {
+	_, assertion, err := v.validate(raw)
+	return assertion, err
+}
+
+func (v *ResponseValidator) validate(raw []byte) (*Response, *Assertion, error) {
+	result := v.runChecks(raw, false)
+	if err := result.Err(); err != nil {
+		return nil, nil, err
+	}
+	return result.Response, result.Assertion, nil
+}
+
+// ValidateDetailed validates the given Response XML document like Validate,
+// but runs every check it can instead of stopping at the first failure, and
+// returns the outcome of each. The checks of the assertion only run once its
+// signature is verified.
+func (v *ResponseValidator) ValidateDetailed(raw []byte) *ValidationResult {
+	return v.runChecks(raw, true)
+}
+
+// runChecks runs the checks of a response, all of them for ValidateDetailed,
+// or, for Validate, stopping at the first failure, before xmlsec1 verifies or
+// decrypts anything for a response that is already rejected.
+func (v *ResponseValidator) runChecks(raw []byte, all bool) *ValidationResult {
+	result := &ValidationResult{}
+	stop := func() bool {
+		return !all && result.Err() != nil
+	}
+	now := v.Now
+	if now.IsZero() {
+		now = Now()
+	}
+
+	var res Response
+	err := unmarshalMessage(raw, &res)
+	if err != nil {
+		err = errors.Wrapf(err, "could not unmarshal XML document: %s", string(raw))
+		result.add(CheckMessage, errors.Wrap(err, "Malformed XML"))
+		return result
+	}
+	result.Response = &res
+
+	// Validate message.
+	result.add(CheckVersion, checkVersion("Response", res.Version))
+	result.add(CheckDestination, v.validateDestination(&res))
+	if v.IdPEntityID != "" {
+		result.add(CheckIssuer, v.validateIssuer(&res))
+	}
+	result.add(CheckStatus, validateStatus(&res))
+	if !v.expectedResponseID(res.InResponseTo) {
+		result.add(CheckInResponseTo, errors.Errorf("Expecting a proper InResponseTo value, got %#v", v.ResponseIDs))
+	} else {
+		result.add(CheckInResponseTo, nil)
+	}
+	if stop() {
+		return result
+	}
+
+	// Validate signatures and retrieve the assertion.
+	assertion, err := v.verifiedAssertion(raw, &res)
+	result.add(CheckSignature, err)
+	if err != nil {
+		return result
+	}
+	if v.PreserveRawXML {
+		res.Raw = raw
+	}
+	result.Assertion = assertion
+	result.add(CheckAssertionVersion, checkVersion("Assertion", assertion.Version))
+	if stop() {
+		return result
+	}
+
+	if assertion.Subject != nil && assertion.Subject.EncryptedID != nil {
+		result.add(CheckDecryption, v.decryptNameID(assertion))
+		if stop() {
+			return result
+		}
+	}
+
+	// Validate assertion.
+	if v.IdPEntityID != "" {
+		result.add(CheckAssertionIssuer, v.validateAssertionIssuer(assertion))
+	}
+	if v.MaxAssertionAge > 0 {
+		result.add(CheckReplay, v.validateAssertionAge(assertion, now))
+	}
+	if len(v.NameIDFormats) > 0 {
+		result.add(CheckNameIDFormat, v.validateNameIDFormat(assertion))
+	}
+
+	// Validate recipient and expiration of the subject confirmation.
+	result.add(CheckRecipient, v.validateSubjectConfirmation(assertion, now))
+
+	result.add(CheckTimeWindow, v.validateConditions(assertion, now))
+
+	if v.Audience != "" {
+		if assertion.Conditions == nil {
+			result.add(CheckAudience, errors.New(`missing Assertion > Conditions`))
+		} else if err := validateAudience(assertion, v.Audience); err != nil {
+			result.add(CheckAudience, errors.Wrap(err, "Audience restriction mismatch"))
+		} else {
+			result.add(CheckAudience, nil)
+		}
+	}
+
+	var inResponseTo string
+	if assertion.Subject != nil {
+		if confirmation := assertion.Subject.BearerConfirmation(); confirmation != nil {
+			inResponseTo = confirmation.SubjectConfirmationData.InResponseTo
+		}
+	}
+	if !v.expectedResponseID(inResponseTo) {
+		result.add(CheckAssertionInResponseTo, errors.New("Unexpected assertion InResponseTo value"))
+	} else {
+		result.add(CheckAssertionInResponseTo, nil)
+	}
+
+	return result
+}
+
+// validateDestination makes sure the response is addressed to our ACS URL.
+func (v *ResponseValidator) validateDestination(res *Response) error {
+	if sameURL(res.Destination, v.AcsURL) {
+		return nil
+	}
+	// Note: OneLogin triggers this error when the Recipient field
+	// is left blank (or when not set to the correct ACS endpoint)
+	// in the OneLogin SAML configuration page. OneLogin returns
+	// Destination="{recipient}" in the SAML reponse in this case.
+	err := errors.Errorf("Wrong ACS destination, expecting %q, got %q", v.AcsURL, res.Destination)
+	return errors.Wrap(err, "Wrong ACS destination")
+}
+
+// validateIssuer makes sure the response is issued by the IdP.
+func (v *ResponseValidator) validateIssuer(res *Response) error {
+	if res.Issuer == nil {
+		return errors.New(`Missing "Issuer" node`)
+	}
+	if res.Issuer.Value != v.IdPEntityID {
+		err := errors.Errorf("Issuer %q does not match expected entity ID %q", res.Issuer.Value, v.IdPEntityID)
+		return errors.Wrap(err, "Issuer does not match expected entity ID")
+	}
+	return nil
+}
+
+// validateStatus makes sure the response reports a success.
+func validateStatus(res *Response) error {
+	if res.Status == nil {
+		return errors.New(`Missing "Status" node`)
+	}
+	if res.Status.StatusCode.Value != "urn:oasis:names:tc:SAML:2.0:status:Success" {
+		err := errors.Errorf("Unexpected status code: %v", res.Status)
+		return errors.Wrap(err, "Unexpected status code")
+	}
+	return nil
+}
+
+// validateAssertionIssuer makes sure the assertion is issued by the IdP.
+func (v *ResponseValidator) validateAssertionIssuer(assertion *Assertion) error {
+	var err error
+	switch {
+	case assertion.Issuer == nil:
+		err = errors.New(`missing Assertion > Issuer`)
+	case assertion.Issuer.Value != v.IdPEntityID:
+		err = errors.Errorf("Assertion issuer %q does not match expected entity ID %q", assertion.Issuer.Value, v.IdPEntityID)
+	}
+	if err != nil {
+		return errors.Wrap(err, "Assertion issuer does not match expected entity ID")
+	}
+	return nil
+}
+
+// validateConditions makes sure the assertion has Conditions and is within
+// their validity period.
+func (v *ResponseValidator) validateConditions(assertion *Assertion, now time.Time) error {
+	// Make sure we have Conditions
+	if assertion.Conditions == nil {
+		return errors.New(`missing Assertion > Conditions`)
+	}
+
+	// The NotBefore and NotOnOrAfter attributes specify time limits on the
+	// validity of the assertion within the context of its profile(s) of use.
+	// They do not guarantee that the statements in the assertion will be
+	// correct or accurate throughout the validity period. The NotBefore
+	// attribute specifies the time instant at which the validity interval
+	// begins. The NotOnOrAfter attribute specifies the time instant at which
+	// the validity interval has ended. If the value for either NotBefore or
+	// NotOnOrAfter is omitted, then it is considered unspecified.
+	validFrom := assertion.Conditions.NotBefore
+	if !validFrom.IsZero() && validFrom.After(now.Add(v.ClockSkew)) {
+		err := errors.Errorf("Assertion conditions are not valid yet, got %v, current time is %v", validFrom, now)
+		return errors.Wrap(err, "Assertion conditions are not valid yet")
+	}
+
+	validUntil := assertion.Conditions.NotOnOrAfter
+	if !validUntil.IsZero() && validUntil.Before(now.Add(-v.ClockSkew)) {
+		err := errors.Errorf("Assertion conditions already expired, got %v current time is %v, extra time is %v", validUntil, now, now.Add(-v.ClockSkew))
+		return errors.Wrap(err, "Assertion conditions already expired")
+	}
+	return nil
+}
+
+// verifiedAssertion returns the response's assertion once it is known to be
+// signed by the IdP. The order matters when the assertion is encrypted, as
+// Azure AD does: the response signature covers the EncryptedAssertion, so it
+// is verified on the raw document before decrypting, then the signature of
+// the decrypted assertion, if any, is verified on its own. The assertion must
+// be covered by at least one of them, a signed plaintext assertion does not
+// vouch for an encrypted one.
+func (v *ResponseValidator) verifiedAssertion(raw []byte, res *Response) (*Assertion, error) {
+	if res.Assertion != nil && res.EncryptedAssertion != nil {
+		return nil, errors.New("Response holds both an Assertion and an EncryptedAssertion")
+	}
+
+	responseSigned := false
+	if res.Signature != nil {
+		err := validateSignedNode(res.Signature, res.ID)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to validate Response + Signature")
+		}
+		responseSigned = true
+	}
+
+	assertionSigned := false
+	if res.Assertion != nil && res.Assertion.Signature != nil {
+		err := validateSignedNode(res.Assertion.Signature, res.Assertion.ID)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to validate Assertion + Signature")
+		}
+		assertionSigned = true
+	}
+
+	if responseSigned || assertionSigned {
+		err := v.verifySignature(raw)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Unable to verify message signature")
+		}
+	}
+
+	if res.EncryptedAssertion == nil {
+		if res.Assertion == nil {
+			return nil, errors.New("Missing assertion")
+		}
+		if !responseSigned && !assertionSigned {
+			return nil, errors.New("Unable to validate signature: node not found")
+		}
+		if v.PreserveRawXML {
+			buf, err := rawElement(raw, res.Assertion.XMLName)
+			if err != nil {
+				return nil, errors.Wrap(err, "Unable to preserve assertion")
+			}
+			res.Assertion.Raw = buf
+		}
+		return res.Assertion, nil
+	}
+
+	if v.PrivkeyFile == "" {
+		return nil, errors.New("Unable to decrypt message: no private key given")
+	}
+
+	plainTextAssertion, err := xmlsec.Decrypt(res.EncryptedAssertion.EncryptedData, v.PrivkeyFile)
+	if err != nil {
+		if IsSecurityException(err, &v.SecurityOpts) {
+			return nil, errors.Wrap(err, "Unable to decrypt message")
+		}
+	}
+
+	assertion := &Assertion{}
+	if err := unmarshalMessage(plainTextAssertion, assertion); err != nil {
+		return nil, errors.Wrap(err, "Unable to parse assertion")
+	}
+
+	if assertion.Signature != nil {
+		err := validateSignedNode(assertion.Signature, assertion.ID)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to validate Assertion + Signature")
+		}
+
+		err = v.verifySignature(plainTextAssertion)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Unable to verify assertion signature")
+		}
+	} else if !responseSigned {
+		return nil, errors.New("Unable to validate signature: node not found")
+	}
+	if v.PreserveRawXML {
+		assertion.Raw = plainTextAssertion
+	}
+
+	return assertion, nil
+}
+
+// decryptNameID decrypts the EncryptedID of a verified assertion into its
+// Subject's NameID.
+func (v *ResponseValidator) decryptNameID(assertion *Assertion) error {
+	if assertion.Subject == nil || assertion.Subject.EncryptedID == nil || assertion.Subject.NameID != nil {
+		return nil
+	}
+	if v.PrivkeyFile == "" {
+		return errors.New("Unable to decrypt NameID: no private key given")
+	}
+
+	plainTextNameID, err := xmlsec.Decrypt(assertion.Subject.EncryptedID.EncryptedData, v.PrivkeyFile)
+	if err != nil {
+		if IsSecurityException(err, &v.SecurityOpts) {
+			return errors.Wrap(err, "Unable to decrypt NameID")
+		}
+	}
+
+	nameID := &NameID{}
+	if err := unmarshalMessage(plainTextNameID, nameID); err != nil {
+		return errors.Wrap(err, "Unable to parse NameID")
+	}
+	assertion.Subject.NameID = nameID
+	assertion.Subject.EncryptedID.NameID = nameID
+	return nil
+}
+
+func (v *ResponseValidator) expectedResponseID(id string) bool {
+	if len(v.ResponseIDs) == 0 {
+		return true
+	}
+	if len(v.ResponseIDs) == 1 && v.ResponseIDs[0] == "" {
+		return true
+	}
+	return containsID(v.ResponseIDs, id)
+}
+
+// verifySignature verifies the signatures of a document as it was received.
+// Parsing drops what this package does not model, so a re-marshalled struct
+// would not digest like the signed document.
+func (v *ResponseValidator) verifySignature(plaintextMessage []byte) error {
+	// Responses and assertions are referenced by their ID attribute, which
+	// xmlsec1 has to be told about unless a DTD is given.
+	err := xmlsec.Verify(plaintextMessage, v.IdPCertFile, &xmlsec.ValidationOptions{
+		DTDFile:          v.DTDFile,
+		EnableIDAttrHack: v.DTDFile == "",
+	})
+	if err == nil {
+		// No error, this message is OK
+		return nil
+	}
+	logSignatureTrace("message failing verification", plaintextMessage)
+	logSignatureCertificateFile("message failing verification", v.IdPCertFile)
+
+	// We got an error...
+	if !IsSecurityException(err, &v.SecurityOpts) {
+		// ...but it was not a security exception, so we ignore it and accept
+		// the verification.
+		return nil
+	}
+
+	return err
+}
+
+// validateSubjectConfirmation checks the assertion's first bearer subject
+// confirmation against the Web Browser SSO profile: it must be addressed to
+// our ACS URL and carry a NotOnOrAfter that has not passed yet. With a
+// ClientCertificate, the holder-of-key confirmation bound to it is checked
+// the same way instead.
+func (v *ResponseValidator) validateSubjectConfirmation(assertion *Assertion, now time.Time) error {
+	var confirmation *SubjectConfirmation
+	if assertion.Subject != nil {
+		if v.ClientCertificate != nil {
+			confirmation = assertion.Subject.HolderOfKeyConfirmation(v.ClientCertificate)
+		} else {
+			confirmation = assertion.Subject.BearerConfirmation()
+		}
+	}
+
+	var err error
+	switch {
+	case assertion.Subject == nil:
+		err = errors.New(`missing Assertion > Subject`)
+	case confirmation == nil && v.ClientCertificate != nil:
+		err = errors.New(`missing Assertion > Subject > SubjectConfirmation bound to the TLS client certificate`)
+	case confirmation == nil:
+		err = errors.New(`missing Assertion > Subject > SubjectConfirmation`)
+	case confirmation.SubjectConfirmationData.Recipient == "":
+		err = errors.New(`missing Assertion > Subject > SubjectConfirmation > SubjectConfirmationData > Recipient`)
+	case !sameURL(confirmation.SubjectConfirmationData.Recipient, v.AcsURL):
+		// A recipient other than our ACS means the assertion was issued to
+		// another SP, and replayed here.
+		err = errors.Errorf("unexpected assertion recipient, expecting %q, got %q", v.AcsURL, confirmation.SubjectConfirmationData.Recipient)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "invalid assertion recipient")
+	}
+
+	// A time instant at which the subject can no longer be confirmed. The time
+	// value is encoded in UTC, as described in Section 1.3.3.
+	//
+	// Note that the time period specified by the optional NotBefore and
+	// NotOnOrAfter attributes, if present, SHOULD fall within the overall
+	// assertion validity period as specified by the element's NotBefore and
+	// NotOnOrAfter attributes. If both attributes are present, the value for
+	// NotBefore MUST be less than (earlier than) the value for NotOnOrAfter.
+	//
+	// A bearer assertion without NotOnOrAfter would be valid forever, the
+	// profile requires it.
+	validUntil := confirmation.SubjectConfirmationData.NotOnOrAfter
+	if validUntil.IsZero() {
+		if v.AllowMissingSubjectConfirmationExpiry {
+			return nil
+		}
+		return errors.New(`missing Assertion > Subject > SubjectConfirmation > SubjectConfirmationData > NotOnOrAfter`)
+	}
+	if validUntil.Before(now.Add(-v.ClockSkew)) {
+		err := errors.Errorf("Assertion conditions already expired, got %v current time is %v", validUntil, now)
+		return errors.Wrap(err, "Assertion conditions already expired")
+	}
+	return nil
+}
+
+// validateAssertionAge enforces MaxAssertionAge, which caps the replay window
+// independently of the NotOnOrAfter chosen by the IdP.
+func (v *ResponseValidator) validateAssertionAge(assertion *Assertion, now time.Time) error {
+	if v.MaxAssertionAge <= 0 {
+		return nil
+	}
+	if assertion.IssueInstant.IsZero() {
+		return errors.New(`missing Assertion > IssueInstant`)
+	}
+	if assertion.IssueInstant.Add(v.MaxAssertionAge).Before(now.Add(-v.ClockSkew)) {
+		err := errors.Errorf("Assertion issued at %v is older than %v, current time is %v", assertion.IssueInstant, v.MaxAssertionAge, now)
+		return errors.Wrap(err, "Assertion is too old")
+	}
+	return nil
+}
+
+// validateNameIDFormat makes sure the assertion's NameID has one of the
+// accepted NameIDFormats. A NameID without a format is unspecified.
+func (v *ResponseValidator) validateNameIDFormat(assertion *Assertion) error {
+	if len(v.NameIDFormats) == 0 {
+		return nil
+	}
+	if assertion.Subject == nil || assertion.Subject.NameID == nil {
+		return errors.New(`missing Assertion > Subject > NameID`)
+	}
+	format := assertion.Subject.NameID.Format
+	if format == "" {
+		format = NameIDFormatUnspecified
+	}
+	for _, accepted := range v.NameIDFormats {
+		if format == accepted {
+			return nil
+		}
+	}
+	err := errors.Errorf("NameID format %q is not one of %q", format, v.NameIDFormats)
+	return errors.Wrap(err, "Unexpected NameID format")
+}
+
+// validateAudience makes sure the assertion is meant for the given audience,
+// which must be one of those of its AudienceRestriction.
+func validateAudience(assertion *Assertion, audience string) error {
+	restriction := assertion.Conditions.AudienceRestriction
+	if restriction == nil {
+		return errors.New(`missing Assertion > Conditions > AudienceRestriction > Audience`)
+	}
+	audiences := restriction.audiences()
+	if len(audiences) == 0 {
+		return errors.New(`missing Assertion > Conditions > AudienceRestriction > Audience`)
+	}
+	for _, value := range audiences {
+		if strings.TrimSpace(value) == audience {
+			return nil
+		}
+	}
+	quoted := make([]string, len(audiences))
+	for i, value := range audiences {
+		quoted[i] = fmt.Sprintf("%q", value)
+	}
+	return errors.Errorf("Audience restriction mismatch, got %s, expecting %q", strings.Join(quoted, ", "), audience)
+}
+
+// sameURL reports whether the URLs a and b, as found in a Destination or a
+// Recipient and in the configured AcsURL, address the same endpoint. IdPs
+// behind or in front of reverse proxies do not always spell the ACS URL the
+// way it was configured: the scheme and host are compared case-insensitively,
+// default ports are ignored and an empty path is "/". URLs that do not parse
+// must be equal.
+func sameURL(a, b string) bool {
+	if a == b {
+		return true
+	}
+	ua, err := url.Parse(a)
+	if err != nil {
+		return false
+	}
+	ub, err := url.Parse(b)
+	if err != nil {
+		return false
+	}
+	return normalizeURL(ua) == normalizeURL(ub)
+}
+
+// normalizeURL returns the form of u compared by sameURL.
+func normalizeURL(u *url.URL) string {
+	scheme := strings.ToLower(u.Scheme)
+	host := strings.ToLower(u.Host)
+	switch {
+	case scheme == "https" && strings.HasSuffix(host, ":443"):
+		host = strings.TrimSuffix(host, ":443")
+	case scheme == "http" && strings.HasSuffix(host, ":80"):
+		host = strings.TrimSuffix(host, ":80")
+	}
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	normalized := scheme + "://" + host + path
+	if u.RawQuery != "" {
+		normalized += "?" + u.RawQuery
+	}
+	return normalized
+}
@@ -0,0 +1,131 @@
+package saml
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// SPRequirementsError lists what an assertion lacks to be accepted by an SP,
+// as found by ValidateAgainstSP.
+type SPRequirementsError struct {
+	EntityID string
+	Problems []string
+}
+
+func (e *SPRequirementsError) Error() string {
+	return fmt.Sprintf("assertion does not meet the requirements of SP %q: %s", e.EntityID, strings.Join(e.Problems, "; "))
+}
+
+// ValidateAgainstSP checks the assertion made by MakeAssertion against what
+// the SP's metadata asks for, to catch misconfigurations that the SP would
+// otherwise reject silently: the required attributes of its default
+// AttributeConsumingService must be present, the assertion must be signed if
+// the SP wants signed assertions, and the NameID format must be one the SP
+// supports. The SP's metadata is taken from the request when spMetadata is
+// nil. The returned error is an *SPRequirementsError listing every problem.
+func (req *IdpAuthnRequest) ValidateAgainstSP(spMetadata *Metadata) error {
+	if req.Assertion == nil {
+		return errors.New("no assertion to validate")
+	}
+	if spMetadata == nil {
+		var err error
+		if spMetadata, err = req.spMetadata(); err != nil {
+			return err
+		}
+	}
+	descriptor := spMetadata.SPSSODescriptor
+	if descriptor == nil {
+		return errors.Errorf("metadata of SP %q has no SPSSODescriptor", spMetadata.EntityID)
+	}
+
+	var problems []string
+	if service := defaultAttributeConsumingService(descriptor); service != nil {
+		for _, requested := range service.RequestedAttribute {
+			if requested.IsRequired && !hasAttribute(req.Assertion, requested) {
+				problems = append(problems, fmt.Sprintf("required attribute %q is missing", requested.Name))
+			}
+		}
+	}
+	if descriptor.WantAssertionsSigned && req.Assertion.Signature == nil {
+		problems = append(problems, "assertion is not signed")
+	}
+	if format, ok := assertionNameIDFormat(req.Assertion); ok && !supportsNameIDFormat(descriptor.NameIDFormat, format) {
+		problems = append(problems, fmt.Sprintf("NameID format %q is not supported, want one of %s", format, strings.Join(descriptor.NameIDFormat, ", ")))
+	}
+
+	if len(problems) > 0 {
+		return &SPRequirementsError{EntityID: spMetadata.EntityID, Problems: problems}
+	}
+	return nil
+}
+
+// defaultAttributeConsumingService returns the service flagged as default,
+// or the first one.
+func defaultAttributeConsumingService(descriptor *SPSSODescriptor) *AttributeConsumingService {
+	for i := range descriptor.AttributeConsumingService {
+		if descriptor.AttributeConsumingService[i].IsDefault {
+			return &descriptor.AttributeConsumingService[i]
+		}
+	}
+	if len(descriptor.AttributeConsumingService) > 0 {
+		return &descriptor.AttributeConsumingService[0]
+	}
+	return nil
+}
+
+// hasAttribute reports whether the assertion carries the requested attribute
+// with at least one value. Name formats are compared when both are given.
+func hasAttribute(assertion *Assertion, requested RequestedAttribute) bool {
+	var statements []AttributeStatement
+	if assertion.AttributeStatement != nil {
+		statements = append(statements, *assertion.AttributeStatement)
+	}
+	statements = append(statements, assertion.AttributeStatements...)
+
+	for _, statement := range statements {
+		for _, attribute := range statement.Attributes {
+			if attribute.Name != requested.Name || len(attribute.Values) == 0 {
+				continue
+			}
+			if attribute.NameFormat != "" && requested.NameFormat != "" && attribute.NameFormat != requested.NameFormat {
+				continue
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// assertionNameIDFormat returns the format of the assertion's NameID, still
+// in the clear in an EncryptedID until MarshalAssertion encrypts it.
+func assertionNameIDFormat(assertion *Assertion) (string, bool) {
+	subject := assertion.Subject
+	if subject == nil {
+		return "", false
+	}
+	nameID := subject.NameID
+	if nameID == nil && subject.EncryptedID != nil {
+		nameID = subject.EncryptedID.NameID
+	}
+	if nameID == nil {
+		return "", false
+	}
+	return nameID.Format, true
+}
+
+// supportsNameIDFormat reports whether an SP advertising the given formats
+// accepts format. SPs that advertise none, or the unspecified format, accept
+// any.
+func supportsNameIDFormat(formats []string, format string) bool {
+	if len(formats) == 0 || format == "" || format == NameIDFormatUnspecified {
+		return true
+	}
+	for _, f := range formats {
+		if f == format || f == NameIDFormatUnspecified {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,132 @@
+package saml
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SPInfo describes a service provider known to an IdP, for dashboards and
+// operational checks. See IdentityProvider.ServiceProviders.
+type SPInfo struct {
+	EntityID string
+
+	// MetadataURL is where the SP's metadata is fetched from, empty when it
+	// is given as SPMetadata.
+	MetadataURL string
+
+	// MetadataCached is false when the SP's metadata has not been fetched
+	// yet, in which case the fields below are empty.
+	MetadataCached bool
+	// MetadataFetched is when the metadata was fetched from MetadataURL.
+	MetadataFetched time.Time
+	// MetadataStale is true when the metadata is past its validUntil, or
+	// was fetched longer than its cacheDuration ago.
+	MetadataStale bool
+	ValidUntil    time.Time
+
+	ACSEndpoints []IndexedEndpoint
+	Certificates []SPCertificate
+
+	// HasOptions is true when the IdP has SPOptions for the SP.
+	HasOptions bool
+}
+
+// SPCertificate is a certificate advertised in an SP's metadata.
+type SPCertificate struct {
+	// Use is "signing", "encryption", or empty for both.
+	Use         string
+	Certificate *x509.Certificate
+}
+
+// Expired reports whether the certificate is outside of its validity period
+// at the given time.
+func (c *SPCertificate) Expired(now time.Time) bool {
+	return checkCertificateValidity(c.Certificate, now) != nil
+}
+
+// ServiceProviders returns what the IdP knows of its SPs: the one whose
+// metadata is configured or already fetched, and those with SPOptions. It
+// never fetches metadata, and is safe to call while the IdP serves requests.
+// SPs are sorted by entity ID.
+func (idp *IdentityProvider) ServiceProviders() []SPInfo {
+	now := Now()
+	infos := map[string]*SPInfo{}
+
+	metadata := idp.SPMetadata
+	var fetched time.Time
+	if metadata == nil {
+		if cached, ok := idp.spMetadata.Load().(*fetchedMetadata); ok {
+			metadata, fetched = cached.metadata, cached.fetched
+		}
+	}
+	switch {
+	case metadata != nil:
+		info := newSPInfo(metadata, fetched, now)
+		if idp.SPMetadata == nil {
+			info.MetadataURL = idp.SPMetadataURL
+		}
+		infos[info.EntityID] = info
+	case idp.SPMetadataURL != "":
+		// The entity ID is unknown until the metadata is fetched.
+		infos[""] = &SPInfo{MetadataURL: idp.SPMetadataURL}
+	}
+
+	for entityID := range idp.SPOptions {
+		info, ok := infos[entityID]
+		if !ok {
+			info = &SPInfo{EntityID: entityID}
+			infos[entityID] = info
+		}
+		info.HasOptions = true
+	}
+
+	list := make([]SPInfo, 0, len(infos))
+	for _, info := range infos {
+		list = append(list, *info)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].EntityID < list[j].EntityID
+	})
+	return list
+}
+
+// newSPInfo describes the SP of the given metadata.
+func newSPInfo(metadata *Metadata, fetched time.Time, now time.Time) *SPInfo {
+	info := &SPInfo{
+		EntityID:        metadata.EntityID,
+		MetadataCached:  true,
+		MetadataFetched: fetched,
+		ValidUntil:      metadata.ValidUntil,
+	}
+	if !metadata.ValidUntil.IsZero() && now.After(metadata.ValidUntil) {
+		info.MetadataStale = true
+	}
+	if !fetched.IsZero() && metadata.CacheDuration > 0 && now.After(fetched.Add(metadata.CacheDuration)) {
+		info.MetadataStale = true
+	}
+
+	descriptor := metadata.SPSSODescriptor
+	if descriptor == nil {
+		return info
+	}
+	info.ACSEndpoints = append([]IndexedEndpoint{}, descriptor.AssertionConsumerService...)
+	for _, keyDescriptor := range descriptor.KeyDescriptor {
+		der, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(keyDescriptor.KeyInfo.Certificate), ""))
+		if err != nil || len(der) == 0 {
+			continue
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			Logf("Warning: failed to parse %s certificate of SP %q: %v", keyDescriptor.Use, metadata.EntityID, err)
+			continue
+		}
+		info.Certificates = append(info.Certificates, SPCertificate{
+			Use:         keyDescriptor.Use,
+			Certificate: cert,
+		})
+	}
+	return info
+}
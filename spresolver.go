@@ -0,0 +1,44 @@
+package saml
+
+import (
+	"github.com/pkg/errors"
+)
+
+// ErrUnknownIssuer is returned by an SPMetadataResolver when no SP has the
+// entity ID it is given.
+var ErrUnknownIssuer = errors.New("unknown service provider")
+
+// SPMetadataResolver returns the metadata of the SP with the given entity ID,
+// e.g. from a database, a cache or a federation metadata file. It returns
+// ErrUnknownIssuer, possibly wrapped, when there is no such SP.
+type SPMetadataResolver func(entityID string) (*Metadata, error)
+
+// resolveSPMetadata sets the ServiceProviderMetadata of the request to what
+// the IdP's MetadataResolver returns for the request's Issuer. It does nothing
+// without a MetadataResolver or when the metadata is already known.
+func (req *IdpAuthnRequest) resolveSPMetadata() error {
+	resolve := req.IDP.MetadataResolver
+	if resolve == nil || req.ServiceProviderMetadata != nil {
+		return nil
+	}
+
+	issuer := req.Request.Issuer.Value
+	if issuer == "" {
+		return errors.Wrap(ErrUnknownIssuer, "request without an Issuer")
+	}
+	metadata, err := resolve(issuer)
+	if errors.Cause(err) == ErrUnknownIssuer {
+		return errors.Wrapf(err, "issuer %q", issuer)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to resolve metadata of SP %q", issuer)
+	}
+	if metadata == nil {
+		return errors.Wrapf(ErrUnknownIssuer, "issuer %q", issuer)
+	}
+	if metadata.EntityID != issuer {
+		return errors.Errorf("metadata resolved for SP %q has entity ID %q", issuer, metadata.EntityID)
+	}
+	req.ServiceProviderMetadata = metadata
+	return nil
+}
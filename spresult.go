@@ -0,0 +1,82 @@
+package saml
+
+// Checks made by ResponseValidator.ValidateDetailed, as named in its
+// ValidationResult.
+const (
+	CheckMessage               = "message"
+	CheckVersion               = "version"
+	CheckDestination           = "destination"
+	CheckIssuer                = "issuer"
+	CheckStatus                = "status"
+	CheckInResponseTo          = "in_response_to"
+	CheckSignature             = "signature"
+	CheckAssertionVersion      = "assertion_version"
+	CheckDecryption            = "decryption"
+	CheckAssertionIssuer       = "assertion_issuer"
+	CheckReplay                = "replay"
+	CheckNameIDFormat          = "name_id_format"
+	CheckRecipient             = "recipient"
+	CheckTimeWindow            = "time_window"
+	CheckAudience              = "audience"
+	CheckAssertionInResponseTo = "assertion_in_response_to"
+)
+
+// CheckResult is the outcome of one of the checks of a response.
+type CheckResult struct {
+	Name string
+
+	// Err tells why the check failed. It is nil when it passed.
+	Err error
+}
+
+// Passed reports whether the check passed.
+func (c CheckResult) Passed() bool {
+	return c.Err == nil
+}
+
+// ValidationResult lists the checks ResponseValidator.ValidateDetailed made
+// on a response, in the order they ran. Checks disabled by the validator's
+// settings are not listed, the replay check is the one of MaxAssertionAge.
+type ValidationResult struct {
+	// Response is the parsed response, and Assertion its assertion once the
+	// signature covering it is verified. They are set even when other
+	// checks failed, don't trust them unless Err is nil.
+	Response  *Response
+	Assertion *Assertion
+
+	Checks []CheckResult
+}
+
+func (r *ValidationResult) add(name string, err error) {
+	r.Checks = append(r.Checks, CheckResult{Name: name, Err: err})
+}
+
+// Check returns the result of the named check, or nil when it did not run.
+func (r *ValidationResult) Check(name string) *CheckResult {
+	for i := range r.Checks {
+		if r.Checks[i].Name == name {
+			return &r.Checks[i]
+		}
+	}
+	return nil
+}
+
+// Failed returns the checks that failed.
+func (r *ValidationResult) Failed() []CheckResult {
+	var failed []CheckResult
+	for _, check := range r.Checks {
+		if !check.Passed() {
+			failed = append(failed, check)
+		}
+	}
+	return failed
+}
+
+// Err returns the error of the first check that failed, the one Validate
+// returns, or nil when the response is valid.
+func (r *ValidationResult) Err() error {
+	if failed := r.Failed(); len(failed) > 0 {
+		return failed[0].Err
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package saml
 
 import (
+	"crypto/subtle"
 	"crypto/x509"
 	"encoding/pem"
 	"fmt"
@@ -62,14 +63,8 @@ func validateKeyFile(file string, err error) (string, error) {
 		return "", errors.Wrapf(err, "failed to read certificate %v", file)
 	}
 
-	now := time.Now()
-
-	if now.Before(cert.NotBefore) {
-		return "", fmt.Errorf("security certificate is not valid yet (notBefore=%v)", cert.NotBefore)
-	}
-
-	if now.After(cert.NotAfter) {
-		return "", fmt.Errorf("security certificate has expired (notAfter=%v)", cert.NotAfter)
+	if err := checkCertificateValidity(cert, time.Now()); err != nil {
+		return "", err
 	}
 
 	certMu.Lock()
@@ -79,3 +74,34 @@ func validateKeyFile(file string, err error) (string, error) {
 
 	return file, err
 }
+
+// checkCertificateValidity returns an error when now is outside of the
+// certificate's validity period.
+func checkCertificateValidity(cert *x509.Certificate, now time.Time) error {
+	if now.Before(cert.NotBefore) {
+		return fmt.Errorf("security certificate is not valid yet (notBefore=%v)", cert.NotBefore)
+	}
+
+	if now.After(cert.NotAfter) {
+		return fmt.Errorf("security certificate has expired (notAfter=%v)", cert.NotAfter)
+	}
+	return nil
+}
+
+// constantTimeEqual compares two strings in constant time. Use it for values
+// an attacker may try to guess, such as request IDs and tokens.
+func constantTimeEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// containsID reports whether id is one of ids. All of them are compared, so
+// the time taken does not reveal which one matched.
+func containsID(ids []string, id string) bool {
+	found := false
+	for i := range ids {
+		if constantTimeEqual(ids[i], id) {
+			found = true
+		}
+	}
+	return found
+}
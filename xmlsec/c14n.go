@@ -0,0 +1,555 @@
+package xmlsec
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Canonicalization methods.
+const (
+	C14N10                      = "http://www.w3.org/TR/2001/REC-xml-c14n-20010315"
+	C14N10WithComments          = "http://www.w3.org/TR/2001/REC-xml-c14n-20010315#WithComments"
+	ExcC14N10                   = "http://www.w3.org/2001/10/xml-exc-c14n#"
+	ExcC14N10WithComments       = "http://www.w3.org/2001/10/xml-exc-c14n#WithComments"
+	EnvelopedSignatureTransform = "http://www.w3.org/2000/09/xmldsig#enveloped-signature"
+)
+
+const (
+	xmldsigNamespace = "http://www.w3.org/2000/09/xmldsig#"
+	xmlNamespace     = "http://www.w3.org/XML/1998/namespace"
+)
+
+type nodeKind int
+
+const (
+	documentNode nodeKind = iota
+	elementNode
+	textNode
+	commentNode
+	procInstNode
+)
+
+// node is a minimal DOM used to canonicalize documents. Element and attribute
+// names keep their prefix in Name.Space, namespaces are resolved through ns.
+type node struct {
+	kind     nodeKind
+	parent   *node
+	name     xml.Name
+	attrs    []xml.Attr
+	ns       map[string]string
+	children []*node
+	data     string
+}
+
+func parseDocument(in []byte) (*node, error) {
+	doc := &node{kind: documentNode, ns: map[string]string{}}
+
+	// encoding/xml does end-of-line handling but no attribute value
+	// normalization, which canonicalization relies on.
+	decoder := xml.NewDecoder(bytes.NewReader(Normalize(in)))
+	current := doc
+	for {
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			el := &node{
+				kind:   elementNode,
+				parent: current,
+				name:   t.Name,
+				attrs:  append([]xml.Attr{}, t.Attr...),
+				ns:     map[string]string{},
+			}
+			for prefix, uri := range current.ns {
+				el.ns[prefix] = uri
+			}
+			for _, attr := range t.Attr {
+				switch {
+				case attr.Name.Space == "" && attr.Name.Local == "xmlns":
+					el.ns[""] = attr.Value
+				case attr.Name.Space == "xmlns":
+					el.ns[attr.Name.Local] = attr.Value
+				}
+			}
+			current.children = append(current.children, el)
+			current = el
+		case xml.EndElement:
+			if current.kind != elementNode || current.name != t.Name {
+				return nil, fmt.Errorf("unexpected end element </%s>", qualifiedName(t.Name))
+			}
+			current = current.parent
+		case xml.CharData:
+			if current.kind == elementNode {
+				current.children = append(current.children, &node{kind: textNode, parent: current, data: string(t)})
+			}
+		case xml.Comment:
+			current.children = append(current.children, &node{kind: commentNode, parent: current, data: string(t)})
+		case xml.ProcInst:
+			if t.Target == "xml" {
+				continue
+			}
+			current.children = append(current.children, &node{kind: procInstNode, parent: current, name: xml.Name{Local: t.Target}, data: string(t.Inst)})
+		}
+	}
+	if current != doc {
+		return nil, errors.New("unexpected end of document")
+	}
+	if doc.root() == nil {
+		return nil, errors.New("missing document element")
+	}
+	return doc, nil
+}
+
+// root returns the document element.
+func (n *node) root() *node {
+	for _, child := range n.children {
+		if child.kind == elementNode {
+			return child
+		}
+	}
+	return nil
+}
+
+// namespace returns the namespace URI of the element.
+func (n *node) namespace() string {
+	return n.ns[n.name.Space]
+}
+
+func (n *node) is(namespace, local string) bool {
+	return n.kind == elementNode && n.name.Local == local && n.namespace() == namespace
+}
+
+func (n *node) attr(local string) (string, bool) {
+	for _, attr := range n.attrs {
+		if attr.Name.Space == "" && attr.Name.Local == local {
+			return attr.Value, true
+		}
+	}
+	return "", false
+}
+
+// child returns the first child element with the given name.
+func (n *node) child(namespace, local string) *node {
+	for _, child := range n.children {
+		if child.is(namespace, local) {
+			return child
+		}
+	}
+	return nil
+}
+
+// find returns the first element, in document order, for which fn is true.
+func (n *node) find(fn func(*node) bool) *node {
+	for _, child := range n.children {
+		if child.kind != elementNode {
+			continue
+		}
+		if fn(child) {
+			return child
+		}
+		if found := child.find(fn); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+func (n *node) setText(text string) {
+	n.children = []*node{{kind: textNode, parent: n, data: text}}
+}
+
+func (n *node) text() string {
+	var s string
+	for _, child := range n.children {
+		if child.kind == textNode {
+			s += child.data
+		}
+	}
+	return s
+}
+
+func qualifiedName(name xml.Name) string {
+	if name.Space == "" {
+		return name.Local
+	}
+	return name.Space + ":" + name.Local
+}
+
+// Canonicalizer converts an XML document to a canonical form. See
+// RegisterCanonicalizer.
+//
+// Canonicalizers only apply to the documents signed natively, and to what
+// TraceSignatures reports. Signatures are always verified by xmlsec1, with its
+// own canonicalization, which no Canonicalizer changes.
+type Canonicalizer interface {
+	Canonicalize(xml []byte) ([]byte, error)
+}
+
+var canonicalizers = struct {
+	sync.RWMutex
+	m map[string]Canonicalizer
+}{m: map[string]Canonicalizer{}}
+
+// RegisterCanonicalizer makes SignWithSigner, TraceSignatures and Canonicalize
+// use c for the given canonicalization method, as named by the Algorithm of a
+// CanonicalizationMethod or Transform, instead of the built-in implementation.
+// This is meant for partners whose XML-DSig implementation has its own idea of
+// canonical XML. A nil c restores the built-in implementation. Sign, Verify
+// and the other functions backed by xmlsec1 are not affected.
+//
+// c receives the nodes to canonicalize as a standalone document, with every
+// namespace in scope declared on its root and the enveloped signature, if
+// any, removed. Comments are kept unless the method or a same document
+// reference excludes them. An InclusiveNamespaces PrefixList is not passed on.
+//
+// Since Verify ignores c, a document signed with c only verifies when c agrees
+// with xmlsec1. Use TraceSignatures to compare what each of them digests.
+func RegisterCanonicalizer(method string, c Canonicalizer) {
+	canonicalizers.Lock()
+	defer canonicalizers.Unlock()
+	if c == nil {
+		delete(canonicalizers.m, method)
+		return
+	}
+	canonicalizers.m[method] = c
+}
+
+func registeredCanonicalizer(method string) Canonicalizer {
+	canonicalizers.RLock()
+	defer canonicalizers.RUnlock()
+	return canonicalizers.m[method]
+}
+
+// NewCanonicalizer returns the built-in Canonicalizer for a method such as
+// C14N10 or ExcC14N10, the default when method is empty. Registered
+// canonicalizers are ignored, so they can wrap the built-in ones.
+func NewCanonicalizer(method string) (Canonicalizer, error) {
+	if method == "" {
+		method = ExcC14N10
+	}
+	if _, err := newBuiltinCanonicalizer(method, nil); err != nil {
+		return nil, err
+	}
+	return builtinCanonicalizer(method), nil
+}
+
+type builtinCanonicalizer string
+
+func (method builtinCanonicalizer) Canonicalize(in []byte) ([]byte, error) {
+	doc, err := parseDocument(in)
+	if err != nil {
+		return nil, err
+	}
+	c, err := newBuiltinCanonicalizer(string(method), nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.canonicalize(doc), nil
+}
+
+// canonicalizer writes nodes in the canonical form defined by Canonical XML
+// 1.0 or, when exclusive is set, Exclusive XML Canonicalization 1.0. When
+// custom is set, transform hands the nodes to it instead.
+type canonicalizer struct {
+	exclusive  bool
+	comments   bool
+	prefixList map[string]bool
+	exclude    *node
+	custom     Canonicalizer
+	buf        bytes.Buffer
+}
+
+func newCanonicalizer(method string, prefixList []string) (*canonicalizer, error) {
+	if custom := registeredCanonicalizer(method); custom != nil {
+		return &canonicalizer{custom: custom, comments: true, prefixList: map[string]bool{}}, nil
+	}
+	return newBuiltinCanonicalizer(method, prefixList)
+}
+
+func newBuiltinCanonicalizer(method string, prefixList []string) (*canonicalizer, error) {
+	c := &canonicalizer{prefixList: map[string]bool{}}
+	switch method {
+	case C14N10:
+	case C14N10WithComments:
+		c.comments = true
+	case ExcC14N10:
+		c.exclusive = true
+	case ExcC14N10WithComments:
+		c.exclusive = true
+		c.comments = true
+	default:
+		return nil, fmt.Errorf("unsupported canonicalization method %q", method)
+	}
+	for _, prefix := range prefixList {
+		if prefix == "#default" {
+			prefix = ""
+		}
+		c.prefixList[prefix] = true
+	}
+	return c, nil
+}
+
+// canonicalize returns the canonical form of a whole document, or of the
+// subtree at n if it is an element.
+func (c *canonicalizer) canonicalize(n *node) []byte {
+	c.buf.Reset()
+	if n.kind != documentNode {
+		c.element(n, nil)
+		return c.buf.Bytes()
+	}
+
+	afterRoot := false
+	for _, child := range n.children {
+		switch child.kind {
+		case elementNode:
+			c.element(child, nil)
+			afterRoot = true
+		case commentNode, procInstNode:
+			if child.kind == commentNode && !c.comments {
+				continue
+			}
+			if afterRoot {
+				c.buf.WriteByte('\n')
+			}
+			c.misc(child)
+			if !afterRoot {
+				c.buf.WriteByte('\n')
+			}
+		}
+	}
+	return c.buf.Bytes()
+}
+
+// transform returns a copy of the canonical form of n, computed by
+// canonicalize or by the registered Canonicalizer.
+func (c *canonicalizer) transform(n *node) ([]byte, error) {
+	if c.custom == nil {
+		return append([]byte{}, c.canonicalize(n)...), nil
+	}
+	// Inclusive canonicalization declares every namespace in scope on the
+	// apex, which makes the subtree a standalone document.
+	serializer := &canonicalizer{comments: c.comments, exclude: c.exclude, prefixList: map[string]bool{}}
+	return c.custom.Canonicalize(serializer.canonicalize(n))
+}
+
+func (c *canonicalizer) misc(n *node) {
+	switch n.kind {
+	case commentNode:
+		c.buf.WriteString("<!--")
+		c.buf.WriteString(n.data)
+		c.buf.WriteString("-->")
+	case procInstNode:
+		c.buf.WriteString("<?")
+		c.buf.WriteString(n.name.Local)
+		if n.data != "" {
+			c.buf.WriteByte(' ')
+			c.buf.WriteString(n.data)
+		}
+		c.buf.WriteString("?>")
+	}
+}
+
+// element writes an element and its descendants. rendered holds the
+// namespace bindings in effect in the output for the parent element, it is
+// nil for the apex of the canonicalized subtree.
+func (c *canonicalizer) element(n *node, rendered map[string]string) {
+	if n == c.exclude {
+		return
+	}
+
+	apex := rendered == nil
+	if apex {
+		rendered = map[string]string{}
+	}
+
+	// Namespace declarations to output.
+	decls := map[string]string{}
+	candidates := map[string]bool{}
+	if c.exclusive {
+		candidates[n.name.Space] = true
+		for _, attr := range n.attrs {
+			if attr.Name.Space != "" && attr.Name.Space != "xmlns" {
+				candidates[attr.Name.Space] = true
+			}
+		}
+		for prefix := range c.prefixList {
+			if _, ok := n.ns[prefix]; ok {
+				candidates[prefix] = true
+			}
+		}
+	} else {
+		for prefix := range n.ns {
+			candidates[prefix] = true
+		}
+	}
+	for prefix := range candidates {
+		if prefix == "xml" {
+			continue
+		}
+		uri := n.ns[prefix]
+		if prev, ok := rendered[prefix]; ok && prev == uri {
+			continue
+		}
+		if uri == "" && rendered[prefix] == "" {
+			// Only undeclare a default namespace that is in effect.
+			continue
+		}
+		decls[prefix] = uri
+	}
+
+	scope := map[string]string{}
+	for prefix, uri := range rendered {
+		scope[prefix] = uri
+	}
+	for prefix, uri := range decls {
+		scope[prefix] = uri
+	}
+
+	// Regular attributes, with xml:* attributes inherited from omitted
+	// ancestors when canonicalizing a subtree inclusively.
+	attrs := []xml.Attr{}
+	for _, attr := range n.attrs {
+		if attr.Name.Space == "xmlns" || (attr.Name.Space == "" && attr.Name.Local == "xmlns") {
+			continue
+		}
+		attrs = append(attrs, attr)
+	}
+	if apex && !c.exclusive {
+		seen := map[string]bool{}
+		for _, attr := range attrs {
+			if attr.Name.Space == "xml" {
+				seen[attr.Name.Local] = true
+			}
+		}
+		for p := n.parent; p != nil && p.kind == elementNode; p = p.parent {
+			for _, attr := range p.attrs {
+				if attr.Name.Space == "xml" && !seen[attr.Name.Local] {
+					seen[attr.Name.Local] = true
+					attrs = append(attrs, attr)
+				}
+			}
+		}
+	}
+
+	attrURI := func(attr xml.Attr) string {
+		switch attr.Name.Space {
+		case "":
+			return ""
+		case "xml":
+			return xmlNamespace
+		}
+		return n.ns[attr.Name.Space]
+	}
+	sort.SliceStable(attrs, func(i, j int) bool {
+		ui, uj := attrURI(attrs[i]), attrURI(attrs[j])
+		if ui != uj {
+			return ui < uj
+		}
+		return attrs[i].Name.Local < attrs[j].Name.Local
+	})
+
+	prefixes := make([]string, 0, len(decls))
+	for prefix := range decls {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+
+	c.buf.WriteByte('<')
+	c.buf.WriteString(qualifiedName(n.name))
+	for _, prefix := range prefixes {
+		if prefix == "" {
+			c.buf.WriteString(` xmlns="`)
+		} else {
+			c.buf.WriteString(` xmlns:` + prefix + `="`)
+		}
+		c.buf.WriteString(escapeAttr(decls[prefix]))
+		c.buf.WriteByte('"')
+	}
+	for _, attr := range attrs {
+		c.buf.WriteByte(' ')
+		c.buf.WriteString(qualifiedName(attr.Name))
+		c.buf.WriteString(`="`)
+		c.buf.WriteString(escapeAttr(attr.Value))
+		c.buf.WriteByte('"')
+	}
+	c.buf.WriteByte('>')
+
+	childScope := scope
+	if !c.exclusive {
+		// In inclusive canonicalization every in-scope namespace has been
+		// rendered by the time children are written.
+		childScope = map[string]string{}
+		for prefix, uri := range n.ns {
+			childScope[prefix] = uri
+		}
+	}
+
+	for _, child := range n.children {
+		switch child.kind {
+		case elementNode:
+			c.element(child, childScope)
+		case textNode:
+			c.buf.WriteString(escapeText(child.data))
+		case commentNode:
+			if c.comments {
+				c.misc(child)
+			}
+		case procInstNode:
+			c.misc(child)
+		}
+	}
+
+	c.buf.WriteString("</")
+	c.buf.WriteString(qualifiedName(n.name))
+	c.buf.WriteByte('>')
+}
+
+var textEscaper = strings.NewReplacer(
+	"&", "&amp;",
+	"<", "&lt;",
+	">", "&gt;",
+	"\r", "&#xD;",
+)
+
+var attrEscaper = strings.NewReplacer(
+	"&", "&amp;",
+	"<", "&lt;",
+	`"`, "&quot;",
+	"\t", "&#x9;",
+	"\n", "&#xA;",
+	"\r", "&#xD;",
+)
+
+func escapeText(s string) string {
+	return textEscaper.Replace(s)
+}
+
+func escapeAttr(s string) string {
+	return attrEscaper.Replace(s)
+}
+
+// Canonicalize returns the canonical form of an XML document using the given
+// canonicalization method, such as C14N10 or ExcC14N10.
+func Canonicalize(in []byte, method string) ([]byte, error) {
+	doc, err := parseDocument(in)
+	if err != nil {
+		return nil, err
+	}
+	c, err := newCanonicalizer(method, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.transform(doc)
+}
@@ -0,0 +1,123 @@
+package xmlsec
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCanonicalize(t *testing.T) {
+	in := `<?xml version="1.0"?>
+<!-- head -->
+<a:root xmlns:a="urn:a" xmlns:b="urn:b" xmlns="urn:default" z="1" b:y="2" a:x="3"><child attr='"&amp;&#9;'>x &gt; y<empty/></child><b:other xmlns:a="urn:a"/></a:root>`
+
+	out, err := Canonicalize([]byte(in), C14N10)
+	assert.NoError(t, err)
+	assert.Equal(t, `<a:root xmlns="urn:default" xmlns:a="urn:a" xmlns:b="urn:b" z="1" a:x="3" b:y="2"><child attr="&quot;&amp;&#x9;">x &gt; y<empty></empty></child><b:other></b:other></a:root>`, string(out))
+
+	out, err = Canonicalize([]byte(in), C14N10WithComments)
+	assert.NoError(t, err)
+	assert.Equal(t, "<!-- head -->\n<a:root", string(out[:21]))
+
+	out, err = Canonicalize([]byte(in), ExcC14N10)
+	assert.NoError(t, err)
+	assert.Equal(t, `<a:root xmlns:a="urn:a" xmlns:b="urn:b" z="1" a:x="3" b:y="2"><child xmlns="urn:default" attr="&quot;&amp;&#x9;">x &gt; y<empty></empty></child><b:other></b:other></a:root>`, string(out))
+
+	_, err = Canonicalize([]byte(in), "urn:unknown")
+	assert.Error(t, err)
+}
+
+// recordingCanonicalizer records its inputs and canonicalizes them with
+// exclusive canonicalization.
+type recordingCanonicalizer struct {
+	inputs []string
+}
+
+func (c *recordingCanonicalizer) Canonicalize(in []byte) ([]byte, error) {
+	c.inputs = append(c.inputs, string(in))
+	exclusive, err := NewCanonicalizer(ExcC14N10)
+	if err != nil {
+		return nil, err
+	}
+	return exclusive.Canonicalize(in)
+}
+
+func TestRegisterCanonicalizer(t *testing.T) {
+	const method = "urn:example:c14n"
+	in := `<a:root xmlns:a="urn:a" xmlns:b="urn:b"><child/><!-- comment --></a:root>`
+
+	exclusive, err := NewCanonicalizer("")
+	assert.NoError(t, err)
+	expected, err := exclusive.Canonicalize([]byte(in))
+	assert.NoError(t, err)
+	assert.Equal(t, `<a:root xmlns:a="urn:a"><child></child></a:root>`, string(expected))
+
+	_, err = NewCanonicalizer("urn:unknown")
+	assert.Error(t, err)
+
+	custom := &recordingCanonicalizer{}
+	RegisterCanonicalizer(method, custom)
+	defer RegisterCanonicalizer(method, nil)
+
+	out, err := Canonicalize([]byte(in), method)
+	assert.NoError(t, err)
+	assert.Equal(t, string(expected), string(out))
+	assert.Equal(t, []string{`<a:root xmlns:a="urn:a" xmlns:b="urn:b"><child></child><!-- comment --></a:root>`}, custom.inputs)
+
+	// Signing canonicalizes the SignedInfo and the reference through the
+	// registered canonicalizer, the enveloped signature removed.
+	crt, err := ioutil.ReadFile("_testdata/test.crt")
+	assert.NoError(t, err)
+	signature := DefaultSignature(crt)
+	signature.CanonicalizationMethod.Algorithm = method
+	signature.Reference.URI = "#id-1"
+	signature.Reference.Transforms = append(signature.Reference.Transforms, Method{Algorithm: method})
+
+	doc, err := xml.Marshal(struct {
+		XMLName   xml.Name `xml:"urn:a Document"`
+		ID        string   `xml:",attr"`
+		Signature Signature
+	}{ID: "id-1", Signature: signature})
+	assert.NoError(t, err)
+
+	custom.inputs = nil
+	signed, err := SignWithSigner(doc, testRSASigner(t))
+	assert.NoError(t, err)
+	if assert.Len(t, custom.inputs, 2) {
+		assert.False(t, strings.Contains(custom.inputs[0], "Signature"))
+		assert.True(t, strings.HasPrefix(custom.inputs[1], `<SignedInfo xmlns="http://www.w3.org/2000/09/xmldsig#">`))
+	}
+
+	traces, err := TraceSignatures(signed)
+	assert.NoError(t, err)
+	if assert.Len(t, traces, 1) && assert.Len(t, traces[0].References, 1) {
+		assert.True(t, traces[0].References[0].Match())
+	}
+
+	RegisterCanonicalizer(method, nil)
+	_, err = Canonicalize([]byte(in), method)
+	assert.Error(t, err)
+}
+
+func TestCanonicalizeCRLF(t *testing.T) {
+	lf := "<Assertion xmlns=\"urn:oasis:names:tc:SAML:2.0:assertion\" ID=\"id-1\">\n" +
+		"  <AttributeValue Name=\"a b  c\" Value=\"x&#xD;&#xA;y\">line 1\nline 2</AttributeValue>\n" +
+		"  <!-- a\ncomment -->\n" +
+		"</Assertion>"
+	crlf := "<Assertion xmlns=\"urn:oasis:names:tc:SAML:2.0:assertion\"\r\n    ID=\"id-1\">\r\n" +
+		"  <AttributeValue Name='a\r\nb\t\rc' Value=\"x&#xD;&#xA;y\">line 1\r\nline 2</AttributeValue>\r\n" +
+		"  <!-- a\rcomment -->\r\n" +
+		"</Assertion>"
+
+	want, err := Canonicalize([]byte(lf), ExcC14N10WithComments)
+	assert.NoError(t, err)
+	got, err := Canonicalize([]byte(crlf), ExcC14N10WithComments)
+	assert.NoError(t, err)
+	assert.Equal(t, string(want), string(got))
+	assert.Contains(t, string(got), `Name="a b  c" Value="x&#xD;&#xA;y"`)
+
+	assert.Equal(t, "<a b=\"1 2\" c='>  '>x\n\n<![CDATA[\n]]></a>", string(Normalize([]byte("<a b=\"1\r\n2\" c='>\t\n'>x\r\r<![CDATA[\r\n]]></a>"))))
+}
@@ -0,0 +1,118 @@
+package xmlsec
+
+import (
+	"bytes"
+)
+
+// Normalize applies the whitespace rules of XML 1.0 that a parser follows
+// before anything is canonicalized: line breaks are end-of-line normalized to
+// LF (section 2.11), and literal tabs and line breaks in attribute values are
+// replaced by spaces (section 3.3.3). SignWithSigner and TraceSignatures
+// apply it to their input, so documents sent with CRLF line endings digest
+// like their LF counterparts, as they do when xmlsec1's parser reads them.
+// Normalize exposes the step to compare both forms when debugging; whitespace
+// written as character references, like &#xD;, is significant and kept.
+func Normalize(in []byte) []byte {
+	out := make([]byte, 0, len(in))
+	for i := 0; i < len(in); {
+		switch {
+		case in[i] == '\r':
+			// CRLF and lone CRs become LF.
+			out = append(out, '\n')
+			i++
+			if i < len(in) && in[i] == '\n' {
+				i++
+			}
+		case in[i] != '<':
+			out = append(out, in[i])
+			i++
+		default:
+			end := markupEnd(in, i)
+			if isTag(in[i:end]) {
+				out = appendTag(out, in[i:end])
+			} else {
+				out = appendEOL(out, in[i:end])
+			}
+			i = end
+		}
+	}
+	return out
+}
+
+// markupEnd returns the offset right after the markup starting at in[start],
+// which is a '<'. Comments, CDATA sections and processing instructions end
+// with their own delimiters, tags with the first '>' outside a quoted
+// attribute value.
+func markupEnd(in []byte, start int) int {
+	rest := in[start:]
+	for _, delims := range [][2]string{{"<!--", "-->"}, {"<![CDATA[", "]]>"}, {"<?", "?>"}} {
+		if bytes.HasPrefix(rest, []byte(delims[0])) {
+			if n := bytes.Index(rest[len(delims[0]):], []byte(delims[1])); n >= 0 {
+				return start + len(delims[0]) + n + len(delims[1])
+			}
+			return len(in)
+		}
+	}
+
+	var quote byte
+	for i := start + 1; i < len(in); i++ {
+		switch c := in[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '>':
+			return i + 1
+		}
+	}
+	return len(in)
+}
+
+// isTag reports whether markup is a start or end tag rather than a comment,
+// CDATA section, processing instruction or declaration.
+func isTag(markup []byte) bool {
+	return len(markup) > 1 && markup[1] != '!' && markup[1] != '?'
+}
+
+// appendTag appends a tag with the whitespace of its attribute values
+// normalized. Between attributes, whitespace is insignificant and only end of
+// line handling applies.
+func appendTag(out []byte, tag []byte) []byte {
+	var quote byte
+	for i := 0; i < len(tag); i++ {
+		c := tag[i]
+		switch {
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case c == '\r':
+			if i+1 < len(tag) && tag[i+1] == '\n' {
+				i++
+			}
+			c = '\n'
+		}
+		if quote != 0 && (c == '\t' || c == '\n') {
+			c = ' '
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// appendEOL appends markup with only end-of-line handling applied.
+func appendEOL(out []byte, markup []byte) []byte {
+	for i := 0; i < len(markup); i++ {
+		if markup[i] == '\r' {
+			if i+1 < len(markup) && markup[i+1] == '\n' {
+				i++
+			}
+			out = append(out, '\n')
+			continue
+		}
+		out = append(out, markup[i])
+	}
+	return out
+}
@@ -26,14 +26,43 @@
 package xmlsec
 
 import (
+	"crypto/rsa"
 	"encoding/base64"
 	"encoding/pem"
 	"encoding/xml"
+	"math/big"
+	"strings"
 )
 
 // Method is part of Signature.
 type Method struct {
 	Algorithm string `xml:",attr"`
+
+	// InclusiveNamespaces is the PrefixList of exclusive canonicalization
+	// methods and transforms, if any.
+	InclusiveNamespaces *InclusiveNamespaces
+}
+
+// InclusiveNamespaces lists the prefixes whose namespaces exclusive
+// canonicalization handles as inclusive canonicalization does.
+type InclusiveNamespaces struct {
+	XMLName    xml.Name `xml:"http://www.w3.org/2001/10/xml-exc-c14n# InclusiveNamespaces"`
+	PrefixList string   `xml:",attr"`
+}
+
+// NewTransforms returns the Transforms of a Reference with the given
+// algorithms. Exclusive canonicalization transforms are given prefixList as
+// their InclusiveNamespaces, when it is not empty.
+func NewTransforms(algorithms []string, prefixList []string) []Method {
+	transforms := make([]Method, 0, len(algorithms))
+	for _, algorithm := range algorithms {
+		transform := Method{Algorithm: algorithm}
+		if len(prefixList) > 0 && (algorithm == ExcC14N10 || algorithm == ExcC14N10WithComments) {
+			transform.InclusiveNamespaces = &InclusiveNamespaces{PrefixList: strings.Join(prefixList, " ")}
+		}
+		transforms = append(transforms, transform)
+	}
+	return transforms
 }
 
 // Signature is a model for the Signature object specified by XMLDSIG. This is
@@ -57,6 +86,7 @@ type Signature struct {
 	Reference              Reference          `xml:"SignedInfo>Reference"`
 	SignatureValue         string             `xml:"SignatureValue"`
 	KeyName                string             `xml:"KeyInfo>KeyName,omitempty"`
+	KeyValue               *SignatureKeyValue `xml:"KeyInfo>KeyValue,omitempty"`
 	X509Certificate        *SignatureX509Data `xml:"KeyInfo>X509Data,omitempty"`
 }
 
@@ -72,6 +102,29 @@ type SignatureX509Data struct {
 	X509Certificate string `xml:"X509Certificate,omitempty"`
 }
 
+// SignatureKeyValue represents the <KeyValue> element of <Signature>
+type SignatureKeyValue struct {
+	RSAKeyValue *RSAKeyValue `xml:"RSAKeyValue,omitempty"`
+}
+
+// RSAKeyValue represents the <RSAKeyValue> element of <KeyValue>. Modulus
+// and Exponent are ds:CryptoBinary values: the base64 encoding of their
+// big-endian bytes, without leading zeros.
+type RSAKeyValue struct {
+	Modulus  string `xml:"Modulus"`
+	Exponent string `xml:"Exponent"`
+}
+
+// NewRSAKeyValue returns the <KeyValue> of an RSA public key.
+func NewRSAKeyValue(key *rsa.PublicKey) *SignatureKeyValue {
+	return &SignatureKeyValue{
+		RSAKeyValue: &RSAKeyValue{
+			Modulus:  base64.StdEncoding.EncodeToString(key.N.Bytes()),
+			Exponent: base64.StdEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		},
+	}
+}
+
 // DefaultSignature returns a Signature struct that uses the default c14n and SHA1 settings.
 func DefaultSignature(pemEncodedPublicKey []byte) Signature {
 	// xmlsec wants the key to be base64-encoded but *not* wrapped with the
@@ -0,0 +1,295 @@
+package xmlsec
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	_ "crypto/sha1" // Registers crypto.SHA1.
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/asn1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// Signature and digest methods understood by SignWithSigner.
+const (
+	RSASHA1     = "http://www.w3.org/2000/09/xmldsig#rsa-sha1"
+	RSASHA256   = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"
+	RSASHA512   = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha512"
+	ECDSASHA1   = "http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha1"
+	ECDSASHA256 = "http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha256"
+	ECDSASHA512 = "http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha512"
+
+	DigestSHA1   = "http://www.w3.org/2000/09/xmldsig#sha1"
+	DigestSHA256 = "http://www.w3.org/2001/04/xmlenc#sha256"
+	DigestSHA512 = "http://www.w3.org/2001/04/xmlenc#sha512"
+)
+
+var signatureHashes = map[string]crypto.Hash{
+	RSASHA1:     crypto.SHA1,
+	RSASHA256:   crypto.SHA256,
+	RSASHA512:   crypto.SHA512,
+	ECDSASHA1:   crypto.SHA1,
+	ECDSASHA256: crypto.SHA256,
+	ECDSASHA512: crypto.SHA512,
+}
+
+var digestHashes = map[string]crypto.Hash{
+	DigestSHA1:   crypto.SHA1,
+	DigestSHA256: crypto.SHA256,
+	DigestSHA512: crypto.SHA512,
+}
+
+// SignWithSigner signs a XML document like Sign does, but without xmlsec1 and
+// without access to the private key: the signature is computed by signer,
+// which may be backed by an HSM or a cloud KMS.
+//
+// The document must contain a Signature template, such as DefaultSignature,
+// whose Reference points to the whole document or to an element by its ID,
+// AssertionID or ResponseID attribute. The signed document is returned in
+// canonical form.
+func SignWithSigner(in []byte, signer crypto.Signer) ([]byte, error) {
+	doc, err := parseDocument(in)
+	if err != nil {
+		return nil, err
+	}
+
+	signature := doc.find(func(n *node) bool {
+		return n.is(xmldsigNamespace, "Signature")
+	})
+	if signature == nil {
+		return nil, errors.New("missing Signature template")
+	}
+
+	signedInfo := signature.child(xmldsigNamespace, "SignedInfo")
+	if signedInfo == nil {
+		return nil, errors.New("missing Signature > SignedInfo")
+	}
+	signatureValue := signature.child(xmldsigNamespace, "SignatureValue")
+	if signatureValue == nil {
+		return nil, errors.New("missing Signature > SignatureValue")
+	}
+
+	for _, reference := range signedInfo.children {
+		if reference.is(xmldsigNamespace, "Reference") {
+			if err := digestReference(doc, signature, reference); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	method, canonicalizer, err := algorithms(signedInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	hash, ok := signatureHashes[method]
+	if !ok {
+		return nil, fmt.Errorf("unsupported signature method %q", method)
+	}
+
+	_, isECDSA := signer.Public().(*ecdsa.PublicKey)
+	if isECDSA != strings.HasPrefix(method, "http://www.w3.org/2001/04/xmldsig-more#ecdsa-") {
+		return nil, fmt.Errorf("signature method %q does not match the signer's %T key", method, signer.Public())
+	}
+
+	canonical, err := canonicalizer.transform(signedInfo)
+	if err != nil {
+		return nil, err
+	}
+	h := hash.New()
+	h.Write(canonical)
+
+	sig, err := signer.Sign(rand.Reader, h.Sum(nil), hash)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign: %v", err)
+	}
+
+	if pub, ok := signer.Public().(*ecdsa.PublicKey); ok {
+		// XML-DSig wants r and s concatenated, not ASN.1 encoded.
+		if sig, err = concatECDSASignature(sig, (pub.Curve.Params().BitSize+7)/8); err != nil {
+			return nil, err
+		}
+	}
+	signatureValue.setText(base64.StdEncoding.EncodeToString(sig))
+
+	c, _ := newCanonicalizer(C14N10WithComments, nil)
+	return c.canonicalize(doc), nil
+}
+
+// algorithms returns the SignatureMethod and CanonicalizationMethod of a
+// SignedInfo element.
+func algorithms(signedInfo *node) (string, *canonicalizer, error) {
+	signatureMethod := signedInfo.child(xmldsigNamespace, "SignatureMethod")
+	if signatureMethod == nil {
+		return "", nil, errors.New("missing SignedInfo > SignatureMethod")
+	}
+	method, _ := signatureMethod.attr("Algorithm")
+
+	canonicalizationMethod := signedInfo.child(xmldsigNamespace, "CanonicalizationMethod")
+	if canonicalizationMethod == nil {
+		return "", nil, errors.New("missing SignedInfo > CanonicalizationMethod")
+	}
+	c14nMethod, _ := canonicalizationMethod.attr("Algorithm")
+
+	c, err := newCanonicalizer(c14nMethod, inclusivePrefixes(canonicalizationMethod))
+	if err != nil {
+		return "", nil, err
+	}
+	return method, c, nil
+}
+
+// digestReference computes and sets the DigestValue of a Reference.
+func digestReference(doc *node, signature *node, reference *node) error {
+	digestValue := reference.child(xmldsigNamespace, "DigestValue")
+	if digestValue == nil {
+		return errors.New("missing Reference > DigestValue")
+	}
+
+	_, digest, err := referenceDigest(doc, signature, reference)
+	if err != nil {
+		return err
+	}
+	digestValue.setText(base64.StdEncoding.EncodeToString(digest))
+	return nil
+}
+
+// referenceDigest returns the octets a Reference points to, after applying
+// its transforms, and their digest.
+func referenceDigest(doc *node, signature *node, reference *node) ([]byte, []byte, error) {
+	target := doc
+	uri, _ := reference.attr("URI")
+	if uri != "" {
+		if !strings.HasPrefix(uri, "#") {
+			return nil, nil, fmt.Errorf("unsupported reference URI %q", uri)
+		}
+		id := uri[1:]
+		target = doc.find(func(n *node) bool {
+			for _, name := range []string{"ID", "AssertionID", "ResponseID"} {
+				if value, ok := n.attr(name); ok && value == id {
+					return true
+				}
+			}
+			return false
+		})
+		if target == nil {
+			return nil, nil, fmt.Errorf("reference URI %q not found", uri)
+		}
+	}
+
+	// Nodes are converted to octets with inclusive canonicalization unless a
+	// transform says otherwise.
+	c, _ := newCanonicalizer(C14N10, nil)
+	if transforms := reference.child(xmldsigNamespace, "Transforms"); transforms != nil {
+		for _, transform := range transforms.children {
+			if !transform.is(xmldsigNamespace, "Transform") {
+				continue
+			}
+			algorithm, _ := transform.attr("Algorithm")
+			if algorithm == EnvelopedSignatureTransform {
+				continue
+			}
+			var err error
+			if c, err = newCanonicalizer(algorithm, inclusivePrefixes(transform)); err != nil {
+				return nil, nil, err
+			}
+		}
+		for _, transform := range transforms.children {
+			if algorithm, _ := transform.attr("Algorithm"); algorithm == EnvelopedSignatureTransform {
+				c.exclude = signature
+			}
+		}
+	}
+	// Same document references, whole document and bare-name "#id" ones
+	// alike, exclude comments, even under a WithComments transform.
+	c.comments = false
+
+	digestMethod := reference.child(xmldsigNamespace, "DigestMethod")
+	if digestMethod == nil {
+		return nil, nil, errors.New("missing Reference > DigestMethod")
+	}
+	algorithm, _ := digestMethod.attr("Algorithm")
+	hash, ok := digestHashes[algorithm]
+	if !ok {
+		return nil, nil, fmt.Errorf("unsupported digest method %q", algorithm)
+	}
+
+	canonical, err := c.transform(target)
+	if err != nil {
+		return nil, nil, err
+	}
+	h := hash.New()
+	h.Write(canonical)
+	return canonical, h.Sum(nil), nil
+}
+
+// inclusivePrefixes returns the PrefixList of an InclusiveNamespaces child.
+func inclusivePrefixes(n *node) []string {
+	inclusive := n.child(ExcC14N10, "InclusiveNamespaces")
+	if inclusive == nil {
+		return nil
+	}
+	prefixList, _ := inclusive.attr("PrefixList")
+	return strings.Fields(prefixList)
+}
+
+// VerifySignatureValue checks a signature computed with the given signature
+// method, such as RSASHA256, over signed. It is meant for detached signatures,
+// like the query string signatures of the SAML HTTP-Redirect binding. ECDSA
+// signatures are r and s concatenated, as in XML-DSig.
+func VerifySignatureValue(method string, pub crypto.PublicKey, signed []byte, signature []byte) error {
+	hash, ok := signatureHashes[method]
+	if !ok {
+		return fmt.Errorf("unsupported signature method %q", method)
+	}
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	isECDSAMethod := strings.HasPrefix(method, "http://www.w3.org/2001/04/xmldsig-more#ecdsa-")
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		if isECDSAMethod {
+			break
+		}
+		if err := rsa.VerifyPKCS1v15(key, hash, digest, signature); err != nil {
+			return errors.New("signature verification failed")
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		if !isECDSAMethod {
+			break
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return errors.New("malformed ECDSA signature")
+		}
+		r, s := new(big.Int).SetBytes(signature[:size]), new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return errors.New("signature verification failed")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported public key type %T", pub)
+	}
+	return fmt.Errorf("signature method %q does not match the %T key", method, pub)
+}
+
+func concatECDSASignature(der []byte, size int) ([]byte, error) {
+	var sig struct {
+		R, S *big.Int
+	}
+	if _, err := asn1.Unmarshal(der, &sig); err != nil {
+		return nil, fmt.Errorf("malformed ECDSA signature: %v", err)
+	}
+	out := make([]byte, 2*size)
+	r, s := sig.R.Bytes(), sig.S.Bytes()
+	copy(out[size-len(r):size], r)
+	copy(out[2*size-len(s):], s)
+	return out, nil
+}
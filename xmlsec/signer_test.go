@@ -0,0 +1,177 @@
+package xmlsec
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"encoding/xml"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testRSASigner(t *testing.T) *rsa.PrivateKey {
+	buf, err := ioutil.ReadFile("_testdata/test.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(buf)
+	if block == nil {
+		t.Fatal("failed to decode _testdata/test.key")
+	}
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// signatureElements returns the DigestValue and SignatureValue of a signed
+// document.
+func signatureElements(t *testing.T, signed []byte) (digestValue, signatureValue string) {
+	var doc struct {
+		DigestValue    string `xml:"Signature>SignedInfo>Reference>DigestValue"`
+		SignatureValue string `xml:"Signature>SignatureValue"`
+	}
+	if err := xml.Unmarshal(signed, &doc); err != nil {
+		t.Fatal(err)
+	}
+	return doc.DigestValue, strings.Join(strings.Fields(doc.SignatureValue), "")
+}
+
+func TestSignWithSigner(t *testing.T) {
+	testIn := `<?xml version="1.0" encoding="UTF-8"?>
+<document>
+  <firstelement attr1="attr1">
+    Content of first element.
+    <secondelement attr2="attr2">
+      Content of the second element.
+      <thirdelement attr3="attr3">
+        And the content of the third element.
+      </thirdelement>
+    </secondelement>
+  </firstelement>
+	` + signatureTemplate + `
+</document>`
+
+	out, err := SignWithSigner([]byte(testIn), testRSASigner(t))
+	assert.NoError(t, err)
+
+	// Same values xmlsec1 produces in TestSignAndVerify.
+	digestValue, signatureValue := signatureElements(t, out)
+	assert.Equal(t, "dZrvFdaRZNqvOMBoHACmIE5X13g=", digestValue)
+	assert.Equal(t, "yiaFcqnjLRe4SFQXAGULtcYy7QPQy8DyX+t1Z4tfVitakOCRu0Yn52nKc+JQCX28"+
+		"ziTB5dGVze4wn4xuNcBYQ2cQ0v5oUNaqqjtR6AW+AvCc5x8NDa1LlRv3F4Mcx7E1"+
+		"UOtapGkSaG8y8vXX9QYOBNspAGHjqkgiyin2UVmRGn1dcZ3xxlqWVTbdwOcyTL20"+
+		"RnLe62TzsDCkxdqaDh0OfZyVBakrU3wlSkk81Be8LnTrY+F7cL/JGU6r8qCkvdFi"+
+		"FY7bQrOPS73L5HPtsAsmInM8SgP+3deBDoqMUVf+pbJ7SDtrjs9ZQy2JkeAF6/C3"+
+		"ohv8eaTdiOUc7qf1L7oIV/oFgaidMj+j+SIQvkDFcrhip45TS2eL1w/NOBVdCB7U"+
+		"gXKQBmQqV0Y4YJLXMMWx9RHjj8UMXEDEeY8EHyLMSGxaYu+qJyykbtMWmQAGhYcX"+
+		"MojSiiJJtWNAm/ijORoYfdaZrXBfGbJuOzfFYQiieYyS4wreiAwetG2sYmD35t6I"+
+		"f2rLW19XQc67dmFb0QgmfaRVNnMeeYo6AhNRzZyM1ItVDYzao6HDAf8plk+kYZpL"+
+		"4QjjSejy7I+8Jqeg7lDRO2pcAskHX3Kuy4dkT7FKh5kCeAAyrkdrMpgLtJ+ihuj9"+
+		"3LHLkkivMUKF/+g97npEjs4rgO5hcGztac9EHCdj6Cs=", signatureValue)
+}
+
+func TestSignWithSignerReference(t *testing.T) {
+	crt, err := ioutil.ReadFile("_testdata/test.crt")
+	assert.NoError(t, err)
+
+	type Assertion struct {
+		XMLName   xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:assertion Assertion"`
+		ID        string   `xml:",attr"`
+		Issuer    string   `xml:"Issuer"`
+		Signature Signature
+	}
+
+	signature := DefaultSignature(crt)
+	signature.CanonicalizationMethod.Algorithm = ExcC14N10
+	signature.SignatureMethod.Algorithm = ECDSASHA256
+	signature.Reference.URI = "#id-1"
+	signature.Reference.Transforms = append(signature.Reference.Transforms, Method{Algorithm: ExcC14N10})
+	signature.Reference.DigestMethod.Algorithm = DigestSHA256
+
+	in, err := xml.Marshal(Assertion{ID: "id-1", Issuer: "https://idp.example.com", Signature: signature})
+	assert.NoError(t, err)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	out, err := SignWithSigner(in, key)
+	assert.NoError(t, err)
+
+	doc, err := parseDocument(out)
+	assert.NoError(t, err)
+	signed := doc.find(func(n *node) bool { return n.is(xmldsigNamespace, "Signature") })
+	signedInfo := signed.child(xmldsigNamespace, "SignedInfo")
+
+	c, _ := newCanonicalizer(ExcC14N10, nil)
+	c.exclude = signed
+	digest := sha256.Sum256(c.canonicalize(doc.root()))
+
+	digestValue, signatureValue := signatureElements(t, out)
+	assert.Equal(t, base64.StdEncoding.EncodeToString(digest[:]), digestValue)
+
+	sig, err := base64.StdEncoding.DecodeString(signatureValue)
+	assert.NoError(t, err)
+	assert.Len(t, sig, 64)
+
+	c, _ = newCanonicalizer(ExcC14N10, nil)
+	h := sha256.Sum256(c.canonicalize(signedInfo))
+	r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+	assert.True(t, ecdsa.Verify(&key.PublicKey, h[:], r, s))
+
+	// RSA keys cannot make ECDSA signatures.
+	_, err = SignWithSigner(in, testRSASigner(t))
+	assert.Error(t, err)
+}
+
+func TestReferenceDigestComments(t *testing.T) {
+	for _, uri := range []string{"", "#id-1"} {
+		in := `<Assertion xmlns="urn:oasis:names:tc:SAML:2.0:assertion" ID="id-1"><!-- comment --><Issuer>idp</Issuer>` +
+			`<Signature xmlns="http://www.w3.org/2000/09/xmldsig#"><SignedInfo><Reference URI="` + uri + `"><Transforms>` +
+			`<Transform Algorithm="` + EnvelopedSignatureTransform + `"></Transform>` +
+			`<Transform Algorithm="` + ExcC14N10WithComments + `"></Transform></Transforms>` +
+			`<DigestMethod Algorithm="` + DigestSHA256 + `"></DigestMethod><DigestValue></DigestValue></Reference></SignedInfo></Signature></Assertion>`
+		doc, err := parseDocument([]byte(in))
+		assert.NoError(t, err)
+		signature := doc.find(func(n *node) bool { return n.is(xmldsigNamespace, "Signature") })
+		reference := doc.find(func(n *node) bool { return n.is(xmldsigNamespace, "Reference") })
+
+		canonical, _, err := referenceDigest(doc, signature, reference)
+		assert.NoError(t, err)
+		assert.Equal(t, `<Assertion xmlns="urn:oasis:names:tc:SAML:2.0:assertion" ID="id-1"><Issuer>idp</Issuer></Assertion>`, string(canonical), "URI %q", uri)
+	}
+}
+
+func TestVerifySignatureValue(t *testing.T) {
+	signed := []byte("SAMLRequest=request&SigAlg=alg")
+	digest := sha256.Sum256(signed)
+
+	rsaKey := testRSASigner(t)
+	sig, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest[:])
+	assert.NoError(t, err)
+	assert.NoError(t, VerifySignatureValue(RSASHA256, &rsaKey.PublicKey, signed, sig))
+	assert.Error(t, VerifySignatureValue(RSASHA256, &rsaKey.PublicKey, []byte("SAMLRequest=forged"), sig))
+	assert.Error(t, VerifySignatureValue(RSASHA1, &rsaKey.PublicKey, signed, sig))
+	assert.Error(t, VerifySignatureValue(ECDSASHA256, &rsaKey.PublicKey, signed, sig))
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	der, err := ecKey.Sign(rand.Reader, digest[:], crypto.SHA256)
+	assert.NoError(t, err)
+	sig, err = concatECDSASignature(der, 32)
+	assert.NoError(t, err)
+	assert.NoError(t, VerifySignatureValue(ECDSASHA256, &ecKey.PublicKey, signed, sig))
+	assert.Error(t, VerifySignatureValue(ECDSASHA256, &ecKey.PublicKey, signed, der))
+	assert.Error(t, VerifySignatureValue(RSASHA256, &ecKey.PublicKey, signed, sig))
+}
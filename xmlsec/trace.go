@@ -0,0 +1,118 @@
+package xmlsec
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// SignatureTrace holds the octets a signature covers, as computed natively by
+// TraceSignatures, to compare them with what another implementation such as
+// xmlsec1 or OpenSSL digested and signed.
+type SignatureTrace struct {
+	// SignedInfo is the canonical form of the SignedInfo element, which is
+	// what the SignatureValue is computed over.
+	SignedInfo      []byte
+	SignatureMethod string
+	References      []ReferenceTrace
+}
+
+// ReferenceTrace holds the octets a Reference points to, after applying its
+// transforms, with their computed digest and the DigestValue found in the
+// document.
+type ReferenceTrace struct {
+	URI            string
+	Canonical      []byte
+	Digest         []byte
+	ExpectedDigest []byte
+}
+
+// Match reports whether the computed digest equals the DigestValue of the
+// Reference.
+func (r *ReferenceTrace) Match() bool {
+	return bytes.Equal(r.Digest, r.ExpectedDigest)
+}
+
+// String formats the trace for logging.
+func (t *SignatureTrace) String() string {
+	lines := []string{
+		fmt.Sprintf("SignatureMethod: %s", t.SignatureMethod),
+		fmt.Sprintf("SignedInfo (canonical): %s", t.SignedInfo),
+	}
+	for _, r := range t.References {
+		lines = append(lines,
+			fmt.Sprintf("Reference %q (canonical): %s", r.URI, r.Canonical),
+			fmt.Sprintf("Reference %q digest: computed %s, expected %s, match %v", r.URI,
+				base64.StdEncoding.EncodeToString(r.Digest), base64.StdEncoding.EncodeToString(r.ExpectedDigest), r.Match()),
+		)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// TraceSignatures recomputes the canonical octets and digests of every
+// signature in a document, without checking the signature values. It is a
+// debugging aid for signature mismatches, the result is the same whether the
+// document was signed by Sign, SignWithSigner or a third party.
+func TraceSignatures(in []byte) ([]SignatureTrace, error) {
+	doc, err := parseDocument(in)
+	if err != nil {
+		return nil, err
+	}
+
+	var signatures []*node
+	doc.find(func(n *node) bool {
+		if n.is(xmldsigNamespace, "Signature") {
+			signatures = append(signatures, n)
+		}
+		return false
+	})
+	if len(signatures) == 0 {
+		return nil, errors.New("missing Signature")
+	}
+
+	traces := make([]SignatureTrace, 0, len(signatures))
+	for _, signature := range signatures {
+		signedInfo := signature.child(xmldsigNamespace, "SignedInfo")
+		if signedInfo == nil {
+			return nil, errors.New("missing Signature > SignedInfo")
+		}
+
+		method, canonicalizer, err := algorithms(signedInfo)
+		if err != nil {
+			return nil, err
+		}
+		canonical, err := canonicalizer.transform(signedInfo)
+		if err != nil {
+			return nil, err
+		}
+		trace := SignatureTrace{
+			SignedInfo:      canonical,
+			SignatureMethod: method,
+		}
+
+		for _, reference := range signedInfo.children {
+			if !reference.is(xmldsigNamespace, "Reference") {
+				continue
+			}
+			canonical, digest, err := referenceDigest(doc, signature, reference)
+			if err != nil {
+				return nil, err
+			}
+			uri, _ := reference.attr("URI")
+			var expected []byte
+			if digestValue := reference.child(xmldsigNamespace, "DigestValue"); digestValue != nil {
+				expected, _ = base64.StdEncoding.DecodeString(strings.Join(strings.Fields(digestValue.text()), ""))
+			}
+			trace.References = append(trace.References, ReferenceTrace{
+				URI:            uri,
+				Canonical:      canonical,
+				Digest:         digest,
+				ExpectedDigest: expected,
+			})
+		}
+		traces = append(traces, trace)
+	}
+	return traces, nil
+}
@@ -0,0 +1,129 @@
+package xmlsec
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/xml"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTraceSignatures(t *testing.T) {
+	crt, err := ioutil.ReadFile("_testdata/test.crt")
+	assert.NoError(t, err)
+
+	type Assertion struct {
+		XMLName   xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:assertion Assertion"`
+		ID        string   `xml:",attr"`
+		Issuer    string   `xml:"Issuer"`
+		Signature Signature
+	}
+
+	signature := DefaultSignature(crt)
+	signature.Reference.URI = "#id-1"
+	in, err := xml.Marshal(Assertion{ID: "id-1", Issuer: "https://idp.example.com", Signature: signature})
+	assert.NoError(t, err)
+
+	key := testRSASigner(t)
+	out, err := SignWithSigner(in, key)
+	assert.NoError(t, err)
+
+	traces, err := TraceSignatures(out)
+	assert.NoError(t, err)
+	if !assert.Len(t, traces, 1) || !assert.Len(t, traces[0].References, 1) {
+		return
+	}
+
+	trace := traces[0]
+	assert.Equal(t, RSASHA1, trace.SignatureMethod)
+
+	reference := trace.References[0]
+	assert.Equal(t, "#id-1", reference.URI)
+	assert.True(t, reference.Match())
+	assert.Equal(t, `<Assertion xmlns="urn:oasis:names:tc:SAML:2.0:assertion" ID="id-1"><Issuer>https://idp.example.com</Issuer></Assertion>`, string(reference.Canonical))
+	digest := sha1.Sum(reference.Canonical)
+	assert.Equal(t, digest[:], reference.Digest)
+
+	// The SignatureValue is computed over the traced SignedInfo.
+	_, signatureValue := signatureElements(t, out)
+	sig, err := base64.StdEncoding.DecodeString(signatureValue)
+	assert.NoError(t, err)
+	h := sha1.Sum(trace.SignedInfo)
+	assert.NoError(t, rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA1, h[:], sig))
+
+	// A tampered document no longer matches its DigestValue.
+	tampered := strings.Replace(string(out), "https://idp.example.com", "https://evil.example.com", 1)
+	traces, err = TraceSignatures([]byte(tampered))
+	assert.NoError(t, err)
+	assert.False(t, traces[0].References[0].Match())
+	assert.Contains(t, traces[0].String(), "match false")
+
+	_, err = TraceSignatures([]byte(`<Assertion></Assertion>`))
+	assert.Error(t, err)
+}
+
+// TestTraceSignaturesCRLF checks that a signed assertion still matches its
+// digest once sent with CRLF line endings and attribute values wrapped on
+// several lines. The document is generated, not captured: an indented,
+// ADFS-like assertion is signed, then its line endings are rewritten, which
+// is what reaches SPs through CRLF-converting transports.
+func TestTraceSignaturesCRLF(t *testing.T) {
+	crt, err := ioutil.ReadFile("_testdata/test.crt")
+	assert.NoError(t, err)
+
+	type Attribute struct {
+		Name         string `xml:",attr"`
+		FriendlyName string `xml:",attr"`
+		Value        string `xml:"AttributeValue"`
+	}
+	type Assertion struct {
+		XMLName   xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:assertion Assertion"`
+		ID        string   `xml:",attr"`
+		Issuer    string   `xml:"Issuer"`
+		Signature Signature
+		Attribute Attribute
+	}
+
+	signature := DefaultSignature(crt)
+	signature.Reference.URI = "#_d71a3a8e9fcc45c9e9d248ef7049393fc8f04e5f75"
+	in, err := xml.MarshalIndent(Assertion{
+		ID:        "_d71a3a8e9fcc45c9e9d248ef7049393fc8f04e5f75",
+		Issuer:    "http://adfs.example.com/adfs/services/trust",
+		Signature: signature,
+		Attribute: Attribute{
+			Name:         "http://schemas.xmlsoap.org/ws/2005/05/identity/claims/emailaddress",
+			FriendlyName: "E-Mail Address",
+			Value:        "anakin@example.com",
+		},
+	}, "", "  ")
+	assert.NoError(t, err)
+
+	out, err := SignWithSigner(in, testRSASigner(t))
+	assert.NoError(t, err)
+
+	sent := strings.Replace(string(out), "\n", "\r\n", -1)
+	sent = strings.Replace(sent, `FriendlyName="E-Mail Address"`, "FriendlyName=\"E-Mail\r\nAddress\"", 1)
+	assert.Contains(t, sent, "E-Mail\r\nAddress")
+
+	traces, err := TraceSignatures([]byte(sent))
+	assert.NoError(t, err)
+	if assert.Len(t, traces, 1) && assert.Len(t, traces[0].References, 1) {
+		assert.True(t, traces[0].References[0].Match(), traces[0].String())
+	}
+
+	// xmlsec1 verifies the document as sent, its parser normalizes it the
+	// same way.
+	if _, err := exec.LookPath("xmlsec1"); err != nil {
+		t.Skip("xmlsec1 is not installed")
+	}
+	err = Verify([]byte(sent), "_testdata/test.crt", &ValidationOptions{
+		EnableIDAttrHack: true,
+	})
+	assert.NoError(t, err)
+}
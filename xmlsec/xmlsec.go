@@ -1,10 +1,19 @@
 // Package xmlsec is a wrapper around the xmlsec1 command
 // https://www.aleksey.com/xmlsec/index.html
+//
+// SignWithSigner signs documents natively instead, for keys that are only
+// reachable through a crypto.Signer. TraceSignatures shows the octets a
+// signature covers, to debug mismatches. Both canonicalize natively, through
+// the Canonicalizer registered for a method with RegisterCanonicalizer if
+// any, after the whitespace normalization of XML parsers, see Normalize.
+// Verify, like the other xmlsec1 backed functions, never uses a registered
+// Canonicalizer: they are for signing only.
 package xmlsec
 
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/xml"
 	"fmt"
 	"io/ioutil"
@@ -17,12 +26,18 @@ const (
 	attrNameResponse     = `urn:oasis:names:tc:SAML:2.0:protocol:Response`
 	attrNameAssertion    = `urn:oasis:names:tc:SAML:2.0:assertion:Assertion`
 	attrNameAuthnRequest = `urn:oasis:names:tc:SAML:2.0:protocol:AuthnRequest`
+
+	attrNameResponse11  = `urn:oasis:names:tc:SAML:1.0:protocol:Response`
+	attrNameAssertion11 = `urn:oasis:names:tc:SAML:1.0:assertion:Assertion`
 )
 
 type ValidationOptions struct {
 	DTDFile          string
 	EnableIDAttrHack bool
 	IDAttrs          []string
+
+	// KeyPassword decrypts an encrypted private key given to Sign.
+	KeyPassword string
 }
 
 // ErrSelfSignedCertificate is a typed error returned when xmlsec1 detects a
@@ -61,6 +76,11 @@ func (e ErrValidityError) Error() string {
 // Encrypt encrypts a byte sequence into an EncryptedData template using the
 // given certificate and encryption method.
 func Encrypt(template *EncryptedData, in []byte, publicCertPath string, method string) ([]byte, error) {
+	return EncryptWithContext(context.Background(), template, in, publicCertPath, method)
+}
+
+// EncryptWithContext is Encrypt, killing xmlsec1 when ctx is done.
+func EncryptWithContext(ctx context.Context, template *EncryptedData, in []byte, publicCertPath string, method string) ([]byte, error) {
 	// Writing template.
 	fp, err := ioutil.TempFile("/tmp", "xmlsec")
 	if err != nil {
@@ -81,7 +101,7 @@ func Encrypt(template *EncryptedData, in []byte, publicCertPath string, method s
 	}
 
 	// Executing command.
-	cmd := exec.Command("xmlsec1", "--encrypt",
+	cmd := exec.CommandContext(ctx, "xmlsec1", "--encrypt",
 		"--session-key", method,
 		"--pubkey-cert-pem", publicCertPath,
 		"--output", "/dev/stdout",
@@ -130,6 +150,9 @@ func Encrypt(template *EncryptedData, in []byte, publicCertPath string, method s
 	}
 
 	if err := cmd.Wait(); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
 		if len(resErr) > 0 {
 			return res, xmlsecErr(string(resErr))
 		}
@@ -142,8 +165,13 @@ func Encrypt(template *EncryptedData, in []byte, publicCertPath string, method s
 // Decrypt takes an encrypted XML document and decrypts it using the given
 // private key.
 func Decrypt(in []byte, privateKeyPath string) ([]byte, error) {
+	return DecryptWithContext(context.Background(), in, privateKeyPath)
+}
+
+// DecryptWithContext is Decrypt, killing xmlsec1 when ctx is done.
+func DecryptWithContext(ctx context.Context, in []byte, privateKeyPath string) ([]byte, error) {
 	// Executing command.
-	cmd := exec.Command("xmlsec1", "--decrypt",
+	cmd := exec.CommandContext(ctx, "xmlsec1", "--decrypt",
 		"--privkey-pem", privateKeyPath,
 		"--output", "/dev/stdout",
 		"/dev/stdin",
@@ -190,6 +218,9 @@ func Decrypt(in []byte, privateKeyPath string) ([]byte, error) {
 	}
 
 	if err := cmd.Wait(); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
 		if len(resErr) > 0 {
 			return res, xmlsecErr(string(resErr))
 		}
@@ -199,9 +230,15 @@ func Decrypt(in []byte, privateKeyPath string) ([]byte, error) {
 	return res, nil
 }
 
-// Verify takes a signed XML document and validates its signature.
+// Verify takes a signed XML document and validates its signature. The
+// document is passed to xmlsec1 as is, so the bytes verified are the bytes
+// the caller goes on to parse.
 func Verify(in []byte, publicCertPath string, opts *ValidationOptions) error {
+	return VerifyWithContext(context.Background(), in, publicCertPath, opts)
+}
 
+// VerifyWithContext is Verify, killing xmlsec1 when ctx is done.
+func VerifyWithContext(ctx context.Context, in []byte, publicCertPath string, opts *ValidationOptions) error {
 	args := []string{
 		"xmlsec1", "--verify",
 		"--pubkey-cert-pem", publicCertPath,
@@ -215,7 +252,7 @@ func Verify(in []byte, publicCertPath string, opts *ValidationOptions) error {
 
 	args = append(args, []string{"/dev/stdin"}...)
 
-	cmd := exec.Command(args[0], args[1:]...)
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
 
 	stdin, err := cmd.StdinPipe()
 	if err != nil {
@@ -258,6 +295,9 @@ func Verify(in []byte, publicCertPath string, opts *ValidationOptions) error {
 	}
 
 	if err := cmd.Wait(); err != nil || isValidityError(resErr) {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		if len(resErr) > 0 {
 			return xmlsecErr(string(res) + "\n" + string(resErr))
 		}
@@ -269,12 +309,21 @@ func Verify(in []byte, publicCertPath string, opts *ValidationOptions) error {
 
 // Sign takes a XML document and produces a signature.
 func Sign(in []byte, privateKeyPath string, opts *ValidationOptions) (out []byte, err error) {
+	return SignWithContext(context.Background(), in, privateKeyPath, opts)
+}
 
-	args := []string{
-		"xmlsec1", "--sign",
+// SignWithContext is Sign, killing xmlsec1 when ctx is done.
+func SignWithContext(ctx context.Context, in []byte, privateKeyPath string, opts *ValidationOptions) (out []byte, err error) {
+
+	args := []string{"xmlsec1", "--sign"}
+	if opts != nil && opts.KeyPassword != "" {
+		// The password applies to the key that follows it.
+		args = append(args, "--pwd", opts.KeyPassword)
+	}
+	args = append(args,
 		"--privkey-pem", privateKeyPath,
 		"--enabled-reference-uris", "empty,same-doc",
-	}
+	)
 
 	applyOptions(&args, opts)
 
@@ -283,7 +332,7 @@ func Sign(in []byte, privateKeyPath string, opts *ValidationOptions) (out []byte
 		"/dev/stdin",
 	}...)
 
-	cmd := exec.Command(args[0], args[1:]...)
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
 
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
@@ -326,6 +375,9 @@ func Sign(in []byte, privateKeyPath string, opts *ValidationOptions) (out []byte
 	}
 
 	if err := cmd.Wait(); err != nil || isValidityError(resErr) {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
 		if len(resErr) > 0 {
 			return res, xmlsecErr(string(res) + "\n" + string(resErr))
 		}
@@ -375,6 +427,8 @@ func applyOptions(args *[]string, opts *ValidationOptions) {
 			"--id-attr:ID", attrNameResponse,
 			"--id-attr:ID", attrNameAssertion,
 			"--id-attr:ID", attrNameAuthnRequest,
+			"--id-attr:ResponseID", attrNameResponse11,
+			"--id-attr:AssertionID", attrNameAssertion11,
 		}...)
 		for _, v := range opts.IDAttrs {
 			*args = append(*args, []string{"--id-attr:ID", v}...)
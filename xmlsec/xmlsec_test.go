@@ -1,10 +1,13 @@
 package xmlsec
 
 import (
+	"context"
 	"encoding/xml"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -207,3 +210,52 @@ h5BC02ePIIwd58lPjdsQUrgetVnDh3DyuKtMqufVmNw=</SignatureValue><KeyInfo><X509Data>
 
 	assert.Equal(t, string(expectedOut), string(out))
 }
+
+// blockingXmlsec1 puts first on the PATH an xmlsec1 that never answers, until
+// the returned function is called.
+func blockingXmlsec1(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "xmlsec1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "xmlsec1"), []byte("#!/bin/sh\nexec sleep 10\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+	return func() {
+		os.Setenv("PATH", path)
+		os.RemoveAll(dir)
+	}
+}
+
+func TestWithContext(t *testing.T) {
+	defer blockingXmlsec1(t)()
+
+	calls := map[string]func(ctx context.Context) error{
+		"Verify": func(ctx context.Context) error {
+			return VerifyWithContext(ctx, []byte("<document/>"), "cert.pem", nil)
+		},
+		"Sign": func(ctx context.Context) error {
+			_, err := SignWithContext(ctx, []byte("<document/>"), "key.pem", nil)
+			return err
+		},
+		"Encrypt": func(ctx context.Context) error {
+			_, err := EncryptWithContext(ctx, NewEncryptedDataTemplate("", ""), []byte("<document/>"), "cert.pem", "aes-128-cbc")
+			return err
+		},
+		"Decrypt": func(ctx context.Context) error {
+			_, err := DecryptWithContext(ctx, []byte("<document/>"), "key.pem")
+			return err
+		},
+	}
+	for name, call := range calls {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		start := time.Now()
+		err := call(ctx)
+		cancel()
+		assert.Equal(t, context.DeadlineExceeded, err, name)
+		assert.True(t, time.Since(start) < 5*time.Second, name)
+	}
+}